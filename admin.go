@@ -0,0 +1,392 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Re Admin
+//
+// /admin is a small dashboard for the chores that otherwise mean poking at entities in the Cloud console: seeing how
+// big the wiki is and what changed recently, browsing and reverting to old revisions, bringing back deleted
+// tiddlers, taking a JSON backup (/admin/export.json) and restoring one (/admin/import), and checking the
+// configuration and read-only mode.  Everything here scans the whole wiki, which is fine at personal-wiki sizes.
+
+func registerAdmin(r *http.ServeMux) {
+	r.HandleFunc("/admin", adminDashboard)
+	r.HandleFunc("/admin/stats", adminStats)
+	r.HandleFunc("/admin/history", adminHistory)
+	r.HandleFunc("/admin/revert", adminRevert)
+	r.HandleFunc("/admin/copy", adminCopy)
+	r.HandleFunc("/admin/export.json", adminExport)
+	r.HandleFunc("/admin/import", adminImport)
+	r.HandleFunc("/admin/bulk-delete", adminBulkDelete)
+	r.HandleFunc("/admin/retag", adminRetag)
+	r.HandleFunc("/admin/read-only", readOnlyAdmin)
+	r.HandleFunc("/admin/upgrade-core", adminUpgradeCore)
+	r.HandleFunc("/admin/reindex", adminReindex)
+	r.HandleFunc("/admin/snapshots", adminSnapshots)
+	r.HandleFunc("/admin/snapshots/", adminSnapshots)
+}
+
+// tiddlerInfo is what the admin pages show about one revision of a tiddler.
+type tiddlerInfo struct {
+	Title    string
+	Rev      int
+	Modified time.Time
+	Modifier string
+	Bytes    int
+	Deleted  bool
+}
+
+func infoFor(title string, t *Tiddler) tiddlerInfo {
+	info := tiddlerInfo{
+		Title:   title,
+		Rev:     t.Rev,
+		Bytes:   len(t.Meta) + len(t.Text),
+		Deleted: t.Meta == "",
+	}
+	var meta struct {
+		Modified string `json:"modified"`
+		Modifier string `json:"modifier"`
+	}
+	if json.Unmarshal([]byte(t.Meta), &meta) == nil {
+		info.Modified, _ = parseTiddlyDate(meta.Modified)
+		info.Modifier = meta.Modifier
+	}
+	return info
+}
+
+// parseTiddlyDate parses TiddlyWiki's YYYYMMDDHHMMSSmmm UTC timestamps.
+func parseTiddlyDate(s string) (time.Time, error) {
+	if len(s) == 17 {
+		s = s[:14] + "." + s[14:]
+	}
+	return time.Parse("20060102150405.000", s)
+}
+
+// tiddlyDate formats t as TiddlyWiki's YYYYMMDDHHMMSSmmm UTC timestamps.
+func tiddlyDate(t time.Time) string {
+	return strings.Replace(t.UTC().Format("20060102150405.000"), ".", "", 1)
+}
+
+// allTiddlers calls fn for every Tiddler entity, deleted ones included.
+func allTiddlers(ctx context.Context, fn func(title string, t *Tiddler) error) error {
+	var t Tiddler
+	return db.Scan(ctx, "Tiddler", "", &t, func(title string) error {
+		t := t
+		return fn(title, &t)
+	})
+}
+
+// historyOf returns every recorded revision of title, oldest first.
+func historyOf(ctx context.Context, title string) ([]Tiddler, error) {
+	// History keys are title#rev.
+	var revs []Tiddler
+	err := retry(ctx, func() error {
+		revs = nil
+		var t Tiddler
+		return db.Scan(ctx, "TiddlerHistory", title+"#", &t, func(name string) error {
+			// Titles can contain #, so the prefix also matches the
+			// history of a title such as title#1.
+			if name != title+"#"+fmt.Sprint(t.Rev) {
+				return nil
+			}
+			revs = append(revs, t)
+			return nil
+		})
+	})
+	sort.Slice(revs, func(i, j int) bool { return revs[i].Rev < revs[j].Rev })
+	return revs, err
+}
+
+// sameOrigin guards the form posts below against cross-site requests riding
+// on the proxy's session cookie.
+func sameOrigin(w http.ResponseWriter, r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			http.Error(w, "cross-origin request refused", 403)
+			return false
+		}
+	}
+	return true
+}
+
+var adminTemplate = template.Must(template.New("admin").Funcs(template.FuncMap{
+	"base": func() string { return cfg.BasePath },
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2006-01-02 15:04")
+	},
+}).Parse(`
+{{define "header"}}<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tiddly admin</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 0.8em; text-align: left; border-bottom: 1px solid #ddd; }
+td.n { text-align: right; }
+form { display: inline; }
+</style>
+</head>
+<body>
+<p><a href="{{base}}/">Wiki</a> · <a href="{{base}}/admin">Admin</a></p>
+{{end}}
+
+{{define "dashboard"}}{{template "header"}}
+<h1>tiddly admin</h1>
+
+<h2>Summary</h2>
+<table>
+<tr><th>Tiddlers</th><td class="n">{{.Tiddlers}}</td></tr>
+<tr><th>System tiddlers</th><td class="n">{{.SystemTiddlers}}</td></tr>
+<tr><th>Deleted</th><td class="n">{{.Deleted}}</td></tr>
+<tr><th>Text bytes</th><td class="n">{{.TextBytes}}</td></tr>
+<tr><th>Stored bytes</th><td class="n">{{.StoredBytes}}</td></tr>
+<tr><th>History entries</th><td class="n">{{.HistoryEntries}}</td></tr>
+<tr><th>Last modified</th><td>{{date .LastModified}}</td></tr>
+<tr><th>Read-only</th><td>{{if .ReadOnly.ReadOnly}}yes{{with .ReadOnly.Message}} ({{.}}){{end}}{{else}}no{{end}}</td></tr>
+</table>
+
+<h2>Recent changes</h2>
+<table>
+<tr><th>Title</th><th>Modified</th><th>By</th><th>Rev</th></tr>
+{{range .Recent}}<tr><td><a href="{{base}}/admin/history?title={{.Title}}">{{.Title}}</a></td><td>{{date .Modified}}</td><td>{{.Modifier}}</td><td class="n">{{.Rev}}</td></tr>
+{{end}}</table>
+
+<h2>Largest tiddlers</h2>
+<table>
+{{range .Largest}}<tr><td><a href="{{base}}/admin/history?title={{.Title}}">{{.Title}}</a></td><td class="n">{{.Bytes}}</td></tr>
+{{end}}</table>
+
+<h2>Storage by user</h2>
+<table>
+<tr><th>User</th><th>Bytes</th><th>Quota</th></tr>
+{{range .Usage}}<tr><td>{{or .User "(nobody)"}}</td><td class="n">{{.Bytes}}</td><td class="n">{{if lt .Quota 0}}none{{else}}{{.Quota}}{{end}}</td></tr>
+{{end}}</table>
+<p>Also available as JSON at <a href="{{base}}/admin/stats">/admin/stats</a>.</p>
+
+<h2>Trash</h2>
+{{if .Trash}}<table>
+<tr><th>Title</th><th>Rev</th><th></th></tr>
+{{range .Trash}}<tr><td><a href="{{base}}/admin/history?title={{.Title}}">{{.Title}}</a></td><td class="n">{{.Rev}}</td>
+<td><form method="post" action="{{base}}/admin/revert"><input type="hidden" name="title" value="{{.Title}}"><button>Restore</button></form></td></tr>
+{{end}}</table>{{else}}<p>Nothing has been deleted.</p>{{end}}
+<p><a href="{{base}}/admin/bulk-delete">Delete many tiddlers by title prefix or tag</a></p>
+<form method="post" action="{{base}}/admin/retag">Rename the tag <input name="from" size="20"> to <input name="to" size="20">
+on every tiddler <button>Rename tag</button></form>
+
+<h2>Backup and restore</h2>
+<p><a href="{{base}}/admin/export.json">Download all tiddlers as JSON</a></p>
+<form method="post" action="{{base}}/admin/import" enctype="multipart/form-data">
+<input type="file" name="file" accept=".json,.tid,.html,.htm" multiple> <button>Import</button>
+</form>
+<p>Importing saves each tiddler in the files (JSON exports, .tid files or TiddlyWiki pages) as a new revision,
+overwriting the current one.</p>
+
+<h2>Snapshots</h2>
+<form method="post" action="{{base}}/admin/snapshots"><button>Take a snapshot</button></form>
+<p>Records the revision of every tiddler, so the wiki can be put back as it was. The snapshots are listed at
+<a href="{{base}}/admin/snapshots">/admin/snapshots</a>.</p>
+
+<h2>TiddlyWiki core</h2>
+<p><a href="{{base}}/admin/upgrade-core">Preview other TiddlyWiki versions</a></p>
+
+<h2>Indexes</h2>
+<form method="post" action="{{base}}/admin/reindex"><button>Rebuild links and catalog</button></form>
+<p>Recomputes the links of every tiddler (and the catalog, if it is on) from the tiddlers themselves.</p>
+
+<h2>Configuration</h2>
+<pre>{{.Config}}</pre>
+</body>
+</html>
+{{end}}
+
+{{define "history"}}{{template "header"}}
+<h1>History of {{.Title}}</h1>
+<table>
+<tr><th>Rev</th><th>Modified</th><th>By</th><th>Bytes</th><th></th></tr>
+{{$title := .Title}}{{range .Revs}}<tr><td class="n">{{.Rev}}</td>
+{{if .Deleted}}<td colspan="3">deleted</td><td></td>
+{{else}}<td>{{date .Modified}}</td><td>{{.Modifier}}</td><td class="n">{{.Bytes}}</td>
+<td><a href="{{base}}/admin/history?title={{$title}}&amp;rev={{.Rev}}">view</a>
+<form method="post" action="{{base}}/admin/revert"><input type="hidden" name="title" value="{{$title}}"><input type="hidden" name="rev" value="{{.Rev}}"><button>Revert to this</button></form></td>{{end}}</tr>
+{{end}}</table>
+<h2>Copy</h2>
+<form method="post" action="{{base}}/admin/copy"><input type="hidden" name="title" value="{{.Title}}">
+To <input name="to" size="40"> <label><input type="checkbox" name="history" value="1"> with its history</label>
+<button>Copy</button></form>
+</body>
+</html>
+{{end}}
+`))
+
+func adminDashboard(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	stats, err := gatherStats(r.Context())
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	var buf bytes.Buffer
+	writeConfig(&buf)
+	data := struct {
+		*wikiStats
+		ReadOnly readOnlyState
+		Config   string
+	}{stats, currentReadOnly(), buf.String()}
+
+	if err := adminTemplate.ExecuteTemplate(w, "dashboard", &data); err != nil {
+		logf(r.Context(), "admin dashboard: %v", err)
+	}
+}
+
+func adminHistory(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	ctx := r.Context()
+	title := r.FormValue("title")
+	revs, err := historyOf(ctx, title)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	if s := r.FormValue("rev"); s != "" {
+		rev, _ := strconv.Atoi(s)
+		for i := range revs {
+			if revs[i].Rev == rev && revs[i].Meta != "" {
+				data, err := tiddlerJSON(&revs[i])
+				if err != nil {
+					storeError(w, err)
+					return
+				}
+				writeJSON(w, data)
+				return
+			}
+		}
+		http.Error(w, "no such revision", 404)
+		return
+	}
+
+	data := struct {
+		Title string
+		Revs  []tiddlerInfo
+	}{Title: title}
+	for i := len(revs) - 1; i >= 0; i-- {
+		data.Revs = append(data.Revs, infoFor(title, &revs[i]))
+	}
+	if err := adminTemplate.ExecuteTemplate(w, "history", &data); err != nil {
+		logf(r.Context(), "admin history: %v", err)
+	}
+}
+
+// adminRevert saves an old revision of a tiddler as its newest one. Without a
+// rev it picks the newest revision that isn't a deletion, which is how
+// deleted tiddlers are restored.
+func adminRevert(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "POST") || !sameOrigin(w, r) {
+		return
+	}
+	ctx := r.Context()
+	title := r.FormValue("title")
+	revs, err := historyOf(ctx, title)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	want, _ := strconv.Atoi(r.FormValue("rev"))
+	var from *Tiddler
+	for i := range revs {
+		if revs[i].Meta != "" && (want == 0 || revs[i].Rev == want) {
+			from = &revs[i]
+		}
+	}
+	if from == nil {
+		http.Error(w, "no such revision", 404)
+		return
+	}
+	var js map[string]interface{}
+	if err := json.Unmarshal([]byte(from.Meta), &js); err != nil {
+		storeError(w, err)
+		return
+	}
+	js["text"] = from.Text
+	rev, err := saveTiddler(ctx, title, js)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	logf(r.Context(), "%s reverted %q to revision %d as revision %d", currentUser(r), loggedTitle(title), from.Rev, rev)
+	http.Redirect(w, r, cfg.BasePath+"/admin/history?title="+url.QueryEscape(title), http.StatusSeeOther)
+}
+
+// adminExport offers every live tiddler as a TiddlyWiki JSON export.
+func adminExport(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	var buf bytes.Buffer
+	if _, err := exportTiddlers(r.Context(), &buf); err != nil {
+		storeError(w, err)
+		return
+	}
+	name := "tiddlers-" + time.Now().UTC().Format("20060102-150405") + ".json"
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	writeJSON(w, buf.Bytes())
+}
+
+// adminImport saves every tiddler in an uploaded JSON export, as produced by
+// adminExport or TiddlyWiki itself. The export can be posted as the request
+// body, or uploaded along with any other files importFiles takes.
+func adminImport(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "POST") || !sameOrigin(w, r) {
+		return
+	}
+	var n int
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		tiddlers, code, uerr := uploadedTiddlers(w, r)
+		if uerr != nil {
+			http.Error(w, uerr.Error(), code)
+			return
+		}
+		n, err = importResults(saveTiddlers(r.Context(), tiddlers))
+	} else {
+		n, err = importTiddlers(r.Context(), http.MaxBytesReader(w, r.Body, cfg.MaxBatchBytes))
+	}
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		msg := fmt.Sprintf("import too large: limit is %d bytes (set max-batch-bytes to change it)", tooBig.Limit)
+		http.Error(w, msg, 413)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	logf(r.Context(), "%s imported %d tiddlers", currentUser(r), n)
+	fmt.Fprintf(w, "Imported %d tiddlers.\n", n)
+}
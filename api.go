@@ -0,0 +1,451 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re JSON:API
+//
+// The TiddlyWeb API is shaped around what the browser needs, which makes it awkward for companion apps.  With
+// api=true the server also offers a read-only JSON:API (https://jsonapi.org) under /api/v1/, to signed-in users:
+//     GET /api/v1/tiddlers                              live tiddlers, by title
+//     GET /api/v1/tiddlers/{title}                      one tiddler, text included
+//     GET /api/v1/tiddlers/{title}/revisions[/{rev}]    its history, newest first, or one revision with its text
+//     GET /api/v1/tiddlers/{title}/links                the tiddlers it links to
+//     GET /api/v1/tiddlers/{title}/backlinks            the tiddlers linking to it
+//     GET /api/v1/tags                                  every tag, with how many tiddlers have it
+// The tiddler list takes filter[tag]=, filter[prefix]= and filter= (in sync profile syntax, see Re Sync profiles).
+// Lists come in pages of page[size]= (default 50, at most 500), with links.next leading to the next page, and
+// meta.total counting the whole list.  Clients that can't hold the whole wiki (the TiddlyWiki page alone is 2MB) can
+// trim what they get: fields[tiddlers]=title,modified sends only the attributes named, and tiddlers in lists leave
+// out their text unless it is named.  render=html (or naming html) adds the text rendered as on the public site
+// (see Re Publishing), with links leading to the linked tiddlers' resources.  A single tiddler comes with its ETag,
+// and If-None-Match naming it gets a 304.
+// Titles in paths are escaped as in the TiddlyWeb API, so a / in a title is %2F.  Errors are JSON:API error objects.
+
+const (
+	apiType         = "application/vnd.api+json"
+	apiPageSize     = 50
+	apiMaxPageSize  = 500
+	apiTiddlersPath = "/api/v1/tiddlers"
+)
+
+type apiResource struct {
+	Type          string                 `json:"type"`
+	ID            string                 `json:"id"`
+	Attributes    map[string]interface{} `json:"attributes,omitempty"`
+	Relationships map[string]apiRelation `json:"relationships,omitempty"`
+	Links         map[string]string      `json:"links,omitempty"`
+}
+
+type apiRelation struct {
+	Links map[string]string `json:"links,omitempty"`
+	Data  interface{}       `json:"data,omitempty"`
+}
+
+type apiIdentifier struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type apiDocument struct {
+	Data  interface{}       `json:"data"`
+	Links map[string]string `json:"links,omitempty"`
+	Meta  map[string]int    `json:"meta,omitempty"`
+}
+
+type apiError struct {
+	Status string `json:"status"`
+	Title  string `json:"title"`
+}
+
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/api/v1")
+	var parts []string
+	for _, p := range strings.Split(strings.Trim(path, "/"), "/") {
+		parts = append(parts, unescapeTitle(p))
+	}
+	switch {
+	case len(parts) == 1 && parts[0] == "tiddlers":
+		apiTiddlers(w, r)
+	case len(parts) == 2 && parts[0] == "tiddlers":
+		apiTiddler(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "tiddlers" && parts[2] == "revisions":
+		apiRevisions(w, r, parts[1], "")
+	case len(parts) == 4 && parts[0] == "tiddlers" && parts[2] == "revisions":
+		apiRevisions(w, r, parts[1], parts[3])
+	case len(parts) == 3 && parts[0] == "tiddlers" && (parts[2] == "links" || parts[2] == "backlinks"):
+		apiLinks(w, r, parts[1], parts[2] == "backlinks")
+	case len(parts) == 1 && parts[0] == "tags":
+		apiTags(w, r)
+	default:
+		apiFail(w, 404, "not found")
+	}
+}
+
+func apiFail(w http.ResponseWriter, code int, msg string) {
+	data, _ := json.Marshal(map[string][]apiError{"errors": {{strconv.Itoa(code), msg}}})
+	w.Header().Set("Content-Type", apiType)
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+func apiStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	logf(r.Context(), "api %s: %v", loggedPath(r), redactRequest(r, err.Error()))
+	apiFail(w, 500, "internal error")
+}
+
+func apiWrite(w http.ResponseWriter, doc *apiDocument) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		apiFail(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", apiType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// apiTiddlerPath returns the path of title's resource.
+func apiTiddlerPath(title string) string {
+	return cfg.BasePath + apiTiddlersPath + "/" + url.PathEscape(title)
+}
+
+// apiFields says which attributes of tiddlers to send.
+type apiFields struct {
+	only map[string]bool // nil for all but text and html
+	text bool
+	html bool
+}
+
+// requestedFields returns the attributes r asks for. Without
+// fields[tiddlers], single tiddlers come with their text and lists without.
+func requestedFields(r *http.Request, single bool) apiFields {
+	f := apiFields{text: single, html: r.URL.Query().Get("render") == "html"}
+	if s := r.URL.Query().Get("fields[tiddlers]"); s != "" {
+		f.only = make(map[string]bool)
+		for _, name := range strings.Split(s, ",") {
+			f.only[strings.TrimSpace(name)] = true
+		}
+		f.text = f.only["text"]
+		f.html = f.html || f.only["html"]
+	}
+	return f
+}
+
+// tiddlerResource returns the resource for t, with the attributes f asks
+// for.
+func tiddlerResource(title string, t *Tiddler, f apiFields) (*apiResource, error) {
+	var attrs map[string]interface{}
+	if err := json.Unmarshal([]byte(t.Meta), &attrs); err != nil {
+		return nil, fmt.Errorf("%s: %v", title, err)
+	}
+	delete(attrs, "bag")
+	attrs["revision"] = t.Rev
+	if f.only != nil {
+		for name := range attrs {
+			if !f.only[name] {
+				delete(attrs, name)
+			}
+		}
+	}
+	if f.text {
+		attrs["text"] = t.Text
+	}
+	if f.html {
+		// Links lead to the linked tiddler's resource.
+		link := func(title string) string { return apiTiddlerPath(title) + "?render=html" }
+		attrs["html"] = string(renderText(parseFields(t).Type, t.Text, link))
+	}
+	self := apiTiddlerPath(title)
+	tags := []apiIdentifier{}
+	for _, tag := range parseFields(t).Tags {
+		tags = append(tags, apiIdentifier{"tags", tag})
+	}
+	return &apiResource{
+		Type:       "tiddlers",
+		ID:         title,
+		Attributes: attrs,
+		Relationships: map[string]apiRelation{
+			"tags":      {Data: tags},
+			"revisions": {Links: map[string]string{"related": self + "/revisions"}},
+			"links":     {Links: map[string]string{"related": self + "/links"}},
+			"backlinks": {Links: map[string]string{"related": self + "/backlinks"}},
+		},
+		Links: map[string]string{"self": self},
+	}, nil
+}
+
+// apiPage returns the page of keys that r asks for, and the link to the next
+// page if there is one. keys must be sorted; page[after] is the last key of
+// the page before.
+func apiPage(r *http.Request, keys []string) ([]string, string, error) {
+	q := r.URL.Query()
+	size := apiPageSize
+	if s := q.Get("page[size]"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > apiMaxPageSize {
+			return nil, "", fmt.Errorf("page[size] must be from 1 to %d", apiMaxPageSize)
+		}
+		size = n
+	}
+	if after := q.Get("page[after]"); after != "" {
+		keys = keys[sort.SearchStrings(keys, after+"\x00"):]
+	}
+	if len(keys) <= size {
+		return keys, "", nil
+	}
+	keys = keys[:size]
+	q.Set("page[after]", keys[len(keys)-1])
+	return keys, cfg.BasePath + r.URL.Path + "?" + q.Encode(), nil
+}
+
+func apiTiddlers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := r.URL.Query()
+	var f *syncFilter
+	if s := q.Get("filter"); s != "" {
+		var err error
+		if f, err = parseSyncFilter(s); err != nil {
+			apiFail(w, 400, "bad filter: "+err.Error())
+			return
+		}
+	}
+	m := tiddlerMatch{Prefix: q.Get("filter[prefix]"), Tag: q.Get("filter[tag]")}
+	fields := requestedFields(r, false)
+
+	var matched map[string]*Tiddler
+	err := retry(ctx, func() error {
+		matched = make(map[string]*Tiddler)
+		return allTiddlers(ctx, func(title string, t *Tiddler) error {
+			if m.matches(title, t) && (f == nil || f.selects(title, parseFields(t).Tags)) {
+				matched[title] = t
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		apiStoreError(w, r, err)
+		return
+	}
+	titles := make([]string, 0, len(matched))
+	for title := range matched {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+	page, next, err := apiPage(r, titles)
+	if err != nil {
+		apiFail(w, 400, err.Error())
+		return
+	}
+	data := []*apiResource{}
+	for _, title := range page {
+		res, err := tiddlerResource(title, matched[title], fields)
+		if err != nil {
+			apiStoreError(w, r, err)
+			return
+		}
+		data = append(data, res)
+	}
+	doc := &apiDocument{Data: data, Links: map[string]string{"self": cfg.BasePath + r.URL.RequestURI()}, Meta: map[string]int{"total": len(titles)}}
+	if next != "" {
+		doc.Links["next"] = next
+	}
+	apiWrite(w, doc)
+}
+
+// apiGetTiddler loads the live tiddler title, answering r if it can't.
+func apiGetTiddler(w http.ResponseWriter, r *http.Request, title string) (*Tiddler, bool) {
+	var t Tiddler
+	err := dbGet(r.Context(), datastore.NameKey("Tiddler", title, nil), &t)
+	if err == datastore.ErrNoSuchEntity || err == nil && t.Meta == "" {
+		apiFail(w, 404, "no such tiddler")
+		return nil, false
+	}
+	if err != nil {
+		apiStoreError(w, r, err)
+		return nil, false
+	}
+	return &t, true
+}
+
+func apiTiddler(w http.ResponseWriter, r *http.Request, title string) {
+	t, ok := apiGetTiddler(w, r, title)
+	if !ok {
+		return
+	}
+	etag := tiddlerETag(title, t)
+	w.Header().Set("Etag", etag)
+	if noneMatch(w, r, etag) {
+		return
+	}
+	res, err := tiddlerResource(title, t, requestedFields(r, true))
+	if err != nil {
+		apiStoreError(w, r, err)
+		return
+	}
+	apiWrite(w, &apiDocument{Data: res})
+}
+
+func apiRevisions(w http.ResponseWriter, r *http.Request, title, rev string) {
+	revs, err := historyOf(r.Context(), title)
+	if err != nil {
+		apiStoreError(w, r, err)
+		return
+	}
+	self := apiTiddlerPath(title) + "/revisions/"
+	resource := func(t *Tiddler, withText bool) *apiResource {
+		info := infoFor(title, t)
+		attrs := map[string]interface{}{
+			"revision": t.Rev,
+			"deleted":  info.Deleted,
+			"bytes":    info.Bytes,
+			"modifier": info.Modifier,
+		}
+		if !info.Modified.IsZero() {
+			attrs["modified"] = info.Modified
+		}
+		if withText && !info.Deleted {
+			if res, err := tiddlerResource(title, t, requestedFields(r, true)); err == nil {
+				attrs["tiddler"] = res.Attributes
+			}
+		}
+		return &apiResource{
+			Type:          "revisions",
+			ID:            title + "#" + strconv.Itoa(t.Rev),
+			Attributes:    attrs,
+			Relationships: map[string]apiRelation{"tiddler": {Data: apiIdentifier{"tiddlers", title}}},
+			Links:         map[string]string{"self": self + strconv.Itoa(t.Rev)},
+		}
+	}
+
+	if rev != "" {
+		for i := range revs {
+			if strconv.Itoa(revs[i].Rev) == rev {
+				apiWrite(w, &apiDocument{Data: resource(&revs[i], true)})
+				return
+			}
+		}
+		apiFail(w, 404, "no such revision")
+		return
+	}
+	if len(revs) == 0 {
+		apiFail(w, 404, "no such tiddler")
+		return
+	}
+	// Newest first, so page on keys that sort that way.
+	byKey := make(map[string]*Tiddler)
+	var keys []string
+	for i := range revs {
+		k := fmt.Sprintf("%010d", 1<<31-revs[i].Rev)
+		byKey[k] = &revs[i]
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	page, next, err := apiPage(r, keys)
+	if err != nil {
+		apiFail(w, 400, err.Error())
+		return
+	}
+	data := []*apiResource{}
+	for _, k := range page {
+		data = append(data, resource(byKey[k], false))
+	}
+	doc := &apiDocument{Data: data, Links: map[string]string{"self": cfg.BasePath + r.URL.RequestURI()}, Meta: map[string]int{"total": len(revs)}}
+	if next != "" {
+		doc.Links["next"] = next
+	}
+	apiWrite(w, doc)
+}
+
+func apiLinks(w http.ResponseWriter, r *http.Request, title string, back bool) {
+	ctx := r.Context()
+	if _, ok := apiGetTiddler(w, r, title); !ok {
+		return
+	}
+	var titles []string
+	if back {
+		err := retry(ctx, func() error {
+			var err error
+			titles, err = db.LinksTo(ctx, title)
+			return err
+		})
+		if err != nil {
+			apiStoreError(w, r, err)
+			return
+		}
+	} else {
+		var l tiddlerLinks
+		if err := dbGet(ctx, linksKey(title), &l); err != nil && err != datastore.ErrNoSuchEntity {
+			apiStoreError(w, r, err)
+			return
+		}
+		titles = l.Links
+	}
+	sort.Strings(titles)
+	data := []apiIdentifier{}
+	for _, t := range titles {
+		data = append(data, apiIdentifier{"tiddlers", t})
+	}
+	apiWrite(w, &apiDocument{Data: data, Links: map[string]string{"self": cfg.BasePath + r.URL.RequestURI()}})
+}
+
+func apiTags(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var counts map[string]int
+	err := retry(ctx, func() error {
+		counts = make(map[string]int)
+		return allTiddlers(ctx, func(title string, t *Tiddler) error {
+			if t.Meta == "" {
+				return nil
+			}
+			for _, tag := range parseFields(t).Tags {
+				counts[tag]++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		apiStoreError(w, r, err)
+		return
+	}
+	tags := make([]string, 0, len(counts))
+	for tag := range counts {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	page, next, err := apiPage(r, tags)
+	if err != nil {
+		apiFail(w, 400, err.Error())
+		return
+	}
+	data := []*apiResource{}
+	for _, tag := range page {
+		data = append(data, &apiResource{
+			Type:       "tags",
+			ID:         tag,
+			Attributes: map[string]interface{}{"count": counts[tag]},
+			Links:      map[string]string{"related": cfg.BasePath + apiTiddlersPath + "?" + url.Values{"filter[tag]": {tag}}.Encode()},
+		})
+	}
+	doc := &apiDocument{Data: data, Links: map[string]string{"self": cfg.BasePath + r.URL.RequestURI()}, Meta: map[string]int{"total": len(tags)}}
+	if next != "" {
+		doc.Links["next"] = next
+	}
+	apiWrite(w, doc)
+}
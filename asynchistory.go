@@ -0,0 +1,216 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Async history
+//
+// Saving a tiddler writes the tiddler, then its history revision, then its links, one round trip after another.
+// With async-history on, the history revision is queued instead and the save answered without waiting for it: the
+// queue is written in batches, by one PutMulti, once historyBatch revisions are waiting or historyDelay after the
+// first, and again with backoff while writing fails.  Anything on this instance that reads or deletes history, or
+// runs a transaction, writes the queue first, so it sees what was saved, and so does shutting down.
+//
+// A crash loses what is queued, but never for good: the revision queued is the tiddler as saved, which the Tiddler
+// entity holds until the next save, and the next save (on any instance) queues the revision it replaces too unless
+// this instance has written it, so each revision is written at least once.  The cost is one more history write, off
+// the save's path, for the first save of each tiddler after an instance starts.  Until then, the newest revision of
+// a tiddler saved just before a crash is missing from its history (the tiddler itself isn't).  Only single saves
+// are queued; batch saves, renames and the like write history in the same call as the tiddlers, as before.
+
+const (
+	historyBatch = 100
+	historyDelay = time.Second
+	// historyWritten is how many written revisions an instance
+	// remembers, so as not to queue them again.
+	historyWritten = 10000
+)
+
+// historyStore queues the TiddlerHistory puts of the Store it wraps.
+type historyStore struct {
+	Store
+
+	mu      sync.Mutex
+	queued  map[string]Tiddler // by name
+	timer   *time.Timer
+	written map[string]bool
+	flushMu sync.Mutex // held while writing the queue
+}
+
+// asyncHistory is the historyStore in db, or nil.
+var asyncHistory *historyStore
+
+func newHistoryStore(s Store) *historyStore {
+	return &historyStore{Store: s, queued: make(map[string]Tiddler), written: make(map[string]bool)}
+}
+
+func (s *historyStore) Put(ctx context.Context, key *datastore.Key, src interface{}) error {
+	t, ok := src.(*Tiddler)
+	if key.Kind != "TiddlerHistory" || !ok {
+		return s.Store.Put(ctx, key, src)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued[key.Name] = *t
+	delete(s.written, key.Name)
+	switch {
+	case len(s.queued) >= historyBatch:
+		go s.flushQueued()
+	case s.timer == nil:
+		s.timer = time.AfterFunc(historyDelay, s.flushQueued)
+	}
+	return nil
+}
+
+// isWritten reports whether this instance has written the revision name.
+func (s *historyStore) isWritten(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.written[name]
+}
+
+func (s *historyStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if key.Kind == "TiddlerHistory" {
+		s.mu.Lock()
+		t, ok := s.queued[key.Name]
+		s.mu.Unlock()
+		if d, isTiddler := dst.(*Tiddler); ok && isTiddler {
+			*d = t
+			return nil
+		}
+		if ok {
+			if err := s.flush(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return s.Store.Get(ctx, key, dst)
+}
+
+func (s *historyStore) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	if err := s.flushFor(ctx, keys); err != nil {
+		return err
+	}
+	return s.Store.GetMulti(ctx, keys, dst)
+}
+
+func (s *historyStore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	if err := s.flushFor(ctx, keys); err != nil {
+		return err
+	}
+	return s.Store.DeleteMulti(ctx, keys)
+}
+
+func (s *historyStore) Scan(ctx context.Context, kind, prefix string, dst interface{}, fn func(name string) error) error {
+	if kind == "TiddlerHistory" {
+		if err := s.flush(ctx); err != nil {
+			return err
+		}
+	}
+	return s.Store.Scan(ctx, kind, prefix, dst, fn)
+}
+
+func (s *historyStore) Names(ctx context.Context, kind, prefix string) ([]string, error) {
+	if kind == "TiddlerHistory" {
+		if err := s.flush(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return s.Store.Names(ctx, kind, prefix)
+}
+
+func (s *historyStore) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	if err := s.flush(ctx); err != nil {
+		return err
+	}
+	return s.Store.RunInTransaction(ctx, f)
+}
+
+func (s *historyStore) Close() error {
+	if err := s.flush(context.Background()); err != nil {
+		log.Printf("writing %d queued history revisions: %v", s.queuedCount(), err)
+	}
+	return s.Store.Close()
+}
+
+func (s *historyStore) queuedCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queued)
+}
+
+// flushFor writes the queue if any of keys is history.
+func (s *historyStore) flushFor(ctx context.Context, keys []*datastore.Key) error {
+	for _, key := range keys {
+		if key.Kind == "TiddlerHistory" {
+			return s.flush(ctx)
+		}
+	}
+	return nil
+}
+
+// flushQueued writes the queue in the background, trying again later if
+// that fails.
+func (s *historyStore) flushQueued() {
+	ctx := context.Background()
+	if err := retry(ctx, func() error { return s.flush(ctx) }); err != nil {
+		log.Printf("writing %d queued history revisions: %v", s.queuedCount(), err)
+		s.mu.Lock()
+		if s.timer == nil {
+			s.timer = time.AfterFunc(historyDelay, s.flushQueued)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// flush writes the queue, historyBatch revisions at a time. Revisions stay
+// queued, and are served, until they are written.
+func (s *historyStore) flush(ctx context.Context) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.mu.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	var keys []*datastore.Key
+	var ts []Tiddler
+	for name, t := range s.queued {
+		keys = append(keys, datastore.NameKey("TiddlerHistory", name, nil))
+		ts = append(ts, t)
+	}
+	s.mu.Unlock()
+
+	for i := 0; i < len(keys); i += historyBatch {
+		j := i + historyBatch
+		if j > len(keys) {
+			j = len(keys)
+		}
+		if err := s.Store.PutMulti(ctx, keys[i:j], ts[i:j]); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		for k, key := range keys[i:j] {
+			// A revision queued again meanwhile is left for next time.
+			if q, ok := s.queued[key.Name]; ok && q.Saved.Equal(ts[i+k].Saved) {
+				delete(s.queued, key.Name)
+			}
+			if len(s.written) >= historyWritten {
+				s.written = make(map[string]bool)
+			}
+			s.written[key.Name] = true
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
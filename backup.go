@@ -0,0 +1,187 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// exportTiddlers writes every live tiddler, text included, as a JSON array in
+// the format TiddlyWiki itself exports and imports. It returns the number of
+// tiddlers written.
+func exportTiddlers(ctx context.Context, w io.Writer) (int, error) {
+	var buf bytes.Buffer
+	n := 0
+	err := retry(ctx, func() error {
+		buf.Reset()
+		n = 0
+		sep := "[\n"
+		err := allTiddlers(ctx, func(title string, t *Tiddler) error {
+			if t.Meta == "" {
+				return nil
+			}
+			data, err := tiddlerJSON(t)
+			if err != nil {
+				return fmt.Errorf("%s: %v", title, err)
+			}
+			buf.WriteString(sep)
+			sep = ",\n"
+			buf.Write(data)
+			n++
+			return nil
+		})
+		if n == 0 {
+			buf.WriteString(sep)
+		}
+		buf.WriteString("\n]\n")
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.Write(buf.Bytes())
+	return n, err
+}
+
+// importTiddlers saves every tiddler in a TiddlyWiki JSON export as a new
+// revision, or the content of a TiddlyWiki page (see Re Empty wiki). It
+// returns the number of tiddlers saved.
+func importTiddlers(ctx context.Context, r io.Reader) (int, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	var tiddlers []map[string]interface{}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		tiddlers, err = pageContent(data)
+	} else {
+		err = json.Unmarshal(data, &tiddlers)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return importResults(saveTiddlers(ctx, tiddlers))
+}
+
+// importResults returns the number of tiddlers saved in an import, and an
+// error listing the failures if there were any.
+func importResults(results []batchResult) (int, error) {
+	n := 0
+	var errs []string
+	for _, res := range results {
+		switch {
+		case res.Error == "":
+			n++
+		case res.Title != "":
+			errs = append(errs, res.Title+": "+res.Error)
+		}
+	}
+	if len(errs) > 0 {
+		return n, fmt.Errorf("imported %d tiddlers, but %d failed: %s", n, len(errs), strings.Join(errs, "; "))
+	}
+	return n, nil
+}
+
+// backupRecord is one line of a backup: a Tiddler or TiddlerHistory entity
+// exactly as stored.
+type backupRecord struct {
+	Kind  string    `json:"kind"`
+	Name  string    `json:"name"`
+	Rev   int       `json:"rev"`
+	Meta  string    `json:"meta"`
+	Text  string    `json:"text"`
+	Saved time.Time `json:"saved"`
+	User  string    `json:"user,omitempty"`
+}
+
+// backupEntities writes every Tiddler and TiddlerHistory entity as a line of
+// JSON. Unlike an export this keeps the history and the records of deletions.
+// It returns the number of entities written.
+func backupEntities(ctx context.Context, w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	n := 0
+	for _, kind := range []string{"Tiddler", "TiddlerHistory"} {
+		var t Tiddler
+		err := db.Scan(ctx, kind, "", &t, func(name string) error {
+			rec := backupRecord{Kind: kind, Name: name, Rev: t.Rev, Meta: t.Meta, Text: t.Text, Saved: t.Saved, User: t.User}
+			if err := enc.Encode(&rec); err != nil {
+				return err
+			}
+			n++
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, bw.Flush()
+}
+
+// pruneHistory deletes all but the newest keep revisions of each tiddler from
+// the history, or with dryRun only counts them. It returns the number of
+// entries deleted.
+func pruneHistory(ctx context.Context, keep int, dryRun bool) (int, error) {
+	names, err := db.Names(ctx, "TiddlerHistory", "")
+	if err != nil {
+		return 0, err
+	}
+	type rev struct {
+		key *datastore.Key
+		n   int
+	}
+	byTitle := make(map[string][]rev)
+	for _, name := range names {
+		i := strings.LastIndex(name, "#")
+		if i < 0 {
+			continue
+		}
+		n, err := strconv.Atoi(name[i+1:])
+		if err != nil {
+			continue
+		}
+		byTitle[name[:i]] = append(byTitle[name[:i]], rev{datastore.NameKey("TiddlerHistory", name, nil), n})
+	}
+	var doomed []*datastore.Key
+	for _, revs := range byTitle {
+		if len(revs) <= keep {
+			continue
+		}
+		sort.Slice(revs, func(i, j int) bool { return revs[i].n > revs[j].n })
+		for _, r := range revs[keep:] {
+			doomed = append(doomed, r.key)
+		}
+	}
+	if dryRun {
+		return len(doomed), nil
+	}
+	// Datastore allows at most 500 keys per call.
+	deleted := 0
+	for len(doomed) > 0 {
+		batch := doomed
+		if len(batch) > 500 {
+			batch = batch[:500]
+		}
+		err := retry(ctx, func() error { return db.DeleteMulti(ctx, batch) })
+		if err != nil {
+			return deleted, err
+		}
+		deleted += len(batch)
+		doomed = doomed[len(batch):]
+	}
+	return deleted, nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Batch saves
+//
+// Saving one tiddler per PUT is fine for the browser, which saves as you edit, but imports and scripted changes to
+// many tiddlers (retagging, say) would take thousands of round trips.  PUT /recipes/all/tiddlers takes a JSON array
+// of tiddlers in the same form as a single PUT and saves them with a handful of GetMulti/PutMulti calls.  Each
+// tiddler succeeds or fails on its own; the response lists the outcome for each, in order:
+//     [{"title": "A", "revision": 3, "etag": "..."}, {"title": "B", "error": "..."}]
+
+// batchChunk is how many tiddlers are saved per PutMulti. Each takes three
+// entities, its Tiddler, its history entry and its links, and a commit is
+// limited to 500.
+const batchChunk = 166
+
+type batchResult struct {
+	Title    string `json:"title"`
+	Revision int    `json:"revision,omitempty"`
+	ETag     string `json:"etag,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func batchSave(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "PUT", "POST") {
+		return
+	}
+	if r.Method == "POST" {
+		if r.URL.Query().Get("template") == "" {
+			http.Error(w, "POST makes a tiddler from a template; say which with ?template=", 400)
+			return
+		}
+		createFromTemplate(w, r)
+		return
+	}
+	if !checkJSONBody(w, r) {
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, cfg.MaxBatchBytes))
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			msg := fmt.Sprintf("batch too large: limit is %d bytes (set max-batch-bytes to change it); "+
+				"split it into smaller batches", tooBig.Limit)
+			http.Error(w, msg, 413)
+			return
+		}
+		http.Error(w, "cannot read data", 400)
+		return
+	}
+	var tiddlers []map[string]interface{}
+	if err := json.Unmarshal(data, &tiddlers); err != nil {
+		http.Error(w, "expected a JSON array of tiddlers: "+err.Error(), 400)
+		return
+	}
+	results := saveTiddlers(r.Context(), tiddlers)
+	out, err := json.Marshal(results)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, out)
+}
+
+// saveTiddlers is saveTiddler for many tiddlers at once, each titled by its
+// title field. It returns the result for each.
+func saveTiddlers(ctx context.Context, tiddlers []map[string]interface{}) []batchResult {
+	results := make([]batchResult, len(tiddlers))
+	seen := make(map[string]bool)
+	var todo []int // indexes of the tiddlers still to save
+	for i, js := range tiddlers {
+		title, _ := js["title"].(string)
+		results[i].Title = title
+		switch {
+		case title == "":
+			results[i].Error = "no title"
+		case checkTitle(title) != nil:
+			results[i].Error = checkTitle(title).Error()
+		case seen[title]:
+			results[i].Error = "title appears more than once in the batch"
+		default:
+			data, _ := json.Marshal(js)
+			if int64(len(data)) > cfg.MaxTiddlerBytes {
+				results[i].Error = fmt.Sprintf("tiddler too large: limit is %d bytes", cfg.MaxTiddlerBytes)
+				break
+			}
+			seen[title] = true
+			todo = append(todo, i)
+		}
+	}
+	for len(todo) > 0 {
+		n := len(todo)
+		if n > batchChunk {
+			n = batchChunk
+		}
+		saveChunk(ctx, tiddlers, results, todo[:n])
+		todo = todo[n:]
+	}
+	return results
+}
+
+// saveChunk saves the tiddlers at indexes, recording the outcomes in
+// results.
+func saveChunk(ctx context.Context, tiddlers []map[string]interface{}, results []batchResult, indexes []int) {
+	fail := func(i int, err error) {
+		results[i].Revision = 0
+		results[i].Error = err.Error()
+	}
+
+	keys := make([]*datastore.Key, len(indexes))
+	for j, i := range indexes {
+		keys[j] = datastore.NameKey("Tiddler", results[i].Title, nil)
+	}
+	olds := make([]Tiddler, len(keys))
+	var getErrs datastore.MultiError
+	err := retry(ctx, func() error {
+		err := db.GetMulti(ctx, keys, olds)
+		getErrs, _ = err.(datastore.MultiError)
+		if getErrs != nil {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		for _, i := range indexes {
+			fail(i, err)
+		}
+		return
+	}
+
+	var putKeys []*datastore.Key
+	var ents []interface{}
+	var saved []int
+	var pending int64              // bytes to save in this chunk, for the quota
+	revs := make(map[int]*Tiddler) // by index, for the ETags
+	for j, i := range indexes {
+		rev := 1
+		if getErrs == nil || getErrs[j] == nil {
+			rev = olds[j].Rev + 1
+		} else if getErrs[j] != datastore.ErrNoSuchEntity {
+			fail(i, getErrs[j])
+			continue
+		}
+		if unchangedSave(ctx, &olds[j], tiddlers[i]) {
+			results[i].Revision = olds[j].Rev
+			results[i].ETag = tiddlerETag(results[i].Title, &olds[j])
+			continue
+		}
+		t, err := newRevision(ctx, tiddlers[i], rev)
+		if err != nil {
+			fail(i, err)
+			continue
+		}
+		if err := checkQuota(ctx, pending+revisionBytes(&t)); err != nil {
+			fail(i, err)
+			continue
+		}
+		pending += revisionBytes(&t)
+		title := results[i].Title
+		putKeys = append(putKeys, keys[j], datastore.NameKey("TiddlerHistory", title+"#"+fmt.Sprint(rev), nil), linksKey(title))
+		ents = append(ents, &t, &t, linksOf(&t))
+		saved = append(saved, i)
+		revs[i] = &t
+		results[i].Revision = rev
+	}
+	if len(saved) == 0 {
+		return
+	}
+
+	err = retry(ctx, func() error {
+		return db.PutMulti(ctx, putKeys, ents)
+	})
+	for _, i := range saved {
+		if err != nil {
+			// There's no telling which entities of a failed call were
+			// written, so report them all; saving again is harmless.
+			fail(i, err)
+			continue
+		}
+		title := results[i].Title
+		results[i].ETag = tiddlerETag(title, revs[i])
+		usage.add(revs[i].User, revisionBytes(revs[i]))
+		tiddlerChanged(title)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Store budgets
+//
+// Datastore bills by the entity read and written, and a browser left polling a big wiki reads every tiddler each
+// minute.  So each instance counts the entities it reads and writes in the store (after the caches; see Re Cache
+// layers), by UTC day, as the expvar counters store_reads_today and store_writes_today alongside store_reads and
+// store_writes for its lifetime.  daily-read-budget and daily-write-budget, if set, are how many of each an instance
+// may use a day before it starts saving them:
+//     reads   the tiddler list is served as last built, rather than read again, until the day is over
+//     writes  saves still save the tiddler, but its history revision is held in memory and written the next day
+// Everything else carries on as usual; the budgets are meant to cap runaway costs, not to stop the wiki.  A held
+// revision is lost if the instance stops before it is written; the tiddler itself never is.  The first time in a day
+// either budget runs out, the log says so, and BUDGET_WEBHOOK (if set) is sent {"text": "..."}, which Slack and
+// most chat webhooks accept.  (Webhook URLs are secrets, so it comes from the environment, where -print-config
+// doesn't show it.)  Counts are per instance: with several, divide the budget between them.
+
+var (
+	storeReads       = expvar.NewInt("store_reads")
+	storeWrites      = expvar.NewInt("store_writes")
+	storeReadsToday  = expvar.NewInt("store_reads_today")
+	storeWritesToday = expvar.NewInt("store_writes_today")
+)
+
+var budgets budget
+
+type budget struct {
+	mu       sync.Mutex
+	day      string
+	reads    int64
+	writes   int64
+	alerted  map[string]bool
+	list     []byte             // the tiddler list as last built
+	deferred map[string]Tiddler // held TiddlerHistory entities, by name
+}
+
+// count records reads and writes of entities.
+func (b *budget) count(reads, writes int) {
+	if reads == 0 && writes == 0 {
+		return
+	}
+	storeReads.Add(int64(reads))
+	storeWrites.Add(int64(writes))
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	b.reads += int64(reads)
+	b.writes += int64(writes)
+	storeReadsToday.Set(b.reads)
+	storeWritesToday.Set(b.writes)
+	if cfg.DailyReadBudget > 0 && b.reads > cfg.DailyReadBudget {
+		b.alert("reads", b.reads, cfg.DailyReadBudget)
+	}
+	if cfg.DailyWriteBudget > 0 && b.writes > cfg.DailyWriteBudget {
+		b.alert("writes", b.writes, cfg.DailyWriteBudget)
+	}
+}
+
+// roll starts a new day's counts if the day has changed, writing the
+// history held back the day before. b.mu must be held.
+func (b *budget) roll() {
+	day := time.Now().UTC().Format("2006-01-02")
+	if day == b.day {
+		return
+	}
+	b.day, b.reads, b.writes, b.alerted = day, 0, 0, nil
+	if len(b.deferred) > 0 {
+		held := b.deferred
+		b.deferred = nil
+		go b.writeDeferred(held)
+	}
+}
+
+// alert reports, once a day, that what has gone over its budget.
+func (b *budget) alert(what string, n, limit int64) {
+	if b.alerted[what] {
+		return
+	}
+	if b.alerted == nil {
+		b.alerted = make(map[string]bool)
+	}
+	b.alerted[what] = true
+	msg := fmt.Sprintf("tiddly: store %s on %s have passed the daily budget of %d (now %d)", what, b.day, limit, n)
+	log.Print(msg)
+	if url := os.Getenv("BUDGET_WEBHOOK"); url != "" {
+		go postWebhook(url, msg)
+	}
+}
+
+func postWebhook(url, text string) {
+	data, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err == nil {
+		res.Body.Close()
+		if res.StatusCode/100 != 2 {
+			err = fmt.Errorf("%s", res.Status)
+		}
+	}
+	if err != nil {
+		log.Printf("budget webhook: %v", err)
+	}
+}
+
+// readsExhausted and writesExhausted report whether today's budgets have
+// run out.
+func (b *budget) readsExhausted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	return cfg.DailyReadBudget > 0 && b.reads >= cfg.DailyReadBudget
+}
+
+func (b *budget) writesExhausted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	return cfg.DailyWriteBudget > 0 && b.writes >= cfg.DailyWriteBudget
+}
+
+// cachedList returns the tiddler list as last built if the read budget has
+// run out, or else builds it.
+func (b *budget) cachedList(build func() ([]byte, error)) ([]byte, error) {
+	if b.readsExhausted() {
+		b.mu.Lock()
+		data := b.list
+		b.mu.Unlock()
+		if data != nil {
+			return data, nil
+		}
+	}
+	data, err := build()
+	if err == nil && cfg.DailyReadBudget > 0 {
+		b.mu.Lock()
+		b.list = data
+		b.mu.Unlock()
+	}
+	return data, err
+}
+
+// putHistory saves t as the TiddlerHistory entity name, or holds it until
+// tomorrow if the write budget has run out.
+func (b *budget) putHistory(ctx context.Context, name string, t *Tiddler) error {
+	if b.writesExhausted() {
+		b.mu.Lock()
+		if b.deferred == nil {
+			b.deferred = make(map[string]Tiddler)
+		}
+		b.deferred[name] = *t
+		b.mu.Unlock()
+		return nil
+	}
+	return dbPut(ctx, datastore.NameKey("TiddlerHistory", name, nil), t)
+}
+
+// writeDeferred writes held history, holding again whatever it can't.
+func (b *budget) writeDeferred(held map[string]Tiddler) {
+	var keys []*datastore.Key
+	var ts []Tiddler
+	for name, t := range held {
+		keys = append(keys, datastore.NameKey("TiddlerHistory", name, nil))
+		ts = append(ts, t)
+	}
+	ctx := context.Background()
+	err := retry(ctx, func() error { return db.PutMulti(ctx, keys, ts) })
+	if err != nil {
+		log.Printf("writing %d held history revisions: %v", len(keys), err)
+		b.mu.Lock()
+		if b.deferred == nil {
+			b.deferred = make(map[string]Tiddler)
+		}
+		for name, t := range held {
+			b.deferred[name] = t
+		}
+		b.mu.Unlock()
+		return
+	}
+	log.Printf("wrote %d history revisions held back yesterday", len(keys))
+}
+
+// budgetStore counts the entities read and written through the Store it
+// wraps.
+type budgetStore struct {
+	Store
+}
+
+func (s budgetStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	budgets.count(1, 0)
+	return s.Store.Get(ctx, key, dst)
+}
+
+func (s budgetStore) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	budgets.count(len(keys), 0)
+	return s.Store.GetMulti(ctx, keys, dst)
+}
+
+func (s budgetStore) Put(ctx context.Context, key *datastore.Key, src interface{}) error {
+	budgets.count(0, 1)
+	return s.Store.Put(ctx, key, src)
+}
+
+func (s budgetStore) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) error {
+	budgets.count(0, len(keys))
+	return s.Store.PutMulti(ctx, keys, src)
+}
+
+func (s budgetStore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	budgets.count(0, len(keys))
+	return s.Store.DeleteMulti(ctx, keys)
+}
+
+func (s budgetStore) Scan(ctx context.Context, kind, prefix string, dst interface{}, fn func(name string) error) error {
+	return s.Store.Scan(ctx, kind, prefix, dst, func(name string) error {
+		budgets.count(1, 0)
+		return fn(name)
+	})
+}
+
+func (s budgetStore) Names(ctx context.Context, kind, prefix string) ([]string, error) {
+	names, err := s.Store.Names(ctx, kind, prefix)
+	budgets.count(len(names), 0)
+	return names, err
+}
+
+func (s budgetStore) LinksTo(ctx context.Context, title string) ([]string, error) {
+	names, err := s.Store.LinksTo(ctx, title)
+	budgets.count(len(names), 0)
+	return names, err
+}
+
+func (s budgetStore) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	return s.Store.RunInTransaction(ctx, func(tx Transaction) error { return f(budgetTx{tx}) })
+}
+
+type budgetTx struct {
+	Transaction
+}
+
+func (tx budgetTx) Get(key *datastore.Key, dst interface{}) error {
+	budgets.count(1, 0)
+	return tx.Transaction.Get(key, dst)
+}
+
+func (tx budgetTx) Put(key *datastore.Key, src interface{}) error {
+	budgets.count(0, 1)
+	return tx.Transaction.Put(key, src)
+}
+
+func (tx budgetTx) PutMulti(keys []*datastore.Key, src interface{}) error {
+	budgets.count(0, len(keys))
+	return tx.Transaction.PutMulti(keys, src)
+}
+
+func (tx budgetTx) Delete(key *datastore.Key) error {
+	budgets.count(0, 1)
+	return tx.Transaction.Delete(key)
+}
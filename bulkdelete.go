@@ -0,0 +1,164 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// tiddlerMatch selects tiddlers by title prefix and tag. Either may be empty
+// but not both, so that nothing can select the whole wiki by accident.
+type tiddlerMatch struct {
+	Prefix string
+	Tag    string
+}
+
+func (m tiddlerMatch) matches(title string, t *Tiddler) bool {
+	if t.Meta == "" || !strings.HasPrefix(title, m.Prefix) {
+		return false
+	}
+	return m.Tag == "" || hasTag(parseFields(t).Tags, m.Tag)
+}
+
+// matchingTiddlers returns the titles of the live tiddlers m selects, sorted.
+func matchingTiddlers(ctx context.Context, m tiddlerMatch) ([]string, error) {
+	var titles []string
+	err := retry(ctx, func() error {
+		titles = nil
+		return allTiddlers(ctx, func(title string, t *Tiddler) error {
+			if m.matches(title, t) {
+				titles = append(titles, title)
+			}
+			return nil
+		})
+	})
+	sort.Strings(titles)
+	return titles, err
+}
+
+// deleteTiddlers deletes titles the way a DELETE does, recording the deletion
+// in each one's history so they can be restored. It returns how many it
+// deleted before any error.
+func deleteTiddlers(ctx context.Context, titles []string) (int, error) {
+	n := 0
+	for len(titles) > 0 {
+		chunk := titles
+		if len(chunk) > batchChunk {
+			chunk = chunk[:batchChunk]
+		}
+		titles = titles[len(chunk):]
+
+		keys := make([]*datastore.Key, len(chunk))
+		for i, title := range chunk {
+			keys[i] = datastore.NameKey("Tiddler", title, nil)
+		}
+		olds := make([]Tiddler, len(keys))
+		err := retry(ctx, func() error { return db.GetMulti(ctx, keys, olds) })
+		if err != nil {
+			return n, err
+		}
+		var putKeys []*datastore.Key
+		var ents []interface{}
+		for i, title := range chunk {
+			t := &Tiddler{Rev: olds[i].Rev + 1}
+			putKeys = append(putKeys, keys[i], datastore.NameKey("TiddlerHistory", title+"#"+fmt.Sprint(t.Rev), nil), linksKey(title))
+			ents = append(ents, t, t, &tiddlerLinks{})
+		}
+		err = retry(ctx, func() error {
+			return db.PutMulti(ctx, putKeys, ents)
+		})
+		if err != nil {
+			return n, err
+		}
+		for _, title := range chunk {
+			tiddlerChanged(title)
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+var bulkDeleteTemplate = template.Must(template.Must(adminTemplate.Clone()).Parse(`
+{{define "bulk-delete"}}{{template "header"}}
+<h1>Delete tiddlers</h1>
+<form method="post" action="{{base}}/admin/bulk-delete">
+<p>Title prefix <input name="prefix" value="{{.Prefix}}" size="40"> and/or tag <input name="tag" value="{{.Tag}}" size="20">
+<button>Find</button></p>
+</form>
+{{if .Deleted}}<p>Deleted {{.Deleted}} tiddlers. They can be restored from the trash on the <a href="{{base}}/admin">dashboard</a>.</p>
+{{else if .Titles}}<p>{{len .Titles}} tiddlers match:</p>
+<ul>
+{{range .Titles}}<li><a href="{{base}}/admin/history?title={{.}}">{{.}}</a></li>
+{{end}}</ul>
+<form method="post" action="{{base}}/admin/bulk-delete">
+<input type="hidden" name="prefix" value="{{.Prefix}}"><input type="hidden" name="tag" value="{{.Tag}}">
+<input type="hidden" name="count" value="{{len .Titles}}"><input type="hidden" name="confirm" value="1">
+<button>Delete these {{len .Titles}} tiddlers</button>
+</form>
+{{else if .Searched}}<p>No tiddlers match.</p>
+{{end}}</body>
+</html>
+{{end}}
+`))
+
+// adminBulkDelete deletes all the tiddlers with a title prefix and/or tag.
+// Posting just the prefix and tag lists what they match; adding confirm=1
+// deletes them, provided count (if given) still matches how many there are,
+// so a list reviewed a while ago doesn't delete tiddlers added since.
+func adminBulkDelete(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET", "POST") {
+		return
+	}
+	data := struct {
+		tiddlerMatch
+		Searched bool
+		Titles   []string
+		Deleted  int
+	}{}
+	if r.Method == "GET" {
+		data.tiddlerMatch = tiddlerMatch{Prefix: r.FormValue("prefix"), Tag: r.FormValue("tag")}
+		bulkDeleteTemplate.ExecuteTemplate(w, "bulk-delete", &data)
+		return
+	}
+	if !sameOrigin(w, r) {
+		return
+	}
+	ctx := r.Context()
+	data.tiddlerMatch = tiddlerMatch{Prefix: r.FormValue("prefix"), Tag: r.FormValue("tag")}
+	if data.Prefix == "" && data.Tag == "" {
+		http.Error(w, "a prefix or tag is required", 400)
+		return
+	}
+	titles, err := matchingTiddlers(ctx, data.tiddlerMatch)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	data.Searched, data.Titles = true, titles
+
+	if r.FormValue("confirm") != "" {
+		if count := r.FormValue("count"); count != "" && count != fmt.Sprint(len(titles)) {
+			http.Error(w, fmt.Sprintf("%s tiddlers were listed but %d now match; list them again", count, len(titles)), 409)
+			return
+		}
+		n, err := deleteTiddlers(ctx, titles)
+		logf(ctx, "%s deleted %d tiddlers (prefix %q, tag %q)", currentUser(r), n, loggedTitle(data.Prefix), loggedTitle(data.Tag))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("deleted %d tiddlers, then: %v", n, err), 500)
+			return
+		}
+		data.Deleted = n
+	}
+	if err := bulkDeleteTemplate.ExecuteTemplate(w, "bulk-delete", &data); err != nil {
+		logf(r.Context(), "bulk delete: %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Re Cache headers
+//
+// What browsers and proxies may keep of the main routes is decided here rather than by each handler, by route class:
+//     core     /core/...                        public, max-age=31536000, immutable  (names carry the version)
+//     page     /, /static.html                  private, no-cache  (revalidated against its Etag)
+//     status   /status                          no-store
+//     tiddler  /recipes/{recipe}/tiddlers/...   private, no-cache, and Vary: Accept  (raw text or JSON)
+//     list     /recipes/{recipe}/tiddlers.json  private, no-cache
+//              /store.json
+// no-cache lets the browser keep a response but not use it without asking first, which costs a 304 when the Etag
+// (or Last-Modified) still matches; private keeps shared caches from serving one user's wiki to another.  The
+// cache-control setting replaces a class's Cache-Control, as class:value pairs separated by semicolons, e.g.
+// tiddler:private, max-age=60;status:no-cache.  The headers go only on successful responses (200 and 304), so an
+// error is never cached as immutable, and a handler that sets Cache-Control itself, such as the share and publish
+// routes, keeps its own.  Routes not listed send none, as before.
+
+// cachePolicy is the caching a class of routes gets.
+type cachePolicy struct {
+	control string
+	vary    string
+}
+
+var cachePolicies = map[string]cachePolicy{
+	"core":    {control: "public, max-age=31536000, immutable"},
+	"page":    {control: "private, no-cache"},
+	"status":  {control: "no-store"},
+	"tiddler": {control: "private, no-cache", vary: "Accept"},
+	"list":    {control: "private, no-cache"},
+}
+
+// parseCacheControl parses the cache-control setting into the policies it
+// changes.
+func parseCacheControl(s string) (map[string]string, error) {
+	changes := make(map[string]string)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.Index(entry, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("%q is not class:value", entry)
+		}
+		class, value := strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+		if _, ok := cachePolicies[class]; !ok {
+			return nil, fmt.Errorf("unknown class %q", class)
+		}
+		changes[class] = value
+	}
+	return changes, nil
+}
+
+// routeClass returns the class of r's route, or "".
+func routeClass(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case path == "/", path == "/static.html":
+		return "page"
+	case path == "/store.json":
+		return "list"
+	case path == "/status":
+		return "status"
+	case strings.HasPrefix(path, "/core/"):
+		return "core"
+	case strings.HasPrefix(path, "/recipes/"):
+		rest := strings.TrimPrefix(path, "/recipes/")
+		i := strings.Index(rest, "/")
+		if i < 0 {
+			return ""
+		}
+		switch rest = rest[i:]; {
+		case rest == "/tiddlers.json":
+			return "list"
+		case strings.HasPrefix(rest, "/tiddlers/") && len(rest) > len("/tiddlers/"):
+			return "tiddler"
+		}
+	}
+	return ""
+}
+
+// cacheHeaders sets the Cache-Control and Vary headers of r's route on
+// next's successful responses.
+func cacheHeaders(next http.Handler) http.Handler {
+	policies := make(map[string]cachePolicy)
+	for class, p := range cachePolicies {
+		policies[class] = p
+	}
+	changes, _ := parseCacheControl(cfg.CacheControl) // checked by validate
+	for class, control := range changes {
+		p := policies[class]
+		p.control = control
+		policies[class] = p
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := policies[routeClass(r)]
+		if !ok || r.Method != "GET" && r.Method != "HEAD" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&cacheWriter{ResponseWriter: w, policy: p}, r)
+	})
+}
+
+// cacheWriter adds a policy's headers to a successful response.
+type cacheWriter struct {
+	http.ResponseWriter
+	policy      cachePolicy
+	wroteHeader bool
+}
+
+func (w *cacheWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		if (code == http.StatusOK || code == http.StatusNotModified) && h.Get("Cache-Control") == "" {
+			h.Set("Cache-Control", w.policy.control)
+			if w.policy.vary != "" {
+				h.Add("Vary", w.policy.vary)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush passes on flushes, so that streamed responses aren't held back.
+func (w *cacheWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
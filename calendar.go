@@ -0,0 +1,206 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Re Calendar
+//
+// /calendar.ics is an iCalendar feed of the tiddlers carrying dates, so that tasks and journal events show up in
+// calendar apps: every live tiddler with a value in one of the calendar-fields ("due,event-date") becomes an event
+// on that date, titled by the tiddler (and the field, if it isn't the first of them), linking back to the tiddler in
+// the wiki.  calendar-filter, or ?filter=, narrows the tiddlers in sync profile filter syntax (see Re Sync
+// profiles); system tiddlers and drafts are always left out.  A field may hold a date (2006-01-02 or 20060102),
+// which makes an all-day event, or a time: a TiddlyWiki timestamp, 2006-01-02 15:04, or RFC 3339.  Times without a
+// zone are UTC.
+//
+// Calendar apps fetch the feed from their own servers, which can't sign in through the proxy, so besides signed-in
+// users it is served to requests carrying ?token= matching CALENDAR_TOKEN.  The proxy must let /calendar.ics
+// through for that, and calendar must be in public-endpoints; nobody is signed in there (see Re Public endpoints),
+// so every request has to carry the token.
+
+func calendar(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	token := os.Getenv("CALENDAR_TOKEN")
+	given := r.URL.Query().Get("token")
+	if currentUser(r) == "" && (token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1) {
+		http.Error(w, "permission denied", 403)
+		return
+	}
+	filter := cfg.CalendarFilter
+	if s := r.URL.Query().Get("filter"); s != "" {
+		filter = s
+	}
+	var f *syncFilter
+	if filter != "" {
+		var err error
+		if f, err = parseSyncFilter(filter); err != nil {
+			http.Error(w, "bad filter: "+err.Error(), 400)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	fields := calendarFields()
+	var events []calendarEvent
+	err := retry(ctx, func() error {
+		events = nil
+		return allTiddlers(ctx, func(title string, t *Tiddler) error {
+			if !publishable(title, t) {
+				return nil
+			}
+			if f != nil && !f.selects(title, parseFields(t).Tags) {
+				return nil
+			}
+			events = append(events, tiddlerEvents(title, t, fields)...)
+			return nil
+		})
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].UID < events[j].UID })
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Write(icalendar(events, requestOrigin(r)+cfg.BasePath+"/", r.Host))
+}
+
+// calendarFields returns the field names in the calendar-fields setting.
+func calendarFields() []string {
+	var fields []string
+	for _, f := range strings.Split(cfg.CalendarFields, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+type calendarEvent struct {
+	UID      string
+	Title    string
+	Field    string
+	Start    time.Time
+	AllDay   bool
+	Modified time.Time
+}
+
+// tiddlerEvents returns an event for each of fields in which t has a date.
+func tiddlerEvents(title string, t *Tiddler, fields []string) []calendarEvent {
+	var meta struct {
+		Modified string                 `json:"modified"`
+		Fields   map[string]interface{} `json:"fields"`
+	}
+	if json.Unmarshal([]byte(t.Meta), &meta) != nil {
+		return nil
+	}
+	modified, _ := parseTiddlyDate(meta.Modified)
+	var events []calendarEvent
+	for i, field := range fields {
+		s, _ := meta.Fields[field].(string)
+		start, allDay, ok := parseCalendarDate(strings.TrimSpace(s))
+		if !ok {
+			continue
+		}
+		e := calendarEvent{Title: title, Start: start, AllDay: allDay, Modified: modified}
+		if i > 0 {
+			e.Field = field
+		}
+		e.UID = fmt.Sprintf("%x", sha256.Sum256([]byte(title+"\x00"+field)))[:32]
+		events = append(events, e)
+	}
+	return events
+}
+
+// parseCalendarDate parses a date field, reporting whether it was a date
+// without a time.
+func parseCalendarDate(s string) (t time.Time, allDay bool, ok bool) {
+	for _, layout := range []string{"2006-01-02", "20060102"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true, true
+		}
+	}
+	if t, err := parseTiddlyDate(s); err == nil {
+		return t, false, true
+	}
+	if t, err := time.Parse("20060102150405", s); err == nil {
+		return t, false, true
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02 15:04"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), false, true
+		}
+	}
+	return time.Time{}, false, false
+}
+
+// icalendar returns the events as an iCalendar (RFC 5545) file. wiki is the
+// URL of the wiki, and host names it in the events' UIDs.
+func icalendar(events []calendarEvent, wiki, host string) []byte {
+	var buf bytes.Buffer
+	line := func(s string) {
+		// Lines are folded at 75 octets, between characters.
+		for len(s) > 75 {
+			n := 75
+			for !utf8.RuneStart(s[n]) {
+				n--
+			}
+			buf.WriteString(s[:n] + "\r\n")
+			s = " " + s[n:]
+		}
+		buf.WriteString(s + "\r\n")
+	}
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//tiddly//calendar//EN")
+	line("CALSCALE:GREGORIAN")
+	line("X-WR-CALNAME:" + icalText(host))
+	for _, e := range events {
+		summary := e.Title
+		if e.Field != "" {
+			summary += " (" + e.Field + ")"
+		}
+		stamp := e.Modified
+		if stamp.IsZero() {
+			stamp = time.Unix(0, 0)
+		}
+		line("BEGIN:VEVENT")
+		line("UID:" + e.UID + "@" + host)
+		line("DTSTAMP:" + stamp.UTC().Format("20060102T150405Z"))
+		if e.AllDay {
+			line("DTSTART;VALUE=DATE:" + e.Start.Format("20060102"))
+			line("DTEND;VALUE=DATE:" + e.Start.AddDate(0, 0, 1).Format("20060102"))
+		} else {
+			line("DTSTART:" + e.Start.UTC().Format("20060102T150405Z"))
+		}
+		line("SUMMARY:" + icalText(summary))
+		line("URL:" + wiki + "#" + url.PathEscape(e.Title))
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	return buf.Bytes()
+}
+
+// icalText escapes s as an iCalendar TEXT value.
+func icalText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,220 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strconv"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Catalog
+//
+// Building the skinny list means reading every tiddler, which costs more the bigger the wiki.  With catalog set,
+// the metadata of every tiddler is also kept in a catalog of a few Catalog entities, so the list costs a read of
+// those (and of the macros and plugins sent whole) however big the wiki is.  The catalog is updated on every save,
+// delete and rename, by a Store layer beneath the caches that sees every write of a Tiddler.  It is split into
+// catalogShards entities by hash of title, both so that it fits Datastore's 1MB limit on an entity for wikis of some
+// tens of thousands of tiddlers and so that concurrent saves rarely contend for the same one.
+//
+// If a shard is missing, as it is the first time, the catalog is rebuilt from a scan.  If a shard can't be
+// updated, it is deleted so that the next list rebuilds it, rather than left wrong.  A rebuild racing a save can
+// still miss the save; deleting the Catalog entities forces another.
+
+const catalogShards = 16
+
+type catalogShard struct {
+	Entries []byte `datastore:"Entries,noindex"` // JSON object of title to meta
+}
+
+func catalogKey(shard int) *datastore.Key {
+	return datastore.NameKey("Catalog", strconv.Itoa(shard), nil)
+}
+
+func catalogShardOf(title string) int {
+	h := fnv.New32a()
+	h.Write([]byte(title))
+	return int(h.Sum32() % catalogShards)
+}
+
+// catalogEntries returns the titles and metadata of all the tiddlers not
+// deleted, in title order, from the catalog.
+func catalogEntries(ctx context.Context) (titles, metas []string, err error) {
+	keys := make([]*datastore.Key, catalogShards)
+	for i := range keys {
+		keys[i] = catalogKey(i)
+	}
+	shards := make([]catalogShard, catalogShards)
+	err = retry(ctx, func() error { return db.GetMulti(ctx, keys, shards) })
+	if merr, ok := err.(datastore.MultiError); ok {
+		for _, e := range merr {
+			if e == datastore.ErrNoSuchEntity {
+				return rebuildCatalog(ctx)
+			}
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	all := make(map[string]string)
+	for _, sh := range shards {
+		var m map[string]string
+		if err := json.Unmarshal(sh.Entries, &m); err != nil {
+			return nil, nil, err
+		}
+		for title, meta := range m {
+			all[title] = meta
+		}
+	}
+	for title := range all {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+	metas = make([]string, len(titles))
+	for i, title := range titles {
+		metas[i] = all[title]
+	}
+	return titles, metas, nil
+}
+
+// rebuildCatalog builds the catalog from a scan, returning what it found.
+func rebuildCatalog(ctx context.Context) (titles, metas []string, err error) {
+	titles, metas, err = scanMetas(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	byShard := make([]map[string]string, catalogShards)
+	for i := range byShard {
+		byShard[i] = make(map[string]string)
+	}
+	for i, title := range titles {
+		byShard[catalogShardOf(title)][title] = metas[i]
+	}
+	keys := make([]*datastore.Key, catalogShards)
+	shards := make([]catalogShard, catalogShards)
+	for i := range keys {
+		keys[i] = catalogKey(i)
+		if shards[i].Entries, err = json.Marshal(byShard[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := retry(ctx, func() error { return db.PutMulti(ctx, keys, shards) }); err != nil {
+		log.Printf("writing catalog: %v", err)
+	} else {
+		log.Printf("rebuilt catalog of %d tiddlers", len(titles))
+	}
+	return titles, metas, nil
+}
+
+// catalogStore is a Store keeping the catalog up to date.
+type catalogStore struct {
+	Store
+}
+
+// record updates the catalog entries of titles from the Tiddlers as they
+// are now.  Each is read in the transaction updating its shard, rather than
+// taken from what was written, so that of two saves racing, the one
+// recording last can't record the other's metadata over its own.
+func (s catalogStore) record(ctx context.Context, titles []string) {
+	byShard := make(map[int][]string)
+	for _, title := range titles {
+		n := catalogShardOf(title)
+		byShard[n] = append(byShard[n], title)
+	}
+	for n, titles := range byShard {
+		key := catalogKey(n)
+		err := s.Store.RunInTransaction(ctx, func(tx Transaction) error {
+			var sh catalogShard
+			if err := tx.Get(key, &sh); err != nil {
+				if err == datastore.ErrNoSuchEntity {
+					return nil // to be rebuilt
+				}
+				return err
+			}
+			var m map[string]string
+			if err := json.Unmarshal(sh.Entries, &m); err != nil {
+				return err
+			}
+			if m == nil {
+				m = make(map[string]string)
+			}
+			for _, title := range titles {
+				var t Tiddler
+				err := tx.Get(datastore.NameKey("Tiddler", title, nil), &t)
+				if err != nil && err != datastore.ErrNoSuchEntity {
+					return err
+				}
+				if t.Meta == "" {
+					delete(m, title)
+				} else {
+					m[title] = t.Meta
+				}
+			}
+			data, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			sh.Entries = data
+			return tx.Put(key, &sh)
+		})
+		if err != nil {
+			log.Printf("updating catalog: %v; dropping shard %d", err, n)
+			if err := s.Store.DeleteMulti(ctx, []*datastore.Key{key}); err != nil {
+				log.Printf("dropping catalog shard %d: %v", n, err)
+			}
+		}
+	}
+}
+
+// recordKeys records the Tiddlers among keys.
+func (s catalogStore) recordKeys(ctx context.Context, keys []*datastore.Key) {
+	var titles []string
+	for _, key := range keys {
+		if key.Kind == "Tiddler" {
+			titles = append(titles, key.Name)
+		}
+	}
+	if len(titles) > 0 {
+		s.record(ctx, titles)
+	}
+}
+
+func (s catalogStore) Put(ctx context.Context, key *datastore.Key, src interface{}) error {
+	if err := s.Store.Put(ctx, key, src); err != nil {
+		return err
+	}
+	s.recordKeys(ctx, []*datastore.Key{key})
+	return nil
+}
+
+func (s catalogStore) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) error {
+	// Some may have been written even if it fails.
+	err := s.Store.PutMulti(ctx, keys, src)
+	s.recordKeys(ctx, keys)
+	return err
+}
+
+func (s catalogStore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	err := s.Store.DeleteMulti(ctx, keys)
+	s.recordKeys(ctx, keys)
+	return err
+}
+
+func (s catalogStore) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	var written []*datastore.Key
+	err := s.Store.RunInTransaction(ctx, func(tx Transaction) error {
+		written = written[:0]
+		return f(&recordingTx{tx, &written})
+	})
+	if err == nil {
+		s.recordKeys(ctx, written)
+	}
+	return err
+}
@@ -0,0 +1,269 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Re Commands
+//
+// The binary is the server and also the tool for operating on its data:
+//     tiddly [serve] [flags]              run the server (the default)
+//     tiddly export [-o wiki.json]        write all tiddlers as a TiddlyWiki JSON export
+//     tiddly import file.json...          save the tiddlers in TiddlyWiki JSON exports
+//     tiddly backup [-o file]             write every entity, history included
+//     tiddly prune-history [-keep N]      delete all but the newest N revisions of each tiddler
+//     tiddly publish -o dir | -bucket b   write the public site (see publish-tag) to a directory or bucket
+//     tiddly reindex                      rebuild links and the catalog from the tiddlers (see Re Reindexing)
+//     tiddly snapshot                     record the revision of every tiddler (see Re Snapshots)
+//     tiddly migrate [-n]                 apply pending data migrations (see Re Data migrations)
+//     tiddly migrate -from b1 -to b2      copy the wiki between storage backends (see Re Moving between backends)
+//     tiddly doctor [-write=false]        check the configuration and storage, with advice (see Re Doctor)
+//     tiddly version                      print build information
+// Every command takes the configuration flags described in config.go.
+
+type command struct {
+	run     func(args []string) error
+	summary string
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"serve":         {serve, "run the wiki server (the default)"},
+		"export":        {exportCmd, "write all tiddlers as a TiddlyWiki JSON export"},
+		"import":        {importCmd, "save the tiddlers in TiddlyWiki JSON export files"},
+		"backup":        {backupCmd, "write every tiddler and history entity to a file"},
+		"prune-history": {pruneHistoryCmd, "delete old revisions from the history"},
+		"publish":       {publishCmd, "write the pages for tiddlers tagged publish-tag"},
+		"reindex":       {reindexCmd, "rebuild links and the catalog from the tiddlers"},
+		"snapshot":      {snapshotCmd, "record the revision of every tiddler as a snapshot"},
+		"migrate":       {migrateCmd, "apply pending data migrations"},
+		"doctor":        {doctorCmd, "check the configuration and storage, and advise"},
+		"version":       {versionCmd, "print build information"},
+		"help":          {helpCmd, "show this help"},
+	}
+}
+
+func main() {
+	args := os.Args[1:]
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "tiddly: unknown command %q\n\n", name)
+		helpCmd(nil)
+		os.Exit(2)
+	}
+	if err := cmd.run(args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func helpCmd(args []string) error {
+	fmt.Fprintf(os.Stderr, "usage: tiddly <command> [flags]\n\ncommands:\n")
+	for _, name := range []string{"serve", "export", "import", "backup", "prune-history", "publish", "reindex", "snapshot", "migrate", "doctor", "version", "help"} {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun tiddly <command> -help for a command's flags.\n")
+	return nil
+}
+
+func versionCmd(args []string) error {
+	fmt.Printf("tiddly %s (built %s with %s)\n", build, build.BuildDate, build.GoVersion)
+	return nil
+}
+
+func newFlagSet(name, argsUsage string) *flag.FlagSet {
+	fs := flag.NewFlagSet("tiddly "+name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: tiddly %s [flags] %s\n", name, argsUsage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// setup parses args into fs and the configuration. It reports whether the
+// command should go on, which it shouldn't after -help or -print-config.
+func setup(fs *flag.FlagSet, args []string) (bool, error) {
+	printConfig, err := loadConfig(fs, args)
+	if err == flag.ErrHelp {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if printConfig {
+		return false, writeConfig(os.Stdout)
+	}
+	return true, nil
+}
+
+// output opens the named file for writing, or returns stdout if name is
+// empty.
+func output(name string) (io.WriteCloser, error) {
+	if name == "" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return os.Create(name)
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func exportCmd(args []string) error {
+	fs := newFlagSet("export", "")
+	out := fs.String("o", "", "file to write (default stdout)")
+	if ok, err := setup(fs, args); !ok {
+		return err
+	}
+	if err := openStore(); err != nil {
+		return err
+	}
+	w, err := output(*out)
+	if err != nil {
+		return err
+	}
+	n, err := exportTiddlers(context.Background(), w)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	log.Printf("Exported %d tiddlers", n)
+	return w.Close()
+}
+
+func importCmd(args []string) error {
+	fs := newFlagSet("import", "file.json|file.html...")
+	if ok, err := setup(fs, args); !ok {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no files to import")
+	}
+	// Tiddlers saved in an empty.html are only imported if changed.
+	var err error
+	if emptyPage, err = loadEmptyPage(filepath.Join(cfg.CoreDir, cfg.Core)); err != nil {
+		log.Printf("importing pages without the empty page: %v", err)
+	}
+	if err := openStore(); err != nil {
+		return err
+	}
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		n, err := importTiddlers(context.Background(), f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		log.Printf("%s: imported %d tiddlers", name, n)
+	}
+	return nil
+}
+
+func backupCmd(args []string) error {
+	fs := newFlagSet("backup", "")
+	out := fs.String("o", "tiddly-backup-"+time.Now().UTC().Format("20060102-150405")+".json", "file to write; - for stdout")
+	if ok, err := setup(fs, args); !ok {
+		return err
+	}
+	if err := openStore(); err != nil {
+		return err
+	}
+	name := *out
+	if name == "-" {
+		name = ""
+	}
+	w, err := output(name)
+	if err != nil {
+		return err
+	}
+	n, err := backupEntities(context.Background(), w)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	if name != "" {
+		log.Printf("Wrote %d entities to %s", n, name)
+	}
+	return w.Close()
+}
+
+func pruneHistoryCmd(args []string) error {
+	fs := newFlagSet("prune-history", "")
+	keep := fs.Int("keep", 50, "revisions of each tiddler to keep")
+	dryRun := fs.Bool("n", false, "only report what would be deleted")
+	if ok, err := setup(fs, args); !ok {
+		return err
+	}
+	if *keep < 1 {
+		return fmt.Errorf("-keep must be at least 1")
+	}
+	if err := openStore(); err != nil {
+		return err
+	}
+	n, err := pruneHistory(context.Background(), *keep, *dryRun)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		log.Printf("Would delete %d history entries", n)
+	} else {
+		log.Printf("Deleted %d history entries", n)
+	}
+	return nil
+}
+
+func publishCmd(args []string) error {
+	fs := newFlagSet("publish", "")
+	dir := fs.String("o", "", "directory to write the site to; other .html files in it are removed")
+	bucket := fs.String("bucket", "", "Cloud Storage bucket to upload the site to instead")
+	prefix := fs.String("prefix", "", "object name prefix within -bucket, e.g. blog/")
+	if ok, err := setup(fs, args); !ok {
+		return err
+	}
+	if cfg.PublishTag == "" {
+		return fmt.Errorf("-publish-tag is not set")
+	}
+	if (*dir == "") == (*bucket == "") {
+		fs.Usage()
+		return fmt.Errorf("need exactly one of -o and -bucket")
+	}
+	if err := openStore(); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	s, err := buildSite(ctx)
+	if err != nil {
+		return err
+	}
+	if *dir != "" {
+		err = writeSiteDir(*dir, s.Files)
+	} else {
+		err = writeSiteBucket(ctx, *bucket, *prefix, s.Files)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Published %d tiddlers", len(s.Tiddlers))
+	return nil
+}
@@ -0,0 +1,215 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Re Clipping
+//
+// Web clipper extensions and bookmarklets run in the browser on other sites, where the proxy's sign-in doesn't
+// reach, so POST /clip takes a token instead: CLIP_TOKENS lists user=token pairs ("alice=3f9a...,bob=..."), and the
+// token comes as "Authorization: Bearer <token>" or ?token=.  The request is then handled as that user's, rate
+// limits, quotas and read-only mode included.  (The tokens come from the environment so that -print-config doesn't
+// show them.)  The body is JSON or a form, with the fields clippers send:
+//     {"url": "https://...", "title": "Page title", "selection": "the selected text", "tags": ["reading"]}
+// html may stand in for selection, and note adds a line of your own above it.  The tiddler is titled by the page
+// (with the time appended if that's taken), quotes the selection with a link back to the page, keeps the page's
+// address in its url field, and is tagged with tags, or "clipped" if there are none.  Allow the extension's origin
+// in cors-origins.
+
+type clipRequest struct {
+	URL       string      `json:"url"`
+	Title     string      `json:"title"`
+	Selection string      `json:"selection"`
+	Text      string      `json:"text"`
+	HTML      string      `json:"html"`
+	Note      string      `json:"note"`
+	Tags      interface{} `json:"tags"`
+}
+
+// clipAuth lets through requests carrying one of the CLIP_TOKENS, as the
+// token's user.
+func clipAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Whatever the client says, it isn't anyone until the token
+		// says so.
+		r.Header.Del(cfg.AuthHeader)
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		user := clipUser(token)
+		if user == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="clip"`)
+			http.Error(w, "a clip token is required", 401)
+			return
+		}
+		r.Header.Set(cfg.AuthHeader, user)
+		next.ServeHTTP(w, withUser(r))
+	})
+}
+
+// clipUser returns the user whose token in CLIP_TOKENS is token, or "".
+func clipUser(token string) string {
+	if token == "" {
+		return ""
+	}
+	for _, f := range strings.Split(os.Getenv("CLIP_TOKENS"), ",") {
+		i := strings.LastIndex(f, "=")
+		if i <= 0 {
+			continue
+		}
+		user, t := strings.TrimSpace(f[:i]), strings.TrimSpace(f[i+1:])
+		if t != "" && subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return user
+		}
+	}
+	return ""
+}
+
+func clip(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "POST") {
+		return
+	}
+	var req clipRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, cfg.MaxTiddlerBytes))
+		if err != nil {
+			http.Error(w, "cannot read data", 400)
+			return
+		}
+		if err := json.Unmarshal(data, &req); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	} else {
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxTiddlerBytes)
+		req = clipRequest{
+			URL:       r.FormValue("url"),
+			Title:     r.FormValue("title"),
+			Selection: r.FormValue("selection"),
+			Text:      r.FormValue("text"),
+			HTML:      r.FormValue("html"),
+			Note:      r.FormValue("note"),
+			Tags:      r.FormValue("tags"),
+		}
+	}
+	if req.URL != "" {
+		if u, err := url.Parse(req.URL); err != nil || u.Scheme == "" {
+			http.Error(w, "url must be an absolute URL", 400)
+			return
+		}
+	}
+	if req.URL == "" && req.Selection == "" && req.Text == "" && req.HTML == "" {
+		http.Error(w, "nothing to clip: give a url or a selection", 400)
+		return
+	}
+
+	ctx := r.Context()
+	now := time.Now().UTC()
+	name := req.Title
+	if strings.TrimSpace(name) == "" {
+		name = req.URL
+	}
+	if strings.TrimSpace(name) == "" {
+		name = "Clipping"
+	}
+	title, err := untakenTitle(ctx, name, now)
+	if err != nil {
+		http.Error(w, "title: "+err.Error(), 400)
+		return
+	}
+	js := clipTiddler(&req, title, currentUser(r), now)
+	t, err := saveRevision(ctx, title, js)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	logf(ctx, "%s clipped %s as %q", currentUser(r), req.URL, loggedTitle(title))
+	etag := tiddlerETag(title, &t)
+	out, err := json.Marshal(batchResult{Title: title, Revision: t.Rev, ETag: etag})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	w.Header().Set("Etag", etag)
+	w.Header().Set("Content-Type", jsonType)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(out)
+}
+
+// clipTiddler returns the tiddler, in TiddlyWeb JSON form, for a clip.
+func clipTiddler(req *clipRequest, title, user string, now time.Time) map[string]interface{} {
+	selection := req.Selection
+	if selection == "" {
+		selection = req.Text
+	}
+	typ := "text/vnd.tiddlywiki"
+	var b strings.Builder
+	if req.HTML != "" && selection == "" {
+		// Clipped markup is kept as it came, as an HTML tiddler.
+		typ = "text/html"
+		if req.Note != "" {
+			b.WriteString("<p>" + html.EscapeString(req.Note) + "</p>\n")
+		}
+		b.WriteString("<blockquote>" + req.HTML + "</blockquote>\n")
+		if req.URL != "" {
+			b.WriteString(`<p><a href="` + html.EscapeString(req.URL) + `">` + html.EscapeString(req.URL) + "</a></p>\n")
+		}
+	} else {
+		if req.Note != "" {
+			b.WriteString(req.Note + "\n\n")
+		}
+		source := req.URL
+		if req.URL != "" && req.Title != "" {
+			source = "[[" + strings.NewReplacer("[", "(", "]", ")", "|", "-").Replace(req.Title) + "|" + req.URL + "]]"
+		}
+		if selection != "" {
+			b.WriteString("<<<\n" + strings.TrimSpace(selection) + "\n<<< " + source + "\n")
+		} else {
+			b.WriteString(source + "\n")
+		}
+	}
+
+	var tags []string
+	switch v := req.Tags.(type) {
+	case string:
+		tags = parseTags(v)
+	case []interface{}:
+		for _, t := range v {
+			if s, ok := t.(string); ok && s != "" {
+				tags = append(tags, s)
+			}
+		}
+	}
+	if len(tags) == 0 {
+		tags = []string{"clipped"}
+	}
+	stamp := tiddlyDate(now)
+	js := map[string]interface{}{
+		"title":    title,
+		"text":     b.String(),
+		"type":     typ,
+		"tags":     tags,
+		"created":  stamp,
+		"modified": stamp,
+		"creator":  user,
+		"modifier": user,
+	}
+	if req.URL != "" {
+		js["fields"] = map[string]interface{}{"url": req.URL}
+	}
+	return js
+}
@@ -0,0 +1,261 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Write coalescing
+//
+// TiddlyWiki saves a tiddler being edited at nearly every pause in typing, and each save writes the tiddler, its
+// links and a history revision.  With coalesce-saves set to a duration, the first save of a tiddler starts a timer
+// of that length, and it and any saves of the same tiddler until the timer fires are held in memory and written
+// together when it does: the tiddler and its links as last saved, and only the newest history revision.  The client
+// is answered as soon as its save is held, with the revision it will have, so the history of a burst of saves shows
+// only its last revision.  Held tiddlers are served to gets by title; anything else that reads or changes the store
+// (a list, a scan, a delete, a transaction, a batch save) writes everything held first, so it sees what was saved.
+// Holds are written on shutdown too, but a crash loses them, and other instances don't see them until they are
+// written: use coalescing with one instance, or keep coalesce-saves short.
+
+// coalescedKinds are the kinds whose puts are held.
+var coalescedKinds = map[string]bool{"Tiddler": true, "TiddlerLinks": true, "TiddlerHistory": true}
+
+// coalesceStore holds puts of the Store it wraps (see Re Write coalescing).
+type coalesceStore struct {
+	Store
+	mu       sync.Mutex
+	pending  map[string]*heldPut // by heldKey
+	timers   map[string]*time.Timer
+	flushing map[string]*titleLock
+}
+
+// titleLock is held while a title's puts are written, so that a flush can't
+// write an older put over what a later flush of the same title wrote.
+type titleLock struct {
+	sync.Mutex
+	waiters int
+}
+
+type heldPut struct {
+	title string
+	key   *datastore.Key
+	src   reflect.Value // a pointer to a copy of what was put
+}
+
+func newCoalesceStore(s Store) *coalesceStore {
+	return &coalesceStore{
+		Store:    s,
+		pending:  make(map[string]*heldPut),
+		timers:   make(map[string]*time.Timer),
+		flushing: make(map[string]*titleLock),
+	}
+}
+
+func heldKey(key *datastore.Key) string {
+	return key.Kind + "\x00" + key.Name
+}
+
+// heldTitle returns the title whose save puts key.
+func heldTitle(key *datastore.Key) string {
+	if key.Kind == "TiddlerHistory" {
+		if i := strings.LastIndex(key.Name, "#"); i >= 0 {
+			return key.Name[:i]
+		}
+	}
+	return key.Name
+}
+
+func (s *coalesceStore) Put(ctx context.Context, key *datastore.Key, src interface{}) error {
+	if !coalescedKinds[key.Kind] {
+		return s.Store.Put(ctx, key, src)
+	}
+	v := reflect.New(reflect.TypeOf(src).Elem())
+	v.Elem().Set(reflect.ValueOf(src).Elem())
+	title := heldTitle(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key.Kind == "TiddlerHistory" {
+		// Only the newest revision of a burst is kept.
+		for k, p := range s.pending {
+			if p.title == title && p.key.Kind == "TiddlerHistory" {
+				delete(s.pending, k)
+			}
+		}
+	}
+	s.pending[heldKey(key)] = &heldPut{title: title, key: key, src: v}
+	if s.timers[title] == nil {
+		s.timers[title] = time.AfterFunc(cfg.CoalesceSaves, func() { s.flushTimed(title) })
+	}
+	return nil
+}
+
+func (s *coalesceStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	s.mu.Lock()
+	p := s.pending[heldKey(key)]
+	s.mu.Unlock()
+	if p != nil {
+		d := reflect.ValueOf(dst).Elem()
+		if p.src.Type().Elem() == d.Type() {
+			d.Set(p.src.Elem())
+			return nil
+		}
+		// Read into something else (such as tiddlerMeta): let the
+		// store do it, once it has the put.
+		if err := s.flush(ctx, p.title); err != nil {
+			return err
+		}
+	}
+	return s.Store.Get(ctx, key, dst)
+}
+
+func (s *coalesceStore) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	if err := s.flushAll(ctx); err != nil {
+		return err
+	}
+	return s.Store.GetMulti(ctx, keys, dst)
+}
+
+func (s *coalesceStore) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) error {
+	if err := s.flushAll(ctx); err != nil {
+		return err
+	}
+	return s.Store.PutMulti(ctx, keys, src)
+}
+
+func (s *coalesceStore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	if err := s.flushAll(ctx); err != nil {
+		return err
+	}
+	return s.Store.DeleteMulti(ctx, keys)
+}
+
+func (s *coalesceStore) Scan(ctx context.Context, kind, prefix string, dst interface{}, fn func(name string) error) error {
+	if err := s.flushAll(ctx); err != nil {
+		return err
+	}
+	return s.Store.Scan(ctx, kind, prefix, dst, fn)
+}
+
+func (s *coalesceStore) Names(ctx context.Context, kind, prefix string) ([]string, error) {
+	if err := s.flushAll(ctx); err != nil {
+		return nil, err
+	}
+	return s.Store.Names(ctx, kind, prefix)
+}
+
+func (s *coalesceStore) LinksTo(ctx context.Context, title string) ([]string, error) {
+	if err := s.flushAll(ctx); err != nil {
+		return nil, err
+	}
+	return s.Store.LinksTo(ctx, title)
+}
+
+func (s *coalesceStore) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	if err := s.flushAll(ctx); err != nil {
+		return err
+	}
+	return s.Store.RunInTransaction(ctx, f)
+}
+
+func (s *coalesceStore) Close() error {
+	if err := s.flushAll(context.Background()); err != nil {
+		log.Printf("writing held saves: %v", err)
+	}
+	return s.Store.Close()
+}
+
+// flushTimed writes title's held puts when its timer fires, trying again
+// later if that fails.
+func (s *coalesceStore) flushTimed(title string) {
+	ctx := context.Background()
+	if err := retry(ctx, func() error { return s.flush(ctx, title) }); err != nil {
+		log.Printf("writing held saves of %q: %v", loggedTitle(title), err)
+		s.mu.Lock()
+		if s.timers[title] == nil {
+			s.timers[title] = time.AfterFunc(cfg.CoalesceSaves, func() { s.flushTimed(title) })
+		}
+		s.mu.Unlock()
+	}
+}
+
+// lockTitle waits for any flush of title to finish, and returns the func
+// that lets the next one go ahead.
+func (s *coalesceStore) lockTitle(title string) (unlock func()) {
+	s.mu.Lock()
+	l := s.flushing[title]
+	if l == nil {
+		l = new(titleLock)
+		s.flushing[title] = l
+	}
+	l.waiters++
+	s.mu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.mu.Lock()
+		if l.waiters--; l.waiters == 0 {
+			delete(s.flushing, title)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// flush writes title's held puts. They stay held, and are served, until
+// they are written, and aren't dropped if they were replaced meanwhile.
+// Flushes of the same title take turns, each writing what is held when its
+// turn comes.
+func (s *coalesceStore) flush(ctx context.Context, title string) error {
+	unlock := s.lockTitle(title)
+	defer unlock()
+	s.mu.Lock()
+	if t := s.timers[title]; t != nil {
+		t.Stop()
+		delete(s.timers, title)
+	}
+	var puts []*heldPut
+	for _, p := range s.pending {
+		if p.title == title {
+			puts = append(puts, p)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, p := range puts {
+		if err := s.Store.Put(ctx, p.key, p.src.Interface()); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		if s.pending[heldKey(p.key)] == p {
+			delete(s.pending, heldKey(p.key))
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// flushAll writes every held put.
+func (s *coalesceStore) flushAll(ctx context.Context) error {
+	s.mu.Lock()
+	titles := make(map[string]bool)
+	for _, p := range s.pending {
+		titles[p.title] = true
+	}
+	s.mu.Unlock()
+	for title := range titles {
+		if err := s.flush(ctx, title); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Re Precompression
+//
+// The page is by far the largest response, a couple of megabytes of HTML and JavaScript that compresses to a fifth
+// of that, and it stays the same from one request to the next.  So rather than compress it per request, each page is
+// compressed once, with gzip and brotli at their best settings, as it is built: at startup for /, /static.html and
+// /empty.html, and for the custom shell (see Re Custom shell) whenever its settings change.  A request whose
+// Accept-Encoding admits br gets the brotli copy, or else one that admits gzip the gzip copy, with Vary:
+// Accept-Encoding and any Etag marked with the encoding, so that caches keep the copies apart.  Compressing takes a
+// few seconds, in the background, so the server listens at once and sends the page as is until it is done.
+
+// pageEncodings holds a page's data compressed ahead of time.
+type pageEncodings struct {
+	done chan struct{} // closed once gzip and br are set
+	gzip []byte
+	br   []byte
+}
+
+// precompress returns p with its data being compressed in the background.
+func precompress(p page) page {
+	e := &pageEncodings{done: make(chan struct{})}
+	data := p.data
+	go func() {
+		defer close(e.done)
+		var gz, br bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&gz, gzip.BestCompression)
+		zw.Write(data)
+		zw.Close()
+		bw := brotli.NewWriterLevel(&br, brotli.BestCompression)
+		bw.Write(data)
+		bw.Close()
+		e.gzip, e.br = gz.Bytes(), br.Bytes()
+	}()
+	p.enc = e
+	return p
+}
+
+// encoded returns p's data in the best encoding r accepts that p has ready,
+// and the name of the encoding, or "" for the data as is.
+func (p page) encoded(r *http.Request) ([]byte, string) {
+	if p.enc == nil {
+		return p.data, ""
+	}
+	select {
+	case <-p.enc.done:
+	default:
+		return p.data, ""
+	}
+	switch {
+	case acceptsEncoding(r, "br"):
+		return p.enc.br, "br"
+	case acceptsEncoding(r, "gzip"):
+		return p.enc.gzip, "gzip"
+	}
+	return p.data, ""
+}
+
+// acceptsEncoding reports whether r's Accept-Encoding header admits coding.
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, c := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		q := 1.0
+		if i := strings.Index(c, ";"); i >= 0 {
+			param := strings.TrimSpace(c[i+1:])
+			if strings.HasPrefix(param, "q=") {
+				q, _ = strconv.ParseFloat(param[len("q="):], 64)
+			}
+			c = c[:i]
+		}
+		c = strings.ToLower(strings.TrimSpace(c))
+		if (c == coding || c == "*") && q > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// servePage serves p as name, in the encoding r prefers if p has it. An Etag
+// set by the caller is marked with the encoding.
+func servePage(w http.ResponseWriter, r *http.Request, name string, p page) {
+	data, coding := p.encoded(r)
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if coding != "" {
+		h.Set("Content-Encoding", coding)
+		if etag := h.Get("Etag"); strings.HasSuffix(etag, `"`) {
+			h.Set("Etag", strings.TrimSuffix(etag, `"`)+"-"+coding+`"`)
+		}
+	}
+	http.ServeContent(w, r, name, p.modTime, bytes.NewReader(data))
+}
@@ -0,0 +1,654 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Re Configuration
+//
+// Every setting can come from a command-line flag, an environment variable, or a config file named by -config (or
+// CONFIG_FILE), in decreasing order of precedence.  The file is YAML if its name ends in .yaml or .yml, TOML if it
+// ends in .toml, and JSON otherwise.  Keys are the flag names, and values are strings, numbers or booleans:
+//     project: my-project
+//     port: 8080
+//     write-timeout: 5m
+// Run with -print-config to see the effective configuration, or -help for the full list of settings.
+
+type Config struct {
+	Project    string
+	Port       string
+	Socket     string
+	SocketMode string
+	BasePath   string
+	CoreDir    string
+	Core       string
+	CoreCDN    string
+	PluginDir  string
+	PublishTag string
+	RobotsFile string
+	Storage    string
+	AuthHeader string
+	Recipe     string
+	Recipes    string
+
+	DataProject     string
+	CredentialsFile string
+	Impersonate     string
+
+	PublicEndpoints string
+	OpsAddr         string
+
+	DatastoreNamespace string
+	TiddlerKind        string
+	HistoryKind        string
+
+	DataFile   string
+	S3Endpoint string
+	S3Bucket   string
+	S3Prefix   string
+	S3Region   string
+	MySQLDSN   string
+
+	MySQLReadDSN string
+	ReplicaLag   time.Duration
+
+	RedisAddr   string
+	RedisPrefix string
+	RedisTTL    time.Duration
+
+	CacheLayers      string
+	MemoryCacheBytes int64
+	MemoryCacheTTL   time.Duration
+	Catalog          bool
+	AutoMigrate      bool
+
+	TiddlerCacheBytes int64
+
+	ConflictCopies  bool
+	CoalesceSaves   time.Duration
+	AsyncHistory    bool
+	Drafts          string
+	DraftTTL        time.Duration
+	ReadOnly        bool
+	ReadOnlyMessage string
+	GuestSandbox    bool
+	GuestTTL        time.Duration
+
+	CORSOrigins     string
+	CORSCredentials bool
+	CORSMaxAge      time.Duration
+
+	TLSCert          string
+	TLSKey           string
+	AutocertHosts    string
+	AutocertCacheDir string
+	AutocertEmail    string
+	AutocertHTTPAddr string
+
+	MaxTiddlerBytes int64
+	MaxBatchBytes   int64
+	QuotaBytes      int64
+	UserQuotas      string
+	RateLimit       float64
+	RateBurst       int
+	ClientIPHeader  string
+	RetryBudget     time.Duration
+	CallTimeout     time.Duration
+	ReadyCacheTTL   time.Duration
+	ShellCacheTTL   time.Duration
+	PublishCacheTTL time.Duration
+	CacheControl    string
+
+	DailyReadBudget  int64
+	DailyWriteBudget int64
+
+	SnapshotInterval time.Duration
+	SnapshotKeep     int
+
+	JournalTitle    string
+	JournalTemplate string
+	JournalTimezone string
+	JournalDaily    bool
+
+	InboundEmailTag  string
+	InboundEmailFrom string
+
+	CalendarFields string
+	CalendarFilter string
+
+	API bool
+
+	Offline bool
+
+	SyncPollInterval time.Duration
+	SyncThrottle     time.Duration
+	SyncHost         string
+	SyncFilter       string
+	SyncEager        bool
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+
+	TraceExporter   string
+	TraceSampleRate float64
+
+	ErrorReporter string
+	SentryDSN     string
+
+	LogTitles string
+}
+
+var cfg = Config{
+	Port:        "8080",
+	CoreDir:     ".",
+	Core:        "index.html",
+	SocketMode:  "0660",
+	Storage:     "datastore",
+	AuthHeader:  "X-Webauth-User",
+	Recipe:      "all",
+	TiddlerKind: "Tiddler",
+	HistoryKind: "TiddlerHistory",
+
+	DataFile: "tiddly.db",
+	S3Region: "us-east-1",
+
+	ReplicaLag: 10 * time.Second,
+
+	RedisPrefix: "tiddly:",
+	RedisTTL:    10 * time.Minute,
+
+	MemoryCacheBytes: 32 << 20,
+	MemoryCacheTTL:   time.Minute,
+	AutoMigrate:      true,
+
+	CORSMaxAge: 10 * time.Minute,
+
+	AutocertCacheDir: "autocert",
+
+	// Datastore rejects entities over 1MiB anyway, so there's no point
+	// reading more than that by default.
+	MaxTiddlerBytes: 1 << 20,
+	MaxBatchBytes:   32 << 20,
+	RateLimit:       2,
+	RateBurst:       30,
+	RetryBudget:     5 * time.Second,
+	CallTimeout:     10 * time.Second,
+	ReadyCacheTTL:   10 * time.Second,
+	ShellCacheTTL:   time.Minute,
+	PublishCacheTTL: 5 * time.Minute,
+
+	ReadHeaderTimeout: 10 * time.Second,
+	ReadTimeout:       time.Minute,
+	// Must cover a 30s /debug/pprof/profile.
+	WriteTimeout:   2 * time.Minute,
+	IdleTimeout:    2 * time.Minute,
+	MaxHeaderBytes: http.DefaultMaxHeaderBytes,
+
+	PublicEndpoints: "health,ready,publish,share,inbound-email,clip,calendar,favicon",
+
+	DraftTTL: 7 * 24 * time.Hour,
+	GuestTTL: 24 * time.Hour,
+
+	LogTitles: "show",
+
+	JournalTitle: "%date%",
+
+	InboundEmailTag: "inbox",
+
+	CalendarFields: "due,event-date",
+
+	TraceSampleRate: -1,
+}
+
+// settingEnv maps each flag to its environment variable.
+var settingEnv = map[string]string{
+	"project":                "GCP_PROJECT",
+	"data-project":           "DATA_PROJECT",
+	"credentials-file":       "CREDENTIALS_FILE",
+	"impersonate":            "IMPERSONATE_SERVICE_ACCOUNT",
+	"port":                   "PORT",
+	"socket":                 "SOCKET",
+	"socket-mode":            "SOCKET_MODE",
+	"base-path":              "BASE_PATH",
+	"core-dir":               "CORE_DIR",
+	"core":                   "CORE",
+	"core-cdn":               "CORE_CDN",
+	"plugin-dir":             "PLUGIN_DIR",
+	"publish-tag":            "PUBLISH_TAG",
+	"robots-file":            "ROBOTS_FILE",
+	"storage":                "STORAGE",
+	"auth-header":            "AUTH_HEADER",
+	"recipe":                 "RECIPE",
+	"recipes":                "RECIPES",
+	"public-endpoints":       "PUBLIC_ENDPOINTS",
+	"ops-addr":               "OPS_ADDR",
+	"datastore-namespace":    "DATASTORE_NAMESPACE",
+	"tiddler-kind":           "TIDDLER_KIND",
+	"history-kind":           "HISTORY_KIND",
+	"data-file":              "DATA_FILE",
+	"s3-endpoint":            "S3_ENDPOINT",
+	"s3-bucket":              "S3_BUCKET",
+	"s3-prefix":              "S3_PREFIX",
+	"s3-region":              "S3_REGION",
+	"mysql-dsn":              "MYSQL_DSN",
+	"mysql-read-dsn":         "MYSQL_READ_DSN",
+	"replica-lag":            "REPLICA_LAG",
+	"redis-addr":             "REDIS_ADDR",
+	"redis-prefix":           "REDIS_PREFIX",
+	"redis-ttl":              "REDIS_TTL",
+	"cache-layers":           "CACHE_LAYERS",
+	"memory-cache-bytes":     "MEMORY_CACHE_BYTES",
+	"memory-cache-ttl":       "MEMORY_CACHE_TTL",
+	"catalog":                "CATALOG",
+	"auto-migrate":           "AUTO_MIGRATE",
+	"tiddler-cache-bytes":    "TIDDLER_CACHE_BYTES",
+	"coalesce-saves":         "COALESCE_SAVES",
+	"async-history":          "ASYNC_HISTORY",
+	"drafts":                 "DRAFTS",
+	"draft-ttl":              "DRAFT_TTL",
+	"conflict-copies":        "CONFLICT_COPIES",
+	"read-only":              "READ_ONLY",
+	"read-only-message":      "READ_ONLY_MESSAGE",
+	"guest-sandbox":          "GUEST_SANDBOX",
+	"guest-ttl":              "GUEST_TTL",
+	"cors-origins":           "CORS_ORIGINS",
+	"cors-credentials":       "CORS_CREDENTIALS",
+	"cors-max-age":           "CORS_MAX_AGE",
+	"tls-cert":               "TLS_CERT",
+	"tls-key":                "TLS_KEY",
+	"autocert-hosts":         "AUTOCERT_HOSTS",
+	"autocert-cache-dir":     "AUTOCERT_CACHE_DIR",
+	"autocert-email":         "AUTOCERT_EMAIL",
+	"autocert-http-addr":     "AUTOCERT_HTTP_ADDR",
+	"max-tiddler-bytes":      "MAX_TIDDLER_BYTES",
+	"max-batch-bytes":        "MAX_BATCH_BYTES",
+	"quota-bytes":            "QUOTA_BYTES",
+	"user-quotas":            "USER_QUOTAS",
+	"rate-limit":             "RATE_LIMIT",
+	"rate-burst":             "RATE_BURST",
+	"client-ip-header":       "CLIENT_IP_HEADER",
+	"datastore-retry-budget": "DATASTORE_RETRY_BUDGET",
+	"datastore-call-timeout": "DATASTORE_CALL_TIMEOUT",
+	"ready-cache-ttl":        "READY_CACHE_TTL",
+	"shell-cache-ttl":        "SHELL_CACHE_TTL",
+	"publish-cache-ttl":      "PUBLISH_CACHE_TTL",
+	"cache-control":          "CACHE_CONTROL",
+	"daily-read-budget":      "DAILY_READ_BUDGET",
+	"daily-write-budget":     "DAILY_WRITE_BUDGET",
+	"snapshot-interval":      "SNAPSHOT_INTERVAL",
+	"snapshot-keep":          "SNAPSHOT_KEEP",
+	"journal-title":          "JOURNAL_TITLE",
+	"journal-template":       "JOURNAL_TEMPLATE",
+	"journal-timezone":       "JOURNAL_TIMEZONE",
+	"journal-daily":          "JOURNAL_DAILY",
+	"inbound-email-tag":      "INBOUND_EMAIL_TAG",
+	"inbound-email-from":     "INBOUND_EMAIL_FROM",
+	"calendar-fields":        "CALENDAR_FIELDS",
+	"calendar-filter":        "CALENDAR_FILTER",
+	"api":                    "API",
+	"offline":                "OFFLINE",
+	"sync-poll-interval":     "SYNC_POLL_INTERVAL",
+	"sync-throttle":          "SYNC_THROTTLE",
+	"sync-host":              "SYNC_HOST",
+	"sync-filter":            "SYNC_FILTER",
+	"sync-eager":             "SYNC_EAGER",
+	"read-header-timeout":    "READ_HEADER_TIMEOUT",
+	"read-timeout":           "READ_TIMEOUT",
+	"write-timeout":          "WRITE_TIMEOUT",
+	"idle-timeout":           "IDLE_TIMEOUT",
+	"max-header-bytes":       "MAX_HEADER_BYTES",
+	"trace-exporter":         "TRACE_EXPORTER",
+	"trace-sample-rate":      "TRACE_SAMPLE_RATE",
+	"error-reporter":         "ERROR_REPORTER",
+	"sentry-dsn":             "SENTRY_DSN",
+	"log-titles":             "LOG_TITLES",
+}
+
+func configFlags(fs *flag.FlagSet, c *Config) {
+	fs.StringVar(&c.Project, "project", c.Project, "Google Cloud project holding the Datastore, and receiving traces and error reports")
+	fs.StringVar(&c.DataProject, "data-project", c.DataProject, "Google Cloud project holding the wiki's data, if not project")
+	fs.StringVar(&c.CredentialsFile, "credentials-file", c.CredentialsFile, "service account key file to use for Google Cloud instead of the ambient credentials")
+	fs.StringVar(&c.Impersonate, "impersonate", c.Impersonate, "service account email to act as for Google Cloud")
+	fs.StringVar(&c.Port, "port", c.Port, "TCP port to listen on")
+	fs.StringVar(&c.Socket, "socket", c.Socket, "Unix socket to listen on instead of port")
+	fs.StringVar(&c.SocketMode, "socket-mode", c.SocketMode, "octal permissions for socket")
+	fs.StringVar(&c.BasePath, "base-path", c.BasePath, "path prefix to serve the wiki under, e.g. /wiki")
+	fs.StringVar(&c.CoreDir, "core-dir", c.CoreDir, "directory holding TiddlyWiki files to serve")
+	fs.StringVar(&c.Core, "core", c.Core, "TiddlyWiki file in core-dir to serve at /")
+	fs.StringVar(&c.CoreCDN, "core-cdn", c.CoreCDN, "URL prefix to load an external TiddlyWiki core script from")
+	fs.StringVar(&c.PluginDir, "plugin-dir", c.PluginDir, "directory of plugin JSON files to offer as a plugin library")
+	fs.StringVar(&c.PublishTag, "publish-tag", c.PublishTag, "publish tiddlers with this tag as static pages under /public/")
+	fs.StringVar(&c.RobotsFile, "robots-file", c.RobotsFile, "file to serve as /robots.txt instead of the default rules")
+	fs.StringVar(&c.Storage, "storage", c.Storage, "storage backend: datastore, firestore, file, s3 or mysql")
+	fs.StringVar(&c.AuthHeader, "auth-header", c.AuthHeader, "request header carrying the authenticated user, set by the proxy")
+	fs.StringVar(&c.Recipe, "recipe", c.Recipe, "name of the recipe /status tells the browser to use")
+	fs.StringVar(&c.Recipes, "recipes", c.Recipes, "comma-separated names of other recipes to serve and list in /status")
+	fs.StringVar(&c.PublicEndpoints, "public-endpoints", c.PublicEndpoints, "comma-separated endpoints served without signing in: health, ready, metrics, publish, share, inbound-email, clip, calendar, favicon")
+	fs.StringVar(&c.OpsAddr, "ops-addr", c.OpsAddr, "host:port to serve admin, debug and health endpoints on, apart from the wiki, e.g. 127.0.0.1:9090")
+
+	fs.StringVar(&c.DatastoreNamespace, "datastore-namespace", c.DatastoreNamespace, "Datastore namespace to keep this wiki in (default the default namespace)")
+	fs.StringVar(&c.TiddlerKind, "tiddler-kind", c.TiddlerKind, "Datastore kind for tiddlers")
+	fs.StringVar(&c.HistoryKind, "history-kind", c.HistoryKind, "Datastore kind for tiddler history")
+	fs.StringVar(&c.DataFile, "data-file", c.DataFile, "file to keep everything in for file storage")
+	fs.StringVar(&c.S3Endpoint, "s3-endpoint", c.S3Endpoint, "URL of the S3-compatible service for s3 storage (default AWS)")
+	fs.StringVar(&c.S3Bucket, "s3-bucket", c.S3Bucket, "bucket to keep tiddlers in for s3 storage")
+	fs.StringVar(&c.S3Prefix, "s3-prefix", c.S3Prefix, "prefix for object names in s3-bucket, e.g. tiddly/")
+	fs.StringVar(&c.S3Region, "s3-region", c.S3Region, "region of s3-bucket, used in request signatures")
+	fs.StringVar(&c.MySQLDSN, "mysql-dsn", c.MySQLDSN, "database for mysql storage, e.g. tiddly@tcp(host:3306)/tiddly (password in MYSQL_PASSWORD)")
+	fs.StringVar(&c.MySQLReadDSN, "mysql-read-dsn", c.MySQLReadDSN, "read replica of mysql-dsn to serve reads from (same password)")
+	fs.DurationVar(&c.ReplicaLag, "replica-lag", c.ReplicaLag, "how long after a write reads keep to the primary rather than the replica")
+
+	fs.StringVar(&c.RedisAddr, "redis-addr", c.RedisAddr, "host:port of a Redis server to cache tiddlers in")
+	fs.StringVar(&c.RedisPrefix, "redis-prefix", c.RedisPrefix, "prefix for this wiki's Redis keys")
+	fs.DurationVar(&c.RedisTTL, "redis-ttl", c.RedisTTL, "how long Redis keeps cached tiddlers")
+	fs.StringVar(&c.CacheLayers, "cache-layers", c.CacheLayers, "caches in front of storage, outermost first: memory, redis or memory,redis (default redis if redis-addr is set)")
+	fs.Int64Var(&c.MemoryCacheBytes, "memory-cache-bytes", c.MemoryCacheBytes, "size of the memory cache layer")
+	fs.DurationVar(&c.MemoryCacheTTL, "memory-cache-ttl", c.MemoryCacheTTL, "how long the memory cache layer trusts an entry")
+	fs.Int64Var(&c.TiddlerCacheBytes, "tiddler-cache-bytes", c.TiddlerCacheBytes, "size of the cache of tiddlers as sent to the browser (0 to disable); without a redis cache layer other servers' saves show only after memory-cache-ttl, so use it alone only with a single server")
+	fs.BoolVar(&c.Catalog, "catalog", c.Catalog, "keep a catalog of tiddler metadata so the list needn't read every tiddler")
+	fs.BoolVar(&c.AutoMigrate, "auto-migrate", c.AutoMigrate, "apply pending data migrations at startup; if false, refuse to start until tiddly migrate has")
+
+	fs.BoolVar(&c.ConflictCopies, "conflict-copies", c.ConflictCopies, "save edits made to an old revision as conflict copies instead of overwriting")
+	fs.DurationVar(&c.CoalesceSaves, "coalesce-saves", c.CoalesceSaves, "hold each tiddler's saves this long and write only the latest; 0 writes every save")
+	fs.BoolVar(&c.AsyncHistory, "async-history", c.AsyncHistory, "answer saves without waiting for their history revision, which is written in batches")
+	fs.StringVar(&c.Drafts, "drafts", c.Drafts, "where to keep draft tiddlers instead of the store, without history: memory or redis (default the store)")
+	fs.DurationVar(&c.DraftTTL, "draft-ttl", c.DraftTTL, "how long a draft kept apart lasts after it was last saved")
+	fs.BoolVar(&c.ReadOnly, "read-only", c.ReadOnly, "start in read-only mode, rejecting all changes")
+	fs.StringVar(&c.ReadOnlyMessage, "read-only-message", c.ReadOnlyMessage, "message returned for changes rejected in read-only mode")
+	fs.BoolVar(&c.GuestSandbox, "guest-sandbox", c.GuestSandbox, "give visitors who aren't signed in a temporary scratch wiki of their own, kept in memory")
+	fs.DurationVar(&c.GuestTTL, "guest-ttl", c.GuestTTL, "how long a guest sandbox lasts after it was last used")
+
+	fs.StringVar(&c.CORSOrigins, "cors-origins", c.CORSOrigins, "comma-separated origins allowed to call the API cross-origin, or *")
+	fs.BoolVar(&c.CORSCredentials, "cors-credentials", c.CORSCredentials, "allow cross-origin requests with credentials")
+	fs.DurationVar(&c.CORSMaxAge, "cors-max-age", c.CORSMaxAge, "how long browsers may cache preflight responses")
+
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "certificate file; serve HTTPS instead of HTTP")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "private key file for tls-cert")
+	fs.StringVar(&c.AutocertHosts, "autocert-hosts", c.AutocertHosts, "comma-separated hostnames to get Let's Encrypt certificates for")
+	fs.StringVar(&c.AutocertCacheDir, "autocert-cache-dir", c.AutocertCacheDir, "directory to keep Let's Encrypt certificates in")
+	fs.StringVar(&c.AutocertEmail, "autocert-email", c.AutocertEmail, "contact address for Let's Encrypt")
+	fs.StringVar(&c.AutocertHTTPAddr, "autocert-http-addr", c.AutocertHTTPAddr, "address to answer HTTP challenges and redirect to HTTPS on, e.g. :80")
+
+	fs.Int64Var(&c.MaxTiddlerBytes, "max-tiddler-bytes", c.MaxTiddlerBytes, "largest accepted PUT body")
+	fs.Int64Var(&c.MaxBatchBytes, "max-batch-bytes", c.MaxBatchBytes, "largest accepted batch save body")
+	fs.Int64Var(&c.QuotaBytes, "quota-bytes", c.QuotaBytes, "bytes of tiddler revisions each user may store; 0 for no limit")
+	fs.StringVar(&c.UserQuotas, "user-quotas", c.UserQuotas, "comma-separated user=bytes quotas overriding quota-bytes; 0 forbids saving")
+	fs.Float64Var(&c.RateLimit, "rate-limit", c.RateLimit, "mutating requests per second per user; 0 disables limiting")
+	fs.IntVar(&c.RateBurst, "rate-burst", c.RateBurst, "mutating requests allowed in a burst")
+	fs.StringVar(&c.ClientIPHeader, "client-ip-header", c.ClientIPHeader, "header the proxy puts the client's address in, e.g. X-Forwarded-For")
+	fs.DurationVar(&c.RetryBudget, "datastore-retry-budget", c.RetryBudget, "total time to spend retrying one Datastore operation")
+	fs.DurationVar(&c.CallTimeout, "datastore-call-timeout", c.CallTimeout, "time allowed for each call to the store; 0 for no limit")
+	fs.DurationVar(&c.ReadyCacheTTL, "ready-cache-ttl", c.ReadyCacheTTL, "how long /readyz caches its Datastore check")
+	fs.DurationVar(&c.ShellCacheTTL, "shell-cache-ttl", c.ShellCacheTTL, "how long to cache the page customized by $:/config/server/ tiddlers")
+	fs.DurationVar(&c.PublishCacheTTL, "publish-cache-ttl", c.PublishCacheTTL, "how long to cache the pages under /public/")
+	fs.StringVar(&c.CacheControl, "cache-control", c.CacheControl, "Cache-Control to send instead of the default, by route class, e.g. tiddler:private, max-age=60;status:no-cache")
+	fs.Int64Var(&c.DailyReadBudget, "daily-read-budget", c.DailyReadBudget, "store entity reads per UTC day before the tiddler list is served as last built; 0 for no budget")
+	fs.Int64Var(&c.DailyWriteBudget, "daily-write-budget", c.DailyWriteBudget, "store entity writes per UTC day before history revisions are held until the next day; 0 for no budget")
+	fs.DurationVar(&c.SnapshotInterval, "snapshot-interval", c.SnapshotInterval, "how often to record the revision of every tiddler as a snapshot; 0 for never")
+	fs.IntVar(&c.SnapshotKeep, "snapshot-keep", c.SnapshotKeep, "snapshots to keep, dropping the oldest; 0 keeps them all")
+	fs.StringVar(&c.JournalTitle, "journal-title", c.JournalTitle, "title of the day's journal tiddler, with template placeholders such as %date%")
+	fs.StringVar(&c.JournalTemplate, "journal-template", c.JournalTemplate, "template tiddler to make journal tiddlers from (default a blank tiddler tagged Journal)")
+	fs.StringVar(&c.JournalTimezone, "journal-timezone", c.JournalTimezone, "time zone whose day the journal follows, e.g. Europe/London (default UTC)")
+	fs.BoolVar(&c.JournalDaily, "journal-daily", c.JournalDaily, "make each day's journal tiddler at midnight in journal-timezone")
+	fs.StringVar(&c.InboundEmailTag, "inbound-email-tag", c.InboundEmailTag, "tag for tiddlers made from inbound email (secret in INBOUND_EMAIL_SECRET)")
+	fs.StringVar(&c.InboundEmailFrom, "inbound-email-from", c.InboundEmailFrom, "comma-separated addresses to accept inbound email from (default any)")
+	fs.StringVar(&c.CalendarFields, "calendar-fields", c.CalendarFields, "comma-separated date fields that put tiddlers in /calendar.ics")
+	fs.StringVar(&c.CalendarFilter, "calendar-filter", c.CalendarFilter, "sync profile filter choosing the tiddlers in /calendar.ics (default all)")
+	fs.BoolVar(&c.API, "api", c.API, "serve a read-only JSON:API of tiddlers, revisions, tags and links under /api/v1/")
+	fs.BoolVar(&c.Offline, "offline", c.Offline, "serve a web app manifest and service worker so the wiki loads and saves offline")
+	fs.DurationVar(&c.SyncPollInterval, "sync-poll-interval", c.SyncPollInterval, "how often the page polls for changes; 0 leaves the wiki's own setting (1m)")
+	fs.DurationVar(&c.SyncThrottle, "sync-throttle", c.SyncThrottle, "how long the page waits after an edit before saving it; 0 leaves the wiki's own setting (1s)")
+	fs.StringVar(&c.SyncHost, "sync-host", c.SyncHost, "server URL the page syncs with, in $:/config/tiddlyweb/host form (default this server)")
+	fs.StringVar(&c.SyncFilter, "sync-filter", c.SyncFilter, "TiddlyWiki filter for the tiddlers the page saves to the server (default the wiki's own)")
+	fs.BoolVar(&c.SyncEager, "sync-eager", c.SyncEager, "load every tiddler's text when the page starts instead of when it is first shown")
+
+	fs.DurationVar(&c.ReadHeaderTimeout, "read-header-timeout", c.ReadHeaderTimeout, "time allowed to read request headers; 0 for none")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "time allowed to read a whole request; 0 for none")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "time allowed to write a response; 0 for none")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "how long to keep idle connections open; 0 for none")
+	fs.IntVar(&c.MaxHeaderBytes, "max-header-bytes", c.MaxHeaderBytes, "largest accepted request header")
+
+	fs.StringVar(&c.TraceExporter, "trace-exporter", c.TraceExporter, "where to send traces: empty for nowhere, cloudtrace, or otlp")
+	fs.Float64Var(&c.TraceSampleRate, "trace-sample-rate", c.TraceSampleRate, "fraction of new traces to record; negative for all of them")
+
+	fs.StringVar(&c.ErrorReporter, "error-reporter", c.ErrorReporter, "where to report 5xx responses and panics: empty for nowhere, google or sentry")
+	fs.StringVar(&c.SentryDSN, "sentry-dsn", c.SentryDSN, "DSN of the Sentry project to report errors to")
+	fs.StringVar(&c.LogTitles, "log-titles", c.LogTitles, "how tiddler titles appear in logs and error reports: show, hash or hide")
+
+	fs.VisitAll(func(f *flag.Flag) { f.Usage += " ($" + settingEnv[f.Name] + ")" })
+}
+
+// loadConfig adds the configuration flags to fs, which may have flags of its
+// own, parses args, and fills cfg from them, the environment, and the config
+// file. It reports whether -print-config was given.
+func loadConfig(fs *flag.FlagSet, args []string) (printConfig bool, err error) {
+	configFlags(fs, &cfg)
+	file := fs.String("config", os.Getenv("CONFIG_FILE"), "config file: YAML (.yaml, .yml), TOML (.toml) or JSON")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective configuration and exit")
+	if err := fs.Parse(args); err != nil {
+		return false, err
+	}
+
+	// Flags win, so remember them and apply them again last.
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = f.Value.String() })
+
+	if *file != "" {
+		if err := loadConfigFile(fs, *file); err != nil {
+			return false, err
+		}
+	}
+	for name, env := range settingEnv {
+		if v := os.Getenv(env); v != "" {
+			if err := fs.Set(name, v); err != nil {
+				return false, fmt.Errorf("%s: %v", env, err)
+			}
+		}
+	}
+	for name, v := range explicit {
+		fs.Set(name, v)
+	}
+	cfg.BasePath = strings.TrimSuffix(cfg.BasePath, "/")
+	return printConfig, cfg.validate()
+}
+
+func loadConfigFile(fs *flag.FlagSet, file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var m map[string]interface{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &m)
+	case ".toml":
+		err = toml.Unmarshal(data, &m)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&m)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	for name, v := range m {
+		if _, ok := settingEnv[name]; !ok {
+			return fmt.Errorf("%s: unknown setting %q", file, name)
+		}
+		switch v.(type) {
+		case string, bool, int, int64, float64, json.Number:
+		default:
+			return fmt.Errorf("%s: %s: expected a string, number or boolean", file, name)
+		}
+		if err := fs.Set(name, fmt.Sprint(v)); err != nil {
+			return fmt.Errorf("%s: %s: %v", file, name, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	var errs []string
+	check := func(ok bool, msg string) {
+		if !ok {
+			errs = append(errs, msg)
+		}
+	}
+	check(c.Port != "" || c.Socket != "", "port or socket must be set")
+	switch c.Storage {
+	case "datastore":
+		check(c.Project != "" || c.DataProject != "", "project (GCP_PROJECT) or data-project must be set for datastore storage")
+		check(c.TiddlerKind != "" && c.HistoryKind != "", "tiddler-kind and history-kind must be set")
+		check(c.TiddlerKind != c.HistoryKind, "tiddler-kind and history-kind must differ")
+	case "firestore":
+		check(c.Project != "" || c.DataProject != "", "project (GCP_PROJECT) or data-project must be set for firestore storage")
+	case "file":
+		check(c.DataFile != "", "data-file must be set for file storage")
+	case "s3":
+		check(c.S3Bucket != "", "s3-bucket must be set for s3 storage")
+		check(c.S3Region != "", "s3-region must be set for s3 storage")
+	case "mysql":
+		check(c.MySQLDSN != "", "mysql-dsn must be set for mysql storage")
+	default:
+		errs = append(errs, fmt.Sprintf("unknown storage %q", c.Storage))
+	}
+	check(c.MySQLReadDSN == "" || c.Storage == "mysql", "mysql-read-dsn is only for mysql storage")
+	check(c.ReplicaLag >= 0, "replica-lag must not be negative")
+	check(c.BasePath == "" || strings.HasPrefix(c.BasePath, "/"), "base-path must start with /")
+	check(c.Core != "" && filepath.Base(c.Core) == c.Core, "core must be a file name in core-dir")
+	check(c.AuthHeader != "", "auth-header must be set")
+	for _, name := range append([]string{c.Recipe}, strings.Split(c.Recipes, ",")...) {
+		name = strings.TrimSpace(name)
+		check(!strings.ContainsAny(name, "/?#%{} "), fmt.Sprintf("recipe name %q must not contain / ? # %% { } or spaces", name))
+	}
+	check(c.Recipe != "", "recipe must be set")
+	if c.OpsAddr != "" {
+		_, _, err := net.SplitHostPort(c.OpsAddr)
+		check(err == nil, "ops-addr must be host:port")
+	}
+	if err := checkPublicEndpoints(c.PublicEndpoints); err != nil {
+		errs = append(errs, "public-endpoints: "+err.Error())
+	}
+	check((c.TLSCert == "") == (c.TLSKey == ""), "tls-cert and tls-key must be set together")
+	check(c.TLSCert == "" || c.AutocertHosts == "", "tls-cert and autocert-hosts are mutually exclusive")
+	check(c.AutocertHosts == "" || c.AutocertCacheDir != "", "autocert-cache-dir must be set to use autocert")
+	if c.CORSCredentials {
+		anyOrigin := c.CORSOrigins == ""
+		for _, o := range strings.Split(c.CORSOrigins, ",") {
+			anyOrigin = anyOrigin || strings.TrimSpace(o) == "*"
+		}
+		check(!anyOrigin, "cors-credentials needs cors-origins to list the origins allowed, not *")
+	}
+	check(c.RedisTTL >= time.Second, "redis-ttl must be at least 1s")
+	if c.CacheLayers != "" {
+		if err := validCacheLayers(strings.Split(c.CacheLayers, ","), c.RedisAddr); err != nil {
+			errs = append(errs, "cache-layers: "+err.Error())
+		}
+	}
+	check(c.MemoryCacheBytes > 0, "memory-cache-bytes must be positive")
+	check(c.MemoryCacheTTL > 0, "memory-cache-ttl must be positive")
+	check(c.MaxTiddlerBytes > 0, "max-tiddler-bytes must be positive")
+	check(c.MaxBatchBytes > 0, "max-batch-bytes must be positive")
+	check(c.QuotaBytes >= 0, "quota-bytes must not be negative")
+	if _, err := parseUserQuotas(c.UserQuotas); err != nil {
+		errs = append(errs, "user-quotas: "+err.Error())
+	}
+	check(c.DailyReadBudget >= 0 && c.DailyWriteBudget >= 0, "daily budgets must not be negative")
+	check(c.CoalesceSaves >= 0 && c.CoalesceSaves <= time.Minute, "coalesce-saves must be between 0 and 1m")
+	switch c.Drafts {
+	case "", "memory":
+	case "redis":
+		check(c.RedisAddr != "", "redis-addr must be set to keep drafts in redis")
+	default:
+		check(false, fmt.Sprintf("unknown drafts %q; want memory or redis", c.Drafts))
+	}
+	check(c.DraftTTL >= time.Minute, "draft-ttl must be at least 1m")
+	check(c.GuestTTL >= time.Minute, "guest-ttl must be at least 1m")
+	check(c.CallTimeout >= 0, "datastore-call-timeout must not be negative")
+	check(c.SnapshotInterval == 0 || c.SnapshotInterval >= time.Minute, "snapshot-interval must be 0 or at least 1m")
+	check(c.SyncPollInterval == 0 || c.SyncPollInterval >= time.Second, "sync-poll-interval must be 0 or at least 1s")
+	check(c.SyncThrottle >= 0, "sync-throttle must not be negative")
+	check(c.SnapshotKeep >= 0, "snapshot-keep must not be negative")
+	check(c.JournalTitle != "", "journal-title must be set")
+	if _, err := time.LoadLocation(c.JournalTimezone); err != nil {
+		errs = append(errs, "journal-timezone: "+err.Error())
+	}
+	if c.CalendarFilter != "" {
+		if _, err := parseSyncFilter(c.CalendarFilter); err != nil {
+			errs = append(errs, "calendar-filter: "+err.Error())
+		}
+	}
+	check(c.RateLimit >= 0, "rate-limit must not be negative")
+	check(c.RateLimit == 0 || c.RateBurst >= 1, "rate-burst must be at least 1")
+	check(c.ClientIPHeader == "" || !strings.ContainsAny(c.ClientIPHeader, " :"), "client-ip-header must be a header name")
+	check(c.TraceExporter == "" || c.TraceExporter == "cloudtrace" || c.TraceExporter == "otlp",
+		fmt.Sprintf("unknown trace-exporter %q", c.TraceExporter))
+	check(c.TraceSampleRate <= 1, "trace-sample-rate must be at most 1")
+	switch c.ErrorReporter {
+	case "", "google":
+	case "sentry":
+		check(c.SentryDSN != "", "sentry-dsn must be set to report errors to sentry")
+	default:
+		check(false, fmt.Sprintf("unknown error-reporter %q", c.ErrorReporter))
+	}
+	check(c.ErrorReporter != "google" || c.Project != "", "project (GCP_PROJECT) must be set to report errors to google")
+	if c.CredentialsFile != "" {
+		_, err := os.Stat(c.CredentialsFile)
+		check(err == nil, fmt.Sprintf("credentials-file: %v", err))
+	}
+	check(c.Impersonate == "" || strings.Contains(c.Impersonate, "@"), "impersonate must be a service account email")
+	if _, err := parseCacheControl(c.CacheControl); err != nil {
+		errs = append(errs, "cache-control: "+err.Error())
+	}
+	switch c.LogTitles {
+	case "show", "hash", "hide":
+	default:
+		check(false, fmt.Sprintf("unknown log-titles %q", c.LogTitles))
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.WriteString("invalid configuration:")
+	for _, e := range errs {
+		buf.WriteString("\n\t" + e)
+	}
+	return errors.New(buf.String())
+}
+
+// writeConfig writes the effective configuration in config file format.
+func writeConfig(w io.Writer) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	c := cfg
+	configFlags(fs, &c)
+	m := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) { m[f.Name] = f.Value.String() })
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Conflicts
+//
+// A PUT says which revision it was edited from, either with If-Match (an ETag from an earlier response) or, as the
+// TiddlyWeb adaptor does, in its revision field.  If the tiddler has changed since, the edit was made without seeing
+// someone else's.  A stale If-Match is refused with 412, as HTTP expects, and a current one is checked again in
+// the transaction that saves (see Re Transactions), so of two PUTs with the same If-Match only one is saved.  A
+// stale revision field is let through, since the adaptor's notion of the revision can lag, unless conflict-copies
+// is on.  Then either kind of stale PUT is saved as a new tiddler, "Title (conflict from user at time)", leaving the
+// current one alone, and answered with 409 and the copy's title, so no edit is silently lost.  The time is the
+// edit's modified field, so the client retrying the same save doesn't make more copies.  Saves replayed by the
+// offline service worker always get copies (see Re Offline).
+
+// baseRevision returns the revision a PUT of title was edited from, and
+// whether it came from If-Match. An If-Match that isn't the ETag of some
+// revision of title matches none, so is given as revision -1.
+func baseRevision(r *http.Request, title string, js map[string]interface{}) (rev int, ifMatch bool, ok bool) {
+	if m := r.Header.Get("If-Match"); m != "" && m != "*" {
+		_, etagTitle, rev, ok := parseETag(m)
+		if !ok || etagTitle != title {
+			return -1, true, true
+		}
+		return rev, true, true
+	}
+	switch v := js["revision"].(type) {
+	case float64:
+		return int(v), false, true
+	case string:
+		rev, err := strconv.Atoi(v)
+		return rev, false, err == nil
+	}
+	return 0, false, false
+}
+
+// currentRevision returns the revision of title's live tiddler, or 0 if
+// there is none.
+func currentRevision(ctx context.Context, title string) (int, error) {
+	var t Tiddler
+	err := dbGet(ctx, datastore.NameKey("Tiddler", title, nil), &t)
+	if err == datastore.ErrNoSuchEntity || err == nil && t.Meta == "" {
+		return 0, nil
+	}
+	return t.Rev, err
+}
+
+// checkConflict handles a PUT of js as title that was based on an old
+// revision, reporting whether it did. The caller should carry on saving
+// only if it didn't.
+func checkConflict(w http.ResponseWriter, r *http.Request, title string, js map[string]interface{}) bool {
+	// Saves replayed from an offline queue always get copies: by the time
+	// they arrive nobody is there to see a 412.
+	copies := cfg.ConflictCopies || r.Header.Get(offlineReplayHeader) != ""
+	base, ifMatch, ok := baseRevision(r, title, js)
+	if !ok || !ifMatch && !copies {
+		return false
+	}
+	ctx := r.Context()
+	cur, err := currentRevision(ctx, title)
+	if err != nil {
+		storeError(w, err)
+		return true
+	}
+	// A base revision with no live tiddler means it was deleted since;
+	// no base revision at all (0) means the client is creating it.
+	if cur == base || cur == 0 && base == 0 {
+		return false
+	}
+	if base < 0 {
+		http.Error(w, "If-Match is not an ETag of "+title, 412)
+		return true
+	}
+	if !copies {
+		http.Error(w, fmt.Sprintf("%s has changed: revision %d is current, not %d", title, cur, base), 412)
+		return true
+	}
+
+	copyTitle := conflictTitle(title, currentUser(r), js)
+	js["title"] = copyTitle
+	delete(js, "revision")
+	if _, err := saveTiddler(ctx, copyTitle, js); err != nil {
+		storeError(w, err)
+		return true
+	}
+	data, _ := json.Marshal(map[string]interface{}{
+		"error":    fmt.Sprintf("%s was changed by someone else (revision %d is current, not %d); your version was saved as %s", title, cur, base, copyTitle),
+		"conflict": copyTitle,
+		"revision": cur,
+	})
+	w.Header().Set("Content-Type", jsonType)
+	w.WriteHeader(409)
+	w.Write(data)
+	return true
+}
+
+// conflictTitle names the copy of a conflicting edit to title.
+func conflictTitle(title, user string, js map[string]interface{}) string {
+	when := time.Now().UTC()
+	if s, ok := js["modified"].(string); ok {
+		if t, err := parseTiddlyDate(s); err == nil {
+			when = t
+		}
+	}
+	if user == "" {
+		user = "unknown"
+	}
+	return fmt.Sprintf("%s (conflict from %s at %s)", title, user, when.Format("2006-01-02 15:04:05"))
+}
@@ -0,0 +1,178 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Copying
+//
+// POST /recipes/all/tiddlers/{title}/copy?to=New+title saves the tiddler's current revision under another title,
+// as a new tiddler, for stamping out a note from a template.  The new title must not name a live tiddler; a deleted
+// one is overwritten as usual, continuing its history.  With history=1 the old title's whole history comes along,
+// renumbered as in a rename (see Re Renaming), and then the new title must never have been used.  The copy is
+// accounted to whoever makes it (see Re Quotas).  /admin/history offers the same as a form.  Every recipe holds the
+// same tiddlers, so there is no other bag to copy into: to move tiddlers to another wiki, export and import them.
+
+var errTitleLive = errors.New("a tiddler with that title exists")
+
+func copyHandler(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(w, r) {
+		return
+	}
+	title := tiddlerTitle(strings.TrimSuffix(r.URL.EscapedPath(), "/copy"))
+	to, rev, ok := copyRequest(w, r, title)
+	if !ok {
+		return
+	}
+	data, err := json.Marshal(renameResult{Title: to, Revision: rev})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, data)
+}
+
+// adminCopy is copyHandler for the form on the history page.
+func adminCopy(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "POST") || !sameOrigin(w, r) {
+		return
+	}
+	to, _, ok := copyRequest(w, r, r.FormValue("title"))
+	if !ok {
+		return
+	}
+	http.Redirect(w, r, cfg.BasePath+"/admin/history?title="+url.QueryEscape(to), http.StatusSeeOther)
+}
+
+// copyRequest copies title as the request r asks, answering it if that
+// fails. It returns the new title and its revision.
+func copyRequest(w http.ResponseWriter, r *http.Request, title string) (string, int, bool) {
+	to := r.FormValue("to")
+	if to == "" || to == title {
+		http.Error(w, "to must name a different title", 400)
+		return "", 0, false
+	}
+	if err := checkTitle(to); err != nil {
+		http.Error(w, "to: "+err.Error(), 400)
+		return "", 0, false
+	}
+	ctx := r.Context()
+	withHistory := r.FormValue("history") != ""
+	rev, err := copyTiddler(ctx, title, to, withHistory)
+	switch {
+	case err == datastore.ErrNoSuchEntity:
+		http.Error(w, "no such tiddler", 404)
+		return "", 0, false
+	case err == errTitleTaken || err == errTitleLive:
+		http.Error(w, to+": "+err.Error(), 409)
+		return "", 0, false
+	case err != nil:
+		storeError(w, err)
+		return "", 0, false
+	}
+	if withHistory {
+		logf(ctx, "%s copied %q to %q with its history", currentUser(r), loggedTitle(title), loggedTitle(to))
+	} else {
+		logf(ctx, "%s copied %q to %q", currentUser(r), loggedTitle(title), loggedTitle(to))
+	}
+	return to, rev, true
+}
+
+// copyTiddler saves the current revision of title under to, and with
+// withHistory the revisions before it too. It returns the revision of the
+// copy.
+func copyTiddler(ctx context.Context, title, to string, withHistory bool) (int, error) {
+	var t Tiddler
+	if err := dbGet(ctx, datastore.NameKey("Tiddler", title, nil), &t); err != nil {
+		return 0, err
+	}
+	if t.Meta == "" {
+		return 0, datastore.ErrNoSuchEntity
+	}
+	newKey := datastore.NameKey("Tiddler", to, nil)
+	var existing Tiddler
+	switch err := dbGet(ctx, newKey, &existing); {
+	case err == nil && (withHistory || existing.Meta != ""):
+		if withHistory {
+			return 0, errTitleTaken
+		}
+		return 0, errTitleLive
+	case err != nil && err != datastore.ErrNoSuchEntity:
+		return 0, err
+	}
+
+	if !withHistory {
+		var js map[string]interface{}
+		if err := json.Unmarshal([]byte(t.Meta), &js); err != nil {
+			return 0, err
+		}
+		js["title"] = to
+		js["text"] = t.Text
+		return saveTiddler(ctx, to, js)
+	}
+
+	revs, err := historyOf(ctx, title)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for i := range revs {
+		n += revisionBytes(&revs[i])
+	}
+	if err := checkQuota(ctx, n); err != nil {
+		return 0, err
+	}
+	// As in a rename, the history goes first, outside the transaction.
+	user := userOf(ctx)
+	for len(revs) > 0 {
+		chunk := revs
+		if len(chunk) > 500 {
+			chunk = chunk[:500]
+		}
+		revs = revs[len(chunk):]
+		keys := make([]*datastore.Key, len(chunk))
+		for i := range chunk {
+			keys[i] = datastore.NameKey("TiddlerHistory", to+"#"+fmt.Sprint(chunk[i].Rev), nil)
+			if chunk[i].Meta != "" {
+				chunk[i].Meta = retitle(chunk[i].Meta, to, chunk[i].Rev)
+			}
+			chunk[i].User = user
+		}
+		if err := retry(ctx, func() error { return db.PutMulti(ctx, keys, chunk) }); err != nil {
+			return 0, err
+		}
+		for i := range chunk {
+			usage.add(user, revisionBytes(&chunk[i]))
+		}
+	}
+
+	cp := Tiddler{Rev: t.Rev, Meta: retitle(t.Meta, to, t.Rev), Text: t.Text, Saved: t.Saved, User: user}
+	err = db.RunInTransaction(ctx, func(tx Transaction) error {
+		var taken Tiddler
+		if err := tx.Get(newKey, &taken); err != datastore.ErrNoSuchEntity {
+			if err == nil {
+				err = errTitleTaken
+			}
+			return err
+		}
+		return tx.PutMulti([]*datastore.Key{newKey, datastore.NameKey("TiddlerHistory", to+"#"+fmt.Sprint(cp.Rev), nil), linksKey(to)},
+			[]interface{}{&cp, &cp, linksOf(&cp)})
+	})
+	if err != nil {
+		return 0, err
+	}
+	tiddlerChanged(to)
+	return cp.Rev, nil
+}
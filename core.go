@@ -0,0 +1,127 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// Re TiddlyWiki core
+//
+// The page served at / is an ordinary TiddlyWiki file with the TiddlyWeb plugin baked in (see the README for how to
+// make one).  Keep as many of them as you like in core-dir and pick the one to serve with core; the default is
+// ./index.html.  To try a new one before switching, drop it in core-dir and open it from /admin/upgrade-core, which
+// serves it against the live wiki without changing what everyone else gets.  Saves made from the preview are real.
+
+// coreInfo describes one TiddlyWiki file in core-dir.
+type coreInfo struct {
+	Name    string
+	Version string
+	Size    int64
+	Current bool
+}
+
+var coreVersionRE = regexp.MustCompile(`<meta name="tiddlywiki-version" content="([^"]*)"`)
+
+// listCores returns the TiddlyWiki files in core-dir.
+func listCores() ([]coreInfo, error) {
+	names, err := filepath.Glob(filepath.Join(cfg.CoreDir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	var cores []coreInfo
+	for _, path := range names {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		head := make([]byte, 4096)
+		n, _ := io.ReadFull(f, head)
+		fi, err := f.Stat()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		m := coreVersionRE.FindSubmatch(head[:n])
+		if m == nil {
+			// Not a TiddlyWiki.
+			continue
+		}
+		name := filepath.Base(path)
+		cores = append(cores, coreInfo{
+			Name:    name,
+			Version: string(m[1]),
+			Size:    fi.Size(),
+			Current: name == cfg.Core,
+		})
+	}
+	sort.Slice(cores, func(i, j int) bool { return cores[i].Name < cores[j].Name })
+	return cores, nil
+}
+
+var coreTemplate = template.Must(template.Must(adminTemplate.Clone()).Parse(`
+{{define "cores"}}{{template "header"}}
+<h1>TiddlyWiki core</h1>
+<p>These are the TiddlyWiki files in the core directory. Preview one to try it against the live wiki;
+to switch to it for good, set <code>core</code> (CORE) to its name and restart.</p>
+<table>
+<tr><th>File</th><th>Version</th><th>Bytes</th><th></th></tr>
+{{range .}}<tr><td>{{.Name}}</td><td>{{.Version}}</td><td class="n">{{.Size}}</td>
+<td>{{if .Current}}serving{{else}}<a href="{{base}}/admin/upgrade-core?preview={{.Name}}">preview</a>{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+{{end}}
+`))
+
+func adminUpgradeCore(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	cores, err := listCores()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if name := r.FormValue("preview"); name != "" {
+		for _, c := range cores {
+			if c.Name == name {
+				p, err := loadPage(filepath.Join(cfg.CoreDir, name))
+				if err != nil {
+					http.Error(w, err.Error(), 500)
+					return
+				}
+				// Saving the page from the browser should
+				// not be confused with the real thing.
+				w.Header().Set("Cache-Control", "no-store")
+				http.ServeContent(w, r, name, p.modTime, bytes.NewReader(p.data))
+				return
+			}
+		}
+		http.Error(w, "no such core", 404)
+		return
+	}
+
+	if err := coreTemplate.ExecuteTemplate(w, "cores", cores); err != nil {
+		log.Printf("upgrade core: %v", err)
+	}
+}
+
+// readCoreVersion returns the TiddlyWiki version of a page, for logging.
+func readCoreVersion(data []byte) string {
+	if m := coreVersionRE.FindSubmatch(data); m != nil {
+		return string(m[1])
+	}
+	return "unknown"
+}
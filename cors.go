@@ -0,0 +1,62 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Re CORS
+//
+// TiddlyWikis served from other origins (a local file, another server, a browser extension) can use this server as
+// their sync backend if cors-origins lists their origin, or is "*".  Set cors-credentials if those clients need to
+// send cookies through the authenticating proxy; that lets the listed origins act as the signed-in user, so it needs
+// an explicit list of origins, never "*".  Preflight requests are answered here, before authentication, since
+// browsers never attach credentials to them, and allow only the headers the sync adaptor sends (corsHeaders): the
+// auth-header in particular can't be sent cross-origin.
+
+// corsHeaders are the request headers cross-origin clients may send.
+const corsHeaders = "Content-Type, If-Match, If-None-Match, X-Requested-With"
+
+func cors(next http.Handler) http.Handler {
+	if cfg.CORSOrigins == "" {
+		return next
+	}
+	allowed := make(map[string]bool)
+	for _, o := range strings.Split(cfg.CORSOrigins, ",") {
+		allowed[strings.TrimSpace(o)] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !(allowed[origin] || allowed["*"]) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		if allowed["*"] {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if cfg.CORSCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET, HEAD, PUT, PATCH, POST, DELETE, OPTIONS")
+			h.Set("Access-Control-Allow-Headers", corsHeaders)
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.CORSMaxAge/time.Second)))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.Set("Access-Control-Expose-Headers", "Etag, Last-Modified, X-Request-Id")
+		next.ServeHTTP(w, r)
+	})
+}
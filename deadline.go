@@ -0,0 +1,114 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Store call deadlines
+//
+// A backend call that stalls would otherwise hold its request, and the browser's sync behind it, until the client
+// gives up.  So every call to the store (a get, put or delete, their multi forms, a names or links lookup, and a
+// transaction as a whole) gets datastore-call-timeout of its own, 10s by default (0 for no limit), however long
+// the request may run.  A call that runs out of time counts as transient, so it is retried within
+// datastore-retry-budget like any other, and if it still fails the request is answered 504 rather than 500.  Scans
+// read every tiddler, which on a large wiki can rightly take longer, so they are limited only by the request.
+
+// timeoutError is the error from a store call that ran out of time.
+type timeoutError struct {
+	err error
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("store call timed out after %v: %v", cfg.CallTimeout, e.err)
+}
+
+func (e *timeoutError) Unwrap() error   { return e.err }
+func (e *timeoutError) Temporary() bool { return true }
+
+// storeError answers a request whose store call failed with err: 504 if the
+// call ran out of time, 503 if it kept failing in some other passing way,
+// else 500.
+func storeError(w http.ResponseWriter, err error) {
+	if quotaError(w, err) {
+		return
+	}
+	var te *timeoutError
+	if errors.As(err, &te) {
+		http.Error(w, err.Error(), 504)
+		return
+	}
+	if isTransient(err) {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, err.Error(), 503)
+		return
+	}
+	http.Error(w, err.Error(), 500)
+}
+
+// timeoutStore gives each call to the Store it wraps its own deadline.
+type timeoutStore struct {
+	Store
+}
+
+func (s timeoutStore) call(ctx context.Context, op func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.CallTimeout)
+	defer cancel()
+	err := op(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return &timeoutError{err}
+	}
+	return err
+}
+
+func (s timeoutStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	return s.call(ctx, func(ctx context.Context) error { return s.Store.Get(ctx, key, dst) })
+}
+
+func (s timeoutStore) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return s.call(ctx, func(ctx context.Context) error { return s.Store.GetMulti(ctx, keys, dst) })
+}
+
+func (s timeoutStore) Put(ctx context.Context, key *datastore.Key, src interface{}) error {
+	return s.call(ctx, func(ctx context.Context) error { return s.Store.Put(ctx, key, src) })
+}
+
+func (s timeoutStore) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) error {
+	return s.call(ctx, func(ctx context.Context) error { return s.Store.PutMulti(ctx, keys, src) })
+}
+
+func (s timeoutStore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	return s.call(ctx, func(ctx context.Context) error { return s.Store.DeleteMulti(ctx, keys) })
+}
+
+func (s timeoutStore) Names(ctx context.Context, kind, prefix string) ([]string, error) {
+	var names []string
+	err := s.call(ctx, func(ctx context.Context) error {
+		var err error
+		names, err = s.Store.Names(ctx, kind, prefix)
+		return err
+	})
+	return names, err
+}
+
+func (s timeoutStore) LinksTo(ctx context.Context, title string) ([]string, error) {
+	var names []string
+	err := s.call(ctx, func(ctx context.Context) error {
+		var err error
+		names, err = s.Store.LinksTo(ctx, title)
+		return err
+	})
+	return names, err
+}
+
+func (s timeoutStore) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	return s.call(ctx, func(ctx context.Context) error { return s.Store.RunInTransaction(ctx, f) })
+}
@@ -0,0 +1,31 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+)
+
+// Importing net/http/pprof and expvar registers their handlers on
+// http.DefaultServeMux, which is why main serves its own mux instead.
+// These registrations go on the authenticated mux; /debug/vars is the
+// metrics endpoint in publicEndpoints.
+func registerDebug(r *http.ServeMux) {
+	r.HandleFunc("/debug/pprof/", pprof.Index)
+	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+var (
+	listRequests = expvar.NewInt("tiddler_list_requests")
+	listBytes    = expvar.NewInt("tiddler_list_last_bytes")
+	listCount    = expvar.NewInt("tiddler_list_last_count")
+
+	unchangedSaves = expvar.NewInt("saves_unchanged")
+)
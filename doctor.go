@@ -0,0 +1,303 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// Re Doctor
+//
+// tiddly doctor checks, a step at a time, what the server needs to start and serve, and says what to do about
+// whatever is wrong, rather than leaving it to surface as a raw gRPC error in the log at the first request:
+//     config    the flags, environment and config file are valid (loading them validates them)
+//     core      the TiddlyWiki page in core-dir loads
+//     storage   the store opens, answers a read and, unless -write=false, takes a write and a delete
+//     tiddlers  a sample of the Tiddler entities load with the fields this server knows, and hold JSON metadata
+//     links     the sampled tiddlers have their TiddlerLinks (see Re Reindexing)
+//     catalog   with catalog set, its entities load (see Re Catalog)
+// Each step prints ok, warn or FAIL, and the command exits non-zero if any failed.  Datastore needs no composite
+// indexes; MySQL's schema is migrated when the store opens, as the server would (see Re MySQL), so a database newer
+// than the binary fails the storage step.  serve reads from the store once it has opened it, too: an error that
+// won't go away by itself (credentials, permissions, a missing database) stops it with the same advice, while a
+// transient one is only logged, so that an instance doesn't refuse to start over a blip (see Re Lazy start).
+
+// doctorSample is how many tiddlers doctor looks at.
+const doctorSample = 200
+
+var errStopScan = errors.New("stop scan")
+
+type doctorStep struct {
+	name string
+	run  func(ctx context.Context) (detail string, warn bool, err error)
+}
+
+func doctorCmd(args []string) error {
+	fs := newFlagSet("doctor", "")
+	write := fs.Bool("write", true, "check that the store can be written, by saving and deleting a probe entity")
+	ok, err := setup(fs, args)
+	if err != nil {
+		doctorReport("config", "", false, err)
+		return errors.New("1 check failed")
+	}
+	if !ok {
+		return nil
+	}
+	doctorReport("config", "storage "+cfg.Storage, false, nil)
+
+	steps := []doctorStep{
+		{"core", doctorCore},
+		{"storage", func(ctx context.Context) (string, bool, error) { return doctorStorage(ctx, *write) }},
+		{"tiddlers", doctorTiddlers},
+		{"links", doctorLinks},
+		{"catalog", doctorCatalog},
+	}
+	failed := 0
+	ctx := context.Background()
+	for _, s := range steps {
+		detail, warn, err := s.run(ctx)
+		doctorReport(s.name, detail, warn, err)
+		if err != nil {
+			failed++
+			if s.name == "storage" {
+				break // the rest need it
+			}
+		}
+	}
+	if db != nil {
+		db.Close()
+	}
+	switch {
+	case failed == 1:
+		return errors.New("1 check failed")
+	case failed > 1:
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+// doctorReport prints a step's outcome, with advice for an error.
+func doctorReport(name, detail string, warn bool, err error) {
+	switch {
+	case err != nil:
+		fmt.Printf("%-9s FAIL  %v\n", name, err)
+		if advice := storeAdvice(err); advice != "" {
+			fmt.Printf("%-9s       %s\n", "", advice)
+		}
+	case warn:
+		fmt.Printf("%-9s warn  %s\n", name, detail)
+	default:
+		fmt.Printf("%-9s ok    %s\n", name, detail)
+	}
+}
+
+func doctorCore(ctx context.Context) (string, bool, error) {
+	p, err := loadPage(filepath.Join(cfg.CoreDir, cfg.Core))
+	if err != nil {
+		return "", false, fmt.Errorf("%v; set core-dir and core to a TiddlyWiki HTML file", err)
+	}
+	return fmt.Sprintf("%s (TiddlyWiki %s)", cfg.Core, readCoreVersion(p.data)), false, nil
+}
+
+// doctorProbe is the entity doctor writes and deletes.
+type doctorProbe struct {
+	Checked time.Time
+}
+
+func doctorStorage(ctx context.Context, write bool) (string, bool, error) {
+	if err := openStore(); err != nil {
+		db = nil
+		return "", false, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := pingStore(ctx); err != nil {
+		return "", false, fmt.Errorf("reading: %w", err)
+	}
+	if !write {
+		return "read", false, nil
+	}
+	host, _ := os.Hostname()
+	key := datastore.NameKey("Doctor", host, nil)
+	if err := db.Put(ctx, key, &doctorProbe{time.Now()}); err != nil {
+		return "", false, fmt.Errorf("writing: %w", err)
+	}
+	if err := db.DeleteMulti(ctx, []*datastore.Key{key}); err != nil {
+		return "", false, fmt.Errorf("deleting: %w", err)
+	}
+	return "read, wrote and deleted", false, nil
+}
+
+// doctorTitles are the live tiddlers doctorTiddlers sampled, for
+// doctorLinks.
+var doctorTitles []string
+
+func doctorTiddlers(ctx context.Context) (string, bool, error) {
+	var t Tiddler
+	n, deleted := 0, 0
+	var bad []string
+	err := db.Scan(ctx, "Tiddler", "", &t, func(title string) error {
+		n++
+		var meta map[string]interface{}
+		switch {
+		case t.Meta == "":
+			deleted++
+		case json.Unmarshal([]byte(t.Meta), &meta) != nil:
+			bad = append(bad, title)
+		default:
+			doctorTitles = append(doctorTitles, title)
+		}
+		if n == doctorSample {
+			return errStopScan
+		}
+		return nil
+	})
+	var mismatch *datastore.ErrFieldMismatch
+	switch {
+	case errors.As(err, &mismatch):
+		return "", false, fmt.Errorf("%v; the entities were written by a newer tiddly: upgrade this one", err)
+	case err != nil && err != errStopScan:
+		return "", false, err
+	case len(bad) > 0:
+		return "", false, fmt.Errorf("%d of %d sampled tiddlers have unreadable metadata (%s); restore them from their history or a backup",
+			len(bad), n, strings.Join(firstN(bad, 5), ", "))
+	case n == 0:
+		return "no tiddlers yet", false, nil
+	}
+	return fmt.Sprintf("sampled %d (%d deleted)", n, deleted), false, nil
+}
+
+func doctorLinks(ctx context.Context) (string, bool, error) {
+	if len(doctorTitles) == 0 {
+		return "nothing to check", false, nil
+	}
+	keys := make([]*datastore.Key, len(doctorTitles))
+	for i, title := range doctorTitles {
+		keys[i] = linksKey(title)
+	}
+	links := make([]tiddlerLinks, len(keys))
+	missing := 0
+	err := db.GetMulti(ctx, keys, links)
+	if merr, ok := err.(datastore.MultiError); ok {
+		for _, e := range merr {
+			if e == datastore.ErrNoSuchEntity {
+				missing++
+			} else if e != nil {
+				return "", false, e
+			}
+		}
+	} else if err != nil {
+		return "", false, err
+	}
+	if missing > 0 {
+		return fmt.Sprintf("%d of %d sampled tiddlers have no links recorded; run tiddly reindex", missing, len(keys)), true, nil
+	}
+	return fmt.Sprintf("recorded for all %d sampled tiddlers", len(keys)), false, nil
+}
+
+func doctorCatalog(ctx context.Context) (string, bool, error) {
+	if !cfg.Catalog {
+		return "off", false, nil
+	}
+	keys := make([]*datastore.Key, catalogShards)
+	for i := range keys {
+		keys[i] = catalogKey(i)
+	}
+	shards := make([]catalogShard, catalogShards)
+	err := db.GetMulti(ctx, keys, shards)
+	if merr, ok := err.(datastore.MultiError); ok {
+		for _, e := range merr {
+			if e == datastore.ErrNoSuchEntity {
+				return "not built yet; the first tiddler list builds it", true, nil
+			} else if e != nil {
+				return "", false, e
+			}
+		}
+	} else if err != nil {
+		return "", false, err
+	}
+	for i, sh := range shards {
+		var m map[string]string
+		if err := json.Unmarshal(sh.Entries, &m); err != nil {
+			return "", false, fmt.Errorf("shard %d: %v; run tiddly reindex", i, err)
+		}
+	}
+	return fmt.Sprintf("%d shards", catalogShards), false, nil
+}
+
+func firstN(s []string, n int) []string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// storeAdvice says what to do about a storage error, or returns "" if it
+// has nothing to add.
+func storeAdvice(err error) string {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "missing project"):
+		return "set project or data-project (or DATASTORE_PROJECT_ID) to the Google Cloud project holding the data"
+	case strings.Contains(msg, "could not find default credentials"):
+		return "set credentials-file (or GOOGLE_APPLICATION_CREDENTIALS) to a service account key, or run gcloud auth application-default login"
+	}
+	switch grpcCode(err) {
+	case codes.PermissionDenied:
+		return "the credentials may not use the database: grant their service account roles/datastore.user"
+	case codes.Unauthenticated:
+		return "the credentials were refused: check credentials-file or GOOGLE_APPLICATION_CREDENTIALS, or run gcloud auth application-default login"
+	case codes.NotFound:
+		return "the project has no database: check project, or create a Firestore database in Datastore mode"
+	case codes.FailedPrecondition:
+		return "if the project's database is Firestore in native mode, set storage to firestore"
+	}
+	if isTransient(err) || errors.Is(err, context.DeadlineExceeded) {
+		return "the store didn't answer in time: check the network and the service's status, and try again"
+	}
+	return ""
+}
+
+// grpcCode returns the gRPC code of err or of an error it wraps.
+func grpcCode(err error) codes.Code {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if c := grpcstatus.Code(err); c != codes.Unknown {
+			return c
+		}
+	}
+	return codes.Unknown
+}
+
+// checkStorageAtStart reads from the store before serve listens, failing
+// on errors that won't clear by themselves (see Re Doctor).
+func checkStorageAtStart() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := pingStore(ctx)
+	if err == nil {
+		return nil
+	}
+	if isTransient(err) || errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("Storage isn't answering yet: %v", err)
+		return nil
+	}
+	msg := fmt.Sprintf("storage check failed: %v", err)
+	if advice := storeAdvice(err); advice != "" {
+		msg += "\n" + advice
+	}
+	return errors.New(msg + "\n(tiddly doctor checks more)")
+}
@@ -0,0 +1,440 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Drafts
+//
+// While a tiddler is open for editing, TiddlyWiki saves it as "Draft of 'Title'" every few seconds, and each save
+// is a tiddler, its links and a history revision in the store, all for something thrown away when editing is done.
+// The drafts setting keeps drafts somewhere cheaper instead:
+//     memory   in the instance's memory, lost when it restarts and not seen by other instances
+//     redis    in Redis at redis-addr, under redis-prefix, where every instance sees them
+// Drafts kept there have no history and no links, and expire draft-ttl (a week) after they were last saved, so a
+// draft abandoned on one device can be picked up on another for that long (with redis) but doesn't linger for ever.
+// They are listed, fetched, saved and deleted like any other tiddler, by a Store layer that sends their entities to
+// the draft area and everything else on to the store.  Drafts already in the store stay there until deleted.
+
+func isDraft(title string) bool {
+	return strings.HasPrefix(title, "Draft of '")
+}
+
+// draftArea is where drafts are kept, as JSON-encoded Tiddler entities.
+type draftArea interface {
+	get(ctx context.Context, title string) ([]byte, error) // nil if there's none
+	set(ctx context.Context, title string, data []byte) error
+	del(ctx context.Context, titles []string) error
+	all(ctx context.Context) (map[string][]byte, error)
+}
+
+// draftKey reports whether key is an entity of a draft, and so kept in
+// the draft area (Tiddler) or not at all (TiddlerHistory, TiddlerLinks).
+func draftKey(key *datastore.Key) bool {
+	switch key.Kind {
+	case "Tiddler", "TiddlerLinks", "TiddlerHistory":
+		return isDraft(key.Name)
+	}
+	return false
+}
+
+// draftStore keeps drafts in a draftArea (see Re Drafts).
+type draftStore struct {
+	Store
+	area draftArea
+}
+
+// drafts is the draft area in use, or nil if drafts are kept in the store.
+var drafts draftArea
+
+func newDraftStore(s Store) Store {
+	switch cfg.Drafts {
+	case "memory":
+		drafts = &memoryDrafts{drafts: make(map[string]memoryDraft)}
+	case "redis":
+		drafts = redisDrafts{newRedisClient(cfg.RedisAddr, os.Getenv("REDIS_PASSWORD"))}
+	default:
+		drafts = nil
+		return s
+	}
+	return draftStore{s, drafts}
+}
+
+func (s draftStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if !draftKey(key) || key.Kind != "Tiddler" {
+		return s.Store.Get(ctx, key, dst)
+	}
+	data, err := s.area.get(ctx, key.Name)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		// Drafts from before they were kept apart.
+		return s.Store.Get(ctx, key, dst)
+	}
+	return json.Unmarshal(data, dst)
+}
+
+func (s draftStore) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	var some bool
+	for _, key := range keys {
+		some = some || draftKey(key)
+	}
+	if !some {
+		return s.Store.GetMulti(ctx, keys, dst)
+	}
+	v := reflect.ValueOf(dst)
+	merr := make(datastore.MultiError, len(keys))
+	var failed bool
+	for i, key := range keys {
+		if merr[i] = s.Get(ctx, key, elemPtr(v, i)); merr[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return merr
+	}
+	return nil
+}
+
+func (s draftStore) Put(ctx context.Context, key *datastore.Key, src interface{}) error {
+	if !draftKey(key) {
+		return s.Store.Put(ctx, key, src)
+	}
+	if key.Kind != "Tiddler" {
+		return nil
+	}
+	// Deleting a tiddler saves it blank, which for a draft is just
+	// deleting it.
+	if t, ok := src.(*Tiddler); ok && t.Meta == "" {
+		return s.DeleteMulti(ctx, []*datastore.Key{key})
+	}
+	data, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return s.area.set(ctx, key.Name, data)
+}
+
+func (s draftStore) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) error {
+	var rest []*datastore.Key
+	v := reflect.ValueOf(src)
+	restSrc := reflect.MakeSlice(v.Type(), 0, v.Len())
+	for i, key := range keys {
+		if !draftKey(key) {
+			rest = append(rest, key)
+			restSrc = reflect.Append(restSrc, v.Index(i))
+			continue
+		}
+		if err := s.Put(ctx, key, elemPtr(v, i)); err != nil {
+			return err
+		}
+	}
+	if len(rest) == 0 {
+		return nil
+	}
+	return s.Store.PutMulti(ctx, rest, restSrc.Interface())
+}
+
+func (s draftStore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	var titles []string
+	for _, key := range keys {
+		if key.Kind == "Tiddler" && isDraft(key.Name) {
+			titles = append(titles, key.Name)
+		}
+	}
+	if len(titles) > 0 {
+		if err := s.area.del(ctx, titles); err != nil {
+			return err
+		}
+	}
+	// The store may still have drafts from before.
+	return s.Store.DeleteMulti(ctx, keys)
+}
+
+func (s draftStore) Scan(ctx context.Context, kind, prefix string, dst interface{}, fn func(name string) error) error {
+	if kind != "Tiddler" {
+		return s.Store.Scan(ctx, kind, prefix, dst, fn)
+	}
+	all, err := s.area.all(ctx)
+	if err != nil {
+		return err
+	}
+	err = s.Store.Scan(ctx, kind, prefix, dst, func(name string) error {
+		// A draft from before drafts were kept apart, saved again since.
+		if _, ok := all[name]; ok {
+			return nil
+		}
+		return fn(name)
+	})
+	if err != nil {
+		return err
+	}
+	v := reflect.ValueOf(dst).Elem()
+	for title, data := range all {
+		if !strings.HasPrefix(title, prefix) {
+			continue
+		}
+		v.Set(reflect.Zero(v.Type()))
+		if err := json.Unmarshal(data, dst); err != nil {
+			return err
+		}
+		if err := fn(title); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s draftStore) Names(ctx context.Context, kind, prefix string) ([]string, error) {
+	names, err := s.Store.Names(ctx, kind, prefix)
+	if err != nil || kind != "Tiddler" {
+		return names, err
+	}
+	all, err := s.area.all(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		delete(all, name)
+	}
+	for title := range all {
+		if strings.HasPrefix(title, prefix) {
+			names = append(names, title)
+		}
+	}
+	return names, nil
+}
+
+func (s draftStore) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	return s.Store.RunInTransaction(ctx, func(tx Transaction) error {
+		return f(draftTx{tx, s, ctx})
+	})
+}
+
+// draftTx sends a transaction's draft entities to the draft area, outside
+// the transaction.
+type draftTx struct {
+	Transaction
+	s   draftStore
+	ctx context.Context
+}
+
+func (tx draftTx) Get(key *datastore.Key, dst interface{}) error {
+	if !draftKey(key) {
+		return tx.Transaction.Get(key, dst)
+	}
+	return tx.s.Get(tx.ctx, key, dst)
+}
+
+func (tx draftTx) Put(key *datastore.Key, src interface{}) error {
+	if !draftKey(key) {
+		return tx.Transaction.Put(key, src)
+	}
+	return tx.s.Put(tx.ctx, key, src)
+}
+
+func (tx draftTx) PutMulti(keys []*datastore.Key, src interface{}) error {
+	v := reflect.ValueOf(src)
+	for i, key := range keys {
+		if err := tx.Put(key, elemPtr(v, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx draftTx) Delete(key *datastore.Key) error {
+	if !draftKey(key) {
+		return tx.Transaction.Delete(key)
+	}
+	return tx.s.DeleteMulti(tx.ctx, []*datastore.Key{key})
+}
+
+// elemPtr returns a pointer to the ith entity in v, a slice of structs or
+// of pointers to them (as []interface{}).
+func elemPtr(v reflect.Value, i int) interface{} {
+	e := v.Index(i)
+	if e.Kind() == reflect.Interface || e.Kind() == reflect.Ptr {
+		return e.Interface()
+	}
+	return e.Addr().Interface()
+}
+
+// draftCatalogEntries adds the drafts to the titles and metadata from the
+// catalog, which only knows about the store.
+func draftCatalogEntries(ctx context.Context, titles, metas []string) ([]string, []string, error) {
+	if drafts == nil {
+		return titles, metas, nil
+	}
+	all, err := drafts.all(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	index := make(map[string]int)
+	for i, title := range titles {
+		index[title] = i
+	}
+	for title, data := range all {
+		var t tiddlerMeta
+		if json.Unmarshal(data, &t) != nil || t.Meta == "" {
+			continue
+		}
+		if i, ok := index[title]; ok {
+			metas[i] = t.Meta
+			continue
+		}
+		titles = append(titles, title)
+		metas = append(metas, t.Meta)
+	}
+	return titles, metas, nil
+}
+
+type memoryDraft struct {
+	data    []byte
+	expires time.Time
+}
+
+// memoryDrafts keeps drafts in memory.
+type memoryDrafts struct {
+	mu     sync.Mutex
+	drafts map[string]memoryDraft
+}
+
+func (m *memoryDrafts) get(ctx context.Context, title string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.drafts[title]
+	if !ok || time.Now().After(d.expires) {
+		delete(m.drafts, title)
+		return nil, nil
+	}
+	return d.data, nil
+}
+
+func (m *memoryDrafts) set(ctx context.Context, title string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.drafts[title] = memoryDraft{data, time.Now().Add(cfg.DraftTTL)}
+	return nil
+}
+
+func (m *memoryDrafts) del(ctx context.Context, titles []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, title := range titles {
+		delete(m.drafts, title)
+	}
+	return nil
+}
+
+func (m *memoryDrafts) all(ctx context.Context) (map[string][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	all := make(map[string][]byte)
+	for title, d := range m.drafts {
+		if now.After(d.expires) {
+			delete(m.drafts, title)
+			continue
+		}
+		all[title] = d.data
+	}
+	return all, nil
+}
+
+// redisDrafts keeps drafts in Redis, each under its own key so that each
+// expires on its own.
+type redisDrafts struct {
+	redis *redisClient
+}
+
+func (r redisDrafts) key(title string) string {
+	return cfg.RedisPrefix + "Draft/" + title
+}
+
+func (r redisDrafts) get(ctx context.Context, title string) ([]byte, error) {
+	reply, err := r.redis.do(ctx, "GET", r.key(title))
+	if err != nil {
+		return nil, err
+	}
+	if data, ok := reply.(string); ok {
+		return []byte(data), nil
+	}
+	return nil, nil
+}
+
+func (r redisDrafts) set(ctx context.Context, title string, data []byte) error {
+	_, err := r.redis.do(ctx, "SET", r.key(title), string(data), "EX", strconv.Itoa(int(cfg.DraftTTL/time.Second)))
+	return err
+}
+
+func (r redisDrafts) del(ctx context.Context, titles []string) error {
+	args := []string{"DEL"}
+	for _, title := range titles {
+		args = append(args, r.key(title))
+	}
+	_, err := r.redis.do(ctx, args...)
+	return err
+}
+
+func (r redisDrafts) all(ctx context.Context) (map[string][]byte, error) {
+	prefix := r.key("")
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := r.redis.do(ctx, "SCAN", cursor, "MATCH", redisGlobEscape(prefix)+"*", "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+		a, ok := reply.([]interface{})
+		if !ok || len(a) != 2 {
+			return nil, fmt.Errorf("redis: unexpected SCAN reply")
+		}
+		cursor, _ = a[0].(string)
+		batch, _ := a[1].([]interface{})
+		for _, k := range batch {
+			if s, ok := k.(string); ok {
+				keys = append(keys, s)
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			break
+		}
+	}
+	all := make(map[string][]byte)
+	if len(keys) == 0 {
+		return all, nil
+	}
+	reply, err := r.redis.do(ctx, append([]string{"MGET"}, keys...)...)
+	if err != nil {
+		return nil, err
+	}
+	values, _ := reply.([]interface{})
+	for i, v := range values {
+		// Keys can expire between the SCAN and the MGET.
+		if data, ok := v.(string); ok && i < len(keys) {
+			all[strings.TrimPrefix(keys[i], prefix)] = []byte(data)
+		}
+	}
+	return all, nil
+}
+
+// redisGlobEscape escapes the characters special in a Redis MATCH pattern.
+func redisGlobEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(s)
+}
@@ -0,0 +1,211 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build e2e
+// +build e2e
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Re Adaptor conformance
+//
+// go test -tags e2e replays, against the whole server, the requests TiddlyWiki's tiddlyweb syncadaptor makes, one
+// session per file in testdata/adaptor named for the TiddlyWiki version it describes, and checks each answer the way
+// that version's adaptor reads it: the status it treats as success, the Etag it parses for the bag, title and
+// revision, the fields it takes from /status, and the skinny list it lazily loads from.  When a release changes
+// what the adaptor sends or expects, copy the newest file under the release's version and change it to match.
+
+// adaptorSession is a file in testdata/adaptor.
+type adaptorSession struct {
+	Version   string            `json:"version"`
+	Exchanges []adaptorExchange `json:"exchanges"`
+}
+
+// adaptorExchange is one request the adaptor makes and what it needs of
+// the response.
+type adaptorExchange struct {
+	Name   string            `json:"name"`
+	Method string            `json:"method"`
+	Path   string            `json:"path"`
+	Header map[string]string `json:"header"`
+	Body   json.RawMessage   `json:"body"`
+	Expect struct {
+		Status    []int                  `json:"status"`    // any of these
+		Etag      string                 `json:"etag"`      // the title the Etag must name
+		JSON      map[string]interface{} `json:"json"`      // dotted path: value
+		Has       []string               `json:"has"`       // dotted paths that must be present
+		Skinny    bool                   `json:"skinny"`    // a tiddler list without text
+		Titles    []string               `json:"titles"`    // titles the list must include
+		NotTitles []string               `json:"notTitles"` // titles it must not
+	} `json:"expect"`
+}
+
+func TestAdaptorConformance(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "adaptor", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no sessions in testdata/adaptor")
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s adaptorSession
+		if err := json.Unmarshal(data, &s); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		t.Run(s.Version, func(t *testing.T) { runAdaptorSession(t, &s) })
+	}
+}
+
+func runAdaptorSession(t *testing.T, s *adaptorSession) {
+	useTestStore(t)
+	srv := httptest.NewServer(newServer("", newHandler()).Handler)
+	defer srv.Close()
+
+	for _, x := range s.Exchanges {
+		req, err := http.NewRequest(x.Method, srv.URL+x.Path, bytes.NewReader(x.Body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Every adaptor request carries these.
+		req.Header.Set(cfg.AuthHeader, "tester")
+		req.Header.Set("X-Requested-With", "TiddlyWiki")
+		if len(x.Body) > 0 {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for k, v := range x.Header {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range checkExchange(&x, res, body) {
+			t.Errorf("%s (%s %s): %s", x.Name, x.Method, x.Path, msg)
+		}
+	}
+}
+
+// checkExchange returns what about res the adaptor would fail on.
+func checkExchange(x *adaptorExchange, res *http.Response, body []byte) []string {
+	var msgs []string
+	fail := func(format string, args ...interface{}) {
+		msgs = append(msgs, fmt.Sprintf(format, args...))
+	}
+	ok := false
+	for _, code := range x.Expect.Status {
+		ok = ok || res.StatusCode == code
+	}
+	if !ok {
+		fail("status %d, want one of %v; body %q", res.StatusCode, x.Expect.Status, body)
+		return msgs
+	}
+	if want := x.Expect.Etag; want != "" {
+		bag, title, rev, ok := adaptorParseEtag(res.Header.Get("Etag"))
+		switch {
+		case !ok:
+			fail("Etag %q doesn't parse", res.Header.Get("Etag"))
+		case bag != "bag" || title != want:
+			fail("Etag names %q in bag %q, want %q in bag %q", title, bag, want, "bag")
+		default:
+			if _, err := strconv.Atoi(rev); err != nil {
+				fail("Etag revision %q isn't a number", rev)
+			}
+		}
+	}
+	e := x.Expect
+	if len(e.JSON) == 0 && len(e.Has) == 0 && !e.Skinny && len(e.Titles) == 0 && len(e.NotTitles) == 0 {
+		return msgs
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		fail("body isn't JSON: %v", err)
+		return msgs
+	}
+	for path, want := range e.JSON {
+		if got, ok := jsonPath(v, path); !ok || !jsonEqual(got, want) {
+			fail("%s is %v, want %v", path, got, want)
+		}
+	}
+	for _, path := range e.Has {
+		if _, ok := jsonPath(v, path); !ok {
+			fail("%s is missing", path)
+		}
+	}
+	if e.Skinny || len(e.Titles) > 0 || len(e.NotTitles) > 0 {
+		list, ok := v.([]interface{})
+		if !ok {
+			fail("body isn't a list")
+			return msgs
+		}
+		titles := make(map[string]bool)
+		for _, item := range list {
+			m, _ := item.(map[string]interface{})
+			title, _ := m["title"].(string)
+			if title == "" {
+				fail("list item without a title: %v", item)
+				continue
+			}
+			titles[title] = true
+			if _, ok := m["text"]; ok && e.Skinny {
+				fail("list item %q has text, so it won't be lazily loaded", title)
+			}
+			if _, ok := m["revision"]; !ok {
+				fail("list item %q has no revision", title)
+			}
+		}
+		for _, title := range e.Titles {
+			if !titles[title] {
+				fail("list lacks %q", title)
+			}
+		}
+		for _, title := range e.NotTitles {
+			if titles[title] {
+				fail("list has %q", title)
+			}
+		}
+	}
+	return msgs
+}
+
+// jsonPath looks up a dotted path such as space.recipe in v.
+func jsonPath(v interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func jsonEqual(a, b interface{}) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return bytes.Equal(x, y)
+}
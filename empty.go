@@ -0,0 +1,197 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Re Empty wiki
+//
+// GET /empty.html serves the core page as a pristine, standalone TiddlyWiki: without the TiddlyWeb plugin, so it
+// doesn't try to sync, and with any external core script inlined, so it works from a local file.  Download it to
+// draft content offline or to try a core upgrade, save it as usual, and import the saved file from /admin (or with
+// tiddly import) to bring the tiddlers written in it into the wiki.  The import takes the tiddlers from the page's
+// store area, skipping the core, the TiddlyWeb plugin, temporary and state tiddlers, and any tiddler that is just
+// as it came in the empty page.
+
+var emptyPage page
+
+// The tiddlers a page may hold that are part of TiddlyWiki or this server
+// rather than content, by title prefix.
+var pageOnlyPrefixes = []string{
+	"$:/core", "$:/boot/", "$:/library/", "$:/temp/", "$:/state/", "$:/StoryList", "$:/HistoryList",
+	"$:/plugins/tiddlywiki/tiddlyweb", "$:/config/tiddlyweb/",
+}
+
+func loadEmptyPage(file string) (page, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return page{}, err
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return page{}, err
+	}
+	p := page{data: data, modTime: fi.ModTime()}
+	if m := externalCoreRE.FindSubmatchIndex(p.data); m != nil {
+		js, err := ioutil.ReadFile(filepath.Join(cfg.CoreDir, string(p.data[m[2]:m[3]])))
+		if err != nil {
+			return page{}, fmt.Errorf("page needs its external core: %v", err)
+		}
+		var b bytes.Buffer
+		b.Write(p.data[:m[0]])
+		b.WriteString("<script>")
+		b.Write(js)
+		b.WriteString("</script>")
+		b.Write(p.data[m[1]:])
+		p.data = b.Bytes()
+	}
+	if err := p.removeTiddler("$:/plugins/tiddlywiki/tiddlyweb"); err != nil {
+		return page{}, fmt.Errorf("%s: %v", file, err)
+	}
+	return p, nil
+}
+
+func emptyHTML(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="empty.html"`)
+	servePage(w, r, "empty.html", emptyPage)
+}
+
+// The forms of a store area: TiddlyWiki 5.2 and later keep tiddlers as JSON
+// in script elements, earlier versions (and addTiddler) as divs.
+var (
+	jsonStoreRE = regexp.MustCompile(`(?s)(<script class="tiddlywiki-tiddler-store" type="application/json">)(.*?)(</script>)`)
+	divStoreRE  = regexp.MustCompile(`(?s)\n?<div((?:\s+[^\s=>]+="[^"]*")*)\s*>\s*<pre>(.*?)</pre>\s*</div>`)
+	attrRE      = regexp.MustCompile(`([^\s=>]+)="([^"]*)"`)
+)
+
+// divFields returns the fields of the tiddler in a store area div matched
+// by divStoreRE.
+func divFields(data []byte, m []int) map[string]interface{} {
+	fields := make(map[string]interface{})
+	for _, a := range attrRE.FindAllSubmatch(data[m[2]:m[3]], -1) {
+		fields[string(a[1])] = html.UnescapeString(string(a[2]))
+	}
+	fields["text"] = html.UnescapeString(string(data[m[4]:m[5]]))
+	return fields
+}
+
+// pageTiddlers returns the tiddlers in the store area of a TiddlyWiki page.
+func pageTiddlers(data []byte) ([]map[string]interface{}, error) {
+	var tiddlers []map[string]interface{}
+	for _, m := range jsonStoreRE.FindAllSubmatch(data, -1) {
+		var ts []map[string]interface{}
+		if err := json.Unmarshal(m[2], &ts); err != nil {
+			return nil, fmt.Errorf("bad tiddler store: %v", err)
+		}
+		tiddlers = append(tiddlers, ts...)
+	}
+	i := bytes.Index(data, storeAreaMarker)
+	if i < 0 {
+		if tiddlers == nil {
+			return nil, fmt.Errorf("not a TiddlyWiki page: no store area")
+		}
+		return tiddlers, nil
+	}
+	area := data[i+len(storeAreaMarker):]
+	for _, m := range divStoreRE.FindAllSubmatchIndex(area, -1) {
+		tiddlers = append(tiddlers, divFields(area, m))
+	}
+	return tiddlers, nil
+}
+
+// removeTiddler removes title from p's store area, in either form.
+func (p *page) removeTiddler(title string) error {
+	found := false
+	data := jsonStoreRE.ReplaceAllFunc(p.data, func(store []byte) []byte {
+		m := jsonStoreRE.FindSubmatch(store)
+		var ts []map[string]interface{}
+		if json.Unmarshal(m[2], &ts) != nil {
+			return store
+		}
+		kept := ts[:0]
+		for _, t := range ts {
+			if t["title"] != title {
+				kept = append(kept, t)
+			}
+		}
+		if len(kept) == len(ts) {
+			return store
+		}
+		found = true
+		js, err := json.Marshal(kept) // escapes <, so it can't end the script
+		if err != nil {
+			return store
+		}
+		return append(append(append([]byte{}, m[1]...), js...), m[3]...)
+	})
+	if i := bytes.Index(data, storeAreaMarker); i >= 0 {
+		i += len(storeAreaMarker)
+		for _, m := range divStoreRE.FindAllSubmatchIndex(data[i:], -1) {
+			if divFields(data[i:], m)["title"] == title {
+				data = append(data[:i+m[0]:i+m[0]], data[i+m[1]:]...)
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("no tiddler %q", title)
+	}
+	p.data = data
+	return nil
+}
+
+// pageContent returns the tiddlers in a page that aren't part of TiddlyWiki
+// or the empty page, in TiddlyWiki JSON export form.
+func pageContent(data []byte) ([]map[string]interface{}, error) {
+	tiddlers, err := pageTiddlers(data)
+	if err != nil {
+		return nil, err
+	}
+	stock := make(map[string]interface{})
+	if emptyPage.data != nil {
+		empty, err := pageTiddlers(emptyPage.data)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range empty {
+			if title, ok := t["title"].(string); ok {
+				stock[title] = t["text"]
+			}
+		}
+	}
+	var content []map[string]interface{}
+Tiddlers:
+	for _, t := range tiddlers {
+		title, _ := t["title"].(string)
+		if title == "" {
+			continue
+		}
+		for _, prefix := range pageOnlyPrefixes {
+			if strings.HasPrefix(title, prefix) {
+				continue Tiddlers
+			}
+		}
+		if text, ok := stock[title]; ok && text == t["text"] {
+			continue
+		}
+		content = append(content, t)
+	}
+	return content, nil
+}
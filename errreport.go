@@ -0,0 +1,286 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/errorreporting"
+)
+
+// Re Error reporting
+//
+// Set error-reporter=google to report 5xx responses and panics in handlers to Google Cloud Error Reporting in the
+// configured project, or error-reporter=sentry to report them to the Sentry project named by sentry-dsn.  A report
+// gives the route (as in trace span names, so without the title), method, user, request ID and message, and for a
+// panic the stack; never the request body.  Either way, reportErrors recovers a panic in a handler, logs it with its
+// stack and answers 500, instead of letting net/http drop the connection; newServer puts it in front of every
+// server's handler.  Goroutines that outlive requests, like the one following the redis cache's changes, run their
+// work under recovered, so that a panic there is logged and reported and the work retried rather than the whole
+// server going down.
+
+type errorReporter interface {
+	// report reports an error in handling r with the given status, or if
+	// r is nil, in the background.
+	report(r *http.Request, status int, msg string, stack []byte)
+	flush()
+}
+
+var reporter errorReporter // nil when reports aren't sent anywhere
+
+// setupErrorReporting starts the configured reporter and returns a function
+// that sends any buffered reports, for use at shutdown.
+func setupErrorReporting(project string) (flush func()) {
+	var err error
+	switch cfg.ErrorReporter {
+	case "":
+		return func() {}
+	case "google":
+		reporter, err = newGoogleReporter(context.Background(), project)
+	case "sentry":
+		reporter, err = newSentryReporter(cfg.SentryDSN)
+	}
+	if err != nil {
+		log.Fatalf("error reporting: %v", err)
+	}
+	log.Printf("Reporting errors to %s", cfg.ErrorReporter)
+	return reporter.flush
+}
+
+// recovered calls fn, turning a panic in it into an error after logging and
+// reporting it.
+func recovered(what string, fn func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			stack := debug.Stack()
+			log.Printf("%s: panic: %v\n%s", what, p, stack)
+			if reporter != nil {
+				reporter.report(nil, 0, fmt.Sprintf("%s: panic: %v", what, p), stack)
+			}
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return fn()
+}
+
+// reportErrors reports 5xx responses from next, and turns a panic in next
+// into a reported 500.
+func reportErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				if sw.status >= 500 && reporter != nil {
+					reporter.report(r, sw.status, redactRequest(r, strings.TrimSpace(string(sw.msg))), nil)
+				}
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p) // the handler's way of dropping the connection on purpose
+			}
+			stack := debug.Stack()
+			msg := redactRequest(r, fmt.Sprintf("panic: %v", p))
+			logf(r.Context(), "%s\n%s", msg, stack)
+			if reporter != nil {
+				reporter.report(r, 500, msg, stack)
+			}
+			if sw.status != 0 {
+				// Too late for a 500; don't let a cut-off response
+				// pass for a complete one.
+				panic(http.ErrAbortHandler)
+			}
+			http.Error(sw, "internal error", 500)
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// statusWriter notes the status of a response, and the start of its body if
+// that is an error.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	msg    []byte
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	if w.status >= 500 && len(w.msg) < 256 {
+		n := len(p)
+		if n > 256-len(w.msg) {
+			n = 256 - len(w.msg)
+		}
+		w.msg = append(w.msg, p[:n]...)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush passes on flushes, so that streamed responses aren't held back.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// reportedURL returns r's URL as reported: the route, without the title or
+// query.
+func reportedURL(r *http.Request) *url.URL {
+	return &url.URL{Scheme: "https", Host: r.Host, Path: strings.TrimPrefix(spanName(r), r.Method+" ")}
+}
+
+type googleReporter struct {
+	client *errorreporting.Client
+}
+
+func newGoogleReporter(ctx context.Context, project string) (*googleReporter, error) {
+	opts, err := googleOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client, err := errorreporting.NewClient(ctx, project, errorreporting.Config{
+		ServiceName:    "tiddly",
+		ServiceVersion: build.Version,
+		OnError:        func(err error) { log.Printf("error reporting: %v", err) },
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &googleReporter{client}, nil
+}
+
+func (g *googleReporter) report(r *http.Request, status int, msg string, stack []byte) {
+	e := errorreporting.Entry{Stack: stack}
+	if r != nil {
+		e.Req = &http.Request{Method: r.Method, URL: reportedURL(r), Header: http.Header{}, RemoteAddr: r.RemoteAddr}
+		e.Req.Header.Set("User-Agent", r.UserAgent())
+		e.User = currentUser(r)
+		if id := requestIDOf(r.Context()); id != "" {
+			msg += " (request " + id + ")"
+		}
+	}
+	e.Error = errors.New(msg)
+	g.client.Report(e)
+}
+
+func (g *googleReporter) flush() {
+	g.client.Flush()
+}
+
+// sentryReporter sends events to Sentry's store endpoint in the background,
+// dropping them if too many are waiting.
+type sentryReporter struct {
+	endpoint string
+	auth     string
+	events   chan []byte
+	pending  sync.WaitGroup
+}
+
+func newSentryReporter(dsn string) (*sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.Host == "" || path.Base(u.Path) == "/" || path.Base(u.Path) == "." {
+		return nil, fmt.Errorf("bad sentry-dsn: want https://key@host/project")
+	}
+	project := path.Base(u.Path)
+	s := &sentryReporter{
+		endpoint: u.Scheme + "://" + u.Host + strings.TrimSuffix(path.Dir(u.Path), "/") + "/api/" + project + "/store/",
+		auth:     "Sentry sentry_version=7, sentry_client=tiddly/" + build.Version + ", sentry_key=" + u.User.Username(),
+		events:   make(chan []byte, 100),
+	}
+	go s.send()
+	return s, nil
+}
+
+func (s *sentryReporter) report(r *http.Request, status int, msg string, stack []byte) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	host, _ := os.Hostname()
+	event := map[string]interface{}{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   time.Now().UTC().Format(time.RFC3339),
+		"platform":    "go",
+		"level":       "error",
+		"logger":      "tiddly",
+		"server_name": host,
+		"release":     build.Version,
+		"message":     msg,
+	}
+	if r != nil {
+		event["request"] = map[string]interface{}{
+			"method":  r.Method,
+			"url":     reportedURL(r).String(),
+			"headers": map[string]string{"User-Agent": r.UserAgent()},
+		}
+		event["tags"] = map[string]string{"status": fmt.Sprint(status), "request_id": requestIDOf(r.Context())}
+		if user := currentUser(r); user != "" {
+			event["user"] = map[string]string{"username": user}
+		}
+	}
+	if stack != nil {
+		event["level"] = "fatal"
+		event["extra"] = map[string]string{"stack": string(stack)}
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	s.pending.Add(1)
+	select {
+	case s.events <- data:
+	default:
+		s.pending.Done()
+		log.Printf("sentry: too many reports waiting; dropped one")
+	}
+}
+
+func (s *sentryReporter) send() {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for data := range s.events {
+		req, err := http.NewRequest("POST", s.endpoint, bytes.NewReader(data))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Sentry-Auth", s.auth)
+			var res *http.Response
+			if res, err = client.Do(req); err == nil {
+				res.Body.Close()
+				if res.StatusCode != 200 {
+					err = errors.New(res.Status)
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("sentry: %v", err)
+		}
+		s.pending.Done()
+	}
+}
+
+func (s *sentryReporter) flush() {
+	s.pending.Wait()
+}
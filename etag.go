@@ -0,0 +1,86 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Re ETags
+//
+// A tiddler's ETag is TiddlyWeb's: "bag/{title}/{revision}:{hash}", the title percent-encoded as by
+// encodeURIComponent, which is how the TiddlyWeb adaptor's parseEtag decodes it to learn the bag and revision of a
+// tiddler it has saved.  (Query escaping, which turns spaces into +, would come back from it with + in the title.)
+// The hash is of the stored revision, so a tiddler has the same ETag whether it comes from the PUT that saved it,
+// a batch save, or a later GET; a DELETE answers with the ETag of the revision recording the deletion.  Coming
+// back, an ETag is parsed the way the adaptor parses it, and If-Match names the revision a PUT was made from (see
+// Re Conflicts), so one for another tiddler, or that can't be parsed, is refused with 412; a DELETE is likewise
+// refused unless its If-Match, if any, names the current revision.  A GET whose If-None-Match lists the current
+// ETag is answered with 304.
+
+// tiddlerETag returns the ETag of revision t of title.
+func tiddlerETag(title string, t *Tiddler) string {
+	sum := md5.Sum([]byte(t.Meta + "\x00" + t.Text))
+	return fmt.Sprintf(`"bag/%s/%d:%x"`, url.PathEscape(title), t.Rev, sum)
+}
+
+// parseETag splits a tiddler's ETag as the TiddlyWeb adaptor does: up to the
+// first slash is the bag, up to the last slash the title, and up to the last
+// colon the revision.
+func parseETag(etag string) (bag, title string, rev int, ok bool) {
+	etag = strings.TrimPrefix(etag, "W/")
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return "", "", 0, false
+	}
+	etag = etag[1 : len(etag)-1]
+	first, last, colon := strings.Index(etag, "/"), strings.LastIndex(etag, "/"), strings.LastIndex(etag, ":")
+	if first < 0 || first == last || colon < last {
+		return "", "", 0, false
+	}
+	bag, err1 := url.PathUnescape(etag[:first])
+	title, err2 := url.PathUnescape(etag[first+1 : last])
+	rev, err3 := strconv.Atoi(etag[last+1 : colon])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return "", "", 0, false
+	}
+	return bag, title, rev, true
+}
+
+// ifMatch reports whether r's If-Match, if it has one, lists an ETag of
+// revision rev of title, where rev is 0 if title has no live tiddler.
+func ifMatch(r *http.Request, title string, rev int) bool {
+	m := r.Header.Get("If-Match")
+	if m == "" {
+		return true
+	}
+	for _, tag := range strings.Split(m, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" && rev != 0 {
+			return true
+		}
+		if _, etagTitle, etagRev, ok := parseETag(tag); ok && rev != 0 && etagTitle == title && etagRev == rev {
+			return true
+		}
+	}
+	return false
+}
+
+// noneMatch answers a GET with 304 if its If-None-Match lists etag,
+// reporting whether it did.
+func noneMatch(w http.ResponseWriter, r *http.Request, etag string) bool {
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,340 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// adaptorParseEtag is the TiddlyWeb adaptor's parseEtag, from
+// plugins/tiddlywiki/tiddlyweb/tiddlywebadaptor.js, with decodeURIComponent
+// for $tw.utils.decodeURIComponentSafe.
+func adaptorParseEtag(etag string) (bag, title, revision string, ok bool) {
+	firstSlash := strings.Index(etag, "/")
+	lastSlash := strings.LastIndex(etag, "/")
+	colon := strings.LastIndex(etag, ":")
+	if firstSlash == -1 || lastSlash == -1 || colon == -1 {
+		return "", "", "", false
+	}
+	return decodeURIComponent(etag[1:firstSlash]), decodeURIComponent(etag[firstSlash+1 : lastSlash]),
+		etag[lastSlash+1 : colon], true
+}
+
+// decodeURIComponent decodes %XX escapes only, leaving + alone, as
+// JavaScript's does.
+func decodeURIComponent(s string) string {
+	d, err := url.PathUnescape(s)
+	if err != nil {
+		return s
+	}
+	return d
+}
+
+// etagTitles are titles whose escaping the adaptor must undo.
+var etagTitles = append([]string{"Plain", "a+b", "C++ notes", "$:/StoryList", "time 12:30", "quote\"d"}, awkwardTitles...)
+
+// etagServer serves the tiddler routes from a test store.
+func etagServer(t *testing.T) (do func(method, path, body string, h http.Header) (*http.Response, string)) {
+	useTestStore(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/recipes/all/tiddlers/", tiddler)
+	mux.HandleFunc("/recipes/all/tiddlers", batchSave)
+	mux.HandleFunc("/bags/bag/tiddlers/", deleteTiddler)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return func(method, path, body string, h http.Header) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range h {
+			req.Header[k] = v
+		}
+		req.Header.Set(cfg.AuthHeader, "tester")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, string(data)
+	}
+}
+
+func TestETagAdaptorCompatible(t *testing.T) {
+	do := etagServer(t)
+	check := func(what, etag, title string, rev int) {
+		t.Helper()
+		bag, gotTitle, gotRev, ok := adaptorParseEtag(etag)
+		if !ok || bag != "bag" || gotTitle != title || gotRev != strconv.Itoa(rev) {
+			t.Errorf("%s of %q: adaptor parses ETag %s as bag %q, title %q, revision %q", what, title, etag, bag, gotTitle, gotRev)
+		}
+	}
+	for _, title := range etagTitles {
+		path := "/recipes/all/tiddlers/" + url.PathEscape(title)
+		body, _ := json.Marshal(map[string]string{"title": title, "text": "x"})
+		res, _ := do("PUT", path, string(body), nil)
+		if res.StatusCode != 200 {
+			t.Errorf("PUT %q: %s", title, res.Status)
+			continue
+		}
+		put := res.Header.Get("Etag")
+		check("PUT", put, title, 1)
+
+		res, _ = do("GET", path, "", nil)
+		if got := res.Header.Get("Etag"); got != put {
+			t.Errorf("GET %q: ETag %s, want %s as from the PUT", title, got, put)
+		}
+
+		res, _ = do("DELETE", "/bags/bag/tiddlers/"+url.PathEscape(title), "", nil)
+		check("DELETE", res.Header.Get("Etag"), title, 2)
+	}
+}
+
+func TestETagBatch(t *testing.T) {
+	do := etagServer(t)
+	body, _ := json.Marshal([]map[string]string{{"title": "one two", "text": "1"}, {"title": "a/b", "text": "2"}})
+	res, data := do("PUT", "/recipes/all/tiddlers", string(body), nil)
+	var results []batchResult
+	if res.StatusCode != 200 || json.Unmarshal([]byte(data), &results) != nil || len(results) != 2 {
+		t.Fatalf("batch PUT: %s %s", res.Status, data)
+	}
+	for _, r := range results {
+		res, _ := do("GET", "/recipes/all/tiddlers/"+url.PathEscape(r.Title), "", nil)
+		if got := res.Header.Get("Etag"); got != r.ETag {
+			t.Errorf("GET %q: ETag %s, want %s as from the batch", r.Title, got, r.ETag)
+		}
+		if bag, title, rev, ok := parseETag(r.ETag); !ok || bag != "bag" || title != r.Title || rev != 1 {
+			t.Errorf("batch ETag of %q: %s", r.Title, r.ETag)
+		}
+	}
+}
+
+func TestParseETag(t *testing.T) {
+	for _, title := range etagTitles {
+		tid := &Tiddler{Rev: 7, Meta: `{}`}
+		etag := tiddlerETag(title, tid)
+		bag, got, rev, ok := parseETag(etag)
+		if !ok || bag != "bag" || got != title || rev != 7 {
+			t.Errorf("parseETag(%s) = %q, %q, %d, %v", etag, bag, got, rev, ok)
+		}
+		if _, _, _, ok := parseETag("W/" + etag); !ok {
+			t.Errorf("parseETag of weak %s failed", etag)
+		}
+	}
+	for _, bad := range []string{"", `""`, `"bag"`, `"bag/title"`, `"bag/title/x:y"`, `bag/title/1:ab`, `"bag/ti%zztle/1:ab"`} {
+		if _, _, _, ok := parseETag(bad); ok {
+			t.Errorf("parseETag(%s) succeeded", bad)
+		}
+	}
+}
+
+func TestETagPreconditions(t *testing.T) {
+	do := etagServer(t)
+	path := "/recipes/all/tiddlers/Home%20page"
+	res, _ := do("PUT", path, `{"title": "Home page", "text": "1"}`, nil)
+	first := res.Header.Get("Etag")
+	res, _ = do("PUT", path, `{"title": "Home page", "text": "2"}`, http.Header{"If-Match": {first}})
+	if res.StatusCode != 200 {
+		t.Fatalf("PUT with current If-Match: %s", res.Status)
+	}
+	second := res.Header.Get("Etag")
+
+	tests := []struct {
+		method  string
+		header  string
+		value   string
+		status  int
+		comment string
+	}{
+		{"PUT", "If-Match", first, 412, "stale revision"},
+		{"PUT", "If-Match", second, 200, "current revision"},
+		{"PUT", "If-Match", `"bag/Other/3:00"`, 412, "another tiddler"},
+		{"PUT", "If-Match", `"garbage"`, 412, "unparseable"},
+		{"PUT", "If-Match", "*", 200, "any revision"},
+		{"GET", "If-None-Match", `"bag/Other/3:00"`, 200, "another ETag"},
+	}
+	for _, tt := range tests {
+		body := ""
+		if tt.method == "PUT" {
+			body = `{"title": "Home page", "text": "3"}`
+		}
+		res, _ := do(tt.method, path, body, http.Header{tt.header: {tt.value}})
+		if res.StatusCode != tt.status {
+			t.Errorf("%s with %s %s (%s): %s, want %d", tt.method, tt.header, tt.value, tt.comment, res.Status, tt.status)
+		}
+	}
+
+	res, _ = do("GET", path, "", nil)
+	current := res.Header.Get("Etag")
+	for _, inm := range []string{current, "W/" + current, `"x", ` + current, "*"} {
+		if res, _ := do("GET", path, "", http.Header{"If-None-Match": {inm}}); res.StatusCode != 304 {
+			t.Errorf("GET with If-None-Match %s: %s, want 304", inm, res.Status)
+		}
+	}
+}
+
+func TestIfMatchSavesAlike(t *testing.T) {
+	do := etagServer(t)
+	path := "/recipes/all/tiddlers/Home%20page"
+	body := `{"title": "Home page", "text": "1"}`
+	res, _ := do("PUT", path, body, nil)
+	first := res.Header.Get("Etag")
+
+	// An unchanged save is no save, If-Match or not.
+	res, msg := do("PUT", path, body, http.Header{"If-Match": {first}})
+	if res.StatusCode != 200 || res.Header.Get("Etag") != first {
+		t.Errorf("unchanged PUT with If-Match: %s %s, ETag %s, want 200 and %s", res.Status, msg, res.Header.Get("Etag"), first)
+	}
+	res, _ = do("PUT", path, `{"title": "Home page", "text": "2"}`, http.Header{"If-Match": {first}})
+	if res.StatusCode != 200 {
+		t.Fatalf("changed PUT with If-Match: %s", res.Status)
+	}
+	revs, err := historyOf(context.Background(), "Home page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 2 {
+		t.Errorf("%d history revisions, want 2", len(revs))
+	}
+}
+
+func TestDeleteStatus(t *testing.T) {
+	do := etagServer(t)
+	path := "/bags/bag/tiddlers/Home%20page"
+	if res, _ := do("DELETE", path, "", nil); res.StatusCode != 404 {
+		t.Errorf("DELETE of missing tiddler: %s, want 404", res.Status)
+	}
+	res, _ := do("PUT", "/recipes/all/tiddlers/Home%20page", `{"title": "Home page", "text": "1"}`, nil)
+	first := res.Header.Get("Etag")
+	res, _ = do("PUT", "/recipes/all/tiddlers/Home%20page", `{"title": "Home page", "text": "2"}`, nil)
+	current := res.Header.Get("Etag")
+
+	for _, im := range []string{first, `"bag/Other/2:00"`, `"garbage"`} {
+		if res, _ := do("DELETE", path, "", http.Header{"If-Match": {im}}); res.StatusCode != 412 {
+			t.Errorf("DELETE with If-Match %s: %s, want 412", im, res.Status)
+		}
+	}
+	if res, _ := do("DELETE", path, "", http.Header{"If-Match": {current}}); res.StatusCode != 204 {
+		t.Errorf("DELETE with current If-Match: %s, want 204", res.Status)
+	}
+	if res, _ := do("DELETE", path, "", nil); res.StatusCode != 404 {
+		t.Errorf("DELETE of deleted tiddler: %s, want 404", res.Status)
+	}
+	if res, _ := do("DELETE", path, "", http.Header{"If-Match": {"*"}}); res.StatusCode != 404 {
+		t.Errorf("DELETE * of deleted tiddler: %s, want 404", res.Status)
+	}
+}
+
+// slowGetStore takes a while over each Get outside a transaction, so that
+// concurrent requests all read before any of them writes.
+type slowGetStore struct{ Store }
+
+func (s slowGetStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	time.Sleep(20 * time.Millisecond)
+	return s.Store.Get(ctx, key, dst)
+}
+
+func TestConcurrentIfMatch(t *testing.T) {
+	do := etagServer(t)
+	db = slowGetStore{db}
+	path := "/recipes/all/tiddlers/Home%20page"
+	res, _ := do("PUT", path, `{"title": "Home page", "text": "1"}`, nil)
+	first := res.Header.Get("Etag")
+
+	const n = 8
+	codes := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			res, _ := do("PUT", path, fmt.Sprintf(`{"title": "Home page", "text": "edit %d"}`, i), http.Header{"If-Match": {first}})
+			codes <- res.StatusCode
+		}(i)
+	}
+	saved := 0
+	for i := 0; i < n; i++ {
+		switch code := <-codes; code {
+		case 200:
+			saved++
+		case 412:
+		default:
+			t.Errorf("PUT with If-Match: %d", code)
+		}
+	}
+	if saved != 1 {
+		t.Errorf("%d PUTs with the same If-Match saved, want 1", saved)
+	}
+}
+
+// barrierGetStore holds each Get outside a transaction, once it has read,
+// until all of them have, so that concurrent requests all read before any
+// of them writes.
+type barrierGetStore struct {
+	Store
+	wg *sync.WaitGroup
+}
+
+func (s barrierGetStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	err := s.Store.Get(ctx, key, dst)
+	s.wg.Done()
+	s.wg.Wait()
+	return err
+}
+
+func TestConcurrentDeleteIfMatch(t *testing.T) {
+	do := etagServer(t)
+	res, _ := do("PUT", "/recipes/all/tiddlers/Home%20page", `{"title": "Home page", "text": "1"}`, nil)
+	first := res.Header.Get("Etag")
+
+	const n = 8
+	store := db
+	var wg sync.WaitGroup
+	wg.Add(n)
+	db = barrierGetStore{store, &wg}
+	codes := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			res, _ := do("DELETE", "/bags/bag/tiddlers/Home%20page", "", http.Header{"If-Match": {first}})
+			codes <- res.StatusCode
+		}()
+	}
+	deleted := 0
+	for i := 0; i < n; i++ {
+		switch code := <-codes; code {
+		case 204:
+			deleted++
+		case 404, 412:
+		default:
+			t.Errorf("DELETE with If-Match: %d", code)
+		}
+	}
+	if deleted != 1 {
+		t.Errorf("%d DELETEs with the same If-Match deleted, want 1", deleted)
+	}
+	db = store
+	revs, err := historyOf(context.Background(), "Home page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 2 {
+		t.Errorf("%d history revisions, want 2", len(revs))
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Re External core
+//
+// TiddlyWiki 5.2 and later can save a wiki with the core as a separate tiddlywikicore-<version>.js file (Saving >
+// "external core" in the control panel), leaving a page that holds only the plugins and tiddlers that are specific
+// to this wiki.  Serve such a page as the core, with the matching tiddlywikicore-<version>.js next to it in core-dir,
+// and the server makes both available: the script is served from /core/ with long-lived caching.  If core-cdn is
+// set to a URL prefix such as https://cdn.example.com/tiddlywiki/, the page loads the script from there instead,
+// pinned by a Subresource Integrity hash of the local copy, and falls back to /core/ if the CDN fails to deliver.
+
+var externalCoreRE = regexp.MustCompile(`<script src="(tiddlywikicore-[^"/]+\.js)"[^>]*>\s*</script>`)
+
+// externalCore rewrites p's reference to an external core script, if it has
+// one, to load from the CDN or /core/. It returns the script's file name.
+func (p *page) externalCore() (string, error) {
+	m := externalCoreRE.FindSubmatchIndex(p.data)
+	if m == nil {
+		return "", nil
+	}
+	name := string(p.data[m[2]:m[3]])
+	local := cfg.BasePath + "/core/" + name
+	js, err := ioutil.ReadFile(filepath.Join(cfg.CoreDir, name))
+	if err != nil {
+		return "", fmt.Errorf("page needs its external core: %v", err)
+	}
+
+	var tag string
+	if cfg.CoreCDN == "" {
+		tag = fmt.Sprintf(`<script src="%s"></script>`, html.EscapeString(local))
+	} else {
+		sum := sha512.Sum384(js)
+		integrity := "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+		cdn := strings.TrimSuffix(cfg.CoreCDN, "/") + "/" + name
+		// If the CDN is unreachable or serves something else, the
+		// integrity check fails, $tw never gets defined, and the
+		// second script loads the local copy before anything runs.
+		tag = fmt.Sprintf(`<script src="%s" integrity="%s" crossorigin="anonymous"></script>
+<script>window.$tw && window.$tw.boot || document.write('<script src="%s"><\/script>');</script>`,
+			html.EscapeString(cdn), integrity, local)
+	}
+
+	data := make([]byte, 0, len(p.data)+len(tag))
+	data = append(data, p.data[:m[0]]...)
+	data = append(data, tag...)
+	data = append(data, p.data[m[1]:]...)
+	p.data = data
+	return name, nil
+}
+
+// coreScript serves external core scripts from core-dir. Their names carry
+// the TiddlyWiki version, so they can be cached indefinitely (see Re Cache
+// headers).
+func coreScript(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/core/")
+	if !externalCoreRE.MatchString(`<script src="` + name + `"></script>`) {
+		http.Error(w, "not found", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	http.ServeFile(w, r, filepath.Join(cfg.CoreDir, name))
+}
@@ -0,0 +1,141 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const faviconTitle = "$:/favicon.ico"
+
+// favicon serves /favicon.ico from the wiki's $:/favicon.ico tiddler, which
+// TiddlyWiki also uses for the page's icon once it has loaded, or a plain
+// default when there is none. Browsers ask for it without being told to,
+// so it's served without authentication.
+func favicon(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	icon := favicons.get(r.Context())
+	w.Header().Set("Content-Type", icon.typ)
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("Etag", icon.etag)
+	http.ServeContent(w, r, "favicon.ico", time.Time{}, bytes.NewReader(icon.data))
+}
+
+type faviconData struct {
+	data []byte
+	typ  string
+	etag string
+}
+
+var favicons faviconCache
+
+type faviconCache struct {
+	mu      sync.Mutex
+	fetched time.Time
+	icon    *faviconData
+}
+
+func (c *faviconCache) get(ctx context.Context) *faviconData {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.icon != nil && time.Since(c.fetched) < cfg.ShellCacheTTL {
+		return c.icon
+	}
+	icon, err := wikiFavicon(ctx)
+	if err != nil {
+		log.Printf("reading %s: %v", faviconTitle, err)
+	}
+	if icon == nil {
+		if c.icon != nil && err != nil {
+			return c.icon
+		}
+		icon = defaultFavicon
+	}
+	c.icon, c.fetched = icon, time.Now()
+	return icon
+}
+
+func (c *faviconCache) invalidate() {
+	c.mu.Lock()
+	c.icon = nil
+	c.mu.Unlock()
+}
+
+// wikiFavicon decodes the $:/favicon.ico tiddler, returning nil if there
+// isn't one.
+func wikiFavicon(ctx context.Context) (*faviconData, error) {
+	var t Tiddler
+	err := dbGet(ctx, datastore.NameKey("Tiddler", faviconTitle, nil), &t)
+	if err == datastore.ErrNoSuchEntity || err == nil && t.Meta == "" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(t.Text))
+	if err != nil {
+		return nil, err
+	}
+	typ := parseFields(&t).Type
+	if !strings.HasPrefix(typ, "image/") {
+		typ = "image/x-icon"
+	}
+	return newFavicon(data, typ), nil
+}
+
+func newFavicon(data []byte, typ string) *faviconData {
+	return &faviconData{data: data, typ: typ, etag: fmt.Sprintf(`"favicon/%x"`, md5.Sum(data))}
+}
+
+var defaultFavicon = drawDefaultFavicon()
+
+// drawDefaultFavicon draws a 16x16 icon, a white T on a dark square, and
+// wraps it in an ICO container, which may hold PNG images.
+func drawDefaultFavicon() *faviconData {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	bg := color.NRGBA{0x33, 0x55, 0x88, 0xff}
+	for y := 1; y < 15; y++ {
+		for x := 1; x < 15; x++ {
+			img.Set(x, y, bg)
+		}
+	}
+	for x := 4; x < 12; x++ {
+		img.Set(x, 4, color.White)
+		img.Set(x, 5, color.White)
+	}
+	for y := 6; y < 13; y++ {
+		img.Set(7, y, color.White)
+		img.Set(8, y, color.White)
+	}
+	var p bytes.Buffer
+	if err := png.Encode(&p, img); err != nil {
+		panic(err)
+	}
+
+	var ico bytes.Buffer
+	binary.Write(&ico, binary.LittleEndian, []uint16{0, 1, 1})                 // reserved, type icon, 1 image
+	ico.Write([]byte{16, 16, 0, 0})                                            // width, height, no palette, reserved
+	binary.Write(&ico, binary.LittleEndian, []uint16{1, 32})                   // color planes, bits per pixel
+	binary.Write(&ico, binary.LittleEndian, []uint32{uint32(p.Len()), 6 + 16}) // size, offset
+	ico.Write(p.Bytes())
+	return newFavicon(ico.Bytes(), "image/x-icon")
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// feedEntries is how many of the most recently modified tiddlers the feed
+// carries.
+const feedEntries = 50
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Base    string      `xml:"xml:base,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Published string     `xml:"published,omitempty"`
+	Updated   string     `xml:"updated"`
+	Link      atomLink   `xml:"link"`
+	Category  []atomTerm `xml:"category"`
+	Content   atomText   `xml:"content"`
+}
+
+type atomTerm struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// feed serves /feed.atom, the most recently changed published tiddlers (see
+// publish-tag), or with ?tag= only those that also have that tag. Like the
+// public pages, it needs no authentication.
+func feed(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	if cfg.PublishTag == "" {
+		http.Error(w, "not found", 404)
+		return
+	}
+	s, err := site.get(r.Context())
+	if err != nil {
+		logf(r.Context(), "building public site: %v", err)
+		http.Error(w, "internal error", 500)
+		return
+	}
+
+	base := requestOrigin(r) + cfg.BasePath + "/public/"
+	self := requestOrigin(r) + cfg.BasePath + r.URL.RequestURI()
+	f := atomFeed{
+		Base:  base,
+		ID:    self,
+		Title: s.Title,
+		Links: []atomLink{{Rel: "self", Href: self}, {Rel: "alternate", Href: base}},
+	}
+	tag := r.FormValue("tag")
+	var updated time.Time
+	for _, t := range s.Tiddlers {
+		if len(f.Entries) == feedEntries {
+			break
+		}
+		if tag != "" && !hasTag(t.Tags, tag) {
+			continue
+		}
+		e := atomEntry{
+			ID:      base + t.Path,
+			Title:   t.Title,
+			Updated: atomDate(t.Modified),
+			Link:    atomLink{Href: t.Path},
+			Content: atomText{Type: "html", Body: string(t.Text)},
+		}
+		if !t.Created.IsZero() {
+			e.Published = atomDate(t.Created)
+		}
+		for _, tag := range t.Tags {
+			e.Category = append(e.Category, atomTerm{tag})
+		}
+		if t.Modified.After(updated) {
+			updated = t.Modified
+		}
+		f.Entries = append(f.Entries, e)
+	}
+	f.Updated = atomDate(updated)
+
+	data, err := xml.MarshalIndent(f, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(cfg.PublishCacheTTL.Seconds())))
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+func atomDate(t time.Time) string {
+	if t.IsZero() {
+		t = time.Unix(0, 0)
+	}
+	return t.UTC().Format(time.RFC3339)
+}
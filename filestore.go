@@ -0,0 +1,294 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Re File storage
+//
+// With storage=file everything is kept in the single file named by data-file, so the server needs nothing but a
+// disk: a personal wiki on a home server is one binary and one file.  The file is a bbolt database with a bucket
+// per kind, each entity stored under its name.  Every write is a bbolt transaction, committed and synced to disk
+// before the write is acknowledged, so a crash loses nothing that was acknowledged and a store transaction happens
+// entirely or not at all.  Reads come from the file, which bbolt maps into memory, so the wiki needn't fit in the
+// heap, and space freed by overwritten entities is reused rather than piling up.
+//
+// Files written before the store was built on bbolt held a log of JSON lines; such a file is converted when it is
+// opened, and the log kept alongside as data-file.log.
+//
+// The file is locked while open, so only one process can use it: stop the server before running commands like
+// backup or export against it, or take the backup through /admin instead.
+
+type fileKV struct {
+	db *bolt.DB
+}
+
+func openFileStore() (Store, error) {
+	if err := convertFileLog(cfg.DataFile); err != nil {
+		return nil, fmt.Errorf("converting %s: %v", cfg.DataFile, err)
+	}
+	db, err := bolt.Open(cfg.DataFile, 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%s is in use by another process", cfg.DataFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", cfg.DataFile, err)
+	}
+	return kvStore{&fileKV{db}}, nil
+}
+
+func checkFileOp(name string, data []byte) error {
+	if name == "" {
+		return errors.New("empty name")
+	}
+	if data != nil && !json.Valid(data) {
+		return errors.New("file storage holds only JSON")
+	}
+	return nil
+}
+
+func (s *fileKV) get(ctx context.Context, kind, name string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		data, err = boltGet(tx, kind, name)
+		return err
+	})
+	return data, err
+}
+
+func (s *fileKV) put(ctx context.Context, kind, name string, data []byte) error {
+	if err := checkFileOp(name, data); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error { return boltPut(tx, kind, name, data) })
+}
+
+func (s *fileKV) delete(ctx context.Context, kind, name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error { return boltDelete(tx, kind, name) })
+}
+
+func (s *fileKV) scan(ctx context.Context, kind, prefix string, keysOnly bool, fn func(name string, data []byte) error) error {
+	// Copy what matches out of the transaction, so that fn can write.
+	var items []boltItem
+	err := s.db.View(func(tx *bolt.Tx) error {
+		items = boltScan(tx, kind, prefix, keysOnly)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return callScan(items, fn)
+}
+
+// update calls f in a bbolt transaction, committed if f returns nil.
+func (s *fileKV) update(ctx context.Context, f func(kv) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error { return f(&fileTx{tx}) })
+}
+
+func (s *fileKV) close() error {
+	return s.db.Close()
+}
+
+// fileTx is the kv within a transaction. It sees its own writes.
+type fileTx struct {
+	tx *bolt.Tx
+}
+
+func (t *fileTx) get(ctx context.Context, kind, name string) ([]byte, error) {
+	return boltGet(t.tx, kind, name)
+}
+
+func (t *fileTx) put(ctx context.Context, kind, name string, data []byte) error {
+	if err := checkFileOp(name, data); err != nil {
+		return err
+	}
+	return boltPut(t.tx, kind, name, data)
+}
+
+func (t *fileTx) delete(ctx context.Context, kind, name string) error {
+	return boltDelete(t.tx, kind, name)
+}
+
+func (t *fileTx) scan(ctx context.Context, kind, prefix string, keysOnly bool, fn func(name string, data []byte) error) error {
+	return callScan(boltScan(t.tx, kind, prefix, keysOnly), fn)
+}
+
+func (t *fileTx) update(ctx context.Context, f func(kv) error) error {
+	return errors.New("file storage: nested transaction")
+}
+
+func (t *fileTx) close() error {
+	return errors.New("file storage: close within a transaction")
+}
+
+// boltGet returns a copy of the value of name in kind's bucket, since bbolt's
+// is only good until tx ends.
+func boltGet(tx *bolt.Tx, kind, name string) ([]byte, error) {
+	b := tx.Bucket([]byte(kind))
+	if b == nil {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	data := b.Get([]byte(name))
+	if data == nil {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func boltPut(tx *bolt.Tx, kind, name string, data []byte) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(kind))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(name), data)
+}
+
+func boltDelete(tx *bolt.Tx, kind, name string) error {
+	b := tx.Bucket([]byte(kind))
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(name))
+}
+
+type boltItem struct {
+	name string
+	data []byte
+}
+
+// boltScan returns copies of the entities of kind whose names start with
+// prefix, in order of name, without their data if keysOnly.
+func boltScan(tx *bolt.Tx, kind, prefix string, keysOnly bool) []boltItem {
+	b := tx.Bucket([]byte(kind))
+	if b == nil {
+		return nil
+	}
+	var items []boltItem
+	c := b.Cursor()
+	for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+		it := boltItem{name: string(k)}
+		if !keysOnly {
+			it.data = append([]byte(nil), v...)
+		}
+		items = append(items, it)
+	}
+	return items
+}
+
+func callScan(items []boltItem, fn func(name string, data []byte) error) error {
+	for _, it := range items {
+		if err := fn(it.name, it.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileOp and fileRecord are the lines of the log files kept before the
+// store was built on bbolt.
+type fileOp struct {
+	Kind string          `json:"kind"`
+	Name string          `json:"name"`
+	Data json.RawMessage `json:"data,omitempty"` // absent for a delete
+}
+
+type fileRecord struct {
+	Ops []fileOp `json:"ops"`
+}
+
+// convertFileLog turns path into a bbolt database if it holds a log, keeping
+// the log as path.log.
+func convertFileLog(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if first, err := r.Peek(1); err != nil || first[0] != '{' {
+		return nil // empty, or already a database
+	}
+
+	data := make(map[string]map[string][]byte) // by kind, then name
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("%s: discarding %d bytes of an incomplete write", path, len(line))
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var rec fileRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("corrupt log record: %v", err)
+		}
+		for _, op := range rec.Ops {
+			if data[op.Kind] == nil {
+				data[op.Kind] = make(map[string][]byte)
+			}
+			if op.Data == nil {
+				delete(data[op.Kind], op.Name)
+			} else {
+				data[op.Kind][op.Name] = op.Data
+			}
+		}
+	}
+
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	db, err := bolt.Open(tmp, 0600, nil)
+	if err != nil {
+		return err
+	}
+	n := 0
+	err = db.Update(func(tx *bolt.Tx) error {
+		for kind, m := range data {
+			for name, v := range m {
+				if err := boltPut(tx, kind, name, v); err != nil {
+					return err
+				}
+				n++
+			}
+		}
+		return nil
+	})
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(path, path+".log"); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	log.Printf("%s: converted %d entities from the log, which is kept as %s.log", path, n, path)
+	return nil
+}
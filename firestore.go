@@ -0,0 +1,163 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// Re Firestore
+//
+// A Firestore database is in either Datastore mode, which the datastore storage uses, or native mode, which new
+// projects get by default and which the Datastore API can't reach.  With storage=firestore each kind is a
+// collection in the native-mode database of the project, and each entity a document whose ID is the escaped name
+// and whose data field holds the entity's JSON.  IDs are limited to 1500 bytes, so titles whose escaped history
+// names would be longer are refused.  Renames and locks use Firestore transactions, so any number of servers can
+// share the database.
+
+type firestoreKV struct {
+	client *firestore.Client
+}
+
+func openFirestore() (Store, error) {
+	ctx := context.Background()
+	opts, err := googleOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c, err := firestore.NewClient(ctx, dataProject(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	storedNameLen = func(kind, name string) int { return len(firestoreID(name)) }
+	maxStoredName = maxFirestoreID
+	return kvStore{&firestoreKV{c}}, nil
+}
+
+type firestoreDoc struct {
+	Data []byte `firestore:"data"`
+}
+
+// maxFirestoreID is the longest document ID Firestore accepts.
+const maxFirestoreID = 1500
+
+// firestoreID returns the document ID of the entity named name: the escaped
+// name, with a leading . or _ escaped too, since Firestore forbids the IDs
+// . and .. and those like __x__.  It preserves prefixes as escapeName does.
+func firestoreID(name string) string {
+	if name != "" && (name[0] == '.' || name[0] == '_') {
+		return fmt.Sprintf("~%02x", name[0]) + escapeName(name[1:])
+	}
+	return escapeName(name)
+}
+
+func (s *firestoreKV) doc(kind, name string) *firestore.DocumentRef {
+	return s.client.Collection(kind).Doc(firestoreID(name))
+}
+
+// docData returns the entity stored in a document.
+func docData(doc *firestore.DocumentSnapshot, err error) ([]byte, error) {
+	if grpcstatus.Code(err) == codes.NotFound {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	if err != nil {
+		return nil, err
+	}
+	var d firestoreDoc
+	if err := doc.DataTo(&d); err != nil {
+		return nil, err
+	}
+	return d.Data, nil
+}
+
+func (s *firestoreKV) get(ctx context.Context, kind, name string) ([]byte, error) {
+	return docData(s.doc(kind, name).Get(ctx))
+}
+
+func (s *firestoreKV) put(ctx context.Context, kind, name string, data []byte) error {
+	_, err := s.doc(kind, name).Set(ctx, firestoreDoc{data})
+	return err
+}
+
+func (s *firestoreKV) delete(ctx context.Context, kind, name string) error {
+	_, err := s.doc(kind, name).Delete(ctx)
+	return err
+}
+
+func (s *firestoreKV) scan(ctx context.Context, kind, prefix string, keysOnly bool, fn func(name string, data []byte) error) error {
+	q := s.client.Collection(kind).Query
+	if prefix != "" {
+		p := firestoreID(prefix)
+		q = q.OrderBy(firestore.DocumentID, firestore.Asc).StartAt(p).EndBefore(prefixEnd(p))
+	}
+	if keysOnly {
+		q = q.Select()
+	}
+	it := q.Documents(ctx)
+	defer it.Stop()
+	for {
+		doc, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, err := unescapeName(doc.Ref.ID)
+		if err != nil {
+			return err
+		}
+		var data []byte
+		if !keysOnly {
+			if data, err = docData(doc, nil); err != nil {
+				return err
+			}
+		}
+		if err := fn(name, data); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *firestoreKV) update(ctx context.Context, f func(kv) error) error {
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		return f(&firestoreTx{s, tx})
+	})
+}
+
+func (s *firestoreKV) close() error {
+	return s.client.Close()
+}
+
+// firestoreTx is the kv within a transaction. As Firestore requires, all
+// its gets must come before its puts and deletes.
+type firestoreTx struct {
+	*firestoreKV
+	tx *firestore.Transaction
+}
+
+func (t *firestoreTx) get(ctx context.Context, kind, name string) ([]byte, error) {
+	return docData(t.tx.Get(t.doc(kind, name)))
+}
+
+func (t *firestoreTx) put(ctx context.Context, kind, name string, data []byte) error {
+	return t.tx.Set(t.doc(kind, name), firestoreDoc{data})
+}
+
+func (t *firestoreTx) delete(ctx context.Context, kind, name string) error {
+	return t.tx.Delete(t.doc(kind, name))
+}
+
+func (t *firestoreTx) scan(ctx context.Context, kind, prefix string, keysOnly bool, fn func(name string, data []byte) error) error {
+	return errors.New("firestore: scan in a transaction")
+}
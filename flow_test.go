@@ -0,0 +1,150 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// flowStep is one request of a TiddlyWeb session.
+type flowStep struct {
+	name   string
+	method string
+	path   string
+	body   string
+	header http.Header
+	anon   bool   // send no user
+	setup  func() // run before the request
+}
+
+// goldenHeaders are the response headers recorded in golden files; the
+// rest (dates, request IDs, lengths) vary from run to run.
+var goldenHeaders = []string{"Content-Type", "Etag", "Allow"}
+
+// TestTiddlyWebFlow runs the requests the TiddlyWeb adaptor makes through
+// the whole server, checking each response against testdata/flow.
+func TestTiddlyWebFlow(t *testing.T) {
+	useTestStore(t)
+	srv := httptest.NewServer(newServer("", newHandler()).Handler)
+	defer srv.Close()
+
+	const home = `{"title": "Home", "text": "Welcome", "tags": "[[Getting started]]", "type": "text/vnd.tiddlywiki", "modified": "20200601120000000", "fields": {"color": "blue"}}`
+	edit := func(text, rev string) string {
+		return fmt.Sprintf(`{"title": "Home", "text": %q, "revision": %s, "modified": "20200602120000000"}`, text, rev)
+	}
+	steps := []flowStep{
+		{name: "status", method: "GET", path: "/status"},
+		{name: "list-empty", method: "GET", path: "/recipes/all/tiddlers.json"},
+		{name: "get-missing", method: "GET", path: "/recipes/all/tiddlers/Home"},
+		{name: "put", method: "PUT", path: "/recipes/all/tiddlers/Home", body: home},
+		{name: "list", method: "GET", path: "/recipes/all/tiddlers.json"},
+		{name: "get", method: "GET", path: "/recipes/all/tiddlers/Home"},
+		{name: "put-edit", method: "PUT", path: "/recipes/all/tiddlers/Home", body: edit("Welcome back", "1")},
+		{name: "put-stale-if-match", method: "PUT", path: "/recipes/all/tiddlers/Home", body: edit("Lost?", "1"),
+			header: http.Header{"If-Match": {`"bag/Home/1:anything"`}}},
+		{name: "put-stale-revision", method: "PUT", path: "/recipes/all/tiddlers/Home", body: edit("Elsewhere", "1"),
+			setup: func() { cfg.ConflictCopies = true }},
+		{name: "list-with-conflict", method: "GET", path: "/recipes/all/tiddlers.json"},
+		{name: "delete", method: "DELETE", path: "/bags/bag/tiddlers/Home"},
+		{name: "get-deleted", method: "GET", path: "/recipes/all/tiddlers/Home"},
+		{name: "unauthenticated", method: "GET", path: "/recipes/all/tiddlers.json", anon: true},
+		{name: "bad-method", method: "TRACE", path: "/recipes/all/tiddlers/Home", body: "{}"},
+	}
+	for i, step := range steps {
+		if step.setup != nil {
+			step.setup()
+		}
+		req, err := http.NewRequest(step.method, srv.URL+step.path, strings.NewReader(step.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !step.anon {
+			req.Header.Set(cfg.AuthHeader, "tester")
+		}
+		req.Header.Set("X-Requested-With", "TiddlyWiki")
+		for k, v := range step.header {
+			req.Header[k] = v
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := goldenResponse(step, res, body)
+		file := filepath.Join("testdata", "flow", fmt.Sprintf("%02d-%s.golden", i+1, step.name))
+		if *update {
+			if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(file, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("%v (run go test -run TestTiddlyWebFlow -update to create it)", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s %s (%s): got\n%s\nwant\n%s", step.method, step.path, file, got, want)
+		}
+	}
+}
+
+// goldenResponse renders a response as it is recorded in a golden file:
+// the request, the status, the stable headers, and the body, with JSON
+// indented and request IDs blanked.
+func goldenResponse(step flowStep, res *http.Response, body []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s\n", step.method, step.path)
+	if step.body != "" {
+		fmt.Fprintf(&b, "%s\n", step.body)
+	}
+	fmt.Fprintf(&b, "\n%d %s\n", res.StatusCode, http.StatusText(res.StatusCode))
+	var names []string
+	for _, name := range goldenHeaders {
+		if res.Header.Get(name) != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s: %s\n", name, res.Header.Get(name))
+	}
+	b.WriteString("\n")
+
+	var v interface{}
+	if json.Unmarshal(body, &v) == nil {
+		if m, ok := v.(map[string]interface{}); ok {
+			if _, ok := m["request_id"]; ok {
+				m["request_id"] = "ID"
+			}
+		}
+		data, _ := json.MarshalIndent(v, "", "  ")
+		b.Write(data)
+		b.WriteString("\n")
+	} else {
+		b.Write(body)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/oauth2"
+	iamcredentials "google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+)
+
+// Re Google Cloud credentials
+//
+// By default every Google Cloud client (Datastore, Firestore, Cloud Storage for publishing, Cloud Trace, Error
+// Reporting) finds its credentials the usual way, GOOGLE_APPLICATION_CREDENTIALS or else the metadata server, and
+// works in project.  A host running many
+// wikis from one environment can instead give each its own: credentials-file names a service account key to use
+// rather than the ambient credentials, and impersonate names a service account to act as, its tokens minted by the
+// IAM Credentials API with whichever credentials are in use (which need roles/iam.serviceAccountTokenCreator on it).
+// With GKE Workload Identity the ambient credentials are already the pod's service account, so impersonate is the
+// way to reach a wiki's own one from there.  data-project names the project holding the wiki's data, if not
+// project, so that each wiki's data can live in its tenant's project while traces and error reports all go to the
+// host's.
+
+// googleOptions returns the options for Google Cloud clients that
+// credentials-file and impersonate call for.
+func googleOptions(ctx context.Context) ([]option.ClientOption, error) {
+	var opts []option.ClientOption
+	if cfg.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(cfg.CredentialsFile))
+	}
+	if cfg.Impersonate == "" {
+		return opts, nil
+	}
+	svc, err := iamcredentials.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("impersonating %s: %v", cfg.Impersonate, err)
+	}
+	ts := oauth2.ReuseTokenSource(nil, impersonatedTokens{svc, cfg.Impersonate})
+	return []option.ClientOption{option.WithTokenSource(ts)}, nil
+}
+
+// dataProject returns the project holding the wiki's data.
+func dataProject() string {
+	if cfg.DataProject != "" {
+		return cfg.DataProject
+	}
+	return cfg.Project
+}
+
+// impersonatedTokens mints access tokens for a service account.
+type impersonatedTokens struct {
+	svc   *iamcredentials.Service
+	email string
+}
+
+func (s impersonatedTokens) Token() (*oauth2.Token, error) {
+	res, err := s.svc.Projects.ServiceAccounts.GenerateAccessToken("projects/-/serviceAccounts/"+s.email,
+		&iamcredentials.GenerateAccessTokenRequest{
+			Scope:    []string{iamcredentials.CloudPlatformScope},
+			Lifetime: "3600s",
+		}).Do()
+	if err != nil {
+		return nil, fmt.Errorf("impersonating %s: %v", s.email, err)
+	}
+	expiry, err := time.Parse(time.RFC3339, res.ExpireTime)
+	if err != nil {
+		return nil, fmt.Errorf("impersonating %s: bad expiry %q", s.email, res.ExpireTime)
+	}
+	return &oauth2.Token{AccessToken: res.AccessToken, TokenType: "Bearer", Expiry: expiry}, nil
+}
@@ -0,0 +1,281 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Re Guest sandbox
+//
+// With guest-sandbox on, a visitor who isn't signed in (whose request the proxy lets through without auth-header)
+// gets a scratch wiki of their own rather than a 403, so that tiddly can be shown off in public without showing or
+// risking the real wiki.  The sandbox is kept in memory, found again by a cookie, and forgotten guest-ttl after it
+// was last used.  It starts empty, under the plain core page (without the real wiki's shell settings such as its
+// title).  Guests are only served what the browser syncs with: /, /status, the tiddler list, and getting, saving and
+// deleting tiddlers; everything else answers 403 as before.  None of it touches the store or the server's caches, so
+// nothing a guest does reaches the real wiki or anyone else's sandbox.  To bound memory, a sandbox holds at most
+// guestSandboxBytes of tiddlers, and there are at most guestSandboxes, the one least recently used being dropped to
+// make room for a new one.  Only loading the page or saving starts a sandbox, so that clients that ignore the cookie
+// don't crowd out the rest.  Guests' saves are rate limited by IP, like any anonymous change (see Re Rate limiting).
+
+const (
+	guestCookie       = "tiddly_guest"
+	guestSandboxes    = 1000
+	guestSandboxBytes = 4 << 20
+)
+
+type sandbox struct {
+	mu       sync.Mutex
+	tiddlers map[string]Tiddler
+	bytes    int64
+	used     time.Time
+}
+
+var guests = struct {
+	sync.Mutex
+	m map[string]*sandbox
+}{m: make(map[string]*sandbox)}
+
+// guestOr serves requests without a user from their sandbox, if
+// guest-sandbox is on, and passes the rest to next.
+func guestOr(next http.Handler) http.Handler {
+	if !cfg.GuestSandbox {
+		return next
+	}
+	guest := rateLimit(guestHandler())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentUser(r) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		guest.ServeHTTP(w, r)
+	})
+}
+
+type sandboxHandler func(w http.ResponseWriter, r *http.Request, sb *sandbox)
+
+func guestHandler() http.Handler {
+	m := http.NewServeMux()
+	handle := func(pattern string, h sandboxHandler) {
+		m.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			h(w, r, sandboxFor(w, r, r.URL.Path == "/" || r.Method == "PUT"))
+		})
+	}
+	handle("/", guestRoot)
+	m.HandleFunc("/status", guestStatus)
+	for _, recipe := range recipes() {
+		handle("/recipes/"+recipe+"/tiddlers/", guestTiddler)
+		handle("/recipes/"+recipe+"/tiddlers.json", guestList)
+	}
+	handle("/bags/bag/tiddlers/", guestDelete)
+	return m
+}
+
+// sandboxFor returns r's sandbox. If it has none, or its own has expired, it
+// starts one (and sets its cookie) if create is set, or else returns an
+// empty one that isn't kept, so that clients that don't keep cookies, such
+// as crawlers, don't crowd out the rest.
+func sandboxFor(w http.ResponseWriter, r *http.Request, create bool) *sandbox {
+	now := time.Now()
+	guests.Lock()
+	defer guests.Unlock()
+	for token, sb := range guests.m {
+		if now.Sub(sb.used) > cfg.GuestTTL {
+			delete(guests.m, token)
+		}
+	}
+	if c, err := r.Cookie(guestCookie); err == nil {
+		if sb := guests.m[c.Value]; sb != nil {
+			sb.used = now
+			return sb
+		}
+	}
+	if !create {
+		return &sandbox{tiddlers: make(map[string]Tiddler), used: now}
+	}
+	if len(guests.m) >= guestSandboxes {
+		var oldest string
+		for token, sb := range guests.m {
+			if oldest == "" || sb.used.Before(guests.m[oldest].used) {
+				oldest = token
+			}
+		}
+		delete(guests.m, oldest)
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	sb := &sandbox{tiddlers: make(map[string]Tiddler), used: now}
+	guests.m[token] = sb
+	http.SetCookie(w, &http.Cookie{
+		Name:     guestCookie,
+		Value:    token,
+		Path:     cfg.BasePath + "/",
+		MaxAge:   int(cfg.GuestTTL / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return sb
+}
+
+func guestRoot(w http.ResponseWriter, r *http.Request, sb *sandbox) {
+	if r.URL.Path != "/" {
+		http.Error(w, "permission denied", 403)
+		return
+	}
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	servePage(w, r, "index.html", indexPage)
+}
+
+func guestStatus(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"username":  "GUEST",
+		"anonymous": true,
+		"space":     map[string]string{"recipe": cfg.Recipe},
+		"recipes":   recipes(),
+		"read_only": false,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, data)
+}
+
+// guestList sends the whole sandbox, text and all: it is small.
+func guestList(w http.ResponseWriter, r *http.Request, sb *sandbox) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	sb.mu.Lock()
+	titles := make([]string, 0, len(sb.tiddlers))
+	for title := range sb.tiddlers {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+	list := make([]json.RawMessage, 0, len(titles))
+	for _, title := range titles {
+		t := sb.tiddlers[title]
+		if data, err := tiddlerJSON(&t); err == nil {
+			list = append(list, data)
+		}
+	}
+	sb.mu.Unlock()
+	data, err := json.Marshal(list)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, data)
+}
+
+func guestTiddler(w http.ResponseWriter, r *http.Request, sb *sandbox) {
+	if !checkMethod(w, r, "GET", "PUT") {
+		return
+	}
+	title := tiddlerTitle(r.URL.EscapedPath())
+	if r.Method == "PUT" {
+		guestPut(w, r, sb, title)
+		return
+	}
+	sb.mu.Lock()
+	t, ok := sb.tiddlers[title]
+	sb.mu.Unlock()
+	if !ok {
+		http.Error(w, "no such tiddler", 404)
+		return
+	}
+	data, err := tiddlerJSON(&t)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Etag", tiddlerETag(title, &t))
+	writeJSON(w, data)
+}
+
+func guestPut(w http.ResponseWriter, r *http.Request, sb *sandbox, title string) {
+	if err := checkTitle(title); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if !checkJSONBody(w, r) {
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, cfg.MaxTiddlerBytes))
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			http.Error(w, fmt.Sprintf("tiddler too large: limit is %d bytes", tooBig.Limit), 413)
+			return
+		}
+		http.Error(w, "cannot read data", 400)
+		return
+	}
+	var js map[string]interface{}
+	if err := json.Unmarshal(data, &js); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	old := sb.tiddlers[title]
+	if !ifMatch(r, title, old.Rev) {
+		http.Error(w, fmt.Sprintf("%s has changed: revision %d is current", title, old.Rev), 412)
+		return
+	}
+	t, err := newRevision(r.Context(), js, old.Rev+1)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	size := sb.bytes - revisionBytes(&old) + revisionBytes(&t)
+	if size > guestSandboxBytes {
+		http.Error(w, fmt.Sprintf("the guest sandbox is full: it holds at most %d bytes", guestSandboxBytes), 413)
+		return
+	}
+	sb.tiddlers[title] = t
+	sb.bytes = size
+	w.Header().Set("Etag", tiddlerETag(title, &t))
+}
+
+func guestDelete(w http.ResponseWriter, r *http.Request, sb *sandbox) {
+	if !checkMethod(w, r, "DELETE") {
+		return
+	}
+	title := pathTitle(r, "/bags/bag/tiddlers/")
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	t, ok := sb.tiddlers[title]
+	if !ok {
+		http.Error(w, "no such tiddler", 404)
+		return
+	}
+	if !ifMatch(r, title, t.Rev) {
+		http.Error(w, fmt.Sprintf("%s has changed: revision %d is current", title, t.Rev), 412)
+		return
+	}
+	delete(sb.tiddlers, title)
+	sb.bytes -= revisionBytes(&t)
+	w.WriteHeader(http.StatusNoContent)
+}
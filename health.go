@@ -0,0 +1,71 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// livez reports that the process is up and serving. /health is kept as an
+// alias for existing proxy configurations.
+func livez(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz reports whether this instance can actually reach its storage, so the
+// proxy can stop routing to it when credentials or the network break. The
+// result is cached briefly so frequent probes don't each cost a read.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	if err := readiness.check(r.Context()); err != nil {
+		// The error can name buckets, hosts or DSNs, which aren't for
+		// whoever is probing.
+		logf(r.Context(), "not ready: %v", err)
+		http.Error(w, "not ready", 503)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+var readiness readyCache
+
+type readyCache struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func (c *readyCache) check(ctx context.Context) error {
+	if err := storageStarting(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < cfg.ReadyCacheTTL {
+		return c.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	c.err = pingStore(ctx)
+	c.checked = time.Now()
+	return c.err
+}
+
+// pingStore does the cheapest authenticated round trip available: a
+// lookup of a key that never exists.
+func pingStore(ctx context.Context) error {
+	key := datastore.NameKey("Tiddler", "$:/server/readyz", nil)
+	var t Tiddler
+	err := db.Get(ctx, key, &t)
+	if err == datastore.ErrNoSuchEntity {
+		err = nil
+	}
+	return err
+}
@@ -0,0 +1,160 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+)
+
+// Re Inbound email
+//
+// Notes can be mailed to the wiki through a mail service's inbound webhook: SendGrid's Inbound Parse and Mailgun's
+// inbound routes both post each message they receive as a form, and POST /inbound-email/{secret} turns it into a
+// tiddler titled by the subject, holding the plain text (or the HTML, if that's all there is) and tagged
+// inbound-email-tag ("inbox"), with the sender in its email-from field and as its creator.  A title already taken
+// gets the time appended.  Attachments are dropped.
+//
+// The mail service can't sign in through the proxy, so the endpoint is mounted outside the authentication check and
+// is only there when INBOUND_EMAIL_SECRET is set; the secret in the path is the password.  (Like the backends'
+// secrets it comes from the environment so that -print-config doesn't show it, and traces, logs and error reports
+// give the route as /inbound-email/{secret} so that they don't either.)  With MAILGUN_SIGNING_KEY set,
+// Mailgun's signature on each post is checked too.  inbound-email-from limits which senders are accepted; anything
+// else is answered 200 and dropped, so that the service doesn't retry it.  Saves belong to nobody (see Re Quotas).
+
+// inboundEmailMaxAge is how old a Mailgun signature may be.
+const inboundEmailMaxAge = 15 * time.Minute
+
+func inboundEmail(w http.ResponseWriter, r *http.Request) {
+	secret := os.Getenv("INBOUND_EMAIL_SECRET")
+	given := strings.TrimPrefix(r.URL.Path, "/inbound-email/")
+	if secret == "" || subtle.ConstantTimeCompare([]byte(given), []byte(secret)) != 1 {
+		http.Error(w, "not found", 404)
+		return
+	}
+	if !checkMethod(w, r, "POST") {
+		return
+	}
+	if st := currentReadOnly(); st.ReadOnly {
+		// The mail service tries again later.
+		http.Error(w, "read-only", http.StatusServiceUnavailable)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBatchBytes)
+	if err := r.ParseMultipartForm(cfg.MaxTiddlerBytes); err != nil && err != http.ErrNotMultipart {
+		http.Error(w, "cannot read form: "+err.Error(), 400)
+		return
+	}
+	ctx := r.Context()
+	if key := os.Getenv("MAILGUN_SIGNING_KEY"); key != "" && !mailgunSigned(r, key) {
+		logf(ctx, "inbound email: bad Mailgun signature")
+		http.Error(w, "bad signature", 403)
+		return
+	}
+
+	from := firstValue(r, "from", "sender")
+	if !inboundSenderAllowed(from) {
+		logf(ctx, "inbound email: dropped message from %q", from)
+		return
+	}
+	title, err := saveEmail(ctx, from, r.FormValue("subject"), firstValue(r, "text", "body-plain"), firstValue(r, "html", "body-html"))
+	if err != nil {
+		logf(ctx, "inbound email from %q: %v", from, err)
+		storeError(w, err)
+		return
+	}
+	logf(ctx, "inbound email from %q saved as %q", from, loggedTitle(title))
+}
+
+// firstValue returns the first of the form fields names that r has.
+func firstValue(r *http.Request, names ...string) string {
+	for _, name := range names {
+		if v := r.FormValue(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// mailgunSigned reports whether r carries a recent Mailgun webhook
+// signature made with key.
+func mailgunSigned(r *http.Request, key string) bool {
+	ts := r.FormValue("timestamp")
+	var sec int64
+	if _, err := fmt.Sscan(ts, &sec); err != nil {
+		return false
+	}
+	if d := time.Since(time.Unix(sec, 0)); d > inboundEmailMaxAge || d < -inboundEmailMaxAge {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(ts + r.FormValue("token")))
+	return hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(r.FormValue("signature")))
+}
+
+// inboundSenderAllowed reports whether mail from the From header from is
+// accepted.
+func inboundSenderAllowed(from string) bool {
+	if strings.TrimSpace(cfg.InboundEmailFrom) == "" {
+		return true
+	}
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return false
+	}
+	for _, a := range strings.Split(cfg.InboundEmailFrom, ",") {
+		if strings.EqualFold(strings.TrimSpace(a), addr.Address) {
+			return true
+		}
+	}
+	return false
+}
+
+// saveEmail saves a message as a new tiddler and returns its title.
+func saveEmail(ctx context.Context, from, subject, text, html string) (string, error) {
+	now := time.Now().UTC()
+	title := subject
+	if strings.TrimSpace(title) == "" {
+		title = "Email from " + from
+	}
+	title, err := untakenTitle(ctx, title, now)
+	if err != nil {
+		return "", err
+	}
+
+	typ := "text/plain"
+	if strings.TrimSpace(text) == "" && html != "" {
+		typ, text = "text/html", html
+	}
+	stamp := tiddlyDate(now)
+	var tags []interface{}
+	if cfg.InboundEmailTag != "" {
+		tags = append(tags, cfg.InboundEmailTag)
+	}
+	js := map[string]interface{}{
+		"title":    title,
+		"text":     text,
+		"type":     typ,
+		"tags":     tags,
+		"created":  stamp,
+		"modified": stamp,
+		"creator":  from,
+		"modifier": from,
+		"fields":   map[string]interface{}{"email-from": from},
+	}
+	if _, err := saveTiddler(ctx, title, js); err != nil {
+		return "", err
+	}
+	return title, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Re Journal
+//
+// POST /journal makes today's journal tiddler if there isn't one yet, and answers with its title either way:
+//     {"title": "2026-10-16", "created": true}
+// with 201 if it made it and 200 if it was there already, so that a bot appending the day's standup notes needn't
+// care whether anyone has written in the journal yet.  The title is journal-title, expanded as a template's title is
+// (see Re Templates), so %date% by default, and the tiddler is made from the template tiddler journal-template, or
+// failing that is a blank tiddler tagged Journal.  The day is journal-timezone's (UTC unless set).  With
+// journal-daily, the server also makes each day's journal itself, just after midnight; several servers sharing a
+// wiki may each try, and all but the first find it there, since the check is made in the transaction that saves.
+// While the server is read-only (see Re Read-only mode) it doesn't try, and makes the journal once it is writable
+// again.
+
+type journalResult struct {
+	Title   string `json:"title"`
+	Created bool   `json:"created"`
+}
+
+func journalHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "POST") || !sameOrigin(w, r) {
+		return
+	}
+	ctx := r.Context()
+	res, err := ensureJournal(ctx, time.Now(), currentUser(r))
+	if err == errNoTemplate {
+		http.Error(w, "no such journal-template "+cfg.JournalTemplate, 500)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", jsonType)
+	if res.Created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.Write(data)
+}
+
+// ensureJournal makes the journal tiddler for the day of now, as user, if
+// it isn't there.
+func ensureJournal(ctx context.Context, now time.Time, user string) (*journalResult, error) {
+	loc, _ := time.LoadLocation(cfg.JournalTimezone) // checked by validate
+	now = now.In(loc)
+	js := map[string]interface{}{"tags": "Journal", "text": ""}
+	if cfg.JournalTemplate != "" {
+		var err error
+		if js, err = templateTiddler(ctx, cfg.JournalTemplate); err != nil {
+			return nil, err
+		}
+	}
+	title, err := fillTemplate(js, cfg.JournalTitle, nil, now, user)
+	if err != nil {
+		return nil, err
+	}
+	_, err = createTiddler(ctx, title, js)
+	if err == errTitleLive {
+		return &journalResult{Title: title}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	logf(ctx, "%s made journal %q", user, loggedTitle(title))
+	return &journalResult{Title: title, Created: true}, nil
+}
+
+// startJournals makes each day's journal tiddler, with journal-daily, until
+// the process exits.
+func startJournals() {
+	if !cfg.JournalDaily {
+		return
+	}
+	go func() {
+		for {
+			if currentReadOnly().ReadOnly {
+				time.Sleep(time.Minute)
+				continue
+			}
+			err := recovered("journal", func() error {
+				_, err := ensureJournal(context.Background(), time.Now(), "")
+				return err
+			})
+			wait := untilTomorrow(time.Now())
+			if err != nil {
+				log.Printf("journal: %v", err)
+				wait = time.Minute
+			}
+			time.Sleep(wait)
+		}
+	}()
+}
+
+// untilTomorrow returns how long from now until just after the next
+// midnight in journal-timezone.
+func untilTomorrow(now time.Time) time.Duration {
+	loc, _ := time.LoadLocation(cfg.JournalTimezone)
+	now = now.In(loc)
+	y, m, d := now.Date()
+	return time.Date(y, m, d+1, 0, 0, 1, 0, loc).Sub(now)
+}
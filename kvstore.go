@@ -0,0 +1,296 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+)
+
+// kv is the storage a kvStore is built on: byte strings named by kind and
+// name. get returns datastore.ErrNoSuchEntity for a missing value.
+type kv interface {
+	get(ctx context.Context, kind, name string) ([]byte, error)
+	put(ctx context.Context, kind, name string, data []byte) error
+	delete(ctx context.Context, kind, name string) error
+	// scan calls fn for each value of kind whose name starts with prefix,
+	// with nil data if keysOnly.
+	scan(ctx context.Context, kind, prefix string, keysOnly bool, fn func(name string, data []byte) error) error
+	// update calls f with a kv whose changes are committed together, or
+	// not at all if it fails, and isolated from other updates.
+	update(ctx context.Context, f func(kv) error) error
+	close() error
+}
+
+// escapeName maps a name to a string of the characters S3 and Signature
+// Version 4 leave alone, preserving prefixes: letters, digits, - _ and .
+// stand for themselves and any other byte b is ~xx in hex.
+func escapeName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "~%02x", c)
+		}
+	}
+	return b.String()
+}
+
+func unescapeName(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '~' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("bad object name %q", s)
+		}
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("bad object name %q", s)
+		}
+		b.WriteByte(c[0])
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// storedNameLen, if set by the storage in use, returns the length of the
+// name it gives the entity of kind named name, and maxStoredName is the
+// longest it can hold; checkTitle refuses titles that wouldn't fit.
+var (
+	storedNameLen func(kind, name string) int
+	maxStoredName int
+)
+
+// kvStore is a Store keeping entities as JSON in a kv.
+type kvStore struct {
+	kv kv
+}
+
+func (s kvStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	return kvGet(ctx, s.kv, key, dst)
+}
+
+func kvGet(ctx context.Context, kv kv, key *datastore.Key, dst interface{}) error {
+	data, err := kv.get(ctx, key.Kind, key.Name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+func kvPut(ctx context.Context, kv kv, key *datastore.Key, src interface{}) error {
+	data, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return kv.put(ctx, key.Kind, key.Name, data)
+}
+
+// elem returns a pointer to the ith element of the slice v, which may hold
+// structs, pointers to them, or interfaces holding pointers, as Datastore
+// allows.
+func elem(v reflect.Value, i int) interface{} {
+	e := v.Index(i)
+	switch e.Kind() {
+	case reflect.Ptr:
+		if e.IsNil() {
+			e.Set(reflect.New(e.Type().Elem()))
+		}
+		return e.Interface()
+	case reflect.Interface:
+		return e.Interface()
+	}
+	return e.Addr().Interface()
+}
+
+func (s kvStore) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	errs := make(datastore.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		errs[i] = s.Get(ctx, key, elem(v, i))
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+func (s kvStore) Put(ctx context.Context, key *datastore.Key, src interface{}) error {
+	return kvPut(ctx, s.kv, key, src)
+}
+
+func (s kvStore) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) error {
+	v := reflect.ValueOf(src)
+	for i, key := range keys {
+		if err := s.Put(ctx, key, elem(v, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s kvStore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	for _, key := range keys {
+		if err := s.kv.delete(ctx, key.Kind, key.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s kvStore) Scan(ctx context.Context, kind, prefix string, dst interface{}, fn func(name string) error) error {
+	v := reflect.ValueOf(dst).Elem()
+	return s.kv.scan(ctx, kind, prefix, false, func(name string, data []byte) error {
+		v.Set(reflect.Zero(v.Type()))
+		if err := json.Unmarshal(data, dst); err != nil {
+			return err
+		}
+		return fn(name)
+	})
+}
+
+func (s kvStore) Names(ctx context.Context, kind, prefix string) ([]string, error) {
+	var names []string
+	err := s.kv.scan(ctx, kind, prefix, true, func(name string, _ []byte) error {
+		names = append(names, name)
+		return nil
+	})
+	return names, err
+}
+
+// LinksTo has no index to use, so it reads every TiddlerLinks entity.
+func (s kvStore) LinksTo(ctx context.Context, title string) ([]string, error) {
+	var names []string
+	var l tiddlerLinks
+	err := s.Scan(ctx, "TiddlerLinks", "", &l, func(name string) error {
+		for _, target := range l.Links {
+			if target == title {
+				names = append(names, name)
+				break
+			}
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (s kvStore) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	return s.kv.update(ctx, func(kv kv) error {
+		return f(kvTx{ctx, kv})
+	})
+}
+
+func (s kvStore) Close() error {
+	return s.kv.close()
+}
+
+type kvTx struct {
+	ctx context.Context
+	kv  kv
+}
+
+func (tx kvTx) Get(key *datastore.Key, dst interface{}) error {
+	return kvGet(tx.ctx, tx.kv, key, dst)
+}
+
+func (tx kvTx) Put(key *datastore.Key, src interface{}) error {
+	return kvPut(tx.ctx, tx.kv, key, src)
+}
+
+func (tx kvTx) PutMulti(keys []*datastore.Key, src interface{}) error {
+	v := reflect.ValueOf(src)
+	for i, key := range keys {
+		if err := tx.Put(key, elem(v, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx kvTx) Delete(key *datastore.Key) error {
+	return tx.kv.delete(tx.ctx, key.Kind, key.Name)
+}
+
+// lockedUpdate is an update for a kv with no transactions of its own, used
+// by a single server. Updates exclude one another, and a failed one undoes
+// the puts and deletes it made before failing, as far as it can.
+type lockedUpdate struct {
+	mu sync.Mutex
+}
+
+func (l *lockedUpdate) update(ctx context.Context, store kv, f func(kv) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u := &undoKV{kv: store}
+	err := f(u)
+	if err != nil {
+		u.undo(ctx)
+	}
+	return err
+}
+
+// undoKV records the previous values of what is written through it.
+type undoKV struct {
+	kv
+	saved []savedValue
+}
+
+type savedValue struct {
+	kind, name string
+	data       []byte // nil if there was none
+}
+
+func (u *undoKV) save(ctx context.Context, kind, name string) error {
+	old, err := u.kv.get(ctx, kind, name)
+	if err == datastore.ErrNoSuchEntity {
+		old, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	u.saved = append(u.saved, savedValue{kind, name, old})
+	return nil
+}
+
+func (u *undoKV) put(ctx context.Context, kind, name string, data []byte) error {
+	if err := u.save(ctx, kind, name); err != nil {
+		return err
+	}
+	return u.kv.put(ctx, kind, name, data)
+}
+
+func (u *undoKV) delete(ctx context.Context, kind, name string) error {
+	if err := u.save(ctx, kind, name); err != nil {
+		return err
+	}
+	return u.kv.delete(ctx, kind, name)
+}
+
+func (u *undoKV) undo(ctx context.Context) {
+	for i := len(u.saved) - 1; i >= 0; i-- {
+		v := u.saved[i]
+		if v.data == nil {
+			u.kv.delete(ctx, v.kind, v.name)
+		} else {
+			u.kv.put(ctx, v.kind, v.name, v.data)
+		}
+	}
+}
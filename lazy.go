@@ -0,0 +1,222 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// Re Lazy start
+//
+// On Cloud Run an instance often starts cold while the metadata server, which hands out its credentials and
+// project, isn't answering yet, and the Datastore client then fails to open.  Rather than exit and be restarted
+// in a loop, serve opens the store in the background, retrying with backoff, and listens at once.  Until the store
+// is open /readyz answers 503 with the last error, and requests that need the store wait lazyWait for it before
+// answering 503 with Retry-After, which the sync adaptor retries.  Once it is open, the startup checks run as before
+// (see Re Doctor and Re Data migrations): an error that won't clear by itself still stops the server, and /readyz
+// stays 503 until migrations are applied (requests are served meanwhile, which migrations allow for).  The commands
+// other than serve open the store directly and fail at once.
+
+// lazyWait is how long a call waits for the store to open.
+const lazyWait = 5 * time.Second
+
+// lazyStore is a Store that opens in the background.
+type lazyStore struct {
+	opened chan struct{} // closed once s is set
+	stop   chan struct{}
+
+	mu  sync.Mutex
+	s   Store
+	err error // the last error opening it
+}
+
+func newLazyStore(open func() (Store, error)) *lazyStore {
+	l := &lazyStore{opened: make(chan struct{}), stop: make(chan struct{})}
+	go l.open(open)
+	return l
+}
+
+func (l *lazyStore) open(open func() (Store, error)) {
+	delay := time.Second
+	for {
+		s, err := open()
+		l.mu.Lock()
+		l.s, l.err = s, err
+		l.mu.Unlock()
+		if err == nil {
+			close(l.opened)
+			return
+		}
+		log.Printf("Opening storage: %v (retrying in %v)", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-l.stop:
+			return
+		}
+		if delay *= 2; delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+	}
+}
+
+// wait returns nil once the store is open, or else an error once ctx is done
+// or lazyWait has passed.
+func (l *lazyStore) wait(ctx context.Context) error {
+	select {
+	case <-l.opened:
+		return nil
+	default:
+	}
+	t := time.NewTimer(lazyWait)
+	defer t.Stop()
+	select {
+	case <-l.opened:
+		return nil
+	case <-ctx.Done():
+	case <-t.C:
+	}
+	return l.notOpen()
+}
+
+// notOpen returns the error for a call made before the store is open: one
+// isTransient reports, so that it is retried and answered with a 503.
+func (l *lazyStore) notOpen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err == nil {
+		return grpcstatus.Error(codes.Unavailable, "storage isn't open yet")
+	}
+	return grpcstatus.Error(codes.Unavailable, fmt.Sprintf("storage isn't open yet: %v", l.err))
+}
+
+// isOpen returns nil if the store is open, or else why not.
+func (l *lazyStore) isOpen() error {
+	select {
+	case <-l.opened:
+		return nil
+	default:
+		return l.notOpen()
+	}
+}
+
+func (l *lazyStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if err := l.wait(ctx); err != nil {
+		return err
+	}
+	return l.s.Get(ctx, key, dst)
+}
+
+func (l *lazyStore) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	if err := l.wait(ctx); err != nil {
+		return err
+	}
+	return l.s.GetMulti(ctx, keys, dst)
+}
+
+func (l *lazyStore) Put(ctx context.Context, key *datastore.Key, src interface{}) error {
+	if err := l.wait(ctx); err != nil {
+		return err
+	}
+	return l.s.Put(ctx, key, src)
+}
+
+func (l *lazyStore) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) error {
+	if err := l.wait(ctx); err != nil {
+		return err
+	}
+	return l.s.PutMulti(ctx, keys, src)
+}
+
+func (l *lazyStore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	if err := l.wait(ctx); err != nil {
+		return err
+	}
+	return l.s.DeleteMulti(ctx, keys)
+}
+
+func (l *lazyStore) Scan(ctx context.Context, kind, prefix string, dst interface{}, fn func(name string) error) error {
+	if err := l.wait(ctx); err != nil {
+		return err
+	}
+	return l.s.Scan(ctx, kind, prefix, dst, fn)
+}
+
+func (l *lazyStore) Names(ctx context.Context, kind, prefix string) ([]string, error) {
+	if err := l.wait(ctx); err != nil {
+		return nil, err
+	}
+	return l.s.Names(ctx, kind, prefix)
+}
+
+func (l *lazyStore) LinksTo(ctx context.Context, title string) ([]string, error) {
+	if err := l.wait(ctx); err != nil {
+		return nil, err
+	}
+	return l.s.LinksTo(ctx, title)
+}
+
+func (l *lazyStore) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	if err := l.wait(ctx); err != nil {
+		return err
+	}
+	return l.s.RunInTransaction(ctx, f)
+}
+
+func (l *lazyStore) Close() error {
+	select {
+	case <-l.opened:
+		return l.s.Close()
+	default:
+		close(l.stop)
+		return nil
+	}
+}
+
+// lazyDB is the store serve opened lazily, or nil.
+var lazyDB *lazyStore
+
+// storageStarted is closed once serve's startup checks have passed.
+var storageStarted = make(chan struct{})
+
+// openStoreLazily opens the store as serve does: in the background, with
+// the startup checks run once it is open.
+func openStoreLazily() {
+	lazyDB = newLazyStore(func() (Store, error) { return openBackend(cfg.Storage) })
+	db = storeLayers(lazyDB)
+	go func() {
+		<-lazyDB.opened
+		if err := checkStorageAtStart(); err != nil {
+			log.Fatal(err)
+		}
+		if err := checkDataMigrations(); err != nil {
+			log.Fatal(err)
+		}
+		close(storageStarted)
+	}()
+}
+
+// storageStarting returns why serve's storage isn't ready yet, or nil.
+func storageStarting() error {
+	if lazyDB == nil {
+		return nil
+	}
+	if err := lazyDB.isOpen(); err != nil {
+		return err
+	}
+	select {
+	case <-storageStarted:
+		return nil
+	default:
+		return fmt.Errorf("storage is open; startup checks are running")
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Re Plugin library
+//
+// TiddlyWiki's control panel installs plugins from libraries: tiddlers tagged $:/tags/PluginLibrary whose url field
+// names a page that the wiki loads in a hidden iframe and talks to with postMessage.  The page fetches
+// recipes/library/tiddlers.json for the list of plugins and recipes/library/tiddlers/<title>.json for one plugin,
+// relative to itself, and posts the results back.
+//
+// Set plugin-dir to a directory of plugin files (TiddlyWiki JSON, a single tiddler or an export array, as produced
+// by "Export tiddler > JSON file") and the server serves them as a library under /library/v1/ and adds it to the
+// wiki's list of libraries.  The files are read once at startup.
+
+const libraryTitle = "$:/config/LocalPluginLibrary"
+
+type pluginLibrary struct {
+	plugins map[string][]byte // title -> tiddler JSON, text included
+	list    []byte            // JSON array of the plugins without their text
+}
+
+var library *pluginLibrary
+
+// loadLibrary reads the plugins in dir.
+func loadLibrary(dir string) (*pluginLibrary, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	lib := &pluginLibrary{plugins: make(map[string][]byte)}
+	var skinny []map[string]interface{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var tiddlers []map[string]interface{}
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+			err = json.Unmarshal(data, &tiddlers)
+		} else {
+			var t map[string]interface{}
+			err = json.Unmarshal(data, &t)
+			tiddlers = append(tiddlers, t)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		for _, t := range tiddlers {
+			title, _ := t["title"].(string)
+			if title == "" || t["plugin-type"] == nil {
+				continue
+			}
+			if _, dup := lib.plugins[title]; dup {
+				return nil, fmt.Errorf("%s: %s is also in another file", file, title)
+			}
+			full, err := json.Marshal(t)
+			if err != nil {
+				return nil, err
+			}
+			lib.plugins[title] = full
+
+			s := make(map[string]interface{})
+			for k, v := range t {
+				if k != "text" {
+					s[k] = v
+				}
+			}
+			skinny = append(skinny, s)
+		}
+	}
+	sort.Slice(skinny, func(i, j int) bool { return skinny[i]["title"].(string) < skinny[j]["title"].(string) })
+	if skinny == nil {
+		skinny = []map[string]interface{}{}
+	}
+	if lib.list, err = json.Marshal(skinny); err != nil {
+		return nil, err
+	}
+	return lib, nil
+}
+
+// initLibrary loads the configured plugin directory, if any, and adds the
+// library to the wiki page.
+func initLibrary(p *page) error {
+	if cfg.PluginDir == "" {
+		return nil
+	}
+	lib, err := loadLibrary(cfg.PluginDir)
+	if err != nil {
+		return err
+	}
+	library = lib
+	log.Printf("Serving %d plugins from %s", len(lib.plugins), cfg.PluginDir)
+	return p.addTiddlerFields(map[string]string{
+		"title":   libraryTitle,
+		"tags":    "$:/tags/PluginLibrary",
+		"url":     cfg.BasePath + "/library/v1/index.html",
+		"caption": "Server plugin library",
+		"text":    "Plugins made available by this server's administrator.",
+	})
+}
+
+func registerLibrary(r *http.ServeMux) {
+	r.HandleFunc("/library/v1/", libraryHandler)
+}
+
+func libraryHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	if library == nil {
+		http.Error(w, "no plugin library configured", 404)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/library/v1/")
+	switch {
+	case path == "index.html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(libraryPage))
+	case path == "recipes/library/tiddlers.json":
+		writeJSON(w, library.list)
+	case strings.HasPrefix(path, "recipes/library/tiddlers/") && strings.HasSuffix(path, ".json"):
+		title := strings.TrimSuffix(strings.TrimPrefix(path, "recipes/library/tiddlers/"), ".json")
+		data, ok := library.plugins[title]
+		if !ok {
+			http.Error(w, "no such plugin", 404)
+			return
+		}
+		writeJSON(w, data)
+	default:
+		http.Error(w, "not found", 404)
+	}
+}
+
+// libraryPage answers the wiki's library requests by fetching the URLs it
+// asks for, which are relative to this page.
+const libraryPage = `<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>Plugin library</title></head>
+<body>
+<script>
+window.addEventListener("message", function(event) {
+	var msg = event.data;
+	if (!msg || msg.verb !== "GET") {
+		return;
+	}
+	var xhr = new XMLHttpRequest();
+	xhr.onload = function() {
+		event.source.postMessage({
+			verb: "GET-RESPONSE",
+			status: String(xhr.status),
+			cookies: msg.cookies,
+			url: msg.url,
+			type: xhr.getResponseHeader("Content-Type"),
+			body: xhr.responseText
+		}, "*");
+	};
+	xhr.open("GET", msg.url);
+	xhr.send();
+}, false);
+</script>
+</body>
+</html>
+`
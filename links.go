@@ -0,0 +1,153 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Links
+//
+// Every save also records the titles the tiddler links to, as a TiddlerLinks entity with the same name whose Links
+// property is indexed.  That makes "what links here" a single query rather than a scan of every tiddler's text,
+// which the browser can't do without loading them all:
+//     GET /links/{title}   {"title": ..., "to": [titles it links to], "from": [titles linking to it]}
+//     GET /graph.json      {"nodes": [titles], "links": [{"source": title, "target": title}, ...]}
+// Links are the [[Title]] and [[label|Title]] kind in the text.  A deleted tiddler keeps an empty TiddlerLinks.
+// Tiddlers saved before this existed have no links recorded until they are next saved.
+
+type tiddlerLinks struct {
+	Links []string
+}
+
+func linksKey(title string) *datastore.Key {
+	return datastore.NameKey("TiddlerLinks", title, nil)
+}
+
+var wikiLinkRE = regexp.MustCompile(`\[\[([^\]]+)\]\]`)
+
+// linksOf returns the entity recording t's outgoing links.
+func linksOf(t *Tiddler) *tiddlerLinks {
+	l := &tiddlerLinks{}
+	if t.Meta == "" {
+		return l
+	}
+	typ := parseFields(t).Type
+	if typ != "" && !strings.HasPrefix(typ, "text/") {
+		return l
+	}
+	seen := make(map[string]bool)
+	for _, m := range wikiLinkRE.FindAllStringSubmatch(t.Text, -1) {
+		target := m[1]
+		if bar := strings.LastIndex(target, "|"); bar >= 0 {
+			target = target[bar+1:]
+		}
+		target = strings.TrimSpace(target)
+		if target == "" || seen[target] || urlRE.MatchString(target) {
+			continue
+		}
+		seen[target] = true
+		l.Links = append(l.Links, target)
+	}
+	sort.Strings(l.Links)
+	return l
+}
+
+type linksResult struct {
+	Title string   `json:"title"`
+	To    []string `json:"to"`
+	From  []string `json:"from"`
+}
+
+func linksHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	ctx := r.Context()
+	title := pathTitle(r, "/links/")
+	res := linksResult{Title: title, To: []string{}, From: []string{}}
+
+	var out tiddlerLinks
+	if err := dbGet(ctx, linksKey(title), &out); err != nil && err != datastore.ErrNoSuchEntity {
+		storeError(w, err)
+		return
+	}
+	if out.Links != nil {
+		res.To = out.Links
+	}
+	err := retry(ctx, func() error {
+		from, err := db.LinksTo(ctx, title)
+		res.From = append(res.From[:0], from...)
+		return err
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	sort.Strings(res.From)
+
+	data, err := json.Marshal(res)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, data)
+}
+
+type graphLink struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+type linkGraph struct {
+	Nodes []string    `json:"nodes"`
+	Links []graphLink `json:"links"`
+}
+
+// graph serves /graph.json, every recorded link in the wiki. The nodes are
+// the tiddlers with links in or out.
+func graph(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	ctx := r.Context()
+	g := linkGraph{Nodes: []string{}, Links: []graphLink{}}
+	err := retry(ctx, func() error {
+		g.Links = g.Links[:0]
+		var l tiddlerLinks
+		return db.Scan(ctx, "TiddlerLinks", "", &l, func(name string) error {
+			for _, target := range l.Links {
+				g.Links = append(g.Links, graphLink{name, target})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	nodes := make(map[string]bool)
+	for _, l := range g.Links {
+		nodes[l.Source] = true
+		nodes[l.Target] = true
+	}
+	for n := range nodes {
+		g.Nodes = append(g.Nodes, n)
+	}
+	sort.Strings(g.Nodes)
+
+	data, err := json.Marshal(g)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, data)
+}
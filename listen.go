@@ -0,0 +1,63 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listen returns the listener to serve on. In order of preference that's a
+// socket passed by systemd socket activation, the configured Unix socket, or
+// the configured TCP port.
+func listen() (net.Listener, error) {
+	if l, err := activationListener(); l != nil || err != nil {
+		return l, err
+	}
+	if cfg.Socket != "" {
+		// A socket left behind by an unclean exit would make Listen fail.
+		if fi, err := os.Stat(cfg.Socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(cfg.Socket)
+		}
+		l, err := net.Listen("unix", cfg.Socket)
+		if err != nil {
+			return nil, err
+		}
+		mode, err := strconv.ParseUint(cfg.SocketMode, 8, 32)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("socket-mode: %v", err)
+		}
+		if err := os.Chmod(cfg.Socket, os.FileMode(mode)); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+	return net.Listen("tcp", ":"+cfg.Port)
+}
+
+// activationListener implements the listening side of sd_listen_fds(3): if
+// LISTEN_PID names this process, the first passed socket is fd 3.
+func activationListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("socket activation: bad LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("socket activation: expected 1 socket, got %d", n)
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	f := os.NewFile(3, "LISTEN_FD_3")
+	defer f.Close()
+	return net.FileListener(f)
+}
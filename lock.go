@@ -0,0 +1,141 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Locks
+//
+// Editing locks are advisory: nothing stops a save of a tiddler someone else holds, but a client can ask first and
+// warn its user.  A lock is a lease that runs out unless renewed, so a closed tab doesn't hold one forever:
+//     POST   /lock/{title}?ttl=2m   take or renew the lock; 409 if someone else holds it
+//     GET    /lock/{title}          who holds it, if anyone
+//     DELETE /lock/{title}          give it up
+// All three answer {"title": ..., "user": ..., "expires": ...}, with no user if the tiddler is unlocked.  Locks are
+// TiddlerLock entities named by title; expired ones are simply ignored and overwritten.
+
+const (
+	defaultLockTTL = 2 * time.Minute
+	maxLockTTL     = 15 * time.Minute
+)
+
+type tiddlerLock struct {
+	User    string    `datastore:"User,noindex"`
+	Expires time.Time `datastore:"Expires,noindex"`
+}
+
+func (l *tiddlerLock) heldBy(user string, now time.Time) bool {
+	return l.User == user && now.Before(l.Expires)
+}
+
+func (l *tiddlerLock) held(now time.Time) bool {
+	return l.User != "" && now.Before(l.Expires)
+}
+
+type lockResult struct {
+	Title   string     `json:"title"`
+	User    string     `json:"user,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func lockHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET", "POST", "DELETE") {
+		return
+	}
+	if r.Method != "GET" && !sameOrigin(w, r) {
+		return
+	}
+	ctx := r.Context()
+	title := pathTitle(r, "/lock/")
+	if title == "" {
+		http.Error(w, "no title", 400)
+		return
+	}
+	key := datastore.NameKey("TiddlerLock", title, nil)
+	user := currentUser(r)
+	now := time.Now()
+
+	ttl := defaultLockTTL
+	if s := r.FormValue("ttl"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			http.Error(w, "bad ttl", 400)
+			return
+		}
+		if d > maxLockTTL {
+			d = maxLockTTL
+		}
+		ttl = d
+	}
+
+	var l tiddlerLock
+	code := 200
+	var err error
+	switch r.Method {
+	case "GET":
+		err = dbGet(ctx, key, &l)
+		if err == datastore.ErrNoSuchEntity {
+			err = nil
+		}
+	case "POST":
+		err = db.RunInTransaction(ctx, func(tx Transaction) error {
+			l = tiddlerLock{}
+			if err := tx.Get(key, &l); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			if l.held(now) && !l.heldBy(user, now) {
+				code = 409
+				return nil
+			}
+			code = 200
+			l = tiddlerLock{User: user, Expires: now.Add(ttl).UTC().Truncate(time.Second)}
+			return tx.Put(key, &l)
+		})
+	case "DELETE":
+		err = db.RunInTransaction(ctx, func(tx Transaction) error {
+			l = tiddlerLock{}
+			if err := tx.Get(key, &l); err != nil {
+				if err == datastore.ErrNoSuchEntity {
+					return nil
+				}
+				return err
+			}
+			if l.held(now) && !l.heldBy(user, now) {
+				code = 409
+				return nil
+			}
+			code = 200
+			l = tiddlerLock{}
+			return tx.Delete(key)
+		})
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	res := lockResult{Title: title}
+	if l.held(now) {
+		res.User, res.Expires = l.User, &l.Expires
+	}
+
+	data, err := json.Marshal(res)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if code != 200 {
+		w.Header().Set("Content-Type", jsonType)
+		w.WriteHeader(code)
+		w.Write(data)
+		return
+	}
+	writeJSON(w, data)
+}
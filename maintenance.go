@@ -0,0 +1,97 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// Re Read-only mode
+//
+// During a migration or restore, or when something has gone wrong, the server can be put in read-only mode: reads
+// keep working but every PUT and DELETE gets a 503 carrying an explanatory message, as the text of a tiddler
+// ($:/server/read-only) in TiddlyWeb JSON so that the sync adaptor and scripts read it like any other tiddler.  Start
+// in read-only mode with read-only=true (and read-only-message), or flip it at runtime with
+//     curl -X PUT -d '{"readOnly": true, "message": "Restoring from backup"}' https://your-app/admin/read-only
+// The runtime setting is per process and lasts until the next restart.
+
+// readOnlyTitle is the title of the tiddler a rejected request gets back.
+const readOnlyTitle = "$:/server/read-only"
+
+type readOnlyState struct {
+	ReadOnly bool   `json:"readOnly"`
+	Message  string `json:"message,omitempty"`
+}
+
+var readOnly struct {
+	sync.Mutex
+	readOnlyState
+}
+
+func initReadOnly() {
+	readOnly.ReadOnly = cfg.ReadOnly
+	readOnly.Message = cfg.ReadOnlyMessage
+}
+
+func currentReadOnly() readOnlyState {
+	readOnly.Lock()
+	defer readOnly.Unlock()
+	return readOnly.readOnlyState
+}
+
+// readOnlyCheck rejects mutating requests while in read-only mode, except
+// the ones that turn it off again.
+func readOnlyCheck(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if st := currentReadOnly(); st.ReadOnly && isMutation(r.Method) && r.URL.Path != "/admin/read-only" {
+			msg := st.Message
+			if msg == "" {
+				msg = "the wiki is in read-only mode for maintenance; try again later"
+			}
+			data, _ := json.Marshal(map[string]string{
+				"title": readOnlyTitle,
+				"text":  msg,
+				"type":  "text/plain",
+				"bag":   "bag",
+			})
+			w.Header().Set("Content-Type", jsonType)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write(data)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func readOnlyAdmin(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET", "PUT") {
+		return
+	}
+	if r.Method == "PUT" {
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+		if err != nil {
+			http.Error(w, "cannot read data", 400)
+			return
+		}
+		var st readOnlyState
+		if err := json.Unmarshal(data, &st); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		readOnly.Lock()
+		readOnly.readOnlyState = st
+		readOnly.Unlock()
+		logf(r.Context(), "%s set read-only=%v (%q)", currentUser(r), st.ReadOnly, st.Message)
+	}
+	data, err := json.Marshal(currentReadOnly())
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, data)
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"net/url"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/text"
+)
+
+// Re Markdown
+//
+// Tiddlers of type text/x-markdown (what TiddlyWiki's markdown plugin uses) or text/markdown are rendered with
+// goldmark, which follows CommonMark, plus GitHub's tables, strikethrough and autolinks.  As in the plugin, a link to
+// #Title is a link to that tiddler.  goldmark is used with its safe defaults, since published pages are served from
+// the wiki's origin: raw HTML is left out rather than passed through, and so are links to javascript: and the like.
+
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.Table, extension.Strikethrough, extension.Linkify),
+)
+
+func renderMarkdown(s string, link linkFunc) template.HTML {
+	var buf bytes.Buffer
+	src := []byte(s)
+	doc := markdown.Parser().Parse(text.NewReader(src))
+	linkTiddlers(doc, link)
+	if err := markdown.Renderer().Render(&buf, src, doc); err != nil {
+		return template.HTML("<pre>" + html.EscapeString(s) + "</pre>\n")
+	}
+	return template.HTML(buf.String())
+}
+
+// linkTiddlers points the links to #Title in doc at the tiddler, as link
+// gives it, or turns them into their text if link gives "".
+func linkTiddlers(doc ast.Node, link linkFunc) {
+	var links []*ast.Link
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if l, ok := n.(*ast.Link); ok && entering && strings.HasPrefix(string(l.Destination), "#") {
+			links = append(links, l)
+		}
+		return ast.WalkContinue, nil
+	})
+	for _, l := range links {
+		title, err := url.PathUnescape(string(l.Destination[1:]))
+		href := ""
+		if err == nil && title != "" {
+			href = link(title)
+		}
+		if href != "" {
+			l.Destination = []byte(href)
+			continue
+		}
+		parent := l.Parent()
+		for c := l.FirstChild(); c != nil; c = l.FirstChild() {
+			parent.InsertBefore(parent, l, c)
+		}
+		parent.RemoveChild(parent, l)
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Cache layers
+//
+// The cache-layers setting stacks caches in front of the storage backend, listed from the outermost in:
+//     memory         an in-process LRU cache of tiddlers and the skinny list, up to memory-cache-bytes
+//     redis          the Redis cache (see Re Redis), shared by every server using redis-addr
+//     memory,redis   both: the memory cache answers what it can, and Redis most of the rest
+// The memory cache is the fastest and costs nothing, but is private to the process.  It keeps itself consistent
+// with the server's own writes, and drops what other servers change when there is a Redis layer beneath it to tell
+// it, through Redis's publish/subscribe.  Without one, its entries are only trusted for memory-cache-ttl, so use the
+// memory layer alone only with a single server, or where that much staleness doesn't matter.  When the Redis
+// subscription fails, which could lose changes, the whole memory cache is dropped.
+//
+// If cache-layers isn't set, it is redis when redis-addr is set and empty otherwise, as before the setting existed.
+
+// cacheLayers returns the configured layers, outermost first.
+func cacheLayers() []string {
+	if cfg.CacheLayers == "" {
+		if cfg.RedisAddr != "" {
+			return []string{"redis"}
+		}
+		return nil
+	}
+	return strings.Split(cfg.CacheLayers, ",")
+}
+
+// validCacheLayers checks the cache-layers setting.
+func validCacheLayers(layers []string, redisAddr string) error {
+	seen := make(map[string]bool)
+	for _, l := range layers {
+		switch {
+		case l != "memory" && l != "redis":
+			return fmt.Errorf("unknown cache layer %q", l)
+		case seen[l]:
+			return fmt.Errorf("cache layer %q is listed twice", l)
+		case l == "memory" && seen["redis"]:
+			return fmt.Errorf("the memory cache layer must come before redis")
+		case l == "redis" && redisAddr == "":
+			return fmt.Errorf("the redis cache layer needs redis-addr")
+		}
+		seen[l] = true
+	}
+	return nil
+}
+
+// addCacheLayers wraps s in the configured caches.
+func addCacheLayers(s Store) Store {
+	layers := cacheLayers()
+	for i := len(layers) - 1; i >= 0; i-- {
+		switch layers[i] {
+		case "redis":
+			s = newRedisStore(s)
+		case "memory":
+			s = newMemoryStore(s)
+		}
+	}
+	return s
+}
+
+// lru is a cache dropping the least recently used values once they total
+// more than max bytes, and any older than ttl.
+type lru struct {
+	max, size int64
+	ttl       time.Duration
+	ll        *list.List // of *lruEntry, most recently used first
+	m         map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	val   interface{}
+	size  int64
+	added time.Time
+}
+
+func newLRU(max int64, ttl time.Duration) *lru {
+	return &lru{max: max, ttl: ttl, ll: list.New(), m: make(map[string]*list.Element)}
+}
+
+func (c *lru) get(key string) (interface{}, bool) {
+	e, ok := c.m[key]
+	if !ok {
+		return nil, false
+	}
+	ent := e.Value.(*lruEntry)
+	if time.Since(ent.added) > c.ttl {
+		c.remove(e)
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return ent.val, true
+}
+
+// add caches val, which takes size bytes, under key.
+func (c *lru) add(key string, val interface{}, size int64) {
+	if e, ok := c.m[key]; ok {
+		c.remove(e)
+	}
+	if size > c.max {
+		return
+	}
+	c.m[key] = c.ll.PushFront(&lruEntry{key, val, size, time.Now()})
+	c.size += size
+	for c.size > c.max {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *lru) delete(key string) {
+	if e, ok := c.m[key]; ok {
+		c.remove(e)
+	}
+}
+
+func (c *lru) remove(e *list.Element) {
+	ent := c.ll.Remove(e).(*lruEntry)
+	delete(c.m, ent.key)
+	c.size -= ent.size
+}
+
+func (c *lru) clear() {
+	c.ll.Init()
+	c.m = make(map[string]*list.Element)
+	c.size = 0
+}
+
+// memoryStore is a Store caching Tiddler entities and the skinny list in
+// memory.
+type memoryStore struct {
+	Store
+	mu    sync.Mutex
+	cache *lru
+	// gen counts changes, so that a value read from s.Store isn't cached if
+	// something changed while it was being read.
+	gen uint64
+}
+
+func newMemoryStore(s Store) Store {
+	m := &memoryStore{Store: s, cache: newLRU(cfg.MemoryCacheBytes, cfg.MemoryCacheTTL)}
+	if n, ok := s.(changeNotifier); ok {
+		n.watchChanges(m.forgetTitles)
+	}
+	return m
+}
+
+// The skinny list is cached under a name no tiddler can have, since
+// Tiddlers are cached by title.
+const memoryListKey = "\x00list"
+
+// forgetTitles drops titles, or everything if titles is nil.
+func (s *memoryStore) forgetTitles(titles []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gen++
+	if titles == nil {
+		s.cache.clear()
+		return
+	}
+	for _, t := range titles {
+		s.cache.delete(t)
+	}
+	s.cache.delete(memoryListKey)
+}
+
+func (s *memoryStore) dropCaches(ctx context.Context) {
+	s.forgetTitles(nil)
+	if d, ok := s.Store.(cacheDropper); ok {
+		d.dropCaches(ctx)
+	}
+}
+
+func (s *memoryStore) forget(keys []*datastore.Key) {
+	var titles []string
+	for _, key := range keys {
+		if key.Kind == "Tiddler" {
+			titles = append(titles, key.Name)
+		}
+	}
+	if len(titles) > 0 {
+		s.forgetTitles(titles)
+	}
+}
+
+// lookup returns the cached data for name, or the generation to pass to
+// fill after reading it.
+func (s *memoryStore) lookup(name string) ([]byte, uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.cache.get(name)
+	data, _ := v.([]byte)
+	return data, s.gen, ok
+}
+
+// fill caches data read at generation gen, unless it has since changed.
+func (s *memoryStore) fill(name string, data []byte, gen uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gen == gen {
+		s.cache.add(name, data, int64(len(data)))
+	}
+}
+
+// watchChanges passes on the changes reported by the layer beneath, if it
+// can.
+func (s *memoryStore) watchChanges(fn func(titles []string)) {
+	if n, ok := s.Store.(changeNotifier); ok {
+		n.watchChanges(fn)
+	}
+}
+
+func (s *memoryStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if key.Kind != "Tiddler" {
+		return s.Store.Get(ctx, key, dst)
+	}
+	data, gen, ok := s.lookup(key.Name)
+	if ok && json.Unmarshal(data, dst) == nil {
+		return nil
+	}
+	if err := s.Store.Get(ctx, key, dst); err != nil {
+		return err
+	}
+	if data, err := json.Marshal(dst); err == nil {
+		s.fill(key.Name, data, gen)
+	}
+	return nil
+}
+
+func (s *memoryStore) Put(ctx context.Context, key *datastore.Key, src interface{}) error {
+	err := s.Store.Put(ctx, key, src)
+	s.forget([]*datastore.Key{key})
+	return err
+}
+
+func (s *memoryStore) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) error {
+	err := s.Store.PutMulti(ctx, keys, src)
+	s.forget(keys)
+	return err
+}
+
+func (s *memoryStore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	err := s.Store.DeleteMulti(ctx, keys)
+	s.forget(keys)
+	return err
+}
+
+func (s *memoryStore) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	var written []*datastore.Key
+	err := s.Store.RunInTransaction(ctx, func(tx Transaction) error {
+		written = written[:0]
+		return f(&recordingTx{tx, &written})
+	})
+	s.forget(written)
+	return err
+}
+
+func (s *memoryStore) cachedList(ctx context.Context, build func() ([]byte, error)) ([]byte, error) {
+	data, gen, ok := s.lookup(memoryListKey)
+	if ok {
+		return data, nil
+	}
+	var err error
+	if c, ok := s.Store.(listCacher); ok {
+		data, err = c.cachedList(ctx, build)
+	} else {
+		data, err = build()
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.fill(memoryListKey, data, gen)
+	return data, nil
+}
@@ -0,0 +1,215 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Data migrations
+//
+// Stored entities outlive the code that wrote them.  When a change needs existing entities changed as well (a new
+// field filled in, an encoding changed), it appends a dataMigration below, and the Schema entity "version" records
+// how many of them the store has had.  serve applies the ones it hasn't once it has opened the store, unless
+// auto-migrate is off, in which case it refuses to start until tiddly migrate has applied them; tiddly migrate -n
+// only reports what each pending migration would change.  A store at a newer version than the binary knows stops it
+// from starting, as MySQL's schema does (see Re MySQL), rather than have an older server write what a newer one no
+// longer reads.
+//
+// Migrations run alongside servers still serving, and instances starting together may both run one, so each must be
+// idempotent and must read and write each entity in a transaction.  Firestore refuses a read after a write in a
+// transaction, so a transaction must make all its Gets before any Put, and write a chunk with one PutMulti.  The
+// version is only recorded once a migration has finished, so one interrupted part way is simply run again.  Never
+// edit or reorder a migration that has shipped.
+
+type dataMigration struct {
+	name string
+	// run applies the migration, or with dryRun only counts what it
+	// would change, returning how many entities it changed.
+	run func(ctx context.Context, dryRun bool) (int, error)
+}
+
+var dataMigrations = []dataMigration{
+	{"saved-times", migrateSavedTimes},
+}
+
+// migrateChunk is how many entities a migration changes per transaction.
+const migrateChunk = 100
+
+type schemaVersion struct {
+	Version  int
+	Migrated time.Time `datastore:"Migrated,noindex"`
+}
+
+func schemaKey() *datastore.Key {
+	return datastore.NameKey("Schema", "version", nil)
+}
+
+// storedSchemaVersion returns how many migrations the store has had.
+func storedSchemaVersion(ctx context.Context) (int, error) {
+	var v schemaVersion
+	err := dbGet(ctx, schemaKey(), &v)
+	if err == datastore.ErrNoSuchEntity {
+		return 0, nil
+	}
+	return v.Version, err
+}
+
+// migrateData applies the migrations the store hasn't had yet, or with
+// dryRun reports what they would change.
+func migrateData(ctx context.Context, dryRun bool) error {
+	version, err := storedSchemaVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("reading schema version: %v", err)
+	}
+	if version > len(dataMigrations) {
+		return fmt.Errorf("data is at schema version %d, newer than this server (%d)", version, len(dataMigrations))
+	}
+	for i := version; i < len(dataMigrations); i++ {
+		m := dataMigrations[i]
+		n, err := m.run(ctx, dryRun)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %v", i+1, m.name, err)
+		}
+		if dryRun {
+			log.Printf("Migration %d (%s) would change %d entities", i+1, m.name, n)
+			continue
+		}
+		if err := recordSchemaVersion(ctx, i+1); err != nil {
+			return fmt.Errorf("recording schema version %d: %v", i+1, err)
+		}
+		log.Printf("Applied migration %d (%s), changing %d entities", i+1, m.name, n)
+	}
+	return nil
+}
+
+// recordSchemaVersion raises the stored version to version, leaving it be
+// if another instance has already gone further.
+func recordSchemaVersion(ctx context.Context, version int) error {
+	return retry(ctx, func() error {
+		return db.RunInTransaction(ctx, func(tx Transaction) error {
+			var v schemaVersion
+			if err := tx.Get(schemaKey(), &v); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			if v.Version >= version {
+				return nil
+			}
+			return tx.Put(schemaKey(), &schemaVersion{Version: version, Migrated: time.Now().UTC()})
+		})
+	})
+}
+
+// checkDataMigrations runs at startup: it applies pending migrations, or
+// with auto-migrate off refuses to start if there are any.
+func checkDataMigrations() error {
+	ctx := context.Background()
+	if cfg.AutoMigrate {
+		return migrateData(ctx, false)
+	}
+	version, err := storedSchemaVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("reading schema version: %v", err)
+	}
+	if version != len(dataMigrations) {
+		return fmt.Errorf("data is at schema version %d, but this server needs %d: run tiddly migrate", version, len(dataMigrations))
+	}
+	return nil
+}
+
+// migrateSavedTimes fills in Saved on tiddlers saved by versions from before
+// it was recorded, from the modified time the browser gave them, so that
+// everything that sorts or filters by Saved needn't fall back on the
+// metadata. Tiddlers without a modified time are left alone.
+func migrateSavedTimes(ctx context.Context, dryRun bool) (int, error) {
+	var titles []string
+	var t Tiddler
+	err := db.Scan(ctx, "Tiddler", "", &t, func(title string) error {
+		if t.Saved.IsZero() && t.Meta != "" && !isDraft(title) && !tiddlerModified(&t).IsZero() {
+			titles = append(titles, title)
+		}
+		return nil
+	})
+	if err != nil || dryRun {
+		return len(titles), err
+	}
+	changed := 0
+	for i := 0; i < len(titles); i += migrateChunk {
+		j := i + migrateChunk
+		if j > len(titles) {
+			j = len(titles)
+		}
+		n := 0
+		err := retry(ctx, func() error {
+			n = 0
+			return db.RunInTransaction(ctx, func(tx Transaction) error {
+				var keys []*datastore.Key
+				var ts []*Tiddler
+				for _, title := range titles[i:j] {
+					key := datastore.NameKey("Tiddler", title, nil)
+					t := new(Tiddler)
+					if err := tx.Get(key, t); err == datastore.ErrNoSuchEntity {
+						continue
+					} else if err != nil {
+						return err
+					}
+					if !t.Saved.IsZero() || t.Meta == "" {
+						continue // saved since the scan
+					}
+					t.Saved = tiddlerModified(t).UTC()
+					keys = append(keys, key)
+					ts = append(ts, t)
+				}
+				n = len(keys)
+				if n == 0 {
+					return nil
+				}
+				return tx.PutMulti(keys, ts)
+			})
+		})
+		if err != nil {
+			return changed, err
+		}
+		changed += n
+	}
+	return changed, nil
+}
+
+func migrateCmd(args []string) error {
+	fs := newFlagSet("migrate", "")
+	dryRun := fs.Bool("n", false, "only report what each pending migration would change")
+	from := fs.String("from", "", "instead, copy the wiki from this storage backend (see Re Moving between backends)")
+	to := fs.String("to", "", "storage backend to copy the wiki to, with -from")
+	overwrite := fs.Bool("overwrite", false, "with -from, copy even if the destination already has tiddlers")
+	if ok, err := setup(fs, args); !ok {
+		return err
+	}
+	if *from != "" || *to != "" {
+		if *from == "" || *to == "" {
+			fs.Usage()
+			return fmt.Errorf("need both -from and -to")
+		}
+		return moveCmd(*from, *to, *overwrite)
+	}
+	if err := openStore(); err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx := context.Background()
+	if err := migrateData(ctx, *dryRun); err != nil {
+		return err
+	}
+	version, err := storedSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Data is at schema version %d of %d", version, len(dataMigrations))
+	return nil
+}
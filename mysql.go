@@ -0,0 +1,278 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re MySQL
+//
+// With storage=mysql everything is kept in a MySQL or MariaDB database, for hosting that offers nothing else.  It
+// is plain database/sql: the entities table holds each entity's JSON under its kind and name, and the links table
+// indexes the TiddlerLinks entities by target, so LinksTo needn't read them all.  Names are VARBINARY, so prefix
+// scans are byte ranges as in the other backends, whatever the collation.  Transactions read with SELECT ... FOR
+// UPDATE and are retried when MySQL picks them as a deadlock victim, so any number of servers can share the
+// database.
+//
+// The schema is created and upgraded by the migrations below, which run when the server starts.  The
+// tiddly_migrations table records how many have been applied, and a named lock keeps servers starting together from
+// running them twice.  To change the schema, append a migration; never edit one that has shipped.
+//
+// The driver (github.com/go-sql-driver/mysql) is only linked in when building with -tags mysql, so that the usual
+// binary doesn't carry it.  mysql-dsn is in its format, e.g. tiddly@tcp(host:3306)/tiddly; as with the other
+// backends' secrets, the password comes from the environment (MYSQL_PASSWORD) so that -print-config doesn't show it.
+
+var mysqlMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS entities (
+		kind VARCHAR(64) CHARACTER SET ascii NOT NULL,
+		name VARBINARY(1024) NOT NULL,
+		data LONGBLOB NOT NULL,
+		PRIMARY KEY (kind, name)
+	) ENGINE=InnoDB`,
+	`CREATE TABLE IF NOT EXISTS links (
+		name VARBINARY(1024) NOT NULL,
+		target VARBINARY(1024) NOT NULL,
+		PRIMARY KEY (name, target),
+		KEY (target)
+	) ENGINE=InnoDB`,
+}
+
+// mysqlOpen connects to the database named by dsn, using password if it
+// isn't empty. It is set by the driver's file.
+var mysqlOpen func(dsn, password string) (*sql.DB, error)
+
+// mysqlDeadlock reports whether err means a transaction was rolled back to
+// break a deadlock or lock wait. It is set by the driver's file.
+var mysqlDeadlock = func(err error) bool { return false }
+
+// sqlQuerier is what sqlKV needs of a *sql.DB or *sql.Tx.
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type sqlKV struct {
+	db *sql.DB
+	q  sqlQuerier
+	tx bool // q is a transaction
+}
+
+// sqlStore is a kvStore in MySQL, which can also answer LinksTo from an
+// index.
+type sqlStore struct {
+	kvStore
+	kv *sqlKV
+}
+
+func openMySQL() (Store, error) {
+	if mysqlOpen == nil {
+		return nil, errors.New("this binary has no MySQL driver; build it with -tags mysql")
+	}
+	d, err := mysqlOpen(cfg.MySQLDSN, os.Getenv("MYSQL_PASSWORD"))
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateMySQL(context.Background(), d); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("migrating MySQL schema: %v", err)
+	}
+	s := &sqlKV{db: d, q: d}
+	primary := sqlStore{kvStore{s}, s}
+	if cfg.MySQLReadDSN == "" {
+		return primary, nil
+	}
+	rd, err := mysqlOpen(cfg.MySQLReadDSN, os.Getenv("MYSQL_PASSWORD"))
+	if err != nil {
+		d.Close()
+		return nil, fmt.Errorf("opening mysql-read-dsn: %v", err)
+	}
+	rs := &sqlKV{db: rd, q: rd}
+	return newReplicaStore(primary, sqlStore{kvStore{rs}, rs}), nil
+}
+
+// migrateMySQL applies the migrations the database hasn't had yet.
+func migrateMySQL(ctx context.Context, d *sql.DB) error {
+	// The lock belongs to the connection, so keep to one.
+	c, err := d.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var got sql.NullInt64
+	if err := c.QueryRowContext(ctx, "SELECT GET_LOCK('tiddly_migrations', 60)").Scan(&got); err != nil {
+		return err
+	}
+	if got.Int64 != 1 {
+		return errors.New("timed out waiting for another server's migrations")
+	}
+	defer c.ExecContext(ctx, "DO RELEASE_LOCK('tiddly_migrations')")
+
+	if _, err := c.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS tiddly_migrations (version INT NOT NULL) ENGINE=InnoDB"); err != nil {
+		return err
+	}
+	var version int
+	if err := c.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM tiddly_migrations").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(mysqlMigrations) {
+		return fmt.Errorf("database is at version %d, newer than this server (%d)", version, len(mysqlMigrations))
+	}
+	// MySQL commits DDL as it goes, so each migration must be safe to
+	// repeat should the server die before recording it.
+	for i := version; i < len(mysqlMigrations); i++ {
+		if _, err := c.ExecContext(ctx, mysqlMigrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+		if _, err := c.ExecContext(ctx, "INSERT INTO tiddly_migrations (version) VALUES (?)", i+1); err != nil {
+			return err
+		}
+		log.Printf("mysql: applied migration %d", i+1)
+	}
+	return nil
+}
+
+func (s *sqlKV) get(ctx context.Context, kind, name string) ([]byte, error) {
+	query := "SELECT data FROM entities WHERE kind = ? AND name = ?"
+	if s.tx {
+		query += " FOR UPDATE"
+	}
+	var data []byte
+	err := s.q.QueryRowContext(ctx, query, kind, []byte(name)).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	return data, err
+}
+
+func (s *sqlKV) put(ctx context.Context, kind, name string, data []byte) error {
+	if kind == "TiddlerLinks" && !s.tx {
+		// Keep the links table in step.
+		return s.update(ctx, func(tx kv) error { return tx.put(ctx, kind, name, data) })
+	}
+	_, err := s.q.ExecContext(ctx,
+		"INSERT INTO entities (kind, name, data) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE data = VALUES(data)",
+		kind, []byte(name), data)
+	if err != nil || kind != "TiddlerLinks" {
+		return err
+	}
+	var l tiddlerLinks
+	if err := json.Unmarshal(data, &l); err != nil {
+		return err
+	}
+	if _, err := s.q.ExecContext(ctx, "DELETE FROM links WHERE name = ?", []byte(name)); err != nil {
+		return err
+	}
+	for _, target := range l.Links {
+		if _, err := s.q.ExecContext(ctx, "INSERT IGNORE INTO links (name, target) VALUES (?, ?)", []byte(name), []byte(target)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlKV) delete(ctx context.Context, kind, name string) error {
+	if _, err := s.q.ExecContext(ctx, "DELETE FROM entities WHERE kind = ? AND name = ?", kind, []byte(name)); err != nil {
+		return err
+	}
+	if kind != "TiddlerLinks" {
+		return nil
+	}
+	_, err := s.q.ExecContext(ctx, "DELETE FROM links WHERE name = ?", []byte(name))
+	return err
+}
+
+func (s *sqlKV) scan(ctx context.Context, kind, prefix string, keysOnly bool, fn func(name string, data []byte) error) error {
+	cols := "name, data"
+	if keysOnly {
+		cols = "name, NULL"
+	}
+	query := "SELECT " + cols + " FROM entities WHERE kind = ?"
+	args := []interface{}{kind}
+	if prefix != "" {
+		query += " AND name >= ? AND name < ?"
+		args = append(args, []byte(prefix), []byte(prefixEnd(prefix)))
+	}
+	rows, err := s.q.QueryContext(ctx, query+" ORDER BY name", args...)
+	if err != nil {
+		return err
+	}
+	// Read them all before calling fn, which may use the connection.
+	type item struct {
+		name string
+		data []byte
+	}
+	var items []item
+	for rows.Next() {
+		var name, data []byte
+		if err := rows.Scan(&name, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		items = append(items, item{string(name), data})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, it := range items {
+		if err := fn(it.name, it.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlKV) update(ctx context.Context, f func(kv) error) error {
+	if s.tx {
+		return errors.New("mysql: nested transaction")
+	}
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		var tx *sql.Tx
+		if tx, err = s.db.BeginTx(ctx, nil); err != nil {
+			return err
+		}
+		if err = f(&sqlKV{db: s.db, q: tx, tx: true}); err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+		if !mysqlDeadlock(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *sqlKV) close() error {
+	return s.db.Close()
+}
+
+func (s sqlStore) LinksTo(ctx context.Context, title string) ([]string, error) {
+	rows, err := s.kv.db.QueryContext(ctx, "SELECT name FROM links WHERE target = ? ORDER BY name", []byte(title))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name []byte
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, string(name))
+	}
+	return names, rows.Err()
+}
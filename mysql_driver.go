@@ -0,0 +1,37 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build mysql
+// +build mysql
+
+package main
+
+import (
+	"database/sql"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func init() {
+	mysqlOpen = func(dsn, password string) (*sql.DB, error) {
+		c, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		if password != "" {
+			c.Passwd = password
+		}
+		c.MaxAllowedPacket = 0 // ask the server
+		conn, err := mysql.NewConnector(c)
+		if err != nil {
+			return nil, err
+		}
+		return sql.OpenDB(conn), nil
+	}
+	mysqlDeadlock = func(err error) bool {
+		e, ok := err.(*mysql.MySQLError)
+		// ER_LOCK_DEADLOCK, ER_LOCK_WAIT_TIMEOUT
+		return ok && (e.Number == 1213 || e.Number == 1205)
+	}
+}
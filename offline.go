@@ -0,0 +1,323 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Re Offline
+//
+// With -offline the page links a web app manifest (/manifest.webmanifest), so it can be installed, and registers a
+// service worker (/sw.js) that keeps the wiki usable without a connection.  The worker answers GETs of the page, the
+// status and the tiddlers from the network when it can and from its cache when it can't, so the wiki opens offline
+// as it was last seen.  A PUT or DELETE of a tiddler that can't reach the server is kept in the browser's IndexedDB
+// and answered as if it had been saved; a later save of the same tiddler replaces the queued one, keeping the
+// revision it was edited from.  The queue is replayed in order once the server answers again: when the browser comes
+// back online, on background sync, and whenever a request gets through.
+//
+// Replayed saves carry X-Offline-Replay, and are checked as if conflict-copies were on (see Re Conflicts): an edit
+// made offline to a revision that has since changed is saved as a conflict copy, not over the newer one.  The page
+// then syncs and lists the copies, and any saves the server refused, in an alert.  A 429, a 5xx, a redirect (the
+// proxy's sign-in, when the session has lapsed) or no answer at all leaves the rest of the queue for next time.
+
+// offlineReplayHeader marks a save queued while offline and sent later.
+const offlineReplayHeader = "X-Offline-Replay"
+
+// offlineHead and offlineBody are added to the page by offlinePage.
+const (
+	offlineHead = `<link rel="manifest" href="manifest.webmanifest">` + "\n"
+	offlineBody = `<script>
+if ("serviceWorker" in navigator) {
+	navigator.serviceWorker.register("sw.js");
+	window.addEventListener("online", function() {
+		if (navigator.serviceWorker.controller) {
+			navigator.serviceWorker.controller.postMessage("replay");
+		}
+	});
+	navigator.serviceWorker.addEventListener("message", function(event) {
+		var d = event.data || {};
+		if (d.type !== "replayed") {
+			return;
+		}
+		if (window.$tw && $tw.syncer) {
+			$tw.syncer.syncFromServer();
+		}
+		var msg = "";
+		if (d.conflicts.length) {
+			msg += "Edits made offline to tiddlers changed since were saved as:\n" + d.conflicts.join("\n") + "\n";
+		}
+		if (d.failed.length) {
+			msg += "Edits made offline could not be saved:\n" + d.failed.join("\n") + "\n";
+		}
+		if (msg) {
+			alert(msg);
+		}
+	});
+}
+</script>
+`
+)
+
+// offlinePage adds the manifest link and service worker registration to p.
+func offlinePage(p page) page {
+	p.data = insertBefore(p.data, "</head>", offlineHead)
+	p.data = insertBefore(p.data, "</body>", offlineBody)
+	return p
+}
+
+func manifest(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	name := "TiddlyWiki"
+	if settings, err := shellSettings(r.Context()); err == nil && strings.TrimSpace(settings["title"]) != "" {
+		name = strings.TrimSpace(settings["title"])
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"name":       name,
+		"short_name": name,
+		"start_url":  "./",
+		"scope":      "./",
+		"display":    "standalone",
+		"icons": []map[string]string{
+			{"src": "favicon.ico", "sizes": "any"},
+		},
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/manifest+json")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Write(data)
+}
+
+func serviceWorker(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	// Browsers check for a new worker at most daily anyway; don't make
+	// it longer.
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(strings.Replace(serviceWorkerScript, "$replay$", offlineReplayHeader, 1)))
+}
+
+const serviceWorkerScript = `"use strict";
+
+var CACHE = "tiddly-offline-v1";
+var REPLAY_HEADER = "$replay$";
+var scope = new URL(self.registration.scope).pathname;
+
+self.addEventListener("install", function(event) {
+	event.waitUntil(caches.open(CACHE).then(function(cache) {
+		return cache.addAll(["./", "status"]);
+	}).then(function() {
+		return self.skipWaiting();
+	}));
+});
+
+self.addEventListener("activate", function(event) {
+	event.waitUntil(self.clients.claim().then(replay));
+});
+
+self.addEventListener("message", function(event) {
+	if (event.data === "replay") {
+		event.waitUntil(replay());
+	}
+});
+
+self.addEventListener("sync", function(event) {
+	if (event.tag === "replay") {
+		event.waitUntil(replay());
+	}
+});
+
+self.addEventListener("fetch", function(event) {
+	var req = event.request;
+	var url = new URL(req.url);
+	if (url.origin !== location.origin || !url.pathname.startsWith(scope)) {
+		return;
+	}
+	var path = url.pathname.slice(scope.length);
+	if (req.method === "GET" && cached(path)) {
+		event.respondWith(networkFirst(req));
+	} else if (req.method === "PUT" && /^recipes\/[^\/]+\/tiddlers\/./.test(path) ||
+			req.method === "DELETE" && /^bags\/[^\/]+\/tiddlers\/./.test(path)) {
+		event.respondWith(saveOrQueue(req, path));
+	}
+});
+
+// cached reports whether GETs of path are kept for offline use.
+function cached(path) {
+	return path === "" || path === "status" || path === "favicon.ico" || path === "manifest.webmanifest" ||
+		/^recipes\/[^\/]+\/tiddlers(\.json|\/)/.test(path) || path.startsWith("core/");
+}
+
+function networkFirst(req) {
+	return fetch(req).then(function(res) {
+		if (res.ok && !res.redirected) {
+			var copy = res.clone();
+			caches.open(CACHE).then(function(cache) { cache.put(req, copy); });
+			replay();
+		}
+		return res;
+	}, function(err) {
+		return caches.match(req, {ignoreVary: true}).then(function(res) {
+			if (res) {
+				return res;
+			}
+			throw err;
+		});
+	});
+}
+
+async function saveOrQueue(req, path) {
+	var title = decodeURIComponent(path.slice(path.indexOf("/tiddlers/") + "/tiddlers/".length));
+	var body = req.method === "PUT" ? await req.clone().text() : null;
+	// A save made while an older one of the same tiddler waits must
+	// wait too, or the older one would be replayed over it.
+	if (!await queued(title)) {
+		try {
+			var res = await fetch(req);
+			replay();
+			return res;
+		} catch (err) {
+			// Offline; queue it.
+		}
+	}
+	var prev = await queued(title);
+	await store("readwrite", function(s) {
+		return s.put({
+			title: title,
+			seq: Date.now(),
+			method: req.method,
+			url: req.url,
+			headers: Array.from(req.headers.entries()),
+			body: prev && prev.method === "PUT" && prev.base !== undefined ? withRevision(body, prev.base) : body,
+			base: prev && prev.base !== undefined ? prev.base : revisionOf(body),
+		});
+	});
+	if (self.registration.sync) {
+		self.registration.sync.register("replay").catch(function() {});
+	}
+	if (req.method === "DELETE") {
+		return new Response(null, {status: 204});
+	}
+	var rev = prev && prev.base !== undefined ? prev.base : revisionOf(body);
+	return new Response(null, {
+		status: 204,
+		headers: {"Etag": '"bag/' + encodeURIComponent(title) + "/" + (rev || 0) + ':queued"'},
+	});
+}
+
+function revisionOf(body) {
+	try {
+		var rev = JSON.parse(body).revision;
+		return rev === undefined ? undefined : String(rev);
+	} catch (err) {
+		return undefined;
+	}
+}
+
+function withRevision(body, rev) {
+	if (body === null) {
+		return body;
+	}
+	try {
+		var js = JSON.parse(body);
+		js.revision = rev;
+		return JSON.stringify(js);
+	} catch (err) {
+		return body;
+	}
+}
+
+var replaying = null;
+
+function replay() {
+	if (!replaying) {
+		replaying = drain().catch(function() {}).then(function() { replaying = null; });
+	}
+	return replaying;
+}
+
+async function drain() {
+	var entries = await store("readonly", function(s) { return s.getAll(); });
+	entries.sort(function(a, b) { return a.seq - b.seq; });
+	var conflicts = [], failed = [], done = 0;
+	for (var e of entries) {
+		var headers = new Headers(e.headers);
+		headers.set(REPLAY_HEADER, "1");
+		var res;
+		try {
+			res = await fetch(e.url, {method: e.method, headers: headers, body: e.body, credentials: "same-origin", redirect: "manual"});
+		} catch (err) {
+			break;
+		}
+		if (res.type === "opaqueredirect" || res.status === 429 || res.status >= 500) {
+			break;
+		}
+		if (res.status === 409) {
+			var js = await res.json().catch(function() { return {}; });
+			conflicts.push(js.conflict || e.title);
+		} else if (!res.ok && !(e.method === "DELETE" && res.status === 404)) {
+			failed.push(e.title + " (" + res.status + " " + (await res.text()).trim() + ")");
+		}
+		await forget(e);
+		done++;
+	}
+	if (done > 0) {
+		var clients = await self.clients.matchAll({type: "window"});
+		clients.forEach(function(c) {
+			c.postMessage({type: "replayed", conflicts: conflicts, failed: failed});
+		});
+	}
+}
+
+// forget drops e from the queue, unless a newer save has replaced it.
+function forget(e) {
+	return store("readwrite", function(s) {
+		var get = s.get(e.title);
+		get.onsuccess = function() {
+			if (get.result && get.result.seq === e.seq) {
+				s.delete(e.title);
+			}
+		};
+	});
+}
+
+function queued(title) {
+	return store("readonly", function(s) { return s.get(title); });
+}
+
+var db = null;
+
+// store runs fn on the queue in a transaction, and returns the result of
+// the request fn returns, if any.
+function store(mode, fn) {
+	if (!db) {
+		db = new Promise(function(resolve, reject) {
+			var open = indexedDB.open("tiddly-offline", 1);
+			open.onupgradeneeded = function() {
+				open.result.createObjectStore("saves", {keyPath: "title"});
+			};
+			open.onsuccess = function() { resolve(open.result); };
+			open.onerror = function() { db = null; reject(open.error); };
+		});
+	}
+	return db.then(function(conn) {
+		return new Promise(function(resolve, reject) {
+			var tx = conn.transaction("saves", mode);
+			var req = fn(tx.objectStore("saves"));
+			tx.oncomplete = function() { resolve(req ? req.result : undefined); };
+			tx.onerror = function() { reject(tx.error); };
+		});
+	});
+}
+`
@@ -0,0 +1,63 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+)
+
+// Re Ops listener
+//
+// With ops-addr set (say 127.0.0.1:9090, or an address on a private network), the admin pages, pprof and
+// /debug/vars move to a second listener on that address and are no longer served on the wiki's, so the proxy in
+// front of the wiki never has to route them or keep them out.  /livez, /health and /readyz are served on both: load
+// balancers often can only reach the wiki's port.  The ops listener speaks plain HTTP and doesn't check
+// authentication, since whoever can reach it is meant to; requests are made as the user in auth-header if they name
+// one, or as opsUser.  Read-only mode applies as usual, and the base path too, so the admin pages' links work.
+
+// opsUser is who requests to the ops listener are made as if they don't
+// say.
+const opsUser = "ops"
+
+// newOpsHandler returns the handler for the ops listener.
+func newOpsHandler() http.Handler {
+	m := http.NewServeMux()
+	m.HandleFunc("/health", livez)
+	m.HandleFunc("/livez", livez)
+	m.HandleFunc("/readyz", readyz)
+	m.Handle("/debug/vars", expvar.Handler())
+	registerDebug(m)
+	registerAdmin(m)
+	next := readOnlyCheck(m)
+	return withBasePath(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentUser(r) == "" {
+			r.Header.Set(cfg.AuthHeader, opsUser)
+		}
+		next.ServeHTTP(w, withUser(r))
+	}))
+}
+
+// startOps starts the ops listener, if ops-addr is set, returning the
+// server so that it can be shut down with the wiki's.
+func startOps() (*http.Server, error) {
+	if cfg.OpsAddr == "" {
+		return nil, nil
+	}
+	l, err := net.Listen("tcp", cfg.OpsAddr)
+	if err != nil {
+		return nil, err
+	}
+	srv := newServer(cfg.OpsAddr, newOpsHandler())
+	go func() {
+		log.Printf("Serving admin, debug and health endpoints on %s", l.Addr())
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			log.Fatalf("ops listener: %v", err)
+		}
+	}()
+	return srv, nil
+}
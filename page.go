@@ -0,0 +1,121 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// page is the wiki page served at /, read once at startup.
+type page struct {
+	data    []byte
+	modTime time.Time
+	enc     *pageEncodings // see Re Precompression
+}
+
+var indexPage page
+
+// The TiddlyWiki 5 store area, which holds the tiddlers baked into the page.
+var storeAreaMarker = []byte(`<div id="storeArea" style="display:none;">`)
+
+func loadPage(file string) (page, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return page{}, err
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return page{}, err
+	}
+	p := page{data: data, modTime: fi.ModTime()}
+
+	if _, err := p.externalCore(); err != nil {
+		return page{}, fmt.Errorf("%s: %v", file, err)
+	}
+
+	// In order, so that every instance serves the same page.
+	config := syncConfig()
+	var titles []string
+	for title := range config {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+	for _, title := range titles {
+		if err := p.addTiddler(title, config[title]); err != nil {
+			return page{}, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	if cfg.Offline {
+		p = offlinePage(p)
+	}
+	return p, nil
+}
+
+// syncConfig returns the sync settings to bake into the page, as the text of
+// the config tiddlers the syncer and TiddlyWeb adaptor read. Settings left
+// at their zero values keep whatever the wiki itself has.
+func syncConfig() map[string]string {
+	config := make(map[string]string)
+	// The TiddlyWeb adaptor talks to $protocol$//$host$/ unless told
+	// otherwise, which is wrong when we're mounted under a base path.
+	if cfg.SyncHost != "" {
+		config["$:/config/tiddlyweb/host"] = cfg.SyncHost
+	} else if cfg.BasePath != "" {
+		config["$:/config/tiddlyweb/host"] = "$protocol$//$host$" + cfg.BasePath + "/"
+	}
+	if cfg.SyncPollInterval > 0 {
+		config["$:/config/SyncPollingInterval"] = fmt.Sprint(cfg.SyncPollInterval.Milliseconds())
+	}
+	if cfg.SyncThrottle > 0 {
+		config["$:/config/SyncThrottleInterval"] = fmt.Sprint(cfg.SyncThrottle.Milliseconds())
+	}
+	if cfg.SyncFilter != "" {
+		config["$:/config/SyncFilter"] = cfg.SyncFilter
+	}
+	if cfg.SyncEager {
+		config["$:/config/SyncDisableLazyLoading"] = "yes"
+	}
+	return config
+}
+
+// addTiddler bakes a tiddler into the page's store area, where it overrides
+// any shadow tiddler of the same title.
+func (p *page) addTiddler(title, text string) error {
+	return p.addTiddlerFields(map[string]string{"title": title, "text": text})
+}
+
+// addTiddlerFields is addTiddler for a tiddler with fields other than its
+// title and text.
+func (p *page) addTiddlerFields(fields map[string]string) error {
+	i := bytes.Index(p.data, storeAreaMarker)
+	if i < 0 {
+		return fmt.Errorf("no store area")
+	}
+	i += len(storeAreaMarker)
+	var names []string
+	for name := range fields {
+		if name != "text" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	div := "\n<div"
+	for _, name := range names {
+		div += fmt.Sprintf(" %s=\"%s\"", name, html.EscapeString(fields[name]))
+	}
+	div += fmt.Sprintf(">\n<pre>%s</pre>\n</div>", html.EscapeString(fields["text"]))
+	data := make([]byte, 0, len(p.data)+len(div))
+	data = append(data, p.data[:i]...)
+	data = append(data, div...)
+	data = append(data, p.data[i:]...)
+	p.data = data
+	return nil
+}
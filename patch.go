@@ -0,0 +1,196 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Patching
+//
+// A bot adding a line to a log tiddler would have to GET it, change it and PUT it back, and two bots doing so at
+// once lose a line.  PATCH /recipes/all/tiddlers/{title} makes the change on the server instead:
+//     {"append": "10:32 deploy finished", "prepend": "", "separator": "\n",
+//      "fields": {"status": "deployed", "draft-of": null}}
+// append and prepend add to the end and start of the text, with separator (a newline unless given) between them
+// and any text already there; fields sets each field given, removing those given as null.  The title, text,
+// revision and bag can't be set this way, and modified and modifier are set as for any save.  The change is saved
+// only if the tiddler is still at the revision it was read from, checked in the transaction that saves it, and is
+// made again from the new one if someone saved in between, so concurrent patches all land, in some order.  An
+// If-Match names the revision the patch must apply to instead (412 if it has changed).  A patch that leaves the
+// tiddler not fitting the field schema is refused with 422, as a PUT is (see Re Field schemas).  The answer is the
+// new revision and ETag, as a batch save gives them; a tiddler that doesn't exist gets 404.
+
+type patchRequest struct {
+	Append    string                 `json:"append"`
+	Prepend   string                 `json:"prepend"`
+	Separator *string                `json:"separator"`
+	Fields    map[string]interface{} `json:"fields"`
+}
+
+// patchAttempts is how many times a patch is made again after losing a
+// race with another save.
+const patchAttempts = 5
+
+// tiddlyWebFields are the fields TiddlyWeb JSON keeps beside the text rather
+// than under "fields".
+var tiddlyWebFields = map[string]bool{
+	"tags": true, "type": true, "created": true, "modified": true, "creator": true, "modifier": true,
+}
+
+func patchTiddler(w http.ResponseWriter, r *http.Request) {
+	if !mustBeAdmin(w, r) || !checkJSONBody(w, r) || !sameOrigin(w, r) {
+		return
+	}
+	title := tiddlerTitle(r.URL.EscapedPath())
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, cfg.MaxTiddlerBytes))
+	if err != nil {
+		http.Error(w, "cannot read data", 400)
+		return
+	}
+	var req patchRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		http.Error(w, `expected {"append": ..., "prepend": ..., "fields": {...}}: `+err.Error(), 400)
+		return
+	}
+	for name := range req.Fields {
+		switch name {
+		case "title", "text", "revision", "bag":
+			http.Error(w, fmt.Sprintf("%s can't be patched", name), 400)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	res, err := patch(ctx, title, &req, r.Header.Get("If-Match"), currentUser(r))
+	var te *txError
+	if errors.As(err, &te) {
+		http.Error(w, te.msg, te.code)
+		return
+	}
+	var se *schemaError
+	if errors.As(err, &se) {
+		writeSchemaErrors(w, se.msg, se.fields)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	out, err := json.Marshal(res)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	w.Header().Set("Etag", res.ETag)
+	writeJSON(w, out)
+}
+
+// patch applies req to title as user, as of the revision ifMatch names if
+// it isn't empty, and otherwise as of the current one.
+func patch(ctx context.Context, title string, req *patchRequest, ifMatch, user string) (*batchResult, error) {
+	for attempt := 1; ; attempt++ {
+		var cur Tiddler
+		err := dbGet(ctx, datastore.NameKey("Tiddler", title, nil), &cur)
+		if err == datastore.ErrNoSuchEntity || err == nil && cur.Meta == "" {
+			return nil, &txError{404, "no such tiddler"}
+		}
+		if err != nil {
+			return nil, err
+		}
+		var js map[string]interface{}
+		if err := json.Unmarshal([]byte(cur.Meta), &js); err != nil {
+			return nil, err
+		}
+		js["text"] = cur.Text
+		applyPatch(js, req, time.Now(), user)
+
+		if data, _ := json.Marshal(js); int64(len(data)) > cfg.MaxTiddlerBytes {
+			return nil, &txError{413, fmt.Sprintf("tiddler too large: limit is %d bytes", cfg.MaxTiddlerBytes)}
+		}
+
+		match := ifMatch
+		if match == "" {
+			match = tiddlerETag(title, &cur)
+		}
+		schema := schemas.get(ctx)
+		t, err := saveRevisionIf(ctx, title, js, func(now *Tiddler) error {
+			live := now.Rev
+			if now.Meta == "" {
+				live = 0
+			}
+			if _, etagTitle, rev, ok := parseETag(match); !ok || etagTitle != title || rev != live {
+				return &txError{412, fmt.Sprintf("%s has changed: revision %d is current", title, live)}
+			}
+			if err := fitSchema(schema, title, js); err != nil {
+				return err
+			}
+			return nil
+		})
+		var te *txError
+		if errors.As(err, &te) && te.code == 412 && ifMatch == "" && attempt < patchAttempts {
+			continue // saved meanwhile; patch the new revision
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &batchResult{Title: title, Revision: t.Rev, ETag: tiddlerETag(title, &t)}, nil
+	}
+}
+
+// applyPatch makes the changes in req to js, a tiddler in TiddlyWeb JSON
+// form, as made by user at now.
+func applyPatch(js map[string]interface{}, req *patchRequest, now time.Time, user string) {
+	sep := "\n"
+	if req.Separator != nil {
+		sep = *req.Separator
+	}
+	text, _ := js["text"].(string)
+	if req.Append != "" {
+		if text != "" {
+			text += sep
+		}
+		text += req.Append
+	}
+	if req.Prepend != "" {
+		if text != "" {
+			text = sep + text
+		}
+		text = req.Prepend + text
+	}
+	js["text"] = text
+
+	custom, _ := js["fields"].(map[string]interface{})
+	for name, v := range req.Fields {
+		if tiddlyWebFields[name] {
+			if v == nil {
+				delete(js, name)
+			} else {
+				js[name] = v
+			}
+			continue
+		}
+		if v == nil {
+			delete(custom, name)
+			continue
+		}
+		if custom == nil {
+			custom = make(map[string]interface{})
+			js["fields"] = custom
+		}
+		custom[name] = fieldString(v)
+	}
+	js["modified"] = tiddlyDate(now)
+	js["modifier"] = user
+	delete(js, "revision")
+}
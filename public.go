@@ -0,0 +1,125 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Re Public endpoints
+//
+// Everything is served behind the authentication check except the endpoints listed here, each of which is meant to
+// be reached by something that can't sign in through the proxy: load balancers, search engines and feed readers,
+// share-link visitors, mail services, clippers, calendar apps.  public-endpoints names the ones served without
+// signing in; the rest are still served, but only to signed-in users, the same as any other route.  Of those that
+// carry their own secrets (inbound-email, clip, calendar), the secret is checked either way.  metrics is off by
+// default: expvar's counters say little, but nothing about them is for strangers either.
+//
+// Nothing in front of a public endpoint vouches for the auth-header, so anyone can send one there: it is dropped
+// before the handler sees the request, and every request to a public endpoint is anonymous.
+//
+// The unauthenticated mux is built from this list and nothing else, so a new route is authenticated unless it is
+// added here by name.
+
+type publicEndpoint struct {
+	name     string
+	patterns []string
+	handler  http.Handler
+}
+
+// publicEndpoints returns the endpoints that may be served without signing
+// in.
+func publicEndpoints() []publicEndpoint {
+	return []publicEndpoint{
+		{"health", []string{"/health", "/livez"}, http.HandlerFunc(livez)},
+		{"ready", []string{"/readyz"}, http.HandlerFunc(readyz)},
+		{"metrics", []string{"/debug/vars"}, expvar.Handler()},
+		{"publish", []string{"/public/", "/render/", "/feed.atom", "/robots.txt", "/sitemap.xml"}, publishMux()},
+		{"share", []string{"/share/"}, http.HandlerFunc(sharedPage)},
+		{"inbound-email", []string{"/inbound-email/"}, http.HandlerFunc(inboundEmail)},
+		{"clip", []string{"/clip"}, clipAuth(readOnlyCheck(http.HandlerFunc(clip)))},
+		{"calendar", []string{"/calendar.ics"}, http.HandlerFunc(calendar)},
+		{"favicon", []string{"/favicon.ico"}, http.HandlerFunc(favicon)},
+	}
+}
+
+// publishMux serves the pages made for the public site.
+func publishMux() http.Handler {
+	m := http.NewServeMux()
+	m.HandleFunc("/public/", publicSite)
+	m.HandleFunc("/render/", renderTiddler)
+	m.HandleFunc("/feed.atom", feed)
+	m.HandleFunc("/robots.txt", robots)
+	m.HandleFunc("/sitemap.xml", sitemap)
+	return m
+}
+
+// registerPublic registers each of publicEndpoints on top if public-endpoints
+// names it, and on the authenticated mux r if not.
+func registerPublic(top, r *http.ServeMux) []string {
+	public := publicSet(cfg.PublicEndpoints)
+	var served []string
+	for _, e := range publicEndpoints() {
+		if e.name == "metrics" && cfg.OpsAddr != "" {
+			// Served on the ops listener instead (see Re Ops listener).
+			continue
+		}
+		mux, h := r, e.handler
+		if public[e.name] {
+			mux, h = top, rateLimitIP(anonymous(h))
+			served = append(served, e.name)
+		}
+		for _, pattern := range e.patterns {
+			mux.Handle(pattern, h)
+		}
+	}
+	return served
+}
+
+// anonymous serves next without the auth-header, which on a public endpoint
+// is only the client's word.
+func anonymous(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(cfg.AuthHeader)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// publicSet returns the endpoint names in a public-endpoints setting.
+func publicSet(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			set[name] = true
+		}
+	}
+	return set
+}
+
+// checkPublicEndpoints reports names in a public-endpoints setting that
+// aren't endpoints.
+func checkPublicEndpoints(s string) error {
+	known := make(map[string]bool)
+	var names []string
+	for _, e := range publicEndpoints() {
+		known[e.name] = true
+		names = append(names, e.name)
+	}
+	var unknown []string
+	for name := range publicSet(s) {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("unknown %s (known: %s)", strings.Join(unknown, ", "), strings.Join(names, ", "))
+}
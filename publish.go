@@ -0,0 +1,385 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Re Publishing
+//
+// The wiki itself is private, but some tiddlers are meant for everyone.  Set publish-tag (say, "public") and the
+// tiddlers carrying that tag are rendered to plain HTML pages, one per tiddler plus an index of them, newest first.
+// The pages are served without authentication under /public/, and "tiddly publish" writes the same files to a
+// directory or a Cloud Storage bucket for hosting elsewhere.  Pages link to each other with relative URLs, so the
+// site works the same wherever it's put.  Links to tiddlers that aren't published are left as text, and system
+// tiddlers and drafts are never published.
+
+// publishedTiddler is a tiddler on the public site.
+type publishedTiddler struct {
+	Title    string
+	Path     string
+	Tags     []string
+	Created  time.Time
+	Modified time.Time
+	Text     template.HTML
+}
+
+// publicSiteData is the built public site.
+type publicSiteData struct {
+	Title    string
+	Tiddlers []*publishedTiddler // newest first
+	Files    map[string][]byte   // by path
+}
+
+// buildSite renders the public site.
+func buildSite(ctx context.Context) (*publicSiteData, error) {
+	var pub []*publishedTiddler
+	var texts []tiddlerFields
+	siteTitle := "Published tiddlers"
+	err := retry(ctx, func() error {
+		pub, texts = nil, nil
+		return allTiddlers(ctx, func(title string, t *Tiddler) error {
+			if title == "$:/SiteTitle" && t.Meta != "" && t.Text != "" {
+				siteTitle = t.Text
+			}
+			if !publishable(title, t) {
+				return nil
+			}
+			f := parseFields(t)
+			if !hasTag(f.Tags, cfg.PublishTag) {
+				return nil
+			}
+			created, _ := parseTiddlyDate(f.Created)
+			modified, _ := parseTiddlyDate(f.Modified)
+			pub = append(pub, &publishedTiddler{
+				Title:    title,
+				Path:     publicPath(title),
+				Tags:     f.Tags,
+				Created:  created,
+				Modified: modified,
+			})
+			texts = append(texts, f)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]string)
+	for _, p := range pub {
+		paths[p.Title] = p.Path
+	}
+	link := func(title string) string { return paths[title] }
+
+	files := make(map[string][]byte)
+	for i, p := range pub {
+		p.Text = renderText(texts[i].Type, texts[i].Text, link)
+		var buf bytes.Buffer
+		if err := publicTemplate.ExecuteTemplate(&buf, "tiddler", struct {
+			Site string
+			*publishedTiddler
+		}{siteTitle, p}); err != nil {
+			return nil, err
+		}
+		files[p.Path] = buf.Bytes()
+	}
+
+	sort.Slice(pub, func(i, j int) bool {
+		if !pub[i].Modified.Equal(pub[j].Modified) {
+			return pub[i].Modified.After(pub[j].Modified)
+		}
+		return pub[i].Title < pub[j].Title
+	})
+	var buf bytes.Buffer
+	if err := publicTemplate.ExecuteTemplate(&buf, "index", struct {
+		Site     string
+		Tiddlers []*publishedTiddler
+	}{siteTitle, pub}); err != nil {
+		return nil, err
+	}
+	files["index.html"] = buf.Bytes()
+	return &publicSiteData{Title: siteTitle, Tiddlers: pub, Files: files}, nil
+}
+
+// tiddlerFields are the fields of a tiddler that rendering cares about.
+type tiddlerFields struct {
+	Tags     tagList `json:"tags"`
+	Type     string  `json:"type"`
+	Created  string  `json:"created"`
+	Modified string  `json:"modified"`
+	Text     string  `json:"-"`
+}
+
+func parseFields(t *Tiddler) tiddlerFields {
+	var f tiddlerFields
+	json.Unmarshal([]byte(t.Meta), &f)
+	f.Text = t.Text
+	return f
+}
+
+// publishable reports whether title may ever be published.
+func publishable(title string, t *Tiddler) bool {
+	return t.Meta != "" && !strings.HasPrefix(title, "$:/") && !strings.HasPrefix(title, "Draft of '")
+}
+
+// tagList is a tiddler's tags, which TiddlyWeb JSON gives as an array but
+// TiddlyWiki's own JSON exports give as a string.
+type tagList []string
+
+func (l *tagList) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*l = parseTags(s)
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+// parseTags splits a TiddlyWiki tags field: space-separated, with [[...]]
+// around tags containing spaces.
+func parseTags(s string) []string {
+	var tags []string
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		if strings.HasPrefix(s, "[[") {
+			if end := strings.Index(s, "]]"); end >= 0 {
+				tags = append(tags, s[2:end])
+				s = s[end+2:]
+				continue
+			}
+		}
+		end := strings.IndexAny(s, " \t\n")
+		if end < 0 {
+			end = len(s)
+		}
+		tags = append(tags, s[:end])
+		s = s[end:]
+	}
+	return tags
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// publicPath returns the file name of title's page. Titles are free text, so
+// anything but a conservative set of characters is replaced, and a hash of
+// the title keeps the names of titles that differ only there apart.
+func publicPath(title string) string {
+	var b strings.Builder
+	changed := false
+	for _, c := range title {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_':
+			b.WriteRune(c)
+		default:
+			b.WriteByte('-')
+			changed = true
+		}
+	}
+	if changed || b.Len() == 0 || title == "index" {
+		sum := md5.Sum([]byte(title))
+		fmt.Fprintf(&b, "-%x", sum[:4])
+	}
+	return b.String() + ".html"
+}
+
+var publicTemplate = template.Must(template.New("public").Funcs(template.FuncMap{
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2 January 2006")
+	},
+}).Parse(`
+{{define "header"}}<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.}}</title>
+<style>
+body { font-family: sans-serif; max-width: 44em; margin: 2em auto; padding: 0 1em; line-height: 1.5; }
+pre { overflow-x: auto; background: #f4f4f4; padding: 0.5em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 0.8em; border: 1px solid #ddd; }
+.meta { color: #666; }
+</style>
+</head>
+<body>
+{{end}}
+
+{{define "index"}}{{template "header" .Site}}
+<h1>{{.Site}}</h1>
+<ul>
+{{range .Tiddlers}}<li><a href="{{.Path}}">{{.Title}}</a> <span class="meta">{{date .Modified}}</span></li>
+{{end}}</ul>
+</body>
+</html>
+{{end}}
+
+{{define "tiddler"}}{{template "header" .Title}}
+<p><a href="index.html">{{.Site}}</a></p>
+<h1>{{.Title}}</h1>
+<p class="meta">{{date .Modified}}{{range .Tags}} · {{.}}{{end}}</p>
+{{.Text}}
+</body>
+</html>
+{{end}}
+
+{{define "render"}}{{template "header" .Title}}
+<h1>{{.Title}}</h1>
+<p class="meta">{{date .Modified}}{{range .Tags}} · {{.}}{{end}}</p>
+{{.Text}}
+</body>
+</html>
+{{end}}
+`))
+
+var site siteCache
+
+// siteCache holds the public site between rebuilds.
+type siteCache struct {
+	mu    sync.Mutex
+	built time.Time
+	site  *publicSiteData
+}
+
+func (c *siteCache) get(ctx context.Context) (*publicSiteData, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.site != nil && time.Since(c.built) < cfg.PublishCacheTTL {
+		return c.site, nil
+	}
+	s, err := buildSite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.site, c.built = s, time.Now()
+	return s, nil
+}
+
+// publicSite serves the public site under /public/. It's mounted outside the
+// authentication check.
+func publicSite(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	if cfg.PublishTag == "" {
+		http.Error(w, "not found", 404)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/public/")
+	if path == "" {
+		path = "index.html"
+	}
+	s, err := site.get(r.Context())
+	if err != nil {
+		// Visitors aren't users; keep the details in the log.
+		logf(r.Context(), "building public site: %v", err)
+		http.Error(w, "internal error", 500)
+		return
+	}
+	data, ok := s.Files[path]
+	if !ok {
+		http.Error(w, "not found", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(cfg.PublishCacheTTL.Seconds())))
+	w.Write(data)
+}
+
+// writeSiteDir writes files to dir, removing pages left over from earlier
+// runs so that unpublished tiddlers don't stay public.
+func writeSiteDir(dir string, files map[string][]byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	old, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return err
+	}
+	for _, name := range old {
+		if _, ok := files[filepath.Base(name)]; !ok {
+			if err := os.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSiteBucket uploads files to bucket under prefix, deleting objects
+// there that are no longer part of the site.
+func writeSiteBucket(ctx context.Context, bucket, prefix string, files map[string][]byte) error {
+	opts, err := googleOptions(ctx)
+	if err != nil {
+		return err
+	}
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	b := client.Bucket(bucket)
+
+	it := b.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(attrs.Name, prefix)
+		if _, ok := files[name]; !ok && strings.HasSuffix(name, ".html") && !strings.Contains(name, "/") {
+			if err := b.Object(attrs.Name).Delete(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	for name, data := range files {
+		w := b.Object(prefix + name).NewWriter(ctx)
+		w.ContentType = "text/html; charset=utf-8"
+		w.CacheControl = fmt.Sprintf("public, max-age=%d", int(cfg.PublishCacheTTL.Seconds()))
+		if _, err := w.Write(data); err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Quotas
+//
+// Everyone shares one wiki, so storage is accounted to the user who saved each revision: every revision records
+// its saver, and a user's usage is the bytes of all the revisions they saved that are still stored, history
+// included, so a user can't get around a quota by saving over the same tiddler.  Revisions saved before the server
+// kept track, or from the command line, belong to nobody.  quota-bytes limits every user, and user-quotas sets
+// limits for particular users ("alice=100000000,bob=0"); a quota of 0 in user-quotas forbids the user to save at
+// all, and a save by them is refused with 403, while a save that would take a user over their quota is refused
+// with 507 Insufficient Storage.  Deleting a tiddler doesn't free anything, since its history stays; pruning the
+// history does.  /admin/stats lists each user's usage and quota.
+//
+// Usage comes from a scan of the history, which is redone every usageRefresh (and kept up to date in between with
+// the saves this server makes), so with several servers a user can go a little over quota before all of them
+// notice.  The scan reads only who saved each revision and how big it is, and saves carry on with the old totals
+// while it runs.
+
+// usageRefresh is how often usage is recounted from the store.
+const usageRefresh = 10 * time.Minute
+
+var (
+	errNoSaving      = errors.New("you are not allowed to save tiddlers")
+	errQuotaExceeded = errors.New("storage quota exceeded")
+)
+
+type userKey struct{}
+
+// withUser returns r with its user recorded in its context, for saves made
+// while handling it.
+func withUser(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKey{}, currentUser(r)))
+}
+
+// userOf returns the user whose request ctx belongs to, or "".
+func userOf(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// parseUserQuotas parses the user-quotas setting.
+func parseUserQuotas(s string) (map[string]int64, error) {
+	quotas := make(map[string]int64)
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		i := strings.LastIndex(f, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%q is not user=bytes", f)
+		}
+		n, err := strconv.ParseInt(f[i+1:], 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%q is not user=bytes", f)
+		}
+		quotas[f[:i]] = n
+	}
+	return quotas, nil
+}
+
+// quotaOf returns user's quota in bytes, or -1 if they have none.
+func quotaOf(user string) int64 {
+	quotas, _ := parseUserQuotas(cfg.UserQuotas)
+	if q, ok := quotas[user]; ok {
+		return q
+	}
+	if cfg.QuotaBytes > 0 {
+		return cfg.QuotaBytes
+	}
+	return -1
+}
+
+// quotasOn reports whether any quota is configured.
+func quotasOn() bool {
+	return cfg.QuotaBytes > 0 || strings.TrimSpace(cfg.UserQuotas) != ""
+}
+
+// revisionBytes is how much of its saver's quota t takes.
+func revisionBytes(t *Tiddler) int64 {
+	return int64(len(t.Meta) + len(t.Text))
+}
+
+type usageTracker struct {
+	mu       sync.Mutex
+	bytes    map[string]int64 // nil until first counted
+	counted  time.Time
+	counting chan struct{}    // closed when the recount under way ends; nil if none is
+	added    map[string]int64 // saves counted during the recount, to carry over into its totals
+}
+
+var usage usageTracker
+
+// revisionSize is a TiddlerHistory entity reduced to what quotas count, so
+// that the scan doesn't keep every revision's text.
+type revisionSize struct {
+	User string
+	Meta byteCount
+	Text byteCount
+}
+
+func (s *revisionSize) Load(ps []datastore.Property) error {
+	*s = revisionSize{}
+	for _, p := range ps {
+		v, _ := p.Value.(string)
+		switch p.Name {
+		case "User":
+			s.User = v
+		case "Meta":
+			s.Meta = byteCount(len(v))
+		case "Text":
+			s.Text = byteCount(len(v))
+		}
+	}
+	return nil
+}
+
+func (s *revisionSize) Save() ([]datastore.Property, error) {
+	return nil, errors.New("revisionSize can't be saved")
+}
+
+// byteCount is the length of a string decoded from JSON, the string itself
+// being dropped.
+type byteCount int64
+
+func (n *byteCount) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*n = byteCount(len(s))
+	return nil
+}
+
+// scanUsage totals the stored revisions by who saved them.
+func scanUsage(ctx context.Context) (map[string]int64, error) {
+	var bytes map[string]int64
+	err := retry(ctx, func() error {
+		bytes = make(map[string]int64)
+		var rs revisionSize
+		return db.Scan(ctx, "TiddlerHistory", "", &rs, func(string) error {
+			bytes[rs.User] += int64(rs.Meta + rs.Text)
+			rs = revisionSize{}
+			return nil
+		})
+	})
+	return bytes, err
+}
+
+// current returns each user's usage, recounting it if it is stale.  One
+// caller recounts, outside the lock, while the rest carry on with the stale
+// totals, or wait for the recount if there are none yet.
+func (u *usageTracker) current(ctx context.Context) (map[string]int64, error) {
+	u.mu.Lock()
+	for u.bytes == nil && u.counting != nil {
+		done := u.counting
+		u.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		u.mu.Lock()
+	}
+	if u.counting != nil || u.bytes != nil && time.Since(u.counted) <= usageRefresh {
+		bytes := u.bytes
+		u.mu.Unlock()
+		return bytes, nil
+	}
+	done := make(chan struct{})
+	u.counting, u.added = done, make(map[string]int64)
+	u.mu.Unlock()
+
+	bytes, err := scanUsage(ctx)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err == nil {
+		for user, n := range u.added {
+			bytes[user] += n
+		}
+		u.bytes, u.counted = bytes, time.Now()
+	}
+	u.counting, u.added = nil, nil
+	close(done)
+	return bytes, err
+}
+
+// add counts n more bytes saved by user.
+func (u *usageTracker) add(user string, n int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.bytes != nil {
+		u.bytes[user] += n
+	}
+	if u.added != nil {
+		u.added[user] += n
+	}
+}
+
+// checkQuota returns an error if the user whose request ctx belongs to may
+// not save n more bytes.
+func checkQuota(ctx context.Context, n int64) error {
+	if !quotasOn() {
+		return nil
+	}
+	user := userOf(ctx)
+	quota := quotaOf(user)
+	switch {
+	case quota < 0 || user == "":
+		return nil
+	case quota == 0:
+		return errNoSaving
+	}
+	bytes, err := usage.current(ctx)
+	if err != nil {
+		return err
+	}
+	usage.mu.Lock()
+	used := bytes[user]
+	usage.mu.Unlock()
+	if used+n > quota {
+		return fmt.Errorf("%w: %d of %d bytes used, and this save needs %d more", errQuotaExceeded, used, quota, n)
+	}
+	return nil
+}
+
+// quotaError answers a request refused by checkQuota, reporting whether err
+// was such a refusal.
+func quotaError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, errNoSaving):
+		http.Error(w, err.Error(), 403)
+	case errors.Is(err, errQuotaExceeded):
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	default:
+		return false
+	}
+	return true
+}
+
+// userUsage is a user's storage, for /admin/stats.
+type userUsage struct {
+	User  string `json:"user"`
+	Bytes int64  `json:"bytes"`
+	Quota int64  `json:"quota"` // -1 for none
+}
+
+// usageByUser returns every user's usage, largest first.
+func usageByUser(ctx context.Context) ([]userUsage, error) {
+	bytes, err := usage.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	usage.mu.Lock()
+	list := make([]userUsage, 0, len(bytes))
+	for user, n := range bytes {
+		list = append(list, userUsage{user, n, quotaOf(user)})
+	}
+	usage.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Bytes > list[j].Bytes })
+	return list, nil
+}
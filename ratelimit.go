@@ -0,0 +1,147 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Re Rate limiting
+//
+// A sync loop gone wrong in some browser tab can issue a write per second forever, each one costing two Datastore
+// writes.  Mutating requests are therefore metered by a token bucket per user (or per client IP if there is no
+// user), refilled at RATE_LIMIT requests per second up to RATE_BURST.  Reads are not limited.  RATE_LIMIT=0 turns
+// limiting off.  The endpoints served without signing in (see Re Public endpoints), such as a share's password form
+// or inbound email, are metered per client IP alone, since anyone can send a user header there.
+//
+// Behind a proxy every request comes from the proxy's address, so set client-ip-header to the header it puts the
+// client's address in, such as X-Forwarded-For or X-Real-IP.  The header is trusted, so it must be one the proxy
+// sets rather than passes on.  Of a list, the last address is taken, the one the proxy itself added; anything
+// before it came from the client.
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from key's bucket. If none is available it reports how
+// long until one will be.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops buckets that have been idle long enough to have refilled, so
+// the map doesn't grow with every client ever seen.
+func (l *rateLimiter) sweep(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.swept) < full {
+		return
+	}
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, k)
+		}
+	}
+	l.swept = now
+}
+
+func rateLimitKey(r *http.Request) string {
+	if user := currentUser(r); user != "" {
+		return "user:" + user
+	}
+	return "ip:" + clientIP(r)
+}
+
+// clientIP returns the address r came from, as client-ip-header gives it if
+// it is set.
+func clientIP(r *http.Request) string {
+	if cfg.ClientIPHeader != "" {
+		if h := r.Header.Values(cfg.ClientIPHeader); len(h) > 0 {
+			list := strings.Split(h[len(h)-1], ",")
+			if ip := strings.TrimSpace(list[len(list)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
+
+func isMutation(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return false
+	}
+	return true
+}
+
+// limiter is the rate limiter every handler newHandler builds shares, or nil
+// if limiting is off.
+var limiter *rateLimiter
+
+func rateLimit(next http.Handler) http.Handler {
+	return limitBy(rateLimitKey, next)
+}
+
+// rateLimitIP limits by client IP alone, for endpoints served without
+// signing in.
+func rateLimitIP(next http.Handler) http.Handler {
+	return limitBy(func(r *http.Request) string { return "ip:" + clientIP(r) }, next)
+}
+
+func limitBy(key func(r *http.Request) string, next http.Handler) http.Handler {
+	l := limiter
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isMutation(r.Method) {
+			if ok, wait := l.allow(key(r), time.Now()); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "too many requests", 429)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,87 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Re Redaction
+//
+// log-titles says what becomes of tiddler titles in what the server logs and reports: show (the default) leaves them
+// be, hash puts a short digest such as #3f9a0c1e in their place, so that lines about the same tiddler can still be
+// matched up without saying what it is, and hide puts [redacted].  It covers the log lines handlers write about what
+// users did (renames, copies, shares and so on), the line logged for each 5xx response, and the messages sent to the
+// error reporter; with hash or hide, the 5xx line names the route rather than the path, as traces and error reports
+// already do, and the title in the request's path is taken out of error messages and panics.  Tiddler text is never
+// logged.  Digests are keyed with LOG_TITLE_KEY if it is set, so that they can't be reversed by hashing likely titles
+// and so that every instance given the same key agrees; without it they are plain SHA-256 and only stop casual reading.
+//
+// Code that logs a title passes it as loggedTitle(title) rather than title, and redaction happens when it is
+// formatted, so that the setting can't be missed by one call site and honoured by the next.
+
+// loggedTitle is a title (or something made of titles, such as a filter)
+// as it may appear in logs.
+type loggedTitle string
+
+func (t loggedTitle) String() string {
+	return redactTitle(string(t))
+}
+
+var logTitleKey = []byte(os.Getenv("LOG_TITLE_KEY"))
+
+// redactTitle returns title as log-titles says it may be logged.
+func redactTitle(title string) string {
+	if title == "" {
+		return ""
+	}
+	switch cfg.LogTitles {
+	case "hash":
+		var sum []byte
+		if len(logTitleKey) > 0 {
+			mac := hmac.New(sha256.New, logTitleKey)
+			mac.Write([]byte(title))
+			sum = mac.Sum(nil)
+		} else {
+			s := sha256.Sum256([]byte(title))
+			sum = s[:]
+		}
+		return "#" + hex.EncodeToString(sum[:4])
+	case "hide":
+		return "[redacted]"
+	}
+	return title
+}
+
+// redactRequest returns msg, about r, with the title in r's path redacted.
+func redactRequest(r *http.Request, msg string) string {
+	if cfg.LogTitles == "show" || r == nil {
+		return msg
+	}
+	if title := requestTitle(r); title != "" {
+		msg = strings.ReplaceAll(msg, title, redactTitle(title))
+	}
+	return msg
+}
+
+// loggedPath returns r's path as it may be logged: the route rather than the
+// path unless titles are shown.
+func loggedPath(r *http.Request) string {
+	if cfg.LogTitles == "show" {
+		return r.URL.Path
+	}
+	return strings.TrimPrefix(spanName(r), r.Method+" ")
+}
+
+// requestTitle returns the title in r's path, if its route has one.
+func requestTitle(r *http.Request) string {
+	_, title := routeOf(r)
+	return unescapeTitle(title)
+}
@@ -0,0 +1,438 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Redis
+//
+// With redis-addr set, a Redis server (or Memorystore) caches tiddlers in front of whichever storage is in use, so
+// that the reads every browser makes, above all the skinny list it polls every minute or so, cost one Redis lookup
+// rather than a scan of the store.  Anything that changes a tiddler, a save as much as a rename transaction or a
+// batch save, removes it from the cache, and the next read fills it again.  A read that misses notes
+// the tiddler's generation, a counter that every removal increments, before reading the store, and fills the cache
+// only if nothing is there and the generation is still the one it noted, checked and set in one script so that
+// nothing can come between: a slow read can't put back what a write it raced with replaced.  The list is cached
+// under a generation number that every change of a Tiddler increments, for the same reason.  Since the cache is
+// shared, all this holds for all the servers using it.  Entries also expire after redis-ttl, which bounds how stale
+// the cache can get if an invalidation is lost.  The cache is only an optimization: if Redis is unreachable, reads
+// go to the store and the failure is logged.
+//
+// Keys are prefixed with redis-prefix, so one Redis can serve several wikis.  Set REDIS_PASSWORD if it needs AUTH.
+//
+// Each change is also published on the changes channel, so that the in-process caches of the other servers (see
+// Re Cache layers) can drop what it replaces.
+
+const redisTimeout = time.Second
+
+// redisClient speaks just enough of the Redis protocol to use it as a cache.
+type redisClient struct {
+	addr     string
+	password string
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newRedisClient(addr, password string) *redisClient {
+	return &redisClient{addr: addr, password: password, idle: make(chan *redisConn, 8)}
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (c *redisClient) conn() (*redisConn, error) {
+	select {
+	case rc := <-c.idle:
+		return rc, nil
+	default:
+	}
+	return c.dial()
+}
+
+func (c *redisClient) dial() (*redisConn, error) {
+	nc, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{nc, bufio.NewReader(nc)}
+	if c.password != "" {
+		if _, err := rc.do("AUTH", c.password); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do sends a command and returns its reply: a string, an int64, nil, or a
+// []interface{} of those.
+func (c *redisClient) do(ctx context.Context, args ...string) (interface{}, error) {
+	rc, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(redisTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	rc.SetDeadline(deadline)
+	reply, err := rc.do(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		rc.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- rc:
+	default:
+		rc.Close()
+	}
+	return reply, err
+}
+
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	w := bufio.NewWriter(rc.Conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return rc.reply()
+}
+
+func (rc *redisConn) reply() (interface{}, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	typ, rest := line[0], line[1:len(line)-2]
+	switch typ {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = rc.reply(); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", typ)
+}
+
+// redisStore is a Store caching Tiddler entities and the skinny list in
+// Redis.
+type redisStore struct {
+	Store
+	redis *redisClient
+}
+
+func newRedisStore(s Store) Store {
+	return &redisStore{s, newRedisClient(cfg.RedisAddr, os.Getenv("REDIS_PASSWORD"))}
+}
+
+func (s *redisStore) key(name string) string {
+	return cfg.RedisPrefix + name
+}
+
+func (s *redisStore) entityKey(key *datastore.Key) (string, bool) {
+	return s.key("Tiddler/" + key.Name), key.Kind == "Tiddler"
+}
+
+// set caches data under name, unless something is already there.
+func (s *redisStore) set(ctx context.Context, name string, data []byte) {
+	ttl := strconv.Itoa(int(cfg.RedisTTL / time.Second))
+	if _, err := s.redis.do(ctx, "SET", name, string(data), "EX", ttl, "NX"); err != nil {
+		log.Printf("redis cache: %v", err)
+	}
+}
+
+// fillScript caches ARGV[1] under KEYS[1] if nothing is cached there and
+// KEYS[2], the entry's generation, is still ARGV[2] ("" for none).
+const fillScript = `
+local gen = redis.call("GET", KEYS[2]) or ""
+if gen ~= ARGV[2] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "EX", ARGV[3], "NX")
+return 1
+`
+
+// forgetScript removes the entries KEYS[1], KEYS[3], ..., moving each on to
+// a new generation, kept in KEYS[2], KEYS[4], ...
+const forgetScript = `
+for i = 1, #KEYS, 2 do
+	redis.call("INCR", KEYS[i+1])
+	redis.call("EXPIRE", KEYS[i+1], ARGV[1])
+	redis.call("DEL", KEYS[i])
+end
+return 0
+`
+
+// genKey returns the name of the generation counter of the entry name.
+func (s *redisStore) genKey(name string) string {
+	return name + "#gen"
+}
+
+// fill caches data under name for a read that found generation gen before
+// going to the store.
+func (s *redisStore) fill(ctx context.Context, name, gen string, data []byte) {
+	ttl := strconv.Itoa(int(cfg.RedisTTL / time.Second))
+	if _, err := s.redis.do(ctx, "EVAL", fillScript, "2", name, s.genKey(name), string(data), gen, ttl); err != nil {
+		log.Printf("redis cache: %v", err)
+	}
+}
+
+// forget removes cached entities, and moves on to a new generation of the
+// list if any are Tiddlers.
+func (s *redisStore) forget(ctx context.Context, keys []*datastore.Key) {
+	var names, titles []string
+	for _, key := range keys {
+		if name, ok := s.entityKey(key); ok {
+			names = append(names, name, s.genKey(name))
+			titles = append(titles, key.Name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	args := append([]string{"EVAL", forgetScript, strconv.Itoa(len(names))}, names...)
+	args = append(args, strconv.Itoa(int(cfg.RedisTTL/time.Second)))
+	if _, err := s.redis.do(ctx, args...); err != nil {
+		log.Printf("redis cache: %v", err)
+	}
+	s.changed(ctx, titles)
+}
+
+// changed moves on to a new generation of the list and tells the other
+// servers that titles have changed.
+func (s *redisStore) changed(ctx context.Context, titles []string) {
+	if _, err := s.redis.do(ctx, "INCR", s.key("generation")); err != nil {
+		log.Printf("redis cache: %v", err)
+	}
+	msg, _ := json.Marshal(titles)
+	if _, err := s.redis.do(ctx, "PUBLISH", s.key("changes"), string(msg)); err != nil {
+		log.Printf("redis cache: %v", err)
+	}
+}
+
+// dropCaches starts a new generation of the list and tells every server to
+// forget all it caches.  Cached Tiddlers are left alone: they are what the
+// backend holds.
+func (s *redisStore) dropCaches(ctx context.Context) {
+	s.changed(ctx, nil)
+	if d, ok := s.Store.(cacheDropper); ok {
+		d.dropCaches(ctx)
+	}
+}
+
+// watchChanges calls fn with the titles of the Tiddlers changed by any
+// server, or with nil when it may have missed some, until the process exits.
+func (s *redisStore) watchChanges(fn func(titles []string)) {
+	go func() {
+		for {
+			err := recovered("redis changes", func() error { return s.subscribe(fn) })
+			log.Printf("redis changes: %v", err)
+			fn(nil)
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+func (s *redisStore) subscribe(fn func(titles []string)) error {
+	rc, err := s.redis.dial()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	rc.SetDeadline(time.Now().Add(redisTimeout))
+	if _, err := rc.do("SUBSCRIBE", s.key("changes")); err != nil {
+		return err
+	}
+	rc.SetDeadline(time.Time{})
+	// Anything may have changed while we weren't subscribed.
+	fn(nil)
+	for {
+		reply, err := rc.reply()
+		if err != nil {
+			return err
+		}
+		// A message is ["message", channel, payload].
+		a, ok := reply.([]interface{})
+		if !ok || len(a) != 3 || a[0] != "message" {
+			continue
+		}
+		payload, _ := a[2].(string)
+		var titles []string
+		if json.Unmarshal([]byte(payload), &titles) != nil {
+			fn(nil)
+			continue
+		}
+		fn(titles)
+	}
+}
+
+func (s *redisStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	name, ok := s.entityKey(key)
+	if !ok {
+		return s.Store.Get(ctx, key, dst)
+	}
+	reply, err := s.redis.do(ctx, "MGET", name, s.genKey(name))
+	if err != nil {
+		log.Printf("redis cache: %v", err)
+		return s.Store.Get(ctx, key, dst)
+	}
+	a, _ := reply.([]interface{})
+	if len(a) != 2 {
+		return s.Store.Get(ctx, key, dst)
+	}
+	if data, ok := a[0].(string); ok && json.Unmarshal([]byte(data), dst) == nil {
+		return nil
+	}
+	gen, _ := a[1].(string)
+	if err := s.Store.Get(ctx, key, dst); err != nil {
+		return err
+	}
+	if data, err := json.Marshal(dst); err == nil {
+		s.fill(ctx, name, gen, data)
+	}
+	return nil
+}
+
+func (s *redisStore) Put(ctx context.Context, key *datastore.Key, src interface{}) error {
+	// Not written through: two saves racing could set the cache in the
+	// other order to the one the store has them in.
+	err := s.Store.Put(ctx, key, src)
+	s.forget(ctx, []*datastore.Key{key})
+	return err
+}
+
+func (s *redisStore) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) error {
+	err := s.Store.PutMulti(ctx, keys, src)
+	s.forget(ctx, keys)
+	return err
+}
+
+func (s *redisStore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	err := s.Store.DeleteMulti(ctx, keys)
+	s.forget(ctx, keys)
+	return err
+}
+
+func (s *redisStore) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	var written []*datastore.Key
+	err := s.Store.RunInTransaction(ctx, func(tx Transaction) error {
+		written = written[:0]
+		return f(&recordingTx{tx, &written})
+	})
+	s.forget(ctx, written)
+	return err
+}
+
+// cachedList returns the skinny tiddler list, calling build if it isn't
+// cached.
+func (s *redisStore) cachedList(ctx context.Context, build func() ([]byte, error)) ([]byte, error) {
+	reply, err := s.redis.do(ctx, "GET", s.key("generation"))
+	if err != nil {
+		log.Printf("redis cache: %v", err)
+		return build()
+	}
+	gen, _ := reply.(string)
+	key := s.key("list/" + gen)
+	if reply, err = s.redis.do(ctx, "GET", key); err != nil {
+		log.Printf("redis cache: %v", err)
+	}
+	if data, ok := reply.(string); ok {
+		return []byte(data), nil
+	}
+	data, err := build()
+	if err != nil {
+		return nil, err
+	}
+	s.set(ctx, key, data)
+	return data, nil
+}
+
+// listCacher is implemented by stores that can cache the skinny tiddler
+// list, forgetting it whenever a Tiddler changes.
+type listCacher interface {
+	cachedList(ctx context.Context, build func() ([]byte, error)) ([]byte, error)
+}
+
+// changeNotifier is implemented by stores that can report changes made by
+// other servers sharing them.
+type changeNotifier interface {
+	watchChanges(fn func(titles []string))
+}
+
+// cacheDropper is implemented by cache layers, which drop everything they
+// hold, and have every other server's layers do the same, when told to.
+type cacheDropper interface {
+	dropCaches(ctx context.Context)
+}
+
+// recordingTx is a Transaction noting the keys written through it.
+type recordingTx struct {
+	Transaction
+	written *[]*datastore.Key
+}
+
+func (tx *recordingTx) Put(key *datastore.Key, src interface{}) error {
+	*tx.written = append(*tx.written, key)
+	return tx.Transaction.Put(key, src)
+}
+
+func (tx *recordingTx) PutMulti(keys []*datastore.Key, src interface{}) error {
+	*tx.written = append(*tx.written, keys...)
+	return tx.Transaction.PutMulti(keys, src)
+}
+
+func (tx *recordingTx) Delete(key *datastore.Key) error {
+	*tx.written = append(*tx.written, key)
+	return tx.Transaction.Delete(key)
+}
@@ -0,0 +1,349 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// fakeRedis is an in-process server speaking the commands redisStore uses,
+// with the two scripts it evaluates run in Go.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu    sync.Mutex
+	data  map[string]string
+	subs  map[string][]*fakeRedisConn
+	dials int
+}
+
+type fakeRedisConn struct {
+	net.Conn
+	mu sync.Mutex // serializes writes, which PUBLISH makes from other conns
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, password: password, data: map[string]string{}, subs: map[string][]*fakeRedisConn{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.dials++
+			f.mu.Unlock()
+			go f.serve(&fakeRedisConn{Conn: nc})
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) addr() string { return f.ln.Addr().String() }
+
+func (f *fakeRedis) get(key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.data[key]
+	return v, ok
+}
+
+func (f *fakeRedis) serve(c *fakeRedisConn) {
+	defer c.Close()
+	// A request is an array of bulk strings, which the client's own parser
+	// reads as well as it reads replies.
+	rc := &redisConn{c.Conn, bufio.NewReader(c.Conn)}
+	authed := f.password == ""
+	for {
+		req, err := rc.reply()
+		if err != nil {
+			return
+		}
+		a, _ := req.([]interface{})
+		args := make([]string, len(a))
+		for i := range a {
+			args[i], _ = a[i].(string)
+		}
+		if len(args) == 0 {
+			c.write("-ERR empty command")
+			continue
+		}
+		switch {
+		case args[0] == "AUTH":
+			if len(args) == 2 && args[1] == f.password {
+				authed = true
+				c.write("+OK")
+			} else {
+				c.write("-WRONGPASS invalid password")
+			}
+		case !authed:
+			c.write("-NOAUTH Authentication required.")
+		default:
+			c.write(f.command(c, args)...)
+		}
+	}
+}
+
+// command runs args and returns the lines of its reply.
+func (f *fakeRedis) command(c *fakeRedisConn, args []string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch args[0] {
+	case "GET":
+		return f.bulk(args[1])
+	case "MGET":
+		reply := []string{fmt.Sprintf("*%d", len(args)-1)}
+		for _, k := range args[1:] {
+			reply = append(reply, f.bulk(k)...)
+		}
+		return reply
+	case "SET":
+		nx := args[len(args)-1] == "NX"
+		if _, ok := f.data[args[1]]; ok && nx {
+			return []string{"$-1"}
+		}
+		f.data[args[1]] = args[2]
+		return []string{"+OK"}
+	case "INCR":
+		return []string{fmt.Sprintf(":%d", f.incr(args[1]))}
+	case "PUBLISH":
+		subs := f.subs[args[1]]
+		for _, s := range subs {
+			s.write("*3", "$7", "message", fmt.Sprintf("$%d", len(args[1])), args[1],
+				fmt.Sprintf("$%d", len(args[2])), args[2])
+		}
+		return []string{fmt.Sprintf(":%d", len(subs))}
+	case "SUBSCRIBE":
+		f.subs[args[1]] = append(f.subs[args[1]], c)
+		return []string{"*3", "$9", "subscribe", fmt.Sprintf("$%d", len(args[1])), args[1], ":1"}
+	case "EVAL":
+		n, _ := strconv.Atoi(args[2])
+		keys, argv := args[3:3+n], args[3+n:]
+		switch args[1] {
+		case fillScript:
+			if f.data[keys[1]] != argv[1] {
+				return []string{":0"}
+			}
+			if _, ok := f.data[keys[0]]; !ok {
+				f.data[keys[0]] = argv[0]
+			}
+			return []string{":1"}
+		case forgetScript:
+			for i := 0; i < len(keys); i += 2 {
+				f.incr(keys[i+1])
+				delete(f.data, keys[i])
+			}
+			return []string{":0"}
+		}
+		return []string{"-ERR unknown script"}
+	}
+	return []string{"-ERR unknown command '" + args[0] + "'"}
+}
+
+func (f *fakeRedis) bulk(key string) []string {
+	v, ok := f.data[key]
+	if !ok {
+		return []string{"$-1"}
+	}
+	return []string{fmt.Sprintf("$%d", len(v)), v}
+}
+
+func (f *fakeRedis) incr(key string) int {
+	n, _ := strconv.Atoi(f.data[key])
+	n++
+	f.data[key] = strconv.Itoa(n)
+	return n
+}
+
+func (c *fakeRedisConn) write(lines ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := bufio.NewWriter(c.Conn)
+	for _, l := range lines {
+		fmt.Fprintf(w, "%s\r\n", l)
+	}
+	w.Flush()
+}
+
+func TestRedisClient(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeRedis(t, "sesame")
+	c := newRedisClient(f.addr(), "sesame")
+
+	if reply, err := c.do(ctx, "SET", "k", "line one\r\nline two", "EX", "60"); err != nil || reply != "OK" {
+		t.Fatalf("SET: %#v, %v", reply, err)
+	}
+	if reply, err := c.do(ctx, "GET", "k"); err != nil || reply != "line one\r\nline two" {
+		t.Errorf("GET: %#v, %v", reply, err)
+	}
+	if reply, err := c.do(ctx, "GET", "missing"); err != nil || reply != nil {
+		t.Errorf("GET of a missing key: %#v, %v", reply, err)
+	}
+	if reply, err := c.do(ctx, "INCR", "n"); err != nil || reply != int64(1) {
+		t.Errorf("INCR: %#v, %v", reply, err)
+	}
+	reply, err := c.do(ctx, "MGET", "k", "missing", "n")
+	a, _ := reply.([]interface{})
+	if err != nil || len(a) != 3 || a[0] != "line one\r\nline two" || a[1] != nil || a[2] != "1" {
+		t.Errorf("MGET: %#v, %v", reply, err)
+	}
+	if _, err := c.do(ctx, "FLUSHALL"); err == nil {
+		t.Error("unknown command: no error")
+	} else if _, ok := err.(redisError); !ok {
+		t.Errorf("unknown command: %T %v, want a redisError", err, err)
+	}
+	// An error reply leaves the connection usable, so it goes back in the pool.
+	if _, err := c.do(ctx, "GET", "k"); err != nil {
+		t.Errorf("GET after an error reply: %v", err)
+	}
+	f.mu.Lock()
+	dials := f.dials
+	f.mu.Unlock()
+	if dials != 1 {
+		t.Errorf("%d connections dialed for commands made one at a time, want 1", dials)
+	}
+
+	if _, err := newRedisClient(f.addr(), "wrong").do(ctx, "GET", "k"); err == nil {
+		t.Error("wrong password: no error")
+	}
+	if _, err := newRedisClient(f.addr(), "").do(ctx, "GET", "k"); err == nil {
+		t.Error("no password: no error")
+	}
+}
+
+func TestRedisPool(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeRedis(t, "")
+	c := newRedisClient(f.addr(), "")
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("k%d", i)
+			for j := 0; j < 20; j++ {
+				if _, err := c.do(ctx, "SET", key, strconv.Itoa(j), "EX", "60"); err != nil {
+					t.Error(err)
+					return
+				}
+				// Each connection's reply must be its own.
+				if reply, err := c.do(ctx, "GET", key); err != nil || reply != strconv.Itoa(j) {
+					t.Errorf("GET %s: %#v, %v, want %d", key, reply, err, j)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := len(c.idle); n > cap(c.idle) || n == 0 {
+		t.Errorf("%d idle connections, want 1 to %d", n, cap(c.idle))
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	useTestStore(t)
+	ctx := context.Background()
+	f := newFakeRedis(t, "")
+	cfg.RedisAddr = f.addr()
+	s := newRedisStore(db).(*redisStore)
+	key := datastore.NameKey("Tiddler", "Cached", nil)
+	name, _ := s.entityKey(key)
+
+	if err := s.Put(ctx, key, &Tiddler{Rev: 1, Meta: "{}", Text: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.get(name); ok {
+		t.Error("Put cached what it wrote, rather than leaving it to the next read")
+	}
+	var got Tiddler
+	if err := s.Get(ctx, key, &got); err != nil || got.Text != "one" {
+		t.Fatalf("Get: %+v, %v", got, err)
+	}
+	if _, ok := f.get(name); !ok {
+		t.Fatal("Get didn't fill the cache")
+	}
+
+	// A read that started before a save must not cache what it read after
+	// the save removed the entry.
+	gen, _ := f.get(s.genKey(name))
+	if err := s.Put(ctx, key, &Tiddler{Rev: 2, Meta: "{}", Text: "two"}); err != nil {
+		t.Fatal(err)
+	}
+	s.fill(ctx, name, gen, []byte(`{"Rev":1,"Meta":"{}","Text":"one"}`))
+	if _, ok := f.get(name); ok {
+		t.Error("a stale read refilled the cache after a save")
+	}
+	got = Tiddler{}
+	if err := s.Get(ctx, key, &got); err != nil || got.Text != "two" {
+		t.Errorf("Get after the second Put: %+v, %v", got, err)
+	}
+
+	// Saving isn't a read, so it mustn't set the entry, but it must move the
+	// list on.
+	listGen, _ := f.get(s.key("generation"))
+	s.Put(ctx, key, &Tiddler{Rev: 3, Meta: "{}", Text: "three"})
+	if g, _ := f.get(s.key("generation")); g == listGen {
+		t.Error("Put left the list generation at", g)
+	}
+}
+
+func TestRedisChanges(t *testing.T) {
+	useTestStore(t)
+	ctx := context.Background()
+	f := newFakeRedis(t, "")
+	cfg.RedisAddr = f.addr()
+	s := newRedisStore(db).(*redisStore)
+
+	changes := make(chan []string, 10)
+	s.watchChanges(func(titles []string) {
+		select {
+		case changes <- titles:
+		default:
+		}
+	})
+	next := func() []string {
+		t.Helper()
+		select {
+		case titles := <-changes:
+			return titles
+		case <-time.After(5 * time.Second):
+			t.Fatal("no change reported")
+			return nil
+		}
+	}
+	// Subscribing reports that anything may have changed.
+	if titles := next(); titles != nil {
+		t.Fatalf("first report %q, want nil", titles)
+	}
+
+	other := newRedisStore(db).(*redisStore)
+	if err := other.Put(ctx, datastore.NameKey("Tiddler", "Elsewhere", nil), &Tiddler{Rev: 1, Meta: "{}"}); err != nil {
+		t.Fatal(err)
+	}
+	if titles := next(); len(titles) != 1 || titles[0] != "Elsewhere" {
+		t.Errorf("reported %q, want [Elsewhere]", titles)
+	}
+	// Changes to other kinds of entity aren't reported.
+	other.Put(ctx, datastore.NameKey("Other", "x", nil), &Tiddler{})
+	other.dropCaches(ctx)
+	if titles := next(); titles != nil {
+		t.Errorf("dropCaches reported %q, want nil", titles)
+	}
+}
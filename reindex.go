@@ -0,0 +1,135 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Reindexing
+//
+// Some entities are derived from the tiddlers rather than saved by the browser: the TiddlerLinks behind /links and
+// /graph.json (and, in MySQL, the links table kept with them), and the catalog when it is on.  They can fall out of
+// step: tiddlers saved before links were recorded have none, data written straight to the backend or restored from
+// a backup bypasses them, and a bug or a crash between writes can leave them wrong.  POST /admin/reindex (or
+// tiddly reindex) rebuilds them all from the Tiddler entities: every tiddler's links are recomputed and saved,
+// TiddlerLinks for tiddlers that no longer exist at all are deleted, the catalog is rebuilt, and the server's
+// caches are dropped.  The response reports progress as it goes, a line at a time.
+
+// reindexChunk is how many TiddlerLinks entities are written at once.
+const reindexChunk = 200
+
+// reindex rebuilds the derived entities, calling progress as it goes.
+func reindex(ctx context.Context, progress func(format string, args ...interface{})) error {
+	var titles []string
+	var links []*tiddlerLinks
+	err := retry(ctx, func() error {
+		titles, links = nil, nil
+		var t Tiddler
+		return db.Scan(ctx, "Tiddler", "", &t, func(title string) error {
+			titles = append(titles, title)
+			links = append(links, linksOf(&t))
+			if len(titles)%1000 == 0 {
+				progress("read %d tiddlers", len(titles))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	progress("read %d tiddlers", len(titles))
+
+	for i := 0; i < len(titles); i += reindexChunk {
+		j := i + reindexChunk
+		if j > len(titles) {
+			j = len(titles)
+		}
+		keys := make([]*datastore.Key, j-i)
+		for k := range keys {
+			keys[k] = linksKey(titles[i+k])
+		}
+		if err := retry(ctx, func() error { return db.PutMulti(ctx, keys, links[i:j]) }); err != nil {
+			return fmt.Errorf("saving links: %v", err)
+		}
+		progress("saved links of %d/%d tiddlers", j, len(titles))
+	}
+
+	names, err := db.Names(ctx, "TiddlerLinks", "")
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool, len(titles))
+	for _, title := range titles {
+		exists[title] = true
+	}
+	var orphans []*datastore.Key
+	for _, name := range names {
+		if !exists[name] {
+			orphans = append(orphans, linksKey(name))
+		}
+	}
+	if len(orphans) > 0 {
+		if err := retry(ctx, func() error { return db.DeleteMulti(ctx, orphans) }); err != nil {
+			return fmt.Errorf("deleting links of missing tiddlers: %v", err)
+		}
+	}
+	progress("deleted links of %d missing tiddlers", len(orphans))
+
+	if cfg.Catalog {
+		if _, _, err := rebuildCatalog(ctx); err != nil {
+			return fmt.Errorf("rebuilding catalog: %v", err)
+		}
+		progress("rebuilt the catalog")
+	}
+
+	if d, ok := db.(cacheDropper); ok {
+		d.dropCaches(ctx)
+	}
+	tiddlers.forgetTitles(nil)
+	progress("dropped caches")
+	return nil
+}
+
+func adminReindex(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "POST") || !sameOrigin(w, r) {
+		return
+	}
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+	progress := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, format+"\n", args...)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	logf(ctx, "%s started a reindex", currentUser(r))
+	if err := reindex(ctx, progress); err != nil {
+		// The status is long gone; say so in the body.
+		progress("FAILED: %v", err)
+		logf(ctx, "reindex: %v", err)
+		return
+	}
+	progress("done")
+	logf(ctx, "reindex done")
+}
+
+func reindexCmd(args []string) error {
+	fs := newFlagSet("reindex", "")
+	if ok, err := setup(fs, args); !ok {
+		return err
+	}
+	if err := openStore(); err != nil {
+		return err
+	}
+	return reindex(context.Background(), log.Printf)
+}
@@ -0,0 +1,288 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Renaming
+//
+// When TiddlyWiki renames a tiddler it saves a new one and deletes the old, so the server sees two unrelated
+// tiddlers: the history stays behind under the old title, and every other tiddler that links to or is tagged with
+// the old title still does.  POST /recipes/all/tiddlers/{title}/rename?to=New+title does it properly.  The old
+// history is copied to the new title first; then, in one transaction, the tiddler is saved under the new title and
+// deleted under the old one (which keeps its own history, and can be restored from it).  With relink=1, links
+// ([[Old]] and [[label|Old]]), tags and list fields naming the old title in other tiddlers are rewritten too.  The
+// new title must not have been used before, so that the two histories can't collide.
+//
+// The browser only ever GETs and PUTs tiddlers, so a POST is never mistaken for a save of a tiddler whose title
+// happens to end in /rename (or /copy, see Re Copying).
+
+var errTitleTaken = errors.New("a tiddler with that title exists or existed before")
+
+type renameResult struct {
+	Title    string   `json:"title"`
+	Revision int      `json:"revision"`
+	Relinked []string `json:"relinked,omitempty"`
+}
+
+func renameHandler(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(w, r) {
+		return
+	}
+	title := tiddlerTitle(strings.TrimSuffix(r.URL.EscapedPath(), "/rename"))
+	to := r.FormValue("to")
+	if to == "" || to == title {
+		http.Error(w, "to must name a different title", 400)
+		return
+	}
+	if err := checkTitle(to); err != nil {
+		http.Error(w, "to: "+err.Error(), 400)
+		return
+	}
+	ctx := r.Context()
+	rev, err := renameTiddler(ctx, title, to)
+	switch {
+	case err == datastore.ErrNoSuchEntity:
+		http.Error(w, "no such tiddler", 404)
+		return
+	case err == errTitleTaken:
+		http.Error(w, to+": "+err.Error(), 409)
+		return
+	case err != nil:
+		storeError(w, err)
+		return
+	}
+	logf(ctx, "%s renamed %q to %q", currentUser(r), loggedTitle(title), loggedTitle(to))
+
+	res := renameResult{Title: to, Revision: rev}
+	if r.FormValue("relink") != "" {
+		res.Relinked, err = relink(ctx, title, to)
+		if err != nil {
+			http.Error(w, "renamed, but relinking failed: "+err.Error(), 500)
+			return
+		}
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, data)
+}
+
+// renameTiddler moves title to to, history and all. It returns the revision
+// of the tiddler under its new title.
+func renameTiddler(ctx context.Context, title, to string) (int, error) {
+	oldKey := datastore.NameKey("Tiddler", title, nil)
+	newKey := datastore.NameKey("Tiddler", to, nil)
+	var t Tiddler
+	if err := dbGet(ctx, oldKey, &t); err != nil {
+		return 0, err
+	}
+	if t.Meta == "" {
+		return 0, datastore.ErrNoSuchEntity
+	}
+	var existing Tiddler
+	if err := dbGet(ctx, newKey, &existing); err != datastore.ErrNoSuchEntity {
+		if err == nil {
+			err = errTitleTaken
+		}
+		return 0, err
+	}
+
+	// Copy the history first. It's outside the transaction, which is
+	// limited in size, but harmless to repeat if the rename fails.
+	revs, err := historyOf(ctx, title)
+	if err != nil {
+		return 0, err
+	}
+	for len(revs) > 0 {
+		chunk := revs
+		if len(chunk) > 500 {
+			chunk = chunk[:500]
+		}
+		revs = revs[len(chunk):]
+		keys := make([]*datastore.Key, len(chunk))
+		for i := range chunk {
+			keys[i] = datastore.NameKey("TiddlerHistory", to+"#"+fmt.Sprint(chunk[i].Rev), nil)
+			if chunk[i].Meta != "" {
+				chunk[i].Meta = retitle(chunk[i].Meta, to, chunk[i].Rev)
+			}
+		}
+		err := retry(ctx, func() error {
+			return db.PutMulti(ctx, keys, chunk)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var rev int
+	err = db.RunInTransaction(ctx, func(tx Transaction) error {
+		var cur, taken Tiddler
+		if err := tx.Get(oldKey, &cur); err != nil {
+			return err
+		}
+		if cur.Meta == "" {
+			return datastore.ErrNoSuchEntity
+		}
+		if err := tx.Get(newKey, &taken); err != datastore.ErrNoSuchEntity {
+			if err == nil {
+				err = errTitleTaken
+			}
+			return err
+		}
+		// The new title continues the numbering of the history copied
+		// to it.
+		rev = cur.Rev + 1
+		moved := Tiddler{Rev: rev, Meta: retitle(cur.Meta, to, rev), Text: cur.Text, Saved: time.Now().UTC(), User: cur.User}
+		deleted := Tiddler{Rev: cur.Rev + 1, User: userOf(ctx)}
+		keys := []*datastore.Key{
+			newKey,
+			datastore.NameKey("TiddlerHistory", to+"#"+fmt.Sprint(rev), nil),
+			linksKey(to),
+			oldKey,
+			datastore.NameKey("TiddlerHistory", title+"#"+fmt.Sprint(deleted.Rev), nil),
+			linksKey(title),
+		}
+		return tx.PutMulti(keys, []interface{}{&moved, &moved, linksOf(&moved), &deleted, &deleted, &tiddlerLinks{}})
+	})
+	if err != nil {
+		return 0, err
+	}
+	tiddlerChanged(title)
+	tiddlerChanged(to)
+	return rev, nil
+}
+
+// retitle returns the stored fields meta with the title and revision fields
+// changed to title and rev.
+func retitle(meta, title string, rev int) string {
+	var js map[string]interface{}
+	if json.Unmarshal([]byte(meta), &js) != nil {
+		return meta
+	}
+	js["title"] = title
+	js["revision"] = rev
+	data, err := json.Marshal(js)
+	if err != nil {
+		return meta
+	}
+	return string(data)
+}
+
+// relink rewrites references to from in all other live tiddlers to refer to
+// to instead, saving a new revision of each one changed. It returns their
+// titles.
+func relink(ctx context.Context, from, to string) ([]string, error) {
+	var changed []map[string]interface{}
+	err := retry(ctx, func() error {
+		changed = nil
+		return allTiddlers(ctx, func(title string, t *Tiddler) error {
+			if t.Meta == "" || title == to {
+				return nil
+			}
+			var js map[string]interface{}
+			if json.Unmarshal([]byte(t.Meta), &js) != nil {
+				return nil
+			}
+			js["text"] = t.Text
+			if relinkFields(js, from, to) {
+				changed = append(changed, js)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	var titles []string
+	for _, res := range saveTiddlers(ctx, changed) {
+		if res.Error != "" {
+			return titles, fmt.Errorf("%s: %s", res.Title, res.Error)
+		}
+		titles = append(titles, res.Title)
+	}
+	return titles, nil
+}
+
+// relinkFields rewrites references to from in a tiddler's text, tags and
+// list, reporting whether there were any.
+func relinkFields(js map[string]interface{}, from, to string) bool {
+	changed := false
+	if text, ok := js["text"].(string); ok {
+		r := strings.NewReplacer("[["+from+"]]", "[["+to+"]]", "|"+from+"]]", "|"+to+"]]")
+		if s := r.Replace(text); s != text {
+			js["text"] = s
+			changed = true
+		}
+	}
+	// TiddlyWeb JSON keeps fields it doesn't know, list among them, in
+	// a "fields" object.
+	lists := []map[string]interface{}{js}
+	if fields, ok := js["fields"].(map[string]interface{}); ok {
+		lists = append(lists, fields)
+	}
+	for _, m := range lists {
+		for _, field := range []string{"tags", "list"} {
+			if relinkList(m, field, from, to) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// relinkList replaces from with to in the list field of m, which may be an
+// array or a TiddlyWiki string list, reporting whether it was there.
+func relinkList(m map[string]interface{}, field, from, to string) bool {
+	switch v := m[field].(type) {
+	case []interface{}:
+		found := false
+		for i := range v {
+			if v[i] == from {
+				v[i] = to
+				found = true
+			}
+		}
+		return found
+	case string:
+		list := parseTags(v)
+		found := false
+		for i := range list {
+			if list[i] == from {
+				list[i] = to
+				found = true
+			}
+		}
+		if found {
+			m[field] = stringifyList(list)
+		}
+		return found
+	}
+	return false
+}
+
+// stringifyList is the inverse of parseTags.
+func stringifyList(list []string) string {
+	var parts []string
+	for _, s := range list {
+		if strings.ContainsAny(s, " \t\n") {
+			s = "[[" + s + "]]"
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,56 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"cloud.google.com/go/datastore"
+)
+
+// renderTiddler serves /render/{title}: the tiddler as a standalone HTML
+// page, for sending to people who don't use the wiki. Signed-in users can
+// render any tiddler; everyone else only published ones (see publish-tag),
+// and gets a 404 for the rest so that private titles aren't confirmed. When
+// publish is a public endpoint nobody is signed in here, so that is everyone.
+func renderTiddler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	ctx := r.Context()
+	title := pathTitle(r, "/render/")
+	key := datastore.NameKey("Tiddler", title, nil)
+	var t Tiddler
+	err := dbGet(ctx, key, &t)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		logf(ctx, "render %q: %v", loggedTitle(title), err)
+		http.Error(w, "internal error", 500)
+		return
+	}
+	f := parseFields(&t)
+	signedIn := currentUser(r) != ""
+	public := cfg.PublishTag != "" && publishable(title, &t) && hasTag(f.Tags, cfg.PublishTag)
+	if err == datastore.ErrNoSuchEntity || t.Meta == "" || !(signedIn || public) {
+		http.Error(w, "not found", 404)
+		return
+	}
+
+	link := func(title string) string { return cfg.BasePath + "/render/" + url.PathEscape(title) }
+	modified, _ := parseTiddlyDate(f.Modified)
+	p := &publishedTiddler{
+		Title:    title,
+		Tags:     f.Tags,
+		Modified: modified,
+		Text:     renderText(f.Type, f.Text, link),
+	}
+	if !public {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := publicTemplate.ExecuteTemplate(w, "render", p); err != nil {
+		logf(ctx, "render %q: %v", loggedTitle(title), err)
+	}
+}
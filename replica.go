@@ -0,0 +1,126 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Read replicas
+//
+// A wiki shared across continents is slow for whoever is far from its database.  With mysql-read-dsn naming a
+// read replica of mysql-dsn, say one in each region with a server next to it, the reads made in answer to GET and
+// HEAD requests (pages, tiddlers, lists, feeds) go to the replica, and everything else, writes, transactions and the
+// reads that decide them, to the primary.  A replica lags the primary, so for replica-lag after this server writes
+// anything its reads keep to the primary too: a browser that saves and then syncs sees its own save, and the cache
+// layers (see Re Cache layers) aren't filled from a replica that hasn't caught up.  Saves made through other servers
+// show up once the replica has them, as they would once the caches expire.  The replica is read with the primary's
+// password, and its errors are answered as the primary's would be; it is never written to.
+
+type replicaKey struct{}
+
+// replicaReads marks the context of GET and HEAD requests as allowed to
+// read from a replica.
+func replicaReads(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			r = r.WithContext(context.WithValue(r.Context(), replicaKey{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// replicaStore is a Store that sends some reads to a replica of it.
+type replicaStore struct {
+	Store   // the primary
+	replica Store
+
+	mu        sync.Mutex
+	lastWrite time.Time
+}
+
+func newReplicaStore(primary, replica Store) *replicaStore {
+	return &replicaStore{Store: primary, replica: replica}
+}
+
+// reader returns the store to read from in ctx.
+func (s *replicaStore) reader(ctx context.Context) Store {
+	if ok, _ := ctx.Value(replicaKey{}).(bool); !ok {
+		return s.Store
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.lastWrite) < cfg.ReplicaLag {
+		return s.Store
+	}
+	return s.replica
+}
+
+// wrote records a write, keeping reads to the primary for replica-lag.
+func (s *replicaStore) wrote() {
+	s.mu.Lock()
+	s.lastWrite = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *replicaStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	return s.reader(ctx).Get(ctx, key, dst)
+}
+
+func (s *replicaStore) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return s.reader(ctx).GetMulti(ctx, keys, dst)
+}
+
+func (s *replicaStore) Scan(ctx context.Context, kind, prefix string, dst interface{}, fn func(name string) error) error {
+	return s.reader(ctx).Scan(ctx, kind, prefix, dst, fn)
+}
+
+func (s *replicaStore) Names(ctx context.Context, kind, prefix string) ([]string, error) {
+	return s.reader(ctx).Names(ctx, kind, prefix)
+}
+
+func (s *replicaStore) LinksTo(ctx context.Context, title string) ([]string, error) {
+	return s.reader(ctx).LinksTo(ctx, title)
+}
+
+// The writes count from when they start, for reads made meanwhile, and
+// again from when they end.
+
+func (s *replicaStore) Put(ctx context.Context, key *datastore.Key, src interface{}) error {
+	s.wrote()
+	defer s.wrote()
+	return s.Store.Put(ctx, key, src)
+}
+
+func (s *replicaStore) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) error {
+	s.wrote()
+	defer s.wrote()
+	return s.Store.PutMulti(ctx, keys, src)
+}
+
+func (s *replicaStore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	s.wrote()
+	defer s.wrote()
+	return s.Store.DeleteMulti(ctx, keys)
+}
+
+func (s *replicaStore) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	s.wrote()
+	defer s.wrote()
+	return s.Store.RunInTransaction(ctx, f)
+}
+
+func (s *replicaStore) Close() error {
+	err := s.Store.Close()
+	if rerr := s.replica.Close(); err == nil {
+		err = rerr
+	}
+	return err
+}
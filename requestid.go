@@ -0,0 +1,171 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Re Request IDs
+//
+// Every request gets an ID, sent back in the X-Request-Id header and in error responses, and prefixed to what the
+// server logs while handling the request, so that a "save failed" someone reports can be found in the logs.  An
+// X-Request-Id set by the proxy is kept, so that its logs and ours agree; failing that, on App Engine and Cloud Run
+// the trace ID from X-Cloud-Trace-Context is used, which ties the request to its trace; otherwise a random ID is made
+// up.  Every 5xx response is logged with its ID and message.
+//
+// Handlers report errors with http.Error, and the plain-text responses that makes are rewritten here as JSON, so
+// that the sync adaptor and scripts get something they can parse:
+//     {"code": "precondition_failed", "message": "Home has changed: ...", "request_id": "5f2c..."}
+// code is the status in words, for scripts that would rather not parse the message.  Requests that ask for HTML or
+// plain text (as a browser following a link or posting an admin form does) get the message as plain text, with the
+// request ID as a last line.  Responses a handler writes as JSON itself, such as a conflict's 409, are left alone.
+
+type requestIDKey struct{}
+
+// requestIDOf returns the ID of the request ctx belongs to, or "".
+func requestIDOf(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logf logs like log.Printf, prefixed with the ID of the request ctx belongs
+// to, if any.
+func logf(ctx context.Context, format string, args ...interface{}) {
+	if id := requestIDOf(ctx); id != "" {
+		format = "[" + id + "] " + format
+	}
+	log.Printf(format, args...)
+}
+
+// validRequestID reports whether a client-supplied ID is safe to log and echo.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); validRequestID(id) {
+		return id
+	}
+	if tc := r.Header.Get("X-Cloud-Trace-Context"); tc != "" {
+		if id := strings.SplitN(tc, "/", 2)[0]; validRequestID(id) {
+			return id
+		}
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func requestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := newRequestID(r)
+		w.Header().Set("X-Request-Id", id)
+		iw := &idWriter{ResponseWriter: w, json: wantsJSONErrors(r)}
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		next.ServeHTTP(iw, r)
+		if iw.status >= 500 {
+			logf(r.Context(), "%s %s: %d %s", r.Method, loggedPath(r), iw.status,
+				redactRequest(r, strings.TrimSpace(string(iw.msg))))
+		}
+		switch {
+		case iw.jsonError:
+			data, _ := json.Marshal(map[string]string{
+				"code":       errorCode(iw.status),
+				"message":    strings.TrimSpace(string(iw.body)),
+				"request_id": id,
+			})
+			w.Write(append(data, '\n'))
+		case iw.plainError:
+			fmt.Fprintf(w, "request %s\n", id)
+		}
+	})
+}
+
+// wantsJSONErrors reports whether r should get errors as JSON rather than
+// plain text.
+func wantsJSONErrors(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return !strings.Contains(accept, "text/html") && !strings.HasPrefix(accept, "text/plain")
+}
+
+// errorCode returns status in words, e.g. "not_found".
+func errorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return fmt.Sprint(status)
+	}
+	return strings.ToLower(strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text))
+}
+
+// idWriter notes the status of a response, and whether and what error text
+// it carries, holding the text back if it is to be sent as JSON.
+type idWriter struct {
+	http.ResponseWriter
+	json       bool // whether to send errors as JSON
+	status     int
+	plainError bool
+	jsonError  bool
+	msg        []byte // the start of a 5xx response
+	body       []byte // the text of an error to send as JSON
+}
+
+func (w *idWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+		w.plainError = code >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") &&
+			w.Header().Get("Content-Length") == ""
+		if w.plainError && w.json {
+			w.plainError, w.jsonError = false, true
+			w.Header().Set("Content-Type", jsonType)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *idWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	if w.jsonError {
+		if len(w.body) < 4096 {
+			w.body = append(w.body, p...)
+		}
+		if w.status >= 500 && len(w.msg) < 256 {
+			w.msg = append(w.msg, p...)
+		}
+		return len(p), nil
+	}
+	if w.status >= 500 && len(w.msg) < 256 {
+		n := len(p)
+		if n > 256-len(w.msg) {
+			n = 256 - len(w.msg)
+		}
+		w.msg = append(w.msg, p[:n]...)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush passes on flushes, so that streamed responses aren't held back.
+func (w *idWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
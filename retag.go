@@ -0,0 +1,155 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Re Retagging
+//
+// POST /admin/retag with from and to renames the tag from to to on every live tiddler that has it, saving a new
+// revision of each, a batch at a time as a batch save does (see Re Batch saves), so that the browser needn't load
+// and save each one.  A tiddler that already has to keeps one copy of it; an empty to removes from instead.  Add
+// dry_run=1 to list the tiddlers it would change without saving them.  The answer is JSON:
+//     {"from": "todo", "to": "done", "titles": ["A", "B"], "saved": 2}
+// with "error" as well if some couldn't be saved, in which case those listed were and posting again finishes the
+// job.  Only the tags field changes; to rewrite links and list fields naming the tag as well,
+// rename the tag's own tiddler with relink=1 instead (see Re Renaming).
+
+type retagResult struct {
+	From   string   `json:"from"`
+	To     string   `json:"to"`
+	Titles []string `json:"titles"`
+	Saved  int      `json:"saved"`
+	Error  string   `json:"error,omitempty"`
+}
+
+func adminRetag(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "POST") || !sameOrigin(w, r) {
+		return
+	}
+	from, to := r.FormValue("from"), r.FormValue("to")
+	if from == "" {
+		http.Error(w, "from is required", 400)
+		return
+	}
+	if from == to {
+		http.Error(w, "from and to are the same", 400)
+		return
+	}
+	ctx := r.Context()
+	res, err := retag(ctx, from, to, r.FormValue("dry_run") != "")
+	if err != nil && len(res.Titles) == 0 {
+		storeError(w, err)
+		return
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	if res.Saved > 0 {
+		logf(ctx, "%s retagged %d tiddlers from %q to %q", currentUser(r), res.Saved, loggedTitle(from), loggedTitle(to))
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, data)
+}
+
+// retag renames the tag from to to, or removes it if to is empty, on every
+// live tiddler that has it, or with dryRun only finds them.
+func retag(ctx context.Context, from, to string, dryRun bool) (*retagResult, error) {
+	res := &retagResult{From: from, To: to, Titles: []string{}}
+	var changed []map[string]interface{}
+	err := retry(ctx, func() error {
+		changed = nil
+		return allTiddlers(ctx, func(title string, t *Tiddler) error {
+			if t.Meta == "" || !hasTag(parseFields(t).Tags, from) {
+				return nil
+			}
+			var js map[string]interface{}
+			if json.Unmarshal([]byte(t.Meta), &js) != nil {
+				return nil
+			}
+			js["text"] = t.Text
+			if retagFields(js, from, to) {
+				changed = append(changed, js)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return res, err
+	}
+	sort.Slice(changed, func(i, j int) bool {
+		return fmt.Sprint(changed[i]["title"]) < fmt.Sprint(changed[j]["title"])
+	})
+	if dryRun {
+		for _, js := range changed {
+			res.Titles = append(res.Titles, fmt.Sprint(js["title"]))
+		}
+		return res, nil
+	}
+	for _, r := range saveTiddlers(ctx, changed) {
+		if r.Error != "" {
+			if err == nil {
+				err = fmt.Errorf("%s: %s", r.Title, r.Error)
+			}
+			continue
+		}
+		res.Titles = append(res.Titles, r.Title)
+		res.Saved++
+	}
+	return res, err
+}
+
+// retagFields renames from to to in a tiddler's tags, which may be an array
+// or a TiddlyWiki string list, dropping it if to is empty and dropping
+// duplicates, and reports whether it was there.
+func retagFields(js map[string]interface{}, from, to string) bool {
+	var tags []string
+	switch v := js["tags"].(type) {
+	case []interface{}:
+		for _, tag := range v {
+			if s, ok := tag.(string); ok {
+				tags = append(tags, s)
+			}
+		}
+	case string:
+		tags = parseTags(v)
+	default:
+		return false
+	}
+	var out []string
+	found := false
+	for _, tag := range tags {
+		if tag == from {
+			found = true
+			tag = to
+		}
+		if tag != "" && !hasTag(out, tag) {
+			out = append(out, tag)
+		}
+	}
+	if !found {
+		return false
+	}
+	if _, ok := js["tags"].([]interface{}); ok {
+		list := make([]interface{}, len(out))
+		for i, tag := range out {
+			list[i] = tag
+		}
+		js["tags"] = list
+	} else {
+		js["tags"] = stringifyList(out)
+	}
+	return true
+}
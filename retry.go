@@ -0,0 +1,61 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+func isTransient(err error) bool {
+	if t, ok := err.(interface{ Temporary() bool }); ok {
+		return t.Temporary()
+	}
+	switch grpcstatus.Code(err) {
+	case codes.DeadlineExceeded, codes.Unavailable, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// retry calls op until it succeeds, returns a non-transient error, or the
+// retry budget (or ctx) runs out, so a Datastore outage still fails the
+// request in a reasonable time. Backoff starts at 50ms and doubles, with
+// full jitter.
+func retry(ctx context.Context, op func() error) error {
+	deadline := time.Now().Add(cfg.RetryBudget)
+	backoff := 50 * time.Millisecond
+	for {
+		err := op()
+		if err == nil || !isTransient(err) {
+			return err
+		}
+		sleep := time.Duration(rand.Int63n(int64(backoff)))
+		if time.Now().Add(sleep).After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(sleep):
+		}
+		if backoff < 2*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func dbGet(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	return retry(ctx, func() error { return db.Get(ctx, key, dst) })
+}
+
+func dbPut(ctx context.Context, key *datastore.Key, src interface{}) error {
+	return retry(ctx, func() error { return db.Put(ctx, key, src) })
+}
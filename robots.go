@@ -0,0 +1,100 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// robots serves /robots.txt: the robots-file if one is configured, or else
+// rules that keep crawlers out of everything but the published pages.
+func robots(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if cfg.RobotsFile != "" {
+		data, err := ioutil.ReadFile(cfg.RobotsFile)
+		if err != nil {
+			logf(r.Context(), "robots: %v", err)
+			http.Error(w, "internal error", 500)
+			return
+		}
+		w.Write(data)
+		return
+	}
+	fmt.Fprintf(w, "User-agent: *\n")
+	if cfg.PublishTag != "" {
+		fmt.Fprintf(w, "Allow: %s/public/\n", cfg.BasePath)
+	}
+	fmt.Fprintf(w, "Disallow: %s/\n", cfg.BasePath)
+	if cfg.PublishTag != "" {
+		fmt.Fprintf(w, "\nSitemap: %s/sitemap.xml\n", requestOrigin(r)+cfg.BasePath)
+	}
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// sitemap serves /sitemap.xml, listing the published pages for search
+// engines.
+func sitemap(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	if cfg.PublishTag == "" {
+		http.Error(w, "not found", 404)
+		return
+	}
+	s, err := site.get(r.Context())
+	if err != nil {
+		logf(r.Context(), "building public site: %v", err)
+		http.Error(w, "internal error", 500)
+		return
+	}
+	base := requestOrigin(r) + cfg.BasePath + "/public/"
+	set := sitemapURLSet{URLs: []sitemapURL{{Loc: base}}}
+	for _, t := range s.Tiddlers {
+		u := sitemapURL{Loc: base + t.Path}
+		if !t.Modified.IsZero() {
+			u.LastMod = t.Modified.UTC().Format("2006-01-02")
+		}
+		set.URLs = append(set.URLs, u)
+	}
+	data, err := xml.MarshalIndent(set, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+// requestSecure reports whether the client reached us over HTTPS, trusting
+// the proxy's X-Forwarded-Proto.
+func requestSecure(r *http.Request) bool {
+	return r.TLS != nil || strings.HasPrefix(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// requestOrigin returns the scheme and host the client used to reach us.
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if requestSecure(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
@@ -0,0 +1,339 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re S3
+//
+// With storage=s3 each entity is an object named {s3-prefix}{kind}/{name} in s3-bucket, with the name escaped so
+// that it needs no further escaping in a URL, in any store that speaks the S3 API: AWS, MinIO, Backblaze B2,
+// Wasabi, and so on.  Object names are limited to 1024 bytes, so titles whose escaped history names would be
+// longer are refused.  Requests are path-style, signed with AWS Signature Version 4 using the usual
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and (optionally) AWS_SESSION_TOKEN.  For AWS only s3-region need be set;
+// for anything else set s3-endpoint too, e.g. http://localhost:9000 for MinIO.
+//
+// Listing the tiddlers, which the browser does every minute or so, reads every Tiddler object.  The listing of
+// the bucket is the metadata index: it carries each object's ETag, so only objects that changed since the last
+// listing are fetched again.  S3 has no transactions, so renames and locks are serialized within the server and
+// undone as far as possible if they fail; run a single server against a bucket.
+
+const s3FetchParallelism = 16
+
+// maxS3Key is the longest object name S3 accepts.
+const maxS3Key = 1024
+
+type s3KV struct {
+	endpoint string // with no trailing slash
+	bucket   string
+	prefix   string
+	region   string
+	keyID    string
+	secret   string
+	token    string
+	client   *http.Client
+
+	lockedUpdate
+
+	// Tiddler objects by object key, as of the last listing.
+	mu    sync.Mutex
+	cache map[string]s3Object
+}
+
+type s3Object struct {
+	etag string
+	data []byte
+}
+
+func openS3() (Store, error) {
+	s := &s3KV{
+		endpoint: strings.TrimSuffix(cfg.S3Endpoint, "/"),
+		bucket:   cfg.S3Bucket,
+		prefix:   cfg.S3Prefix,
+		region:   cfg.S3Region,
+		keyID:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret:   os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:    os.Getenv("AWS_SESSION_TOKEN"),
+		client:   &http.Client{Timeout: time.Minute},
+		cache:    make(map[string]s3Object),
+	}
+	if s.endpoint == "" {
+		s.endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	storedNameLen = func(kind, name string) int { return len(s.objectKey(kind, name)) }
+	maxStoredName = maxS3Key
+	if s.keyID == "" || s.secret == "" {
+		return nil, errors.New("s3 storage needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return kvStore{s}, nil
+}
+
+// s3Error is an unsuccessful response from the store.
+type s3Error struct {
+	status int
+	body   string
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.status, http.StatusText(e.status), e.body)
+}
+
+// Temporary reports whether the request is worth retrying.
+func (e *s3Error) Temporary() bool {
+	return e.status >= 500 || e.status == http.StatusTooManyRequests
+}
+
+func (s *s3KV) objectKey(kind, name string) string {
+	return s.prefix + kind + "/" + escapeName(name)
+}
+
+// awsEscape escapes s as Signature Version 4 requires, leaving / alone if
+// path is set.
+func awsEscape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 || path && c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// do makes a signed request for the object key (or the bucket if key is
+// empty), returning the response if it succeeded.
+func (s *s3KV) do(ctx context.Context, method, key string, query map[string]string, body []byte) (*http.Response, []byte, error) {
+	path := "/" + s.bucket
+	if key != "" {
+		path += "/" + key
+	}
+	var params []string
+	for k, v := range query {
+		params = append(params, awsEscape(k, false)+"="+awsEscape(v, false))
+	}
+	sort.Strings(params)
+	rawQuery := strings.Join(params, "&")
+	u := s.endpoint + awsEscape(path, true)
+	if rawQuery != "" {
+		u += "?" + rawQuery
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(sum[:]), time.Now())
+
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		if resp.StatusCode == 404 && key != "" {
+			return nil, nil, datastore.ErrNoSuchEntity
+		}
+		return nil, nil, &s3Error{resp.StatusCode, string(data)}
+	}
+	return resp, data, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req, whose
+// body has the SHA-256 hash payload, as of now.
+func (s *s3KV) sign(req *http.Request, payload string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if s.token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+		signed = append(signed, "x-amz-security-token")
+	}
+	var canonHeaders strings.Builder
+	for _, h := range signed {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		fmt.Fprintf(&canonHeaders, "%s:%s\n", h, v)
+	}
+	canonical := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonHeaders.String(), strings.Join(signed, ";"), payload,
+	}, "\n")
+	canonSum := sha256.Sum256([]byte(canonical))
+	scope := now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(canonSum[:])
+	k := hmacSHA256([]byte("AWS4"+s.secret), now.Format("20060102"))
+	k = hmacSHA256(k, s.region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		s.keyID, scope, strings.Join(signed, ";"), hmacSHA256(k, toSign)))
+}
+
+func (s *s3KV) get(ctx context.Context, kind, name string) ([]byte, error) {
+	_, data, err := s.do(ctx, "GET", s.objectKey(kind, name), nil, nil)
+	return data, err
+}
+
+func (s *s3KV) put(ctx context.Context, kind, name string, data []byte) error {
+	key := s.objectKey(kind, name)
+	resp, _, err := s.do(ctx, "PUT", key, nil, data)
+	if err != nil {
+		return err
+	}
+	if kind == "Tiddler" {
+		s.mu.Lock()
+		s.cache[key] = s3Object{resp.Header.Get("Etag"), data}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *s3KV) delete(ctx context.Context, kind, name string) error {
+	key := s.objectKey(kind, name)
+	_, _, err := s.do(ctx, "DELETE", key, nil, nil)
+	if err == datastore.ErrNoSuchEntity {
+		err = nil
+	}
+	s.mu.Lock()
+	delete(s.cache, key)
+	s.mu.Unlock()
+	return err
+}
+
+type s3Listing struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key  string
+		ETag string
+	}
+}
+
+func (s *s3KV) scan(ctx context.Context, kind, prefix string, keysOnly bool, fn func(name string, data []byte) error) error {
+	dir := s.prefix + kind + "/"
+	query := map[string]string{"list-type": "2", "prefix": dir + escapeName(prefix)}
+	for {
+		_, data, err := s.do(ctx, "GET", "", query, nil)
+		if err != nil {
+			return err
+		}
+		var page s3Listing
+		if err := xml.Unmarshal(data, &page); err != nil {
+			return err
+		}
+		names := make([]string, len(page.Contents))
+		for i, obj := range page.Contents {
+			if names[i], err = unescapeName(strings.TrimPrefix(obj.Key, dir)); err != nil {
+				return err
+			}
+		}
+		var objs []s3Object
+		if !keysOnly {
+			if objs, err = s.fetch(ctx, kind, page); err != nil {
+				return err
+			}
+		}
+		for i, name := range names {
+			var data []byte
+			if !keysOnly {
+				if data = objs[i].data; data == nil {
+					continue // deleted since the listing
+				}
+			}
+			if err := fn(name, data); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated {
+			return nil
+		}
+		query["continuation-token"] = page.NextContinuationToken
+	}
+}
+
+// fetch gets the objects in a page of a listing, several at a time, using
+// the cached copy of any Tiddler object whose ETag hasn't changed.
+func (s *s3KV) fetch(ctx context.Context, kind string, page s3Listing) ([]s3Object, error) {
+	objs := make([]s3Object, len(page.Contents))
+	errs := make([]error, len(page.Contents))
+	sem := make(chan struct{}, s3FetchParallelism)
+	var wg sync.WaitGroup
+	for i, obj := range page.Contents {
+		s.mu.Lock()
+		cached, ok := s.cache[obj.Key]
+		s.mu.Unlock()
+		if ok && cached.etag == obj.ETag {
+			objs[i] = cached
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, key string) {
+			defer func() { <-sem; wg.Done() }()
+			var resp *http.Response
+			err := retry(ctx, func() error {
+				var err error
+				resp, objs[i].data, err = s.do(ctx, "GET", key, nil, nil)
+				return err
+			})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			objs[i].etag = resp.Header.Get("Etag")
+			if kind == "Tiddler" {
+				s.mu.Lock()
+				s.cache[key] = objs[i]
+				s.mu.Unlock()
+			}
+		}(i, obj.Key)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+	}
+	return objs, nil
+}
+
+func (s *s3KV) update(ctx context.Context, f func(kv) error) error {
+	return s.lockedUpdate.update(ctx, s, f)
+}
+
+func (s *s3KV) close() error { return nil }
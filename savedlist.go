@@ -0,0 +1,100 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Saved lists
+//
+// A saved list is a named filter kept in the wiki itself, as a tiddler titled $:/config/server/lists/{name} whose
+// text is the filter, so it is edited, synced and versioned like any other tiddler.  GET /lists/{name}.json answers
+// with the tiddlers it selects, as a skinny list like the one the browser syncs from, and GET /lists/ with the names
+// of the lists.  Both are cut from the cached tiddler list (see Re Cache layers), so a dashboard or script polling a
+// list costs no more than a browser syncing does, and reads no text.  The filter is a sync profile's (see Re Sync
+// profiles), e.g. [tag[todo]!tag[done]] or [prefix[Journal/]] -[is[draft]]; a list whose filter is empty or doesn't
+// parse is answered with 422, rather than an empty filter being taken to mean the whole wiki.
+
+const savedListPrefix = "$:/config/server/lists/"
+
+func savedListHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	ctx := r.Context()
+	name := pathTitle(r, "/lists/")
+	if name == "" {
+		listSavedLists(w, r)
+		return
+	}
+	if !strings.HasSuffix(name, ".json") {
+		http.Error(w, "not found", 404)
+		return
+	}
+	name = strings.TrimSuffix(name, ".json")
+	var t Tiddler
+	err := dbGet(ctx, datastore.NameKey("Tiddler", savedListPrefix+name, nil), &t)
+	if err == datastore.ErrNoSuchEntity || err == nil && t.Meta == "" {
+		http.Error(w, fmt.Sprintf("no such list %q", name), 404)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if strings.TrimSpace(t.Text) == "" {
+		http.Error(w, fmt.Sprintf("list %q has no filter", name), 422)
+		return
+	}
+	f, err := parseSyncFilter(t.Text)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("list %q: %v", name, err), 422)
+		return
+	}
+	data, err := cachedSkinnyList(ctx)
+	if err == nil {
+		data, err = filterList(data, f)
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, data)
+}
+
+// listSavedLists answers with the names of the saved lists.
+func listSavedLists(w http.ResponseWriter, r *http.Request) {
+	data, err := cachedSkinnyList(r.Context())
+	var all []struct {
+		Title string `json:"title"`
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &all)
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	names := []string{}
+	for _, t := range all {
+		if name := strings.TrimPrefix(t.Title, savedListPrefix); name != t.Title && name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	data, err = json.Marshal(names)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, data)
+}
@@ -0,0 +1,261 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Field schemas
+//
+// To keep structured data in the wiki, say tasks with due dates, the $:/config/server/schema tiddler can declare the
+// fields that tiddlers with a given tag must have, as JSON mapping each tag to its fields and each field to a type:
+//     {"task": {"due": "date", "priority": "integer?", "status": "todo|doing|done"}}
+// The types are text (anything but empty), number, integer, date (TiddlyWiki's YYYYMMDDHHMMSSmmm, or YYYY-MM-DD),
+// boolean (yes, no, true or false), url (absolute), and a list of values separated by |, one of which the field must
+// be.  A field is required unless its type ends in ?, in which case it may be missing or empty but must otherwise be
+// of the type.  A PUT of a tiddler that breaks the schema for any of its tags is refused with 422 and what is wrong
+// with each field:
+//     {"error": "Buy milk doesn't fit the schema: due is required (and 1 more)",
+//      "fields": {"due": "is required", "priority": "must be an integer"}}
+// The schema is soft: it is checked only on PUT, the way the browser saves, and PATCH (see Re Patching), so
+// imports, batch saves, renames and tiddlers saved before it existed are left as they are.  A PUT of the schema
+// itself is refused with 422 if it doesn't parse; one that can't be read or parsed otherwise is logged and checks
+// nothing.
+
+const schemaTitle = "$:/config/server/schema"
+
+// fieldRule is the type a schema gives a field.
+type fieldRule struct {
+	typ      string   // text, number, integer, date, boolean, url or oneOf
+	values   []string // for oneOf
+	optional bool
+}
+
+// fieldSchema holds the rules for each tag's fields.
+type fieldSchema map[string]map[string]fieldRule
+
+// parseSchema parses the text of the schema tiddler.
+func parseSchema(text string) (fieldSchema, error) {
+	var js map[string]map[string]string
+	if err := json.Unmarshal([]byte(text), &js); err != nil {
+		return nil, fmt.Errorf("schema must be a JSON object of tags, each an object of field types: %v", err)
+	}
+	s := make(fieldSchema)
+	for tag, fields := range js {
+		s[tag] = make(map[string]fieldRule)
+		for field, typ := range fields {
+			rule := fieldRule{typ: strings.TrimSuffix(typ, "?"), optional: strings.HasSuffix(typ, "?")}
+			switch {
+			case strings.Contains(rule.typ, "|"):
+				rule.values, rule.typ = strings.Split(rule.typ, "|"), "oneOf"
+			case rule.typ == "text", rule.typ == "number", rule.typ == "integer", rule.typ == "date",
+				rule.typ == "boolean", rule.typ == "url":
+			default:
+				return nil, fmt.Errorf("%s: %s: unknown type %q", tag, field, typ)
+			}
+			s[tag][field] = rule
+		}
+	}
+	return s, nil
+}
+
+// check returns what is wrong with each field of a tiddler that breaks the
+// rules for its tags, or nil.
+func (s fieldSchema) check(fields map[string]string) map[string]string {
+	var errs map[string]string
+	for _, tag := range parseTags(fields["tags"]) {
+		for field, rule := range s[tag] {
+			if msg := rule.check(fields[field]); msg != "" {
+				if errs == nil {
+					errs = make(map[string]string)
+				}
+				errs[field] = msg
+			}
+		}
+	}
+	return errs
+}
+
+var tiddlyDateRE = regexp.MustCompile(`^\d{8}(\d{6}(\d{3})?)?$`)
+
+// check returns what is wrong with value, or "".
+func (rule fieldRule) check(value string) string {
+	if value == "" {
+		if rule.optional {
+			return ""
+		}
+		return "is required"
+	}
+	switch rule.typ {
+	case "number":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "must be a number"
+		}
+	case "integer":
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return "must be an integer"
+		}
+	case "date":
+		if !validDate(value) {
+			return "must be a date, as YYYYMMDDHHMMSSmmm or YYYY-MM-DD"
+		}
+	case "boolean":
+		switch value {
+		case "yes", "no", "true", "false":
+		default:
+			return "must be yes, no, true or false"
+		}
+	case "url":
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" && u.Opaque == "" {
+			return "must be an absolute URL"
+		}
+	case "oneOf":
+		for _, v := range rule.values {
+			if value == v {
+				return ""
+			}
+		}
+		return "must be one of " + strings.Join(rule.values, ", ")
+	}
+	return ""
+}
+
+// validDate reports whether value is a date as TiddlyWiki stores them, or
+// as YYYY-MM-DD.
+func validDate(value string) bool {
+	if _, err := time.Parse("2006-01-02", value); err == nil {
+		return true
+	}
+	if !tiddlyDateRE.MatchString(value) {
+		return false
+	}
+	if len(value) == 17 {
+		value = value[:14] // the milliseconds
+	}
+	_, err := time.Parse("20060102150405"[:len(value)], value)
+	return err == nil
+}
+
+var schemas schemaCache
+
+type schemaCache struct {
+	mu      sync.Mutex
+	fetched time.Time
+	schema  fieldSchema
+}
+
+func (c *schemaCache) get(ctx context.Context) fieldSchema {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.fetched.IsZero() && time.Since(c.fetched) < cfg.ShellCacheTTL {
+		return c.schema
+	}
+	s, err := readSchema(ctx)
+	if err != nil {
+		log.Printf("reading %s: %v", schemaTitle, err)
+		return c.schema
+	}
+	c.schema, c.fetched = s, time.Now()
+	return s
+}
+
+func (c *schemaCache) invalidate() {
+	c.mu.Lock()
+	c.fetched = time.Time{}
+	c.mu.Unlock()
+}
+
+// readSchema reads the schema tiddler, returning nil if there isn't one.
+func readSchema(ctx context.Context) (fieldSchema, error) {
+	var t Tiddler
+	err := dbGet(ctx, datastore.NameKey("Tiddler", schemaTitle, nil), &t)
+	if err == datastore.ErrNoSuchEntity || err == nil && (t.Meta == "" || strings.TrimSpace(t.Text) == "") {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseSchema(t.Text)
+}
+
+// checkSchema refuses a PUT of js as title with 422 if it doesn't fit the
+// schema, reporting whether it did. The caller should carry on saving only
+// if it didn't.
+func checkSchema(w http.ResponseWriter, r *http.Request, title string, js map[string]interface{}) bool {
+	var s fieldSchema
+	if title != schemaTitle {
+		s = schemas.get(r.Context())
+	}
+	if err := fitSchema(s, title, js); err != nil {
+		writeSchemaErrors(w, err.msg, err.fields)
+		return true
+	}
+	return false
+}
+
+// schemaError says why a tiddler doesn't fit the schema.
+type schemaError struct {
+	msg    string
+	fields map[string]string // what is wrong with each field
+}
+
+func (e *schemaError) Error() string { return e.msg }
+
+// fitSchema returns why js, saved as title, doesn't fit s, or nil. The
+// schema tiddler itself must parse.
+func fitSchema(s fieldSchema, title string, js map[string]interface{}) *schemaError {
+	fields := flatJSON(js)
+	if title == schemaTitle {
+		if strings.TrimSpace(fields["text"]) == "" {
+			return nil
+		}
+		if _, err := parseSchema(fields["text"]); err != nil {
+			return &schemaError{msg: fmt.Sprintf("%s doesn't parse: %v", title, err)}
+		}
+		return nil
+	}
+	if len(s) == 0 {
+		return nil
+	}
+	errs := s.check(fields)
+	if errs == nil {
+		return nil
+	}
+	var names []string
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msg := fmt.Sprintf("%s doesn't fit the schema: %s %s", title, names[0], errs[names[0]])
+	if len(names) > 1 {
+		msg += fmt.Sprintf(" (and %d more)", len(names)-1)
+	}
+	return &schemaError{msg, errs}
+}
+
+func writeSchemaErrors(w http.ResponseWriter, msg string, errs map[string]string) {
+	body := map[string]interface{}{"error": msg}
+	if errs != nil {
+		body["fields"] = errs
+	}
+	data, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", jsonType)
+	w.WriteHeader(422)
+	w.Write(data)
+}
@@ -0,0 +1,401 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Re Share links
+//
+// To show a tiddler to someone the proxy won't let in, a signed-in user makes a share link:
+//     POST   /shares           {"title": "Meeting notes", "expires": "72h", "password": "optional"}
+//     GET    /shares           the links, newest first
+//     DELETE /shares/{token}   revoke one
+// Instead of a title, "filter" shares every tiddler a sync profile filter (see Re Sync profiles) selects, as an
+// index page linking to each.  The answer gives the link, {base}/share/{token}, which is served without
+// authentication, read-only, rendered as on the public site, until it expires (7 days by default, 90 at most), and
+// then answered 410.  With a password, visitors get a form first, and once they give it a cookie for that link
+// alone.  System tiddlers and drafts are never shared, and links to tiddlers outside the share are left as text.
+// Links are ShareLink entities named by their token; the password is kept only as a bcrypt hash.  A token is as good
+// as a password, so logs give only its first few characters, enough to find the link in GET /shares, and traces and
+// error reports give the route as /share/{token}.
+
+// loggedToken is a share token as it may appear in logs.
+type loggedToken string
+
+func (t loggedToken) String() string {
+	if len(t) > 6 {
+		return string(t[:6]) + "..."
+	}
+	return string(t)
+}
+
+const (
+	defaultShareTTL = 7 * 24 * time.Hour
+	maxShareTTL     = 90 * 24 * time.Hour
+)
+
+type shareLink struct {
+	Title        string    `datastore:"Title,noindex" json:"title,omitempty"`
+	Filter       string    `datastore:"Filter,noindex" json:"filter,omitempty"`
+	Expires      time.Time `datastore:"Expires,noindex" json:"expires"`
+	PasswordHash []byte    `datastore:"PasswordHash,noindex" json:"passwordHash,omitempty"` // stores other than Datastore keep JSON
+	Creator      string    `datastore:"Creator,noindex" json:"creator"`
+	Created      time.Time `datastore:"Created,noindex" json:"created"`
+}
+
+type shareResult struct {
+	Token    string `json:"token"`
+	URL      string `json:"url"`
+	Password bool   `json:"password"`
+	*shareLink
+}
+
+func newShareResult(r *http.Request, token string, l *shareLink) shareResult {
+	shown := *l
+	shown.PasswordHash = nil // whether there is one is enough
+	return shareResult{token, requestOrigin(r) + cfg.BasePath + "/share/" + token, l.PasswordHash != nil, &shown}
+}
+
+// sharesHandler makes, lists and revokes share links for signed-in users.
+func sharesHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET", "POST", "DELETE") {
+		return
+	}
+	if r.Method != "GET" && !sameOrigin(w, r) {
+		return
+	}
+	ctx := r.Context()
+	token := strings.TrimPrefix(r.URL.Path, "/shares/")
+	switch {
+	case r.Method == "DELETE":
+		if token == "" || token == r.URL.Path {
+			http.Error(w, "no token", 400)
+			return
+		}
+		if err := retry(ctx, func() error {
+			return db.DeleteMulti(ctx, []*datastore.Key{datastore.NameKey("ShareLink", token, nil)})
+		}); err != nil {
+			storeError(w, err)
+			return
+		}
+		logf(ctx, "%s revoked share link %s", currentUser(r), loggedToken(token))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET":
+		listShares(w, r)
+	default:
+		createShare(w, r)
+	}
+}
+
+func createShare(w http.ResponseWriter, r *http.Request) {
+	if !checkJSONBody(w, r) {
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, "cannot read data", 400)
+		return
+	}
+	var req struct {
+		Title    string `json:"title"`
+		Filter   string `json:"filter"`
+		Expires  string `json:"expires"`
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if (req.Title == "") == (req.Filter == "") {
+		http.Error(w, "give either a title or a filter", 400)
+		return
+	}
+	if req.Filter != "" {
+		if _, err := parseSyncFilter(req.Filter); err != nil {
+			http.Error(w, "bad filter: "+err.Error(), 400)
+			return
+		}
+	}
+	ttl := defaultShareTTL
+	if req.Expires != "" {
+		d, err := time.ParseDuration(req.Expires)
+		if err != nil || d <= 0 || d > maxShareTTL {
+			http.Error(w, "expires must be a duration up to 2160h", 400)
+			return
+		}
+		ttl = d
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	l := &shareLink{
+		Title:   req.Title,
+		Filter:  req.Filter,
+		Expires: now.Add(ttl),
+		Creator: currentUser(r),
+		Created: now,
+	}
+	if req.Password != "" {
+		if l.PasswordHash, err = bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		storeError(w, err)
+		return
+	}
+	token := hex.EncodeToString(b)
+	ctx := r.Context()
+	if err := dbPut(ctx, datastore.NameKey("ShareLink", token, nil), l); err != nil {
+		storeError(w, err)
+		return
+	}
+	logf(ctx, "%s shared %q%s until %s", currentUser(r), loggedTitle(l.Title), loggedTitle(l.Filter), l.Expires.Format(time.RFC3339))
+	out, err := json.Marshal(newShareResult(r, token, l))
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, out)
+}
+
+func listShares(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	res := []shareResult{}
+	err := retry(ctx, func() error {
+		res = res[:0]
+		var l shareLink
+		return db.Scan(ctx, "ShareLink", "", &l, func(token string) error {
+			l := l
+			res = append(res, newShareResult(r, token, &l))
+			return nil
+		})
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Created.After(res[j].Created) })
+	data, err := json.Marshal(res)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, data)
+}
+
+// shareCookie returns the value of the cookie showing that the visitor gave
+// the password of the link token.
+func shareCookie(token string, l *shareLink) string {
+	mac := hmac.New(sha256.New, l.PasswordHash)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sharedPage serves /share/{token}[/{page}]. It's mounted outside the
+// authentication check.
+func sharedPage(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET", "POST") {
+		return
+	}
+	ctx := r.Context()
+	rest := strings.TrimPrefix(r.URL.Path, "/share/")
+	token, page := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		token, page = rest[:i], rest[i+1:]
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	if token == "" {
+		http.Error(w, "not found", 404)
+		return
+	}
+
+	var l shareLink
+	if err := dbGet(ctx, datastore.NameKey("ShareLink", token, nil), &l); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			http.Error(w, "not found", 404)
+			return
+		}
+		logf(ctx, "share %s: %v", loggedToken(token), err)
+		http.Error(w, "internal error", 500)
+		return
+	}
+	if time.Now().After(l.Expires) {
+		http.Error(w, "this link has expired", http.StatusGone)
+		return
+	}
+	base := cfg.BasePath + "/share/" + token
+	if l.PasswordHash != nil {
+		cookieName := "share-" + token
+		if c, err := r.Cookie(cookieName); err != nil || !hmac.Equal([]byte(c.Value), []byte(shareCookie(token, &l))) {
+			wrong := false
+			if r.Method == "POST" {
+				if bcrypt.CompareHashAndPassword(l.PasswordHash, []byte(r.FormValue("password"))) == nil {
+					http.SetCookie(w, &http.Cookie{
+						Name:     cookieName,
+						Value:    shareCookie(token, &l),
+						Path:     base,
+						Expires:  l.Expires,
+						HttpOnly: true,
+						Secure:   requestSecure(r),
+						SameSite: http.SameSiteLaxMode,
+					})
+					http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+					return
+				}
+				wrong = true
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if wrong {
+				w.WriteHeader(403)
+			}
+			shareTemplate.ExecuteTemplate(w, "password", wrong)
+			return
+		}
+	}
+	if r.Method == "POST" {
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+
+	data, err := renderShare(r, &l, base, page)
+	if err != nil {
+		logf(ctx, "share %s: %v", loggedToken(token), err)
+		http.Error(w, "internal error", 500)
+		return
+	}
+	if data == nil {
+		http.Error(w, "not found", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(data)
+}
+
+// renderShare renders page of the tiddlers shared by l, or nil if there is
+// no such page.
+func renderShare(r *http.Request, l *shareLink, base, page string) ([]byte, error) {
+	ctx := r.Context()
+	tiddlers := make(map[string]*Tiddler)
+	if l.Title != "" {
+		var t Tiddler
+		err := dbGet(ctx, datastore.NameKey("Tiddler", l.Title, nil), &t)
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if publishable(l.Title, &t) {
+			tiddlers[l.Title] = &t
+		}
+	} else {
+		f, err := parseSyncFilter(l.Filter)
+		if err != nil {
+			return nil, err
+		}
+		err = retry(ctx, func() error {
+			tiddlers = make(map[string]*Tiddler)
+			return allTiddlers(ctx, func(title string, t *Tiddler) error {
+				if publishable(title, t) && f.selects(title, parseFields(t).Tags) {
+					tiddlers[title] = t
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	paths := make(map[string]string)
+	for title := range tiddlers {
+		paths[title] = publicPath(title)
+	}
+	link := func(title string) string {
+		if p, ok := paths[title]; ok {
+			return base + "/" + p
+		}
+		return ""
+	}
+	pageTiddler := func(title string, t *Tiddler) *publishedTiddler {
+		f := parseFields(t)
+		modified, _ := parseTiddlyDate(f.Modified)
+		return &publishedTiddler{Title: title, Path: link(title), Tags: f.Tags, Modified: modified, Text: renderText(f.Type, f.Text, link)}
+	}
+
+	var buf bytes.Buffer
+	switch {
+	case l.Title != "" && page == "":
+		t, ok := tiddlers[l.Title]
+		if !ok {
+			return nil, nil
+		}
+		if err := publicTemplate.ExecuteTemplate(&buf, "render", pageTiddler(l.Title, t)); err != nil {
+			return nil, err
+		}
+	case page == "":
+		var list []*publishedTiddler
+		for title, t := range tiddlers {
+			list = append(list, pageTiddler(title, t))
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Title < list[j].Title })
+		if err := publicTemplate.ExecuteTemplate(&buf, "index", struct {
+			Site     string
+			Tiddlers []*publishedTiddler
+		}{"Shared tiddlers", list}); err != nil {
+			return nil, err
+		}
+	default:
+		for title, t := range tiddlers {
+			if paths[title] == page {
+				if err := publicTemplate.ExecuteTemplate(&buf, "render", pageTiddler(title, t)); err != nil {
+					return nil, err
+				}
+				return buf.Bytes(), nil
+			}
+		}
+		return nil, nil
+	}
+	return buf.Bytes(), nil
+}
+
+var shareTemplate = template.Must(template.New("share").Parse(`
+{{define "password"}}<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Password required</title>
+<style>body { font-family: sans-serif; max-width: 30em; margin: 4em auto; padding: 0 1em; }</style>
+</head>
+<body>
+<h1>Password required</h1>
+{{if .}}<p>That password isn't right.</p>{{end}}
+<form method="post">
+<input type="password" name="password" autofocus> <button>View</button>
+</form>
+</body>
+</html>
+{{end}}
+`))
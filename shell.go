@@ -0,0 +1,204 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"html"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Custom shell
+//
+// The page served at / can be branded without rebuilding it: tiddlers titled $:/config/server/<name> are read from
+// the Datastore and rendered into the page when it is served.  Their text is used as follows:
+//     title             the browser title, and $:/SiteTitle
+//     subtitle          $:/SiteSubtitle
+//     palette           $:/palette, the title of the palette to use
+//     default-tiddlers  $:/DefaultTiddlers, the story shown at startup
+//     stylesheet        CSS added to the page head
+//     script            JavaScript added to the end of the page body
+// Baking them into the page means they apply before the wiki has synced with the server, so there is no flash of
+// the stock title or palette.  The customized page is cached for shell-cache-ttl, and rebuilt right away when this
+// instance saves one of the tiddlers.
+
+const shellPrefix = "$:/config/server/"
+
+// shellTiddlers maps each $:/config/server/ setting to the wiki tiddler it
+// overrides, or "" for settings that are rendered into the HTML instead.
+var shellTiddlers = map[string]string{
+	"title":            "$:/SiteTitle",
+	"subtitle":         "$:/SiteSubtitle",
+	"palette":          "$:/palette",
+	"default-tiddlers": "$:/DefaultTiddlers",
+	"stylesheet":       "",
+	"script":           "",
+}
+
+var shell shellCache
+
+type shellCache struct {
+	mu    sync.Mutex
+	built time.Time
+	page  page
+	etag  string
+}
+
+// tiddlerChanged drops whatever is cached from title after this instance
+// saves or deletes it.
+func tiddlerChanged(title string) {
+	tiddlers.forgetTitles([]string{title})
+	invalidateShell(title)
+	if title == faviconTitle {
+		favicons.invalidate()
+	}
+	if title == schemaTitle {
+		schemas.invalidate()
+	}
+}
+
+// invalidateShell drops the cached page if title is one of its settings.
+func invalidateShell(title string) {
+	if !strings.HasPrefix(title, shellPrefix) {
+		return
+	}
+	shell.mu.Lock()
+	shell.built = time.Time{}
+	shell.mu.Unlock()
+}
+
+// get returns the page to serve at /, and its ETag if it was customized. If
+// the settings can't be read, the last page built is served again.
+func (c *shellCache) get(ctx context.Context) (page, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.built.IsZero() && time.Since(c.built) < cfg.ShellCacheTTL {
+		return c.page, c.etag
+	}
+	settings, err := shellSettings(ctx)
+	if err != nil {
+		log.Printf("reading %s tiddlers: %v", shellPrefix, err)
+		if c.page.data == nil {
+			return indexPage, ""
+		}
+		return c.page, c.etag
+	}
+	prev, prevETag := c.page, c.etag
+	c.page, c.etag = indexPage, ""
+	if len(settings) > 0 {
+		p, err := customPage(indexPage, settings)
+		if err != nil {
+			log.Printf("customizing page: %v", err)
+		} else if c.etag = fmt.Sprintf(`"shell/%x"`, md5.Sum(p.data)); c.etag == prevETag {
+			c.page = prev // compressed already
+		} else {
+			c.page = precompress(p)
+		}
+	}
+	c.built = time.Now()
+	return c.page, c.etag
+}
+
+// shellSettings reads the $:/config/server/ tiddlers that exist.
+func shellSettings(ctx context.Context) (map[string]string, error) {
+	var names []string
+	var keys []*datastore.Key
+	for name := range shellTiddlers {
+		names = append(names, name)
+		keys = append(keys, datastore.NameKey("Tiddler", shellPrefix+name, nil))
+	}
+	ts := make([]Tiddler, len(keys))
+	err := retry(ctx, func() error {
+		err := db.GetMulti(ctx, keys, ts)
+		if merr, ok := err.(datastore.MultiError); ok {
+			for _, err := range merr {
+				if err != nil && err != datastore.ErrNoSuchEntity {
+					return err
+				}
+			}
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	settings := make(map[string]string)
+	for i, t := range ts {
+		// Deleted tiddlers are kept with their fields blanked.
+		if t.Meta != "" {
+			settings[names[i]] = t.Text
+		}
+	}
+	return settings, nil
+}
+
+// customPage returns a copy of p with settings applied.
+func customPage(p page, settings map[string]string) (page, error) {
+	p.data = append([]byte(nil), p.data...)
+	var names []string
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if target := shellTiddlers[name]; target != "" {
+			if err := p.addTiddler(target, settings[name]); err != nil {
+				return page{}, err
+			}
+		}
+	}
+	if title, ok := settings["title"]; ok {
+		p.data = replaceElement(p.data, "<title>", "</title>", html.EscapeString(title))
+	}
+	if css, ok := settings["stylesheet"]; ok {
+		p.data = insertBefore(p.data, "</head>", "<style>\n"+css+"\n</style>\n")
+	}
+	if js, ok := settings["script"]; ok {
+		p.data = insertBefore(p.data, "</body>", "<script>\n"+js+"\n</script>\n")
+	}
+	return p, nil
+}
+
+// replaceElement replaces the contents of the first open...close element in
+// data with text.
+func replaceElement(data []byte, open, close, text string) []byte {
+	i := bytes.Index(data, []byte(open))
+	if i < 0 {
+		return data
+	}
+	i += len(open)
+	j := bytes.Index(data[i:], []byte(close))
+	if j < 0 {
+		return data
+	}
+	return concat(data[:i], []byte(text), data[i+j:])
+}
+
+// insertBefore inserts text before the last occurrence of tag in data.
+func insertBefore(data []byte, tag, text string) []byte {
+	i := bytes.LastIndex(data, []byte(tag))
+	if i < 0 {
+		return data
+	}
+	return concat(data[:i], []byte(text), data[i:])
+}
+
+func concat(parts ...[]byte) []byte {
+	var b bytes.Buffer
+	for _, p := range parts {
+		b.Write(p)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,391 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Snapshots
+//
+// The history keeps every revision of every tiddler, but not which revisions made up the wiki at a given moment.  A
+// snapshot records that: the revision of each live tiddler, as a WikiSnapshot entity named by the time it was taken
+// (YYYYMMDDTHHMMSSZ, so names sort by time).  With snapshot-interval set the server takes one whenever the newest
+// is that old, and snapshot-keep bounds how many are kept; tiddly snapshot (say from cron) or POST /admin/snapshots
+// takes one now.  Then, for signed-in users:
+//     GET  /admin/snapshots                          the snapshots, newest first
+//     GET  /admin/snapshots/{name}                   the title and revision of each tiddler in one
+//     GET  /admin/snapshots/{name}/tiddlers/{title}  a tiddler as it was then
+//     POST /admin/snapshots/{name}/restore[?title=]  put the wiki (or one tiddler) back as it was
+// Restoring saves the old revision of each tiddler that has changed since as its newest revision, and deletes the
+// tiddlers created since, so a restore can itself be undone from the history or an earlier snapshot.  Snapshots
+// hold only revision numbers: revisions removed by prune-history can't be restored, and are reported as missing.
+
+const snapshotNameFormat = "20060102T150405Z"
+
+type wikiSnapshot struct {
+	Taken    time.Time `datastore:"Taken,noindex"`
+	Tiddlers int       `datastore:"Tiddlers,noindex"`
+	// Manifest is a JSON object mapping each title to its revision.
+	Manifest string `datastore:"Manifest,noindex"`
+}
+
+func (s *wikiSnapshot) revs() (map[string]int, error) {
+	revs := make(map[string]int)
+	err := json.Unmarshal([]byte(s.Manifest), &revs)
+	return revs, err
+}
+
+// takeSnapshot records the current revision of every live tiddler and
+// returns the snapshot's name.
+func takeSnapshot(ctx context.Context) (string, *wikiSnapshot, error) {
+	var revs map[string]int
+	err := retry(ctx, func() error {
+		revs = make(map[string]int)
+		return allTiddlers(ctx, func(title string, t *Tiddler) error {
+			if t.Meta != "" {
+				revs[title] = t.Rev
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := json.Marshal(revs)
+	if err != nil {
+		return "", nil, err
+	}
+	s := &wikiSnapshot{Taken: time.Now().UTC().Truncate(time.Second), Tiddlers: len(revs), Manifest: string(data)}
+	name := s.Taken.Format(snapshotNameFormat)
+	if err := dbPut(ctx, datastore.NameKey("WikiSnapshot", name, nil), s); err != nil {
+		return "", nil, err
+	}
+	return name, s, nil
+}
+
+// snapshotNames returns the names of the snapshots, oldest first.
+func snapshotNames(ctx context.Context) ([]string, error) {
+	var names []string
+	err := retry(ctx, func() error {
+		var err error
+		names, err = db.Names(ctx, "WikiSnapshot", "")
+		return err
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// dropOldSnapshots deletes all but the newest keep snapshots.
+func dropOldSnapshots(ctx context.Context, keep int) (int, error) {
+	names, err := snapshotNames(ctx)
+	if err != nil || len(names) <= keep {
+		return 0, err
+	}
+	var doomed []*datastore.Key
+	for _, name := range names[:len(names)-keep] {
+		doomed = append(doomed, datastore.NameKey("WikiSnapshot", name, nil))
+	}
+	return len(doomed), retry(ctx, func() error { return db.DeleteMulti(ctx, doomed) })
+}
+
+// startSnapshots takes a snapshot every snapshot-interval until the process
+// exits. Several servers sharing a wiki each check the newest snapshot
+// first, so they seldom take more than one per interval between them.
+func startSnapshots() {
+	if cfg.SnapshotInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			var wait time.Duration
+			err := recovered("snapshot", func() error {
+				var err error
+				wait, err = snapshotIfDue(context.Background())
+				return err
+			})
+			if err != nil {
+				log.Printf("snapshot: %v", err)
+				wait = time.Minute
+			}
+			time.Sleep(wait)
+		}
+	}()
+}
+
+// snapshotIfDue takes a snapshot if the newest is at least snapshot-interval
+// old, and returns how long until the next is due.
+func snapshotIfDue(ctx context.Context) (time.Duration, error) {
+	names, err := snapshotNames(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(names) > 0 {
+		if last, err := time.Parse(snapshotNameFormat, names[len(names)-1]); err == nil {
+			if due := last.Add(cfg.SnapshotInterval); time.Until(due) > 0 {
+				return time.Until(due), nil
+			}
+		}
+	}
+	name, s, err := takeSnapshot(ctx)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Took snapshot %s of %d tiddlers", name, s.Tiddlers)
+	if cfg.SnapshotKeep > 0 {
+		if n, err := dropOldSnapshots(ctx, cfg.SnapshotKeep); err != nil {
+			log.Printf("snapshot: dropping old snapshots: %v", err)
+		} else if n > 0 {
+			log.Printf("Dropped %d old snapshots", n)
+		}
+	}
+	return cfg.SnapshotInterval, nil
+}
+
+type restoreResult struct {
+	Restored int      `json:"restored"`
+	Deleted  int      `json:"deleted"`
+	Missing  []string `json:"missing,omitempty"`
+}
+
+// restoreSnapshot puts the tiddlers back as they were in s, or just title if
+// it isn't empty.
+func restoreSnapshot(ctx context.Context, s *wikiSnapshot, title string) (*restoreResult, error) {
+	revs, err := s.revs()
+	if err != nil {
+		return nil, err
+	}
+	var current map[string]*Tiddler
+	err = retry(ctx, func() error {
+		current = make(map[string]*Tiddler)
+		return allTiddlers(ctx, func(t string, td *Tiddler) error {
+			if title == "" || t == title {
+				current[t] = td
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &restoreResult{}
+	var doomed []string
+	for t, td := range current {
+		if _, ok := revs[t]; !ok && td.Meta != "" {
+			doomed = append(doomed, t)
+		}
+	}
+	sort.Strings(doomed)
+	var titles []string
+	for t := range revs {
+		if title == "" || t == title {
+			titles = append(titles, t)
+		}
+	}
+	sort.Strings(titles)
+	for _, t := range titles {
+		if td := current[t]; td != nil && td.Rev == revs[t] {
+			continue
+		}
+		var old Tiddler
+		err := dbGet(ctx, datastore.NameKey("TiddlerHistory", t+"#"+fmt.Sprint(revs[t]), nil), &old)
+		if err == datastore.ErrNoSuchEntity || err == nil && old.Meta == "" {
+			res.Missing = append(res.Missing, t)
+			continue
+		}
+		if err != nil {
+			return res, err
+		}
+		// A tiddler restored before has a newer revision with the
+		// same content; don't save it again.
+		if td := current[t]; td != nil && td.Meta == old.Meta && td.Text == old.Text {
+			continue
+		}
+		var js map[string]interface{}
+		if err := json.Unmarshal([]byte(old.Meta), &js); err != nil {
+			return res, fmt.Errorf("%s: %v", t, err)
+		}
+		js["text"] = old.Text
+		if _, err := saveTiddler(ctx, t, js); err != nil {
+			return res, fmt.Errorf("%s: %v", t, err)
+		}
+		res.Restored++
+	}
+	res.Deleted, err = deleteTiddlers(ctx, doomed)
+	return res, err
+}
+
+type snapshotInfo struct {
+	Name     string    `json:"name"`
+	Taken    time.Time `json:"taken"`
+	Tiddlers int       `json:"tiddlers"`
+}
+
+// adminSnapshots serves /admin/snapshots and everything under it.
+func adminSnapshots(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET", "POST") {
+		return
+	}
+	if r.Method == "POST" && !sameOrigin(w, r) {
+		return
+	}
+	ctx := r.Context()
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/snapshots"), "/")
+	if rest == "" {
+		if r.Method == "POST" {
+			name, s, err := takeSnapshot(ctx)
+			if err != nil {
+				storeError(w, err)
+				return
+			}
+			logf(ctx, "%s took snapshot %s", currentUser(r), name)
+			data, err := json.Marshal(snapshotInfo{name, s.Taken, s.Tiddlers})
+			if err != nil {
+				storeError(w, err)
+				return
+			}
+			writeJSON(w, data)
+			return
+		}
+		listSnapshots(w, r)
+		return
+	}
+
+	name, sub := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		name, sub = rest[:i], rest[i+1:]
+	}
+	var s wikiSnapshot
+	if err := dbGet(ctx, datastore.NameKey("WikiSnapshot", name, nil), &s); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			http.Error(w, "no such snapshot", 404)
+			return
+		}
+		storeError(w, err)
+		return
+	}
+	revs, err := s.revs()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	switch {
+	case sub == "" && r.Method == "GET":
+		data, err := json.Marshal(struct {
+			snapshotInfo
+			Revs map[string]int `json:"revs"`
+		}{snapshotInfo{name, s.Taken, s.Tiddlers}, revs})
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		writeJSON(w, data)
+	case strings.HasPrefix(sub, "tiddlers/") && r.Method == "GET":
+		title := strings.TrimPrefix(sub, "tiddlers/")
+		rev, ok := revs[title]
+		if !ok {
+			http.Error(w, "not in this snapshot", 404)
+			return
+		}
+		var t Tiddler
+		err := dbGet(ctx, datastore.NameKey("TiddlerHistory", title+"#"+fmt.Sprint(rev), nil), &t)
+		if err == datastore.ErrNoSuchEntity || err == nil && t.Meta == "" {
+			http.Error(w, "revision no longer in the history", http.StatusGone)
+			return
+		}
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		data, err := tiddlerJSON(&t)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		writeJSON(w, data)
+	case sub == "restore" && r.Method == "POST":
+		title := r.FormValue("title")
+		res, err := restoreSnapshot(ctx, &s, title)
+		if res != nil {
+			what := "the wiki"
+			if title != "" {
+				what = fmt.Sprintf("%q", loggedTitle(title))
+			}
+			logf(ctx, "%s restored %s to snapshot %s: %d restored, %d deleted, %d missing", currentUser(r), what, name,
+				res.Restored, res.Deleted, len(res.Missing))
+		}
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		data, err := json.Marshal(res)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		writeJSON(w, data)
+	default:
+		http.Error(w, "not found", 404)
+	}
+}
+
+func listSnapshots(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	list := []snapshotInfo{}
+	err := retry(ctx, func() error {
+		list = list[:0]
+		var s wikiSnapshot
+		return db.Scan(ctx, "WikiSnapshot", "", &s, func(name string) error {
+			list = append(list, snapshotInfo{name, s.Taken, s.Tiddlers})
+			return nil
+		})
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name > list[j].Name })
+	data, err := json.Marshal(list)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, data)
+}
+
+func snapshotCmd(args []string) error {
+	fs := newFlagSet("snapshot", "")
+	if ok, err := setup(fs, args); !ok {
+		return err
+	}
+	if err := openStore(); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	name, s, err := takeSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Took snapshot %s of %d tiddlers", name, s.Tiddlers)
+	if cfg.SnapshotKeep > 0 {
+		n, err := dropOldSnapshots(ctx, cfg.SnapshotKeep)
+		if err != nil {
+			return err
+		}
+		log.Printf("Dropped %d old snapshots", n)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Re Static store
+//
+// The page at / holds the core and plugins, a few megabytes that change only with the core, and then syncs every
+// tiddler from the server.  GET /static.html serves the same page with its boot held back, and a loader that fetches
+// GET /store.json, every live tiddler, text included, in the JSON form of a TiddlyWiki store area, adds it to the
+// page as a store and boots.  The browser keeps the page (it is revalidated against an Etag that changes only with
+// the core), so only the tiddlers go over the wire; they come in one response, and are answered with 304 while the
+// tiddler list (see Re Cache layers) hasn't changed.  Each tiddler keeps its revision and bag, so the TiddlyWeb
+// adaptor takes it as loaded and syncs from there as usual.  The page is the core page as configured, not as the
+// custom shell renders it (see Re Custom shell), so that it stays the same from one request to the next; the
+// shell's tiddlers arrive in the store instead.
+
+var (
+	skeletonPage page
+	skeletonETag string
+)
+
+// skeletonHead and skeletonBody are added to the page by initSkeleton.
+const (
+	skeletonHead = `<script>var $tw = {boot: {suppressBoot: true}};</script>` + "\n"
+	skeletonBody = `<script>
+fetch("store.json", {credentials: "same-origin"}).then(function(res) {
+	if (!res.ok) {
+		throw new Error(res.status + " " + res.statusText);
+	}
+	return res.text();
+}).then(function(text) {
+	var store = document.createElement("script");
+	store.className = "tiddlywiki-tiddler-store";
+	store.type = "application/json";
+	store.textContent = text;
+	document.body.appendChild(store);
+	$tw.boot.boot();
+}, function(err) {
+	document.body.textContent = "Loading the wiki failed: " + err.message;
+});
+</script>
+`
+)
+
+// initSkeleton builds the page served at /static.html from p.
+func initSkeleton(p page) {
+	p.data = insertBefore(p.data, "</head>", skeletonHead)
+	p.data = insertBefore(p.data, "</body>", skeletonBody)
+	skeletonPage = precompress(p)
+	skeletonETag = fmt.Sprintf(`"skeleton/%x"`, md5.Sum(p.data))
+}
+
+func staticHTML(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	w.Header().Set("Etag", skeletonETag)
+	servePage(w, r, "static.html", skeletonPage)
+}
+
+func storeJSON(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	ctx := r.Context()
+	list, err := cachedSkinnyList(ctx)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	etag := fmt.Sprintf(`"store/%x"`, md5.Sum(list))
+	w.Header().Set("Etag", etag)
+	if noneMatch(w, r, etag) {
+		return
+	}
+	data, err := storeTiddlers(ctx)
+	if err != nil {
+		logf(ctx, "building store.json: %v", err)
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, data)
+}
+
+// storeTiddlers returns every live tiddler as the JSON of a TiddlyWiki
+// store area.
+func storeTiddlers(ctx context.Context) ([]byte, error) {
+	var tiddlers []map[string]string
+	err := retry(ctx, func() error {
+		tiddlers = []map[string]string{}
+		return allTiddlers(ctx, func(title string, t *Tiddler) error {
+			if t.Meta == "" {
+				return nil
+			}
+			fields, err := storeFields(t)
+			if err != nil {
+				return fmt.Errorf("%s: %v", title, err)
+			}
+			tiddlers = append(tiddlers, fields)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(tiddlers) // escapes <, so it can't end the script
+}
+
+// storeFields returns t's fields as a TiddlyWiki store holds them, with the
+// revision and bag the TiddlyWeb adaptor looks for.
+func storeFields(t *Tiddler) (map[string]string, error) {
+	fields, err := flatFields([]byte(t.Meta))
+	if err != nil {
+		return nil, err
+	}
+	fields["text"] = t.Text
+	fields["revision"] = strconv.Itoa(t.Rev)
+	fields["bag"] = "bag"
+	return fields, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// wikiStats summarizes the stored wiki, for /admin and /admin/stats.
+type wikiStats struct {
+	Tiddlers       int           `json:"tiddlers"`
+	SystemTiddlers int           `json:"systemTiddlers"`
+	Deleted        int           `json:"deleted"`
+	TextBytes      int           `json:"textBytes"`
+	StoredBytes    int           `json:"storedBytes"`
+	HistoryEntries int           `json:"historyEntries"`
+	Largest        []sizeInfo    `json:"largest"`
+	LastModified   time.Time     `json:"lastModified"`
+	Usage          []userUsage   `json:"usage"`
+	Recent         []tiddlerInfo `json:"-"`
+	Trash          []tiddlerInfo `json:"-"`
+}
+
+type sizeInfo struct {
+	Title string `json:"title"`
+	Bytes int    `json:"bytes"`
+}
+
+const (
+	statsLargest = 10
+	statsRecent  = 25
+)
+
+func gatherStats(ctx context.Context) (*wikiStats, error) {
+	var s *wikiStats
+	err := retry(ctx, func() error {
+		s = new(wikiStats)
+		return allTiddlers(ctx, func(title string, t *Tiddler) error {
+			info := infoFor(title, t)
+			s.StoredBytes += info.Bytes
+			if info.Deleted {
+				s.Deleted++
+				s.Trash = append(s.Trash, info)
+				return nil
+			}
+			s.TextBytes += len(t.Text)
+			s.Largest = append(s.Largest, sizeInfo{title, info.Bytes})
+			if info.Modified.After(s.LastModified) {
+				s.LastModified = info.Modified
+			}
+			if strings.HasPrefix(title, "$:/") {
+				s.SystemTiddlers++
+				return nil
+			}
+			s.Tiddlers++
+			s.Recent = append(s.Recent, info)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = retry(ctx, func() error {
+		names, err := db.Names(ctx, "TiddlerHistory", "")
+		s.HistoryEntries = len(names)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Usage, err = usageByUser(ctx); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(s.Largest, func(i, j int) bool { return s.Largest[i].Bytes > s.Largest[j].Bytes })
+	if len(s.Largest) > statsLargest {
+		s.Largest = s.Largest[:statsLargest]
+	}
+	sort.Slice(s.Recent, func(i, j int) bool { return s.Recent[i].Modified.After(s.Recent[j].Modified) })
+	if len(s.Recent) > statsRecent {
+		s.Recent = s.Recent[:statsRecent]
+	}
+	sort.Slice(s.Trash, func(i, j int) bool { return s.Trash[i].Title < s.Trash[j].Title })
+	return s, nil
+}
+
+func adminStats(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	s, err := gatherStats(r.Context())
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, data)
+}
@@ -0,0 +1,266 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// Re Storage
+//
+// Everything is kept as entities of a few kinds (Tiddler, TiddlerHistory, TiddlerLinks, ...), each named by a
+// string, which is all Datastore is used for.  The Store interface is that much of Datastore, so that other backends
+// can stand in for it; it keeps Datastore's keys, ErrNoSuchEntity and MultiError so that callers needn't care which
+// backend they have.  Backends other than Datastore are built on a simpler key-value interface (see kvStore) and
+// keep entities as JSON.  The storage setting chooses one:
+//     datastore   Google Cloud Datastore, or Firestore in Datastore mode (the default)
+//     firestore   Firestore in native mode
+//     file        a single local file
+//     s3          any S3-compatible object store
+//     mysql       MySQL or MariaDB
+
+type Store interface {
+	Get(ctx context.Context, key *datastore.Key, dst interface{}) error
+	// GetMulti is like Get for each key, loading into the elements of the
+	// slice dst and returning a datastore.MultiError if any fail.
+	GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error
+	Put(ctx context.Context, key *datastore.Key, src interface{}) error
+	PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) error
+	DeleteMulti(ctx context.Context, keys []*datastore.Key) error
+
+	// Scan loads each entity of kind whose name starts with prefix into
+	// dst, a pointer to a struct, and calls fn with its name.
+	Scan(ctx context.Context, kind, prefix string, dst interface{}, fn func(name string) error) error
+	// Names returns the names of the entities of kind starting with prefix.
+	Names(ctx context.Context, kind, prefix string) ([]string, error)
+	// LinksTo returns the names of the TiddlerLinks entities listing title.
+	LinksTo(ctx context.Context, title string) ([]string, error)
+
+	// RunInTransaction calls f in a transaction, committing what it puts
+	// and deletes if it returns nil.
+	RunInTransaction(ctx context.Context, f func(tx Transaction) error) error
+	Close() error
+}
+
+type Transaction interface {
+	Get(key *datastore.Key, dst interface{}) error
+	Put(key *datastore.Key, src interface{}) error
+	PutMulti(keys []*datastore.Key, src interface{}) error
+	Delete(key *datastore.Key) error
+}
+
+var db Store
+
+// openStore connects to the configured storage backend.
+func openStore() error {
+	s, err := openBackend(cfg.Storage)
+	if err != nil {
+		return err
+	}
+	db = storeLayers(s)
+	return nil
+}
+
+// storeLayers wraps a backend in the layers the server uses.
+func storeLayers(s Store) Store {
+	s = budgetStore{s}
+	if cfg.CallTimeout > 0 {
+		s = timeoutStore{s}
+	}
+	asyncHistory = nil
+	if cfg.AsyncHistory {
+		asyncHistory = newHistoryStore(s)
+		s = asyncHistory
+	}
+	if cfg.Catalog {
+		s = catalogStore{s}
+	}
+	s = newDraftStore(s)
+	if cfg.CoalesceSaves > 0 {
+		s = newCoalesceStore(s)
+	}
+	return addCacheLayers(s)
+}
+
+// openBackend connects to the named storage backend, configured as usual,
+// without the layers openStore adds.
+func openBackend(storage string) (Store, error) {
+	switch storage {
+	case "datastore":
+		ctx := context.Background()
+		opts, err := googleOptions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c, err := datastore.NewClient(ctx, dataProject(), opts...)
+		if err != nil {
+			return nil, err
+		}
+		return datastoreStore{c}, nil
+	case "firestore":
+		return openFirestore()
+	case "file":
+		return openFileStore()
+	case "s3":
+		return openS3()
+	case "mysql":
+		return openMySQL()
+	}
+	return nil, fmt.Errorf("unknown storage %q", storage)
+}
+
+// datastoreStore is a Store kept in Google Cloud Datastore.
+//
+// # Re Datastore namespace and kinds
+//
+// The rest of the server names kinds Tiddler, TiddlerHistory and so on; datastoreStore maps them to the kinds
+// named by tiddler-kind and history-kind, and puts every entity in the namespace datastore-namespace, so that
+// several wikis (or staging and production) can share a project.  The defaults are the names used before these
+// settings existed, and the default namespace, so existing data needs no migration.
+type datastoreStore struct {
+	*datastore.Client
+}
+
+// dsKind returns the Datastore kind for kind.
+func dsKind(kind string) string {
+	switch kind {
+	case "Tiddler":
+		return cfg.TiddlerKind
+	case "TiddlerHistory":
+		return cfg.HistoryKind
+	}
+	return kind
+}
+
+// dsKey returns the Datastore key for key.
+func dsKey(key *datastore.Key) *datastore.Key {
+	k := datastore.NameKey(dsKind(key.Kind), key.Name, nil)
+	k.Namespace = cfg.DatastoreNamespace
+	return k
+}
+
+func dsKeys(keys []*datastore.Key) []*datastore.Key {
+	ks := make([]*datastore.Key, len(keys))
+	for i, k := range keys {
+		ks[i] = dsKey(k)
+	}
+	return ks
+}
+
+func (s datastoreStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	return s.Client.Get(ctx, dsKey(key), dst)
+}
+
+func (s datastoreStore) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return s.Client.GetMulti(ctx, dsKeys(keys), dst)
+}
+
+func (s datastoreStore) Put(ctx context.Context, key *datastore.Key, src interface{}) error {
+	_, err := s.Client.Put(ctx, dsKey(key), src)
+	return err
+}
+
+func (s datastoreStore) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) error {
+	_, err := s.Client.PutMulti(ctx, dsKeys(keys), src)
+	return err
+}
+
+func (s datastoreStore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	return s.Client.DeleteMulti(ctx, dsKeys(keys))
+}
+
+// nameRange returns a query for the entities of kind whose names start with
+// prefix.
+func nameRange(kind, prefix string) *datastore.Query {
+	q := datastore.NewQuery(dsKind(kind)).Namespace(cfg.DatastoreNamespace)
+	if prefix != "" {
+		q = q.Filter("__key__ >=", dsKey(datastore.NameKey(kind, prefix, nil))).
+			Filter("__key__ <", dsKey(datastore.NameKey(kind, prefixEnd(prefix), nil)))
+	}
+	return q
+}
+
+// prefixEnd returns the least string greater than every string starting with
+// prefix, which must not be empty.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return prefix + "\xff"
+}
+
+func (s datastoreStore) Scan(ctx context.Context, kind, prefix string, dst interface{}, fn func(name string) error) error {
+	it := s.Run(ctx, nameRange(kind, prefix))
+	v := reflect.ValueOf(dst).Elem()
+	for {
+		v.Set(reflect.Zero(v.Type()))
+		key, err := it.Next(dst)
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(key.Name); err != nil {
+			return err
+		}
+	}
+}
+
+func (s datastoreStore) Names(ctx context.Context, kind, prefix string) ([]string, error) {
+	keys, err := s.GetAll(ctx, nameRange(kind, prefix).KeysOnly(), nil)
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.Name
+	}
+	return names, err
+}
+
+func (s datastoreStore) LinksTo(ctx context.Context, title string) ([]string, error) {
+	keys, err := s.GetAll(ctx, datastore.NewQuery("TiddlerLinks").Namespace(cfg.DatastoreNamespace).Filter("Links =", title).KeysOnly(), nil)
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.Name
+	}
+	return names, err
+}
+
+func (s datastoreStore) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	_, err := s.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return f(datastoreTx{tx})
+	})
+	return err
+}
+
+type datastoreTx struct {
+	*datastore.Transaction
+}
+
+func (tx datastoreTx) Get(key *datastore.Key, dst interface{}) error {
+	return tx.Transaction.Get(dsKey(key), dst)
+}
+
+func (tx datastoreTx) Put(key *datastore.Key, src interface{}) error {
+	_, err := tx.Transaction.Put(dsKey(key), src)
+	return err
+}
+
+func (tx datastoreTx) PutMulti(keys []*datastore.Key, src interface{}) error {
+	_, err := tx.Transaction.PutMulti(dsKeys(keys), src)
+	return err
+}
+
+func (tx datastoreTx) Delete(key *datastore.Key) error {
+	return tx.Transaction.Delete(dsKey(key))
+}
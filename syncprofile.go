@@ -0,0 +1,305 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Sync profiles
+//
+// Every device syncs every tiddler, which for a wiki with a large archive means a phone carrying years of notes it
+// never shows.  A sync profile is a named filter choosing the tiddlers a device syncs:
+//     PUT    /sync-profiles/{name}   {"filter": "-[prefix[$:/]] -[tag[archive]]"}
+//     GET    /sync-profiles/{name}   the profile, or GET /sync-profiles/ for all of them
+//     DELETE /sync-profiles/{name}
+// A device picks one by asking for /recipes/all/tiddlers.json?profile={name}, or by carrying a sync-profile cookie
+// naming it, which works with an unmodified TiddlyWeb adaptor; the list then leaves out the tiddlers the filter
+// doesn't select, so the browser never loads them.  The tiddlers themselves are still served and saved as usual.
+// Profiles are SyncProfile entities named by the profile's name.
+//
+// The filter is a small part of TiddlyWiki's filter syntax, enough to say which tiddlers to keep or drop: runs of
+// [step[param]...] steps, each optionally negated with !, where a step is title, prefix, suffix, tag or is (with
+// system or draft).  A run selects the tiddlers matching all its steps; runs are combined as in TiddlyWiki, a plain
+// run adding its tiddlers and a run starting with - taking them away.  A filter starting with a - run starts from
+// every tiddler.
+
+const maxProfileNameBytes = 100
+
+type syncProfile struct {
+	Filter string `datastore:"Filter,noindex" json:"filter"`
+}
+
+type syncProfileResult struct {
+	Name   string `json:"name"`
+	Filter string `json:"filter"`
+}
+
+func syncProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET", "PUT", "DELETE") {
+		return
+	}
+	if r.Method != "GET" && (!mustBeAdmin(w, r) || !sameOrigin(w, r)) {
+		return
+	}
+	ctx := r.Context()
+	name := pathTitle(r, "/sync-profiles/")
+	if name == "" {
+		if r.Method != "GET" {
+			http.Error(w, "no profile name", 400)
+			return
+		}
+		listSyncProfiles(w, r)
+		return
+	}
+	if len(name) > maxProfileNameBytes || !utf8.ValidString(name) || strings.Contains(name, "/") {
+		http.Error(w, "bad profile name", 400)
+		return
+	}
+	key := datastore.NameKey("SyncProfile", name, nil)
+	var p syncProfile
+	switch r.Method {
+	case "GET":
+		if err := dbGet(ctx, key, &p); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				http.Error(w, "no such profile", 404)
+				return
+			}
+			storeError(w, err)
+			return
+		}
+	case "PUT":
+		if !checkJSONBody(w, r) {
+			return
+		}
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+		if err != nil {
+			http.Error(w, "cannot read data", 400)
+			return
+		}
+		if err := json.Unmarshal(data, &p); err != nil {
+			http.Error(w, "expected {\"filter\": ...}: "+err.Error(), 400)
+			return
+		}
+		if _, err := parseSyncFilter(p.Filter); err != nil {
+			http.Error(w, "bad filter: "+err.Error(), 400)
+			return
+		}
+		if err := dbPut(ctx, key, &p); err != nil {
+			storeError(w, err)
+			return
+		}
+		logf(ctx, "%s set sync profile %q to %q", currentUser(r), name, p.Filter)
+	case "DELETE":
+		if err := retry(ctx, func() error { return db.DeleteMulti(ctx, []*datastore.Key{key}) }); err != nil {
+			storeError(w, err)
+			return
+		}
+		logf(ctx, "%s deleted sync profile %q", currentUser(r), name)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	data, err := json.Marshal(syncProfileResult{name, p.Filter})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, data)
+}
+
+func listSyncProfiles(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	res := []syncProfileResult{}
+	var p syncProfile
+	err := retry(ctx, func() error {
+		res = res[:0]
+		return db.Scan(ctx, "SyncProfile", "", &p, func(name string) error {
+			res = append(res, syncProfileResult{name, p.Filter})
+			return nil
+		})
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	data, err := json.Marshal(res)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, data)
+}
+
+// requestedProfile returns the filter of the sync profile r asks for, or nil
+// if it doesn't ask for one. An error is meant for the client.
+func requestedProfile(r *http.Request) (*syncFilter, int, error) {
+	name := r.FormValue("profile")
+	if name == "" {
+		if c, err := r.Cookie("sync-profile"); err == nil {
+			name = c.Value
+		}
+	}
+	if name == "" {
+		return nil, 0, nil
+	}
+	var p syncProfile
+	if err := dbGet(r.Context(), datastore.NameKey("SyncProfile", name, nil), &p); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, 404, fmt.Errorf("no such sync profile %q", name)
+		}
+		return nil, 0, err
+	}
+	f, err := parseSyncFilter(p.Filter)
+	if err != nil {
+		return nil, 500, fmt.Errorf("sync profile %q: %v", name, err)
+	}
+	return f, 0, nil
+}
+
+// filterList returns the tiddlers in list, a skinny list, that f selects.
+func filterList(list []byte, f *syncFilter) ([]byte, error) {
+	var all []json.RawMessage
+	if err := json.Unmarshal(list, &all); err != nil {
+		return nil, err
+	}
+	kept := make([]json.RawMessage, 0, len(all))
+	for _, data := range all {
+		var t struct {
+			Title string  `json:"title"`
+			Tags  tagList `json:"tags"`
+		}
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, err
+		}
+		if f.selects(t.Title, t.Tags) {
+			kept = append(kept, data)
+		}
+	}
+	return json.Marshal(kept)
+}
+
+// syncFilter is a parsed sync profile filter.
+type syncFilter struct {
+	runs []filterRun
+}
+
+type filterRun struct {
+	remove bool
+	steps  []filterStep
+}
+
+type filterStep struct {
+	negate    bool
+	op, param string
+}
+
+// parseSyncFilter parses the filter of a sync profile.
+func parseSyncFilter(s string) (*syncFilter, error) {
+	f := new(syncFilter)
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		var run filterRun
+		switch s[0] {
+		case '-':
+			run.remove = true
+			s = s[1:]
+		case '+':
+			s = s[1:]
+		}
+		if !strings.HasPrefix(s, "[") {
+			return nil, errors.New("expected [ to start a run")
+		}
+		s = s[1:]
+		for !strings.HasPrefix(s, "]") {
+			var step filterStep
+			if strings.HasPrefix(s, "!") {
+				step.negate = true
+				s = s[1:]
+			}
+			i := strings.IndexByte(s, '[')
+			if i < 0 {
+				return nil, errors.New("expected [ after the step name")
+			}
+			step.op, s = s[:i], s[i+1:]
+			j := strings.IndexByte(s, ']')
+			if j < 0 {
+				return nil, errors.New("unterminated parameter")
+			}
+			step.param, s = s[:j], s[j+1:]
+			switch step.op {
+			case "title", "prefix", "suffix", "tag":
+			case "is":
+				if step.param != "system" && step.param != "draft" {
+					return nil, fmt.Errorf("unsupported is[%s]; want system or draft", step.param)
+				}
+			default:
+				return nil, fmt.Errorf("unsupported step %q; want title, prefix, suffix, tag or is", step.op)
+			}
+			run.steps = append(run.steps, step)
+			if s == "" {
+				return nil, errors.New("unterminated run")
+			}
+		}
+		if len(run.steps) == 0 {
+			return nil, errors.New("empty run")
+		}
+		s = s[1:]
+		f.runs = append(f.runs, run)
+	}
+	return f, nil
+}
+
+// selects reports whether f keeps the tiddler with title and tags.
+func (f *syncFilter) selects(title string, tags []string) bool {
+	in := len(f.runs) == 0 || f.runs[0].remove
+	for _, run := range f.runs {
+		if run.matches(title, tags) {
+			in = !run.remove
+		}
+	}
+	return in
+}
+
+func (run *filterRun) matches(title string, tags []string) bool {
+	for _, step := range run.steps {
+		if step.matches(title, tags) == step.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (step *filterStep) matches(title string, tags []string) bool {
+	switch step.op {
+	case "title":
+		return title == step.param
+	case "prefix":
+		return strings.HasPrefix(title, step.param)
+	case "suffix":
+		return strings.HasSuffix(title, step.param)
+	case "tag":
+		for _, tag := range tags {
+			if tag == step.param {
+				return true
+			}
+		}
+		return false
+	case "is":
+		if step.param == "system" {
+			return strings.HasPrefix(title, "$:/")
+		}
+		return strings.HasPrefix(title, "Draft of '")
+	}
+	return false
+}
@@ -0,0 +1,224 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Templates
+//
+// Scripts and webhooks that start the day's journal or a meeting's notes can have the server do the work:
+//     POST /recipes/all/tiddlers?template=Meeting+template
+//     {"title": "Meeting %date%", "vars": {"topic": "Budget"}, "timezone": "Europe/London"}
+// makes a new tiddler from the template tiddler's fields and text, replacing placeholders in its title, text, tags
+// and other string fields:
+//     %date%     the date, 2006-01-02      %time%   the time, 15:04
+//     %weekday%  the day of the week       %user%   who is making the tiddler
+//     %title%    the new tiddler's title   %name%   anything else, from vars
+// Dates and times are in UTC unless timezone names another zone.  The title can also be given as ?title=, or left
+// to the template's template-title field; the body is optional.  Placeholders nobody knows are left alone, as is the
+// template itself.  The new tiddler gets fresh created and modified times, and the request's user as creator and
+// modifier, and is answered like a batch save, with 201; a live tiddler with that title already there gets 409.
+
+type templateRequest struct {
+	Title    string            `json:"title"`
+	Vars     map[string]string `json:"vars"`
+	Timezone string            `json:"timezone"`
+}
+
+func createFromTemplate(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(w, r) || !checkJSONBody(w, r) {
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, "cannot read data", 400)
+		return
+	}
+	var req templateRequest
+	if len(strings.TrimSpace(string(data))) > 0 {
+		if err := json.Unmarshal(data, &req); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	if req.Title == "" {
+		req.Title = r.URL.Query().Get("title")
+	}
+	now := time.Now().UTC()
+	if req.Timezone != "" {
+		loc, err := time.LoadLocation(req.Timezone)
+		if err != nil {
+			http.Error(w, "bad timezone: "+err.Error(), 400)
+			return
+		}
+		now = now.In(loc)
+	}
+
+	ctx := r.Context()
+	name := r.URL.Query().Get("template")
+	js, err := templateTiddler(ctx, name)
+	if err == errNoTemplate {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	user := currentUser(r)
+	title, err := fillTemplate(js, req.Title, req.Vars, now, user)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	t, err := createTiddler(ctx, title, js)
+	if err == errTitleLive {
+		http.Error(w, title+": "+err.Error(), 409)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	logf(ctx, "%s made %q from template %q", user, loggedTitle(title), loggedTitle(name))
+	etag := tiddlerETag(title, &t)
+	out, err := json.Marshal(batchResult{Title: title, Revision: t.Rev, ETag: etag})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	w.Header().Set("Etag", etag)
+	w.Header().Set("Content-Type", jsonType)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(out)
+}
+
+var errNoTemplate = errors.New("no such template")
+
+// templateTiddler reads the template tiddler name, text included.
+func templateTiddler(ctx context.Context, name string) (map[string]interface{}, error) {
+	var tmpl Tiddler
+	if err := dbGet(ctx, datastore.NameKey("Tiddler", name, nil), &tmpl); err != nil || tmpl.Meta == "" {
+		if err == nil || err == datastore.ErrNoSuchEntity {
+			return nil, errNoTemplate
+		}
+		return nil, err
+	}
+	var js map[string]interface{}
+	if err := json.Unmarshal([]byte(tmpl.Meta), &js); err != nil {
+		return nil, err
+	}
+	js["text"] = tmpl.Text
+	return js, nil
+}
+
+// fillTemplate turns js, a template, into a new tiddler titled title, or the
+// template's template-title if title is empty, made by user at now, and
+// returns its title.
+func fillTemplate(js map[string]interface{}, title string, vars map[string]string, now time.Time, user string) (string, error) {
+	fields, _ := js["fields"].(map[string]interface{})
+	if title == "" {
+		title, _ = fields["template-title"].(string)
+	}
+	delete(fields, "template-title")
+	if title == "" {
+		return "", errors.New("give a title, or a template-title field in the template")
+	}
+
+	all := map[string]string{
+		"date":    now.Format("2006-01-02"),
+		"time":    now.Format("15:04"),
+		"weekday": now.Weekday().String(),
+		"user":    user,
+	}
+	for k, v := range vars {
+		all[k] = v
+	}
+	title = expandPlaceholders(title, all)
+	if err := checkTitle(title); err != nil {
+		return "", fmt.Errorf("title: %v", err)
+	}
+	all["title"] = title
+	expandFields(js, all)
+
+	stamp := tiddlyDate(now)
+	js["title"] = title
+	js["created"] = stamp
+	js["modified"] = stamp
+	js["creator"] = user
+	js["modifier"] = user
+	delete(js, "revision")
+	return title, nil
+}
+
+// createTiddler saves js as the first revision of a live tiddler title,
+// returning errTitleLive if there is one already. The check is made in the
+// transaction that saves, so of two creating the same title one gets
+// errTitleLive.
+func createTiddler(ctx context.Context, title string, js map[string]interface{}) (Tiddler, error) {
+	return saveRevisionIf(ctx, title, js, func(cur *Tiddler) error {
+		if cur.Meta != "" {
+			return errTitleLive
+		}
+		return nil
+	})
+}
+
+// expandPlaceholders replaces each %name% in s with vars[name], leaving
+// the ones vars hasn't got.
+func expandPlaceholders(s string, vars map[string]string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "%")
+		if i < 0 {
+			break
+		}
+		j := strings.Index(s[i+1:], "%")
+		if j < 0 {
+			break
+		}
+		if v, ok := vars[s[i+1:i+1+j]]; ok {
+			b.WriteString(s[:i])
+			b.WriteString(v)
+			s = s[i+j+2:]
+			continue
+		}
+		// Not a placeholder; the closing % may open the next one.
+		b.WriteString(s[:i+1])
+		s = s[i+1:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// expandFields expands the placeholders in the string values of the
+// tiddler js, in its fields object, and in its tags.
+func expandFields(js map[string]interface{}, vars map[string]string) {
+	for k, v := range js {
+		switch v := v.(type) {
+		case string:
+			js[k] = expandPlaceholders(v, vars)
+		case []interface{}:
+			for i := range v {
+				if s, ok := v[i].(string); ok {
+					v[i] = expandPlaceholders(s, vars)
+				}
+			}
+		case map[string]interface{}:
+			expandFields(v, vars)
+		}
+	}
+}
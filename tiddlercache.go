@@ -0,0 +1,88 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Re Tiddler cache
+//
+// The browser fetches a tiddler's text when it is first shown, and again when the story is switched back to it, so
+// the same few tiddlers are fetched over and over.  GET of a tiddler therefore keeps the JSON it sends, with its
+// revision and ETag, in a small cache of tiddler-cache-bytes, and serves repeats from it without reading the store.
+// A tiddler is dropped from the cache when this server saves or deletes it, and when another server does if the
+// storage layers can report it (a redis cache layer can); otherwise, like the memory cache layer, entries are
+// trusted for memory-cache-ttl, and with several servers a save through one is missed by the others until then.
+// That breaks read-after-write for a browser whose requests land on different servers, so the cache is off
+// unless tiddler-cache-bytes is set.
+
+type renderedTiddler struct {
+	rev      int
+	etag     string
+	modified time.Time
+	data     []byte
+}
+
+type tiddlerCache struct {
+	mu    sync.Mutex
+	cache *lru
+	gen   uint64 // counts changes, as in memoryStore
+	watch sync.Once
+}
+
+var tiddlers tiddlerCache
+
+// get returns the cached rendering of title, or the generation to pass to
+// add after rendering it.
+func (c *tiddlerCache) get(title string) (*renderedTiddler, uint64, bool) {
+	if cfg.TiddlerCacheBytes <= 0 {
+		return nil, 0, false
+	}
+	c.watch.Do(func() {
+		if n, ok := db.(changeNotifier); ok {
+			n.watchChanges(c.forgetTitles)
+		}
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = newLRU(cfg.TiddlerCacheBytes, cfg.MemoryCacheTTL)
+	}
+	v, ok := c.cache.get(title)
+	rt, _ := v.(*renderedTiddler)
+	return rt, c.gen, ok
+}
+
+// add caches rt as the rendering of title made at generation gen, unless
+// something has changed since.
+func (c *tiddlerCache) add(title string, rt *renderedTiddler, gen uint64) {
+	if cfg.TiddlerCacheBytes <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen == gen && c.cache != nil {
+		c.cache.add(title, rt, int64(len(title)+len(rt.etag)+len(rt.data)))
+	}
+}
+
+// forgetTitles drops titles, or everything if titles is nil.
+func (c *tiddlerCache) forgetTitles(titles []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if c.cache == nil {
+		return
+	}
+	if titles == nil {
+		c.cache.clear()
+		return
+	}
+	for _, t := range titles {
+		c.cache.delete(t)
+	}
+}
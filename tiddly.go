@@ -7,71 +7,183 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/md5"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"cloud.google.com/go/datastore"
-	"google.golang.org/api/iterator"
 )
 
 // Re Authentication
 //
 // With the apparent impending demise of the App Engine Users API, I've converted this version to sit behind an
 // authenticating proxy like https://github.com/davars/sohop or https://github.com/pusher/oauth2_proxy.  Set the
-// X-Webauth-User header to the authorized user's ID.  In sohop you can add a Headers clause like:
+// X-Webauth-User header (or whatever auth-header is configured as) to the authorized user's ID.  In sohop you can
+// add a Headers clause like:
 //     "tiddly": {
 //      "URL": "http://127.0.0.1:8080",
-//      "HealthCheck": "http://127.0.0.1:8080/health",
+//      "HealthCheck": "http://127.0.0.1:8080/readyz",
 //      "Auth": true,
 //      "Headers": { "X-WEBAUTH-USER":["{{.Session.Values.user}}"] }
 //    },
 //
 
-var dsClient = func() *datastore.Client {
-	project := os.Getenv("GCP_PROJECT")
-	if project == "" {
-		log.Fatal("must set GCP_PROJECT env var")
+func serve(args []string) error {
+	fs := newFlagSet("serve", "")
+	if ok, err := setup(fs, args); !ok {
+		return err
 	}
-	cli, err := datastore.NewClient(context.Background(), project)
+
+	var err error
+	indexPage, err = loadPage(filepath.Join(cfg.CoreDir, cfg.Core))
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving %s (TiddlyWiki %s)", cfg.Core, readCoreVersion(indexPage.data))
+	emptyPage, err = loadEmptyPage(filepath.Join(cfg.CoreDir, cfg.Core))
+	if err != nil {
+		return err
+	}
+	if err := initLibrary(&indexPage); err != nil {
+		return err
+	}
+	initSkeleton(indexPage)
+	indexPage = precompress(indexPage)
+	emptyPage = precompress(emptyPage)
+	openStoreLazily()
+	flushTraces := setupTracing(cfg.Project)
+	flushErrors := setupErrorReporting(cfg.Project)
+	initReadOnly()
+	startSnapshots()
+	startJournals()
+
+	handler := newHandler()
+	opsSrv, err := startOps()
+	if err != nil {
+		return err
+	}
+
+	srv := newServer(":"+cfg.Port, handler)
+	serveOn := configureTLS(srv)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		log.Printf("Received %v, shutting down", <-sig)
+
+		// Cloud Run allows 10 seconds between SIGTERM and SIGKILL.
+		ctx, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown: %v", err)
+		}
+		if opsSrv != nil {
+			opsSrv.Shutdown(ctx)
+		}
+	}()
+
+	l, err := listen()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	return cli
-}()
+	log.Printf("tiddly %s listening on %s", build, l.Addr())
+	if err := serveOn(l); err != http.ErrServerClosed {
+		return err
+	}
+	<-done
 
-func main() {
+	if err := db.Close(); err != nil {
+		log.Printf("Closing storage: %v", err)
+	}
+	flushTraces()
+	flushErrors()
+	return nil
+}
+
+// newHandler returns the handler for every route the server answers.
+func newHandler() http.Handler {
+	limiter = nil
+	if cfg.RateLimit > 0 {
+		limiter = newRateLimiter(cfg.RateLimit, cfg.RateBurst)
+	}
 	r := http.NewServeMux()
 	r.HandleFunc("/", root)
 	r.HandleFunc("/auth", auth)
 	r.HandleFunc("/status", status)
-	r.HandleFunc("/recipes/all/tiddlers/", tiddler)
-	r.HandleFunc("/recipes/all/tiddlers.json", tiddlerList)
+	r.HandleFunc("/about", about)
+	r.HandleFunc("/empty.html", emptyHTML)
+	r.HandleFunc("/static.html", staticHTML)
+	r.HandleFunc("/store.json", storeJSON)
+	r.HandleFunc("/core/", coreScript)
+	for _, recipe := range recipes() {
+		r.HandleFunc("/recipes/"+recipe+"/tiddlers/", tiddler)
+		r.HandleFunc("/recipes/"+recipe+"/tiddlers.json", tiddlerList)
+		r.HandleFunc("/recipes/"+recipe+"/tiddlers", batchSave)
+		r.HandleFunc("/recipes/"+recipe+"/transaction", transactionHandler)
+	}
 	r.HandleFunc("/bags/bag/tiddlers/", deleteTiddler)
+	r.HandleFunc("/links/", linksHandler)
+	r.HandleFunc("/graph.json", graph)
+	r.HandleFunc("/lock/", lockHandler)
+	r.HandleFunc("/import/files", importFiles)
+	r.HandleFunc("/sync-profiles/", syncProfilesHandler)
+	r.HandleFunc("/lists/", savedListHandler)
+	r.HandleFunc("/journal", journalHandler)
+	r.HandleFunc("/shares", sharesHandler)
+	r.HandleFunc("/shares/", sharesHandler)
+	if cfg.API {
+		r.HandleFunc("/api/v1/", apiHandler)
+	}
+	if cfg.Offline {
+		r.HandleFunc("/manifest.webmanifest", manifest)
+		r.HandleFunc("/sw.js", serviceWorker)
+	}
+	registerLibrary(r)
+	if cfg.OpsAddr == "" {
+		registerAdmin(r)
+		registerDebug(r)
+	}
 
-	http.HandleFunc("/health", health)
-	http.Handle("/", authCheck(r))
+	// Only publicEndpoints go on top; everything else is behind authCheck,
+	// or for guests, when they have sandboxes, served from those instead.
+	top := http.NewServeMux()
+	log.Printf("Serving without authentication: %s", strings.Join(registerPublic(top, r), ", "))
+	top.Handle("/", guestOr(authCheck(rateLimit(readOnlyCheck(r)))))
+	routeMuxes = []*http.ServeMux{top, r}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-		log.Printf("Defaulting to port %s", port)
-	}
+	return withBasePath(versionHeader(cacheHeaders(cors(replicaReads(top)))))
+}
 
-	log.Printf("Listening on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal(err)
+// withBasePath mounts h under base-path, if it is set.
+func withBasePath(h http.Handler) http.Handler {
+	if cfg.BasePath == "" {
+		return h
 	}
+	base := http.NewServeMux()
+	base.Handle(cfg.BasePath+"/", http.StripPrefix(cfg.BasePath, h))
+	base.Handle(cfg.BasePath, http.RedirectHandler(cfg.BasePath+"/", http.StatusMovedPermanently))
+	return base
 }
 
 func currentUser(r *http.Request) string {
-	return r.Header.Get("X-Webauth-User")
+	return r.Header.Get(cfg.AuthHeader)
 }
 
 func authCheck(next http.Handler) http.Handler {
@@ -79,7 +191,7 @@ func authCheck(next http.Handler) http.Handler {
 		if !mustBeAdmin(w, r) {
 			return
 		}
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, withUser(r))
 	})
 }
 
@@ -91,15 +203,117 @@ func mustBeAdmin(w http.ResponseWriter, r *http.Request) bool {
 	return true
 }
 
+// checkMethod answers OPTIONS requests with the allowed methods and rejects
+// methods not in allowed, reporting whether the caller should carry on. HEAD
+// is allowed wherever GET is; net/http drops the body.
+func checkMethod(w http.ResponseWriter, r *http.Request, allowed ...string) bool {
+	for _, m := range allowed {
+		if m == "GET" {
+			allowed = append(allowed, "HEAD")
+			break
+		}
+	}
+	allowed = append(allowed, "OPTIONS")
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+	for _, m := range allowed {
+		if r.Method == m {
+			return true
+		}
+	}
+	http.Error(w, "bad method", 405)
+	return false
+}
+
+// jsonType is the Content-Type of JSON responses. JSON is always UTF-8, but
+// some clients decode bodies without a charset as Latin-1.
+const jsonType = "application/json; charset=utf-8"
+
+// writeJSON writes an already-encoded JSON response with an explicit
+// Content-Length, so HEAD responses carry it too.
+func writeJSON(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", jsonType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// checkJSONBody rejects a request whose body is declared as something other
+// than UTF-8 JSON, reporting whether the caller should carry on. A body
+// without a Content-Type, as curl -T sends, is taken to be JSON.
+func checkJSONBody(w http.ResponseWriter, r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return true
+	}
+	typ, params, err := mime.ParseMediaType(ct)
+	if err == nil && typ == "application/json" && (params["charset"] == "" || strings.EqualFold(params["charset"], "utf-8")) {
+		return true
+	}
+	http.Error(w, "unsupported Content-Type "+ct+": send application/json", 415)
+	return false
+}
+
+// accepts reports whether r's Accept header admits the media type typ. A
+// request without one accepts anything.
+func accepts(r *http.Request, typ string) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return true
+	}
+	for _, rng := range strings.Split(accept, ",") {
+		rng, params, err := mime.ParseMediaType(strings.TrimSpace(rng))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		if rng == typ || rng == "*/*" || strings.HasSuffix(rng, "/*") && strings.HasPrefix(typ, strings.TrimSuffix(rng, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
 type Tiddler struct {
-	Rev  int    `datastore:"Rev,noindex"`
-	Meta string `datastore:"Meta,noindex"`
-	Text string `datastore:"Text,noindex"`
+	Rev   int       `datastore:"Rev,noindex"`
+	Meta  string    `datastore:"Meta,noindex"`
+	Text  string    `datastore:"Text,noindex"`
+	Saved time.Time `datastore:"Saved,noindex"` // zero in tiddlers saved by older versions
+	User  string    `datastore:"User,noindex"`  // who saved it (see Re Quotas)
+}
+
+// tiddlerModified returns when t was last saved, falling back for older
+// tiddlers on the modified time the browser gave it.
+func tiddlerModified(t *Tiddler) time.Time {
+	if !t.Saved.IsZero() {
+		return t.Saved
+	}
+	var f struct {
+		Modified string `json:"modified"`
+	}
+	json.Unmarshal([]byte(t.Meta), &f)
+	modified, _ := parseTiddlyDate(f.Modified)
+	return modified
+}
+
+// notModified answers a GET with 304 if the resource hasn't changed since
+// If-Modified-Since, reporting whether it did. If-None-Match takes
+// precedence when present, as RFC 7232 says.
+func notModified(w http.ResponseWriter, r *http.Request, modified time.Time) bool {
+	if modified.IsZero() || r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.Truncate(time.Second).After(since) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
 }
 
 func root(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "bad method", 405)
+	if !checkMethod(w, r, "GET") {
 		return
 	}
 	if r.URL.Path != "/" {
@@ -107,11 +321,14 @@ func root(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	http.ServeFile(w, r, "index.html")
-}
-
-func health(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, "ok")
+	p, etag := shell.get(r.Context())
+	if etag != "" {
+		// The page depends on tiddlers as well as the file, so its
+		// modification time means nothing.
+		w.Header().Set("Etag", etag)
+		p.modTime = time.Time{}
+	}
+	servePage(w, r, "index.html", p)
 }
 
 func auth(w http.ResponseWriter, r *http.Request) {
@@ -119,112 +336,356 @@ func auth(w http.ResponseWriter, r *http.Request) {
 	if name == "" {
 		name = "GUEST"
 	}
-	fmt.Fprintf(w, "<html>\nYou are logged in as %s.\n\n<a href=\"/\">Main page</a>.\n", name)
+	fmt.Fprintf(w, "<html>\nYou are logged in as %s.\n\n<a href=\"%s/\">Main page</a>.\n", name, cfg.BasePath)
 }
 
 func status(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "bad method", 405)
+	if !checkMethod(w, r, "GET") {
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
 	name := currentUser(r)
 	if name == "" {
 		name = "GUEST"
 	}
-	w.Write([]byte(`{"username": "` + name + `", "space": {"recipe": "all"}}`))
+	data, err := json.Marshal(map[string]interface{}{
+		"username":  name,
+		"space":     map[string]string{"recipe": cfg.Recipe},
+		"recipes":   recipes(),
+		"read_only": currentReadOnly().ReadOnly,
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, data)
+}
+
+// Re Recipes
+//
+// TiddlyWeb serves tiddlers through recipes, and the browser uses the one /status names as its space's recipe,
+// "all" unless the recipe setting says otherwise.  The recipes setting names more, which /status also lists, for
+// clients configured to use them.  For now every recipe holds the same tiddlers, from the one bag.
+
+// recipes returns the names of the recipes served, the main one first.
+func recipes() []string {
+	names := []string{cfg.Recipe}
+	for _, name := range strings.Split(cfg.Recipes, ",") {
+		if name = strings.TrimSpace(name); name != "" && name != cfg.Recipe {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// tiddlerTitle returns the title in an escaped
+// /recipes/{recipe}/tiddlers/{title} path. The browser escapes titles with
+// encodeURIComponent, so the title is decoded only after the path has been
+// split: an escaped / is part of the title, not a separator.
+func tiddlerTitle(path string) string {
+	path = strings.TrimPrefix(path, "/recipes/")
+	if i := strings.Index(path, "/tiddlers/"); i >= 0 {
+		return unescapeTitle(path[i+len("/tiddlers/"):])
+	}
+	return ""
+}
+
+// pathTitle returns the title following prefix in r's path, decoded from the
+// escaped path as in tiddlerTitle.
+func pathTitle(r *http.Request, prefix string) string {
+	return unescapeTitle(strings.TrimPrefix(r.URL.EscapedPath(), prefix))
+}
+
+func unescapeTitle(s string) string {
+	title, err := url.PathUnescape(s)
+	if err != nil {
+		return "" // net/http has already refused bad escapes
+	}
+	return title
+}
+
+// maxTitleBytes is the longest title a tiddler can be saved under. Datastore
+// key names are limited to 1500 bytes and the MySQL store's to 1024, and
+// history keys add #rev to the title.
+const maxTitleBytes = 1000
+
+// untakenTitle makes a title for a tiddler the server writes from something
+// sent to it, such as an email subject: the first 100 characters of s,
+// spaces tidied, with now appended if a live tiddler already has that title.
+func untakenTitle(ctx context.Context, s string, now time.Time) (string, error) {
+	title := strings.Join(strings.Fields(s), " ")
+	if r := []rune(title); len(r) > 100 {
+		title = strings.TrimSpace(string(r[:100]))
+	}
+	var existing Tiddler
+	switch err := dbGet(ctx, datastore.NameKey("Tiddler", title, nil), &existing); {
+	case err == nil && existing.Meta != "":
+		title += " " + now.Format("2006-01-02 15:04:05")
+	case err != nil && err != datastore.ErrNoSuchEntity:
+		return "", err
+	}
+	return title, checkTitle(title)
+}
+
+// checkTitle returns what is wrong with title as the title of a tiddler to
+// save, or nil.
+func checkTitle(title string) error {
+	switch {
+	case title == "":
+		return errors.New("title is empty")
+	case len(title) > maxTitleBytes:
+		return fmt.Errorf("title too long: limit is %d bytes", maxTitleBytes)
+	case !utf8.ValidString(title):
+		return errors.New("title is not valid UTF-8")
+	case strings.TrimSpace(title) != title:
+		return errors.New("title has leading or trailing whitespace")
+	case strings.IndexFunc(title, unicode.IsControl) >= 0:
+		return errors.New("title contains control characters")
+	case title == "." || title == "..":
+		return errors.New("title can't be . or .., which URLs can't hold")
+	case storedNameLen != nil && storedNameLen("TiddlerHistory", title+"#"+strconv.Itoa(math.MaxInt32)) > maxStoredName:
+		return fmt.Errorf("title too long: the %s store's names are limited to %d bytes, escaped", cfg.Storage, maxStoredName)
+	}
+	return nil
 }
 
 func tiddlerList(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
 	ctx := r.Context()
-	q := datastore.NewQuery("Tiddler")
-	// Only need Meta, but get no results if we do this.
-	if false {
-		q = q.Project("Meta")
+	profile, code, err := requestedProfile(r)
+	if err != nil {
+		if code != 0 {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		storeError(w, err)
+		return
 	}
 
-	it := dsClient.Run(ctx, q)
-	var buf bytes.Buffer
-	sep := ""
-	buf.WriteString("[")
-	for {
-		var t Tiddler
-		_, err := it.Next(&t)
-		if err != nil {
-			if err == iterator.Done {
-				break
+	listRequests.Add(1)
+	data, err := cachedSkinnyList(ctx)
+	if err == nil && profile != nil {
+		data, err = filterList(data, profile)
+	}
+	if err != nil {
+		logf(ctx, "listing tiddlers: %v", err)
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, data)
+}
+
+// cachedSkinnyList returns the skinny tiddler list, from the caches if they
+// have it.
+func cachedSkinnyList(ctx context.Context) ([]byte, error) {
+	build := func() ([]byte, error) {
+		return budgets.cachedList(func() ([]byte, error) { return skinnyList(ctx) })
+	}
+	if c, ok := db.(listCacher); ok {
+		return c.cachedList(ctx, build)
+	}
+	return build()
+}
+
+// tiddlerMeta is a Tiddler without its text, for scanning the list. The
+// properties are unindexed, so Datastore can't project them, but at least
+// the texts aren't kept.
+type tiddlerMeta struct {
+	Rev  int
+	Meta string
+}
+
+func (m *tiddlerMeta) Load(ps []datastore.Property) error {
+	for _, p := range ps {
+		switch p.Name {
+		case "Rev":
+			rev, _ := p.Value.(int64)
+			m.Rev = int(rev)
+		case "Meta":
+			m.Meta, _ = p.Value.(string)
+		}
+	}
+	return nil
+}
+
+func (m *tiddlerMeta) Save() ([]datastore.Property, error) {
+	return nil, errors.New("tiddlerMeta can't be saved")
+}
+
+// skinnyList returns the list of all tiddlers for the browser, mostly
+// without their text.
+func skinnyList(ctx context.Context) ([]byte, error) {
+	var titles, metas []string
+	var err error
+	if cfg.Catalog {
+		titles, metas, err = catalogEntries(ctx)
+		if err == nil {
+			titles, metas, err = draftCatalogEntries(ctx, titles, metas)
+		}
+	} else {
+		titles, metas, err = scanMetas(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Tiddlers containing macros don't take effect until they are loaded.
+	// Force them to be loaded by including their bodies in the skinny
+	// tiddler list. The same goes for plugins, such as those installed from
+	// the library. Might need to expand this to other kinds of tiddlers in
+	// the future as we discover them. The bodies are fetched all at once.
+	var fat []int // indexes in metas of the tiddlers to send with text
+	var fatKeys []*datastore.Key
+	for i, meta := range metas {
+		if strings.Contains(meta, `"$:/tags/Macro"`) || strings.Contains(meta, `"plugin-type"`) {
+			fat = append(fat, i)
+			fatKeys = append(fatKeys, datastore.NameKey("Tiddler", titles[i], nil))
+		}
+	}
+	texts := make([]Tiddler, len(fatKeys))
+	err = retry(ctx, func() error { return db.GetMulti(ctx, fatKeys, texts) })
+	if merr, ok := err.(datastore.MultiError); ok {
+		// Tiddlers deleted since the scan are sent without text.
+		err = nil
+		for _, e := range merr {
+			if e != nil && e != datastore.ErrNoSuchEntity {
+				err = e
 			}
-			println("ERR", err.Error())
-			http.Error(w, err.Error(), 500)
-			return
 		}
-		if len(t.Meta) == 0 {
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, j := range fat {
+		var js map[string]interface{}
+		if err := json.Unmarshal([]byte(metas[j]), &js); err != nil {
 			continue
 		}
-		meta := t.Meta
-
-		// Tiddlers containing macros don't take effect until
-		// they are loaded. Force them to be loaded by including
-		// their bodies in the skinny tiddler list.
-		// Might need to expand this to other kinds of tiddlers
-		// in the future as we discover them.
-		if strings.Contains(meta, `"$:/tags/Macro"`) {
-			var js map[string]interface{}
-			err := json.Unmarshal([]byte(meta), &js)
-			if err != nil {
-				continue
-			}
-			js["text"] = string(t.Text)
-			data, err := json.Marshal(js)
-			if err != nil {
-				continue
-			}
-			meta = string(data)
+		js["text"] = texts[i].Text
+		if data, err := json.Marshal(js); err == nil {
+			metas[j] = string(data)
 		}
-
-		buf.WriteString(sep)
-		sep = ","
-		buf.WriteString(meta)
 	}
+
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	buf.WriteString(strings.Join(metas, ","))
 	buf.WriteString("]")
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(buf.Bytes())
+	listBytes.Set(int64(buf.Len()))
+	listCount.Set(int64(len(metas)))
+	return buf.Bytes(), nil
+}
+
+// scanMetas returns the titles and metadata of all the tiddlers not
+// deleted, in title order.
+func scanMetas(ctx context.Context) (titles, metas []string, err error) {
+	// A failed scan is restarted from scratch.
+	err = retry(ctx, func() error {
+		titles, metas = titles[:0], metas[:0]
+		var t tiddlerMeta
+		return db.Scan(ctx, "Tiddler", "", &t, func(title string) error {
+			if len(t.Meta) > 0 {
+				titles = append(titles, title)
+				metas = append(metas, t.Meta)
+			}
+			return nil
+		})
+	})
+	return titles, metas, err
 }
 
 func tiddler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET", "PUT", "PATCH", "POST") {
+		return
+	}
 	switch r.Method {
-	case "GET":
+	case "GET", "HEAD":
 		getTiddler(w, r)
 	case "PUT":
 		putTiddler(w, r)
-	default:
-		http.Error(w, "bad method", 405)
+	case "PATCH":
+		patchTiddler(w, r)
+	case "POST":
+		switch path := r.URL.EscapedPath(); {
+		case strings.HasSuffix(path, "/rename"):
+			renameHandler(w, r)
+		case strings.HasSuffix(path, "/copy"):
+			copyHandler(w, r)
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
 	}
 }
 
 func getTiddler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	title := strings.TrimPrefix(r.URL.Path, "/recipes/all/tiddlers/")
-	key := datastore.NameKey("Tiddler", title, nil)
-	var t Tiddler
-	if err := dsClient.Get(ctx, key, &t); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+	title := tiddlerTitle(r.URL.EscapedPath())
+	rt, gen, ok := tiddlers.get(title)
+	if !ok {
+		key := datastore.NameKey("Tiddler", title, nil)
+		var t Tiddler
+		err := dbGet(ctx, key, &t)
+		if err == datastore.ErrNoSuchEntity || err == nil && t.Meta == "" {
+			http.Error(w, "no such tiddler", 404)
+			return
+		}
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		data, err := tiddlerJSON(&t)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		rt = &renderedTiddler{t.Rev, tiddlerETag(title, &t), tiddlerModified(&t), data}
+		tiddlers.add(title, rt, gen)
 	}
-	var js map[string]interface{}
-	err := json.Unmarshal([]byte(t.Meta), &js)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+	w.Header().Set("Etag", rt.etag)
+	if !rt.modified.IsZero() {
+		w.Header().Set("Last-Modified", rt.modified.UTC().Format(http.TimeFormat))
+	}
+	if noneMatch(w, r, rt.etag) || notModified(w, r, rt.modified) || writeTiddlerFile(w, r, title, rt.data) {
 		return
 	}
-	js["text"] = string(t.Text)
-	data, err := json.Marshal(js)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+	if !accepts(r, "application/json") && writeRawTiddler(w, r, rt.data) {
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
+	writeJSON(w, rt.data)
+}
+
+// writeRawTiddler writes the text of data, a tiddler in TiddlyWeb JSON form,
+// as a response of the tiddler's own type, as TiddlyWeb does for clients that
+// ask for that type rather than JSON. It reports whether it did.
+func writeRawTiddler(w http.ResponseWriter, r *http.Request, data []byte) bool {
+	var js struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &js); err != nil {
+		return false
+	}
+	typ := js.Type
+	if typ == "" {
+		typ = "text/vnd.tiddlywiki"
+	}
+	if !accepts(r, typ) {
+		return false
+	}
+	body := []byte(js.Text)
+	if strings.HasPrefix(typ, "text/") {
+		typ += "; charset=utf-8"
+	} else if dec, err := base64.StdEncoding.DecodeString(js.Text); err == nil {
+		body = dec // TiddlyWiki keeps binary tiddlers base64-encoded
+	}
+	w.Header().Set("Content-Type", typ)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	// The text may be HTML or SVG, which mustn't run as the wiki's origin.
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(body)
+	return true
 }
 
 func putTiddler(w http.ResponseWriter, r *http.Request) {
@@ -232,27 +693,183 @@ func putTiddler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	ctx := r.Context()
-	title := strings.TrimPrefix(r.URL.Path, "/recipes/all/tiddlers/")
-	key := datastore.NameKey("Tiddler", title, nil)
-	data, err := ioutil.ReadAll(r.Body)
+	title := tiddlerTitle(r.URL.EscapedPath())
+	if err := checkTitle(title); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if !checkJSONBody(w, r) {
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, cfg.MaxTiddlerBytes))
 	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			msg := fmt.Sprintf("tiddler too large: limit is %d bytes (set max-tiddler-bytes to change it); "+
+				"consider storing large files outside the wiki and linking to them", tooBig.Limit)
+			http.Error(w, msg, 413)
+			return
+		}
 		http.Error(w, "cannot read data", 400)
 		return
 	}
 	var js map[string]interface{}
-	err = json.Unmarshal(data, &js)
+	if err := json.Unmarshal(data, &js); err != nil {
+		http.Error(w, "expected a JSON tiddler: "+err.Error(), 400)
+		return
+	}
+	if checkSchema(w, r, title, js) || checkConflict(w, r, title, js) {
+		return
+	}
+	var precondition func(cur *Tiddler) error
+	if m := r.Header.Get("If-Match"); m != "" && m != "*" {
+		// checkConflict only looked; the revision is checked again in
+		// the transaction that saves, so two PUTs with the same If-Match
+		// can't both pass.
+		precondition = func(cur *Tiddler) error {
+			live := cur.Rev
+			if cur.Meta == "" {
+				live = 0
+			}
+			if !ifMatch(r, title, live) {
+				return &txError{412, fmt.Sprintf("%s has changed: revision %d is current", title, live)}
+			}
+			return nil
+		}
+	}
+
+	t, err := saveRevisionIf(ctx, title, js, precondition)
+	var te *txError
+	if errors.As(err, &te) {
+		http.Error(w, te.msg, te.code)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		storeError(w, err)
 		return
 	}
 
-	js["bag"] = "bag"
+	w.Header().Set("Etag", tiddlerETag(title, &t))
+}
+
+// saveTiddler stores js, a tiddler in TiddlyWeb JSON form, as the next
+// revision of title, and records that revision in the history. It returns the
+// new revision number, or the current one if js is the tiddler unchanged
+// (see unchangedSave).
+func saveTiddler(ctx context.Context, title string, js map[string]interface{}) (int, error) {
+	t, err := saveRevision(ctx, title, js)
+	return t.Rev, err
+}
 
-	rev := 1
-	var old Tiddler
-	if err := dsClient.Get(ctx, key, &old); err == nil {
-		rev = old.Rev + 1
+// saveRevision is saveTiddler returning the new revision itself.
+func saveRevision(ctx context.Context, title string, js map[string]interface{}) (Tiddler, error) {
+	return saveRevisionIf(ctx, title, js, nil)
+}
+
+// saveRevisionIf is saveRevision that first calls precondition, if it isn't
+// nil, with the current revision of title, and saves only if it returns nil.
+// The check and the save are made in one transaction, so nothing can be saved
+// between them.
+func saveRevisionIf(ctx context.Context, title string, js map[string]interface{}, precondition func(cur *Tiddler) error) (Tiddler, error) {
+	key := datastore.NameKey("Tiddler", title, nil)
+	fresh := func() map[string]interface{} {
+		cp := make(map[string]interface{}, len(js))
+		for k, v := range js {
+			cp[k] = v
+		}
+		return cp
 	}
+
+	var old, t Tiddler
+	var unchanged, rescue bool
+	var oldName string
+	// prepare reads the current revision into old with get and makes t
+	// from js, or sets unchanged if there is nothing to save. It may run
+	// more than once in a transaction, so it leaves js alone.
+	prepare := func(get func(dst interface{}) error) error {
+		old, unchanged = Tiddler{}, false
+		if err := get(&old); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if precondition != nil {
+			if err := precondition(&old); err != nil {
+				return err
+			}
+		}
+		if unchanged = unchangedSave(ctx, &old, js); unchanged {
+			return nil
+		}
+		// In case the old revision's history was queued by an instance
+		// that stopped before writing it (see Re Async history).
+		oldName = title + "#" + fmt.Sprint(old.Rev)
+		rescue = asyncHistory != nil && old.Meta != "" && !asyncHistory.isWritten(oldName)
+		var err error
+		t, err = newRevision(ctx, fresh(), old.Rev+1)
+		return err
+	}
+
+	if precondition == nil {
+		if err := prepare(func(dst interface{}) error { return dbGet(ctx, key, dst) }); err != nil {
+			return Tiddler{}, err
+		}
+		if unchanged {
+			return old, nil
+		}
+		if err := checkQuota(ctx, revisionBytes(&t)); err != nil {
+			return Tiddler{}, err
+		}
+		if rescue {
+			if err := budgets.putHistory(ctx, oldName, &old); err != nil {
+				return Tiddler{}, err
+			}
+		}
+		if err := dbPut(ctx, key, &t); err != nil {
+			return Tiddler{}, err
+		}
+	} else {
+		// The quota can't be checked in the transaction; the revision
+		// is near enough in size whatever its number.
+		est, err := newRevision(ctx, fresh(), 1)
+		if err != nil {
+			return Tiddler{}, err
+		}
+		if err := checkQuota(ctx, revisionBytes(&est)); err != nil {
+			return Tiddler{}, err
+		}
+		err = db.RunInTransaction(ctx, func(tx Transaction) error {
+			if err := prepare(func(dst interface{}) error { return tx.Get(key, dst) }); err != nil || unchanged {
+				return err
+			}
+			if rescue {
+				if err := tx.Put(datastore.NameKey("TiddlerHistory", oldName, nil), &old); err != nil {
+					return err
+				}
+			}
+			return tx.Put(key, &t)
+		})
+		if err != nil {
+			return Tiddler{}, err
+		}
+		if unchanged {
+			return old, nil
+		}
+	}
+
+	if err := budgets.putHistory(ctx, title+"#"+fmt.Sprint(t.Rev), &t); err != nil {
+		return Tiddler{}, err
+	}
+	if err := dbPut(ctx, linksKey(title), linksOf(&t)); err != nil {
+		return Tiddler{}, err
+	}
+	usage.add(t.User, revisionBytes(&t))
+	tiddlerChanged(title)
+	return t, nil
+}
+
+// newRevision returns the entity storing js as revision rev. It sets the
+// bag and revision fields of js and removes its text.
+func newRevision(ctx context.Context, js map[string]interface{}, rev int) (Tiddler, error) {
+	js["bag"] = "bag"
 	js["revision"] = rev
 
 	var t Tiddler
@@ -262,26 +879,44 @@ func putTiddler(w http.ResponseWriter, r *http.Request) {
 	}
 	delete(js, "text")
 	t.Rev = rev
+	t.Saved = time.Now().UTC()
+	t.User = userOf(ctx)
 	meta, err := json.Marshal(js)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+		return Tiddler{}, err
 	}
 	t.Meta = string(meta)
-	_, err = dsClient.Put(ctx, key, &t)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
+	return t, nil
+}
 
-	key2 := datastore.NameKey("TiddlerHistory", title+"#"+fmt.Sprint(t.Rev), nil)
-	if _, err := dsClient.Put(ctx, key2, &t); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+// unchangedSave reports whether saving js over old would store exactly what
+// old holds, and counts it if so. TiddlyWiki re-saves system tiddlers it
+// hasn't changed when it starts, and each would otherwise make a new
+// revision, a history entry and a changed ETag for every other client.
+func unchangedSave(ctx context.Context, old *Tiddler, js map[string]interface{}) bool {
+	if old.Meta == "" {
+		return false
+	}
+	cp := make(map[string]interface{}, len(js))
+	for k, v := range js {
+		cp[k] = v
+	}
+	t, err := newRevision(ctx, cp, old.Rev)
+	if err != nil || t.Meta != old.Meta || t.Text != old.Text {
+		return false
 	}
+	unchangedSaves.Add(1)
+	return true
+}
 
-	etag := fmt.Sprintf("\"bag/%s/%d:%x\"", url.QueryEscape(title), rev, md5.Sum(data))
-	w.Header().Set("Etag", etag)
+// tiddlerJSON returns t in TiddlyWeb JSON form, text included.
+func tiddlerJSON(t *Tiddler) ([]byte, error) {
+	var js map[string]interface{}
+	if err := json.Unmarshal([]byte(t.Meta), &js); err != nil {
+		return nil, err
+	}
+	js["text"] = string(t.Text)
+	return json.Marshal(js)
 }
 
 func deleteTiddler(w http.ResponseWriter, r *http.Request) {
@@ -289,27 +924,48 @@ func deleteTiddler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	ctx := r.Context()
-	if r.Method != "DELETE" {
-		http.Error(w, "bad method", 405)
+	if !checkMethod(w, r, "DELETE") {
 		return
 	}
-	title := strings.TrimPrefix(r.URL.Path, "/bags/bag/tiddlers/")
+	title := pathTitle(r, "/bags/bag/tiddlers/")
 	key := datastore.NameKey("Tiddler", title, nil)
+	// The revision is checked in the transaction that writes the deletion,
+	// so two DELETEs, or a DELETE and a PUT, can't both pass one If-Match.
 	var t Tiddler
-	if err := dsClient.Get(ctx, key, &t); err != nil {
-		http.Error(w, err.Error(), 500)
+	err := db.RunInTransaction(ctx, func(tx Transaction) error {
+		t = Tiddler{}
+		if err := tx.Get(key, &t); err == datastore.ErrNoSuchEntity || err == nil && t.Meta == "" {
+			return &txError{404, "no such tiddler"}
+		} else if err != nil {
+			return err
+		}
+		if !ifMatch(r, title, t.Rev) {
+			return &txError{412, fmt.Sprintf("%s has changed: revision %d is current", title, t.Rev)}
+		}
+		t.Rev++
+		t.Meta = ""
+		t.Text = ""
+		t.User = userOf(ctx)
+		return tx.Put(key, &t)
+	})
+	var te *txError
+	if errors.As(err, &te) {
+		http.Error(w, te.msg, te.code)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
 		return
 	}
-	t.Rev++
-	t.Meta = ""
-	t.Text = ""
-	if _, err := dsClient.Put(ctx, key, &t); err != nil {
-		http.Error(w, err.Error(), 500)
+	if err := budgets.putHistory(ctx, title+"#"+fmt.Sprint(t.Rev), &t); err != nil {
+		storeError(w, err)
 		return
 	}
-	key2 := datastore.NameKey("TiddlerHistory", title+"#"+fmt.Sprint(t.Rev), nil)
-	if _, err := dsClient.Put(ctx, key2, &t); err != nil {
-		http.Error(w, err.Error(), 500)
+	if err := dbPut(ctx, linksKey(title), &tiddlerLinks{}); err != nil {
+		storeError(w, err)
 		return
 	}
+	tiddlerChanged(title)
+	w.Header().Set("Etag", tiddlerETag(title, &t))
+	w.WriteHeader(http.StatusNoContent)
 }
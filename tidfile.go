@@ -0,0 +1,265 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Re Tiddler files
+//
+// GET /recipes/all/tiddlers/<title>?format=tid answers with the tiddler as a .tid file, the format TiddlyWiki uses
+// for tiddlers on disk and accepts when one is dropped on a wiki: a "name: value" line for each field, a blank line,
+// then the text.  format=json&download=1 gives it instead as a TiddlyWiki JSON export of one tiddler, which also
+// holds fields a .tid file can't (those with line breaks in them; asking for .tid then gets a 406).  Both come as
+// attachments named after the title.  Either way the tiddler is written as TiddlyWiki itself has it: the custom
+// fields TiddlyWeb JSON nests under "fields" are brought up beside the others, tags are a string list, and the
+// revision and bag, which mean nothing to another wiki, are left out.
+//
+// Going the other way, POST /import/files takes a multipart upload of any number of .tid files, JSON exports (of one
+// tiddler or many) and TiddlyWiki pages, as dropping them on a wiki would import them, and saves every tiddler in
+// them as a batch save does, answering with the same list of results.  A .tid file without a title field is titled
+// after its file name.  The import form on /admin takes the same files.
+
+// flatFields returns the fields of data, a tiddler in TiddlyWeb JSON form, as
+// TiddlyWiki's own string fields.
+func flatFields(data []byte) (map[string]string, error) {
+	var js map[string]interface{}
+	if err := json.Unmarshal(data, &js); err != nil {
+		return nil, err
+	}
+	return flatJSON(js), nil
+}
+
+// flatJSON is flatFields for a tiddler already decoded.
+func flatJSON(js map[string]interface{}) map[string]string {
+	fields := make(map[string]string)
+	for name, v := range js {
+		switch name {
+		case "fields", "revision", "bag", "permissions":
+			continue
+		}
+		fields[name] = fieldString(v)
+	}
+	if custom, ok := js["fields"].(map[string]interface{}); ok {
+		for name, v := range custom {
+			fields[name] = fieldString(v)
+		}
+	}
+	return fields
+}
+
+// fieldString returns a JSON field value as TiddlyWiki would write it.
+func fieldString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	case []interface{}:
+		list := make([]string, len(v))
+		for i := range v {
+			list[i] = fieldString(v[i])
+		}
+		return stringifyList(list)
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+var errNotTid = errors.New("tiddler has fields with line breaks, which a .tid file can't hold; use format=json")
+
+// tidFile returns fields in .tid form.
+func tidFile(fields map[string]string) ([]byte, error) {
+	var names []string
+	for name := range fields {
+		if name == "text" {
+			continue
+		}
+		if strings.ContainsAny(name, ":\r\n") || strings.ContainsAny(fields[name], "\r\n") {
+			return nil, errNotTid
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		buf.WriteString(name + ": " + fields[name] + "\n")
+	}
+	buf.WriteString("\n" + fields["text"])
+	return buf.Bytes(), nil
+}
+
+// writeTiddlerFile answers a GET for the tiddler in data as a download in
+// the format asked for, reporting whether one was.
+func writeTiddlerFile(w http.ResponseWriter, r *http.Request, title string, data []byte) bool {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format != "tid" && !(format == "json" && q.Get("download") == "1") {
+		return false
+	}
+	fields, err := flatFields(data)
+	if err != nil {
+		storeError(w, err)
+		return true
+	}
+	var body []byte
+	typ := "application/x-tiddler"
+	if format == "tid" {
+		if body, err = tidFile(fields); err != nil {
+			http.Error(w, err.Error(), 406)
+			return true
+		}
+	} else {
+		typ = jsonType
+		if body, err = json.Marshal([]map[string]string{fields}); err != nil {
+			storeError(w, err)
+			return true
+		}
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName(title) + "." + format}))
+	w.Header().Set("Content-Type", typ)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(body)
+	return true
+}
+
+// fileName returns title with the characters file systems object to
+// replaced by underscores.
+func fileName(title string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, title)
+}
+
+// parseTidFile returns the tiddler in a .tid file, titled name if it has no
+// title field.
+func parseTidFile(name string, data []byte) (map[string]interface{}, error) {
+	s := strings.Replace(string(data), "\r\n", "\n", -1)
+	js := make(map[string]interface{})
+	for s != "" {
+		var line string
+		if i := strings.IndexByte(s, '\n'); i >= 0 {
+			line, s = s[:i], s[i+1:]
+		} else {
+			line, s = s, ""
+		}
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("bad field line %q", line)
+		}
+		js[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+	js["text"] = s
+	if title, _ := js["title"].(string); title == "" {
+		js["title"] = name
+	}
+	return js, nil
+}
+
+// fileTiddlers returns the tiddlers in an uploaded file, going by its
+// extension and, failing that, its content.
+func fileTiddlers(name string, data []byte) ([]map[string]interface{}, error) {
+	ext := strings.ToLower(path.Ext(name))
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case ext == ".tid":
+		t, err := parseTidFile(strings.TrimSuffix(path.Base(name), path.Ext(name)), data)
+		if err != nil {
+			return nil, err
+		}
+		return []map[string]interface{}{t}, nil
+	case ext == ".html" || ext == ".htm" || bytes.HasPrefix(trimmed, []byte("<")):
+		return pageContent(data)
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		var t map[string]interface{}
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, err
+		}
+		return []map[string]interface{}{t}, nil
+	}
+	var tiddlers []map[string]interface{}
+	if err := json.Unmarshal(data, &tiddlers); err != nil {
+		return nil, err
+	}
+	return tiddlers, nil
+}
+
+// uploadedTiddlers returns the tiddlers in every file of a multipart upload,
+// reading up to max-batch-bytes in all. An error is meant for the client.
+func uploadedTiddlers(w http.ResponseWriter, r *http.Request) ([]map[string]interface{}, int, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBatchBytes)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, 400, err
+	}
+	var tiddlers []map[string]interface{}
+	files := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err == nil && part.FileName() == "" {
+			continue // a form field
+		}
+		var data []byte
+		if err == nil {
+			data, err = ioutil.ReadAll(part)
+		}
+		if err != nil {
+			var tooBig *http.MaxBytesError
+			if errors.As(err, &tooBig) {
+				return nil, 413, fmt.Errorf("upload too large: limit is %d bytes (set max-batch-bytes to change it)", tooBig.Limit)
+			}
+			return nil, 400, err
+		}
+		files++
+		ts, err := fileTiddlers(part.FileName(), data)
+		if err != nil {
+			return nil, 400, fmt.Errorf("%s: %v", part.FileName(), err)
+		}
+		tiddlers = append(tiddlers, ts...)
+	}
+	if files == 0 {
+		return nil, 400, errors.New("no files uploaded")
+	}
+	return tiddlers, 0, nil
+}
+
+func importFiles(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "POST") || !mustBeAdmin(w, r) || !sameOrigin(w, r) {
+		return
+	}
+	tiddlers, code, err := uploadedTiddlers(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	results := saveTiddlers(r.Context(), tiddlers)
+	out, err := json.Marshal(results)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	logf(r.Context(), "%s imported %d tiddlers from files", currentUser(r), len(tiddlers))
+	writeJSON(w, out)
+}
@@ -0,0 +1,48 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Re TLS
+//
+// By default tiddly speaks plain HTTP and expects a proxy in front of it to terminate TLS.  Small deployments can
+// instead set tls-cert and tls-key to serve HTTPS with those files, or set autocert-hosts to a comma-separated list
+// of hostnames to get certificates from Let's Encrypt.  Autocert answers the TLS-ALPN challenge on the main port,
+// which then needs to be 443; set autocert-http-addr (e.g. ":80") to also answer HTTP challenges and redirect
+// plain HTTP to HTTPS.
+
+// configureTLS sets up srv according to the TLS configuration and returns the
+// function that starts it serving on a listener.
+func configureTLS(srv *http.Server) (serve func(net.Listener) error) {
+	switch {
+	case cfg.TLSCert != "":
+		return func(l net.Listener) error { return srv.ServeTLS(l, cfg.TLSCert, cfg.TLSKey) }
+
+	case cfg.AutocertHosts != "":
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(strings.Split(cfg.AutocertHosts, ",")...),
+			Cache:      autocert.DirCache(cfg.AutocertCacheDir),
+			Email:      cfg.AutocertEmail,
+		}
+		srv.TLSConfig = m.TLSConfig()
+		if cfg.AutocertHTTPAddr != "" {
+			go func() {
+				log.Printf("Answering ACME challenges on %s", cfg.AutocertHTTPAddr)
+				log.Fatal(newServer(cfg.AutocertHTTPAddr, m.HTTPHandler(nil)).ListenAndServe())
+			}()
+		}
+		return func(l net.Listener) error { return srv.ServeTLS(l, "", "") }
+	}
+	return srv.Serve
+}
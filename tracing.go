@@ -0,0 +1,230 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	texporter "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/trace"
+	gcppropagator "github.com/GoogleCloudPlatform/opentelemetry-operations-go/propagator"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/api/option"
+)
+
+// Re Tracing
+//
+// Tracing uses OpenTelemetry.  The Google Cloud clients, Datastore's included, are instrumented with it, so every
+// Get/Put/Run shows up as a span as long as the request context carries one.  traceHandler starts that span,
+// continuing the trace started by the proxy if it sent an X-Cloud-Trace-Context or traceparent header.  Set
+// trace-exporter=cloudtrace to send spans to Cloud Trace in the configured project, or trace-exporter=otlp to send
+// them over OTLP/HTTP to a collector, configured with the usual OTEL_EXPORTER_OTLP_ENDPOINT and
+// OTEL_EXPORTER_OTLP_HEADERS.  Set trace-sample-rate to the fraction of new traces to record (requests whose parent
+// was sampled are always recorded).  Spans carry the route, such as /api/v1/tiddlers/{title}, rather than the path,
+// so nothing the client put in the path, titles included, ends up in the trace backend.  A path that fits none of
+// the templated routes is named after the mux pattern that serves it, with {path} for the rest.
+
+// setupTracing registers the configured exporter and returns a function that
+// flushes any buffered spans, for use at shutdown.
+func setupTracing(project string) (flush func()) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		// Last, so that it wins over traceparent, as on Google's load
+		// balancers.
+		gcppropagator.CloudTraceFormatPropagator{},
+	))
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.TraceExporter {
+	case "":
+		return func() {}
+	case "cloudtrace":
+		var opts []option.ClientOption
+		if opts, err = googleOptions(context.Background()); err == nil {
+			exporter, err = texporter.New(texporter.WithProjectID(project), texporter.WithTraceClientOptions(opts))
+		}
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background())
+	}
+	if err != nil {
+		log.Fatalf("%s trace exporter: %v", cfg.TraceExporter, err)
+	}
+
+	sampler := sdktrace.ParentBased(sdktrace.AlwaysSample())
+	if cfg.TraceSampleRate >= 0 {
+		sampler = sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TraceSampleRate))
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(routeExporter{exporter}),
+		sdktrace.WithSampler(sampler),
+	)
+	otel.SetTracerProvider(tp)
+	log.Printf("Exporting traces to %s", cfg.TraceExporter)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			log.Printf("flushing traces: %v", err)
+		}
+	}
+}
+
+func traceHandler(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "request",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string { return spanName(r) }),
+	)
+}
+
+// routes are the templates of the routes whose paths hold something the
+// caller chose.  Each {param} segment stands for one segment of the path or,
+// last, for the rest of it, and {recipe} only for one of recipes().  More
+// specific templates come first.
+var routes = []string{
+	"/recipes/{recipe}/tiddlers/{title}/rename",
+	"/recipes/{recipe}/tiddlers/{title}/copy",
+	"/recipes/{recipe}/tiddlers/{title}",
+	"/bags/bag/tiddlers/{title}",
+	"/render/{title}",
+	"/links/{title}",
+	"/lock/{title}",
+	"/lists/{name}",
+	"/sync-profiles/{name}",
+	"/api/v1/tiddlers/{title}/revisions/{rev}",
+	"/api/v1/tiddlers/{title}/revisions",
+	"/api/v1/tiddlers/{title}/links",
+	"/api/v1/tiddlers/{title}/backlinks",
+	"/api/v1/tiddlers/{title}",
+	"/admin/snapshots/{snapshot}/tiddlers/{title}",
+	"/admin/snapshots/{snapshot}/restore",
+	"/admin/snapshots/{snapshot}",
+	"/shares/{token}",
+	"/share/{token}/{page}",
+	"/share/{token}",
+	"/inbound-email/{secret}",
+}
+
+// routeMuxes are the muxes newHandler built, outermost first, for routeOf to
+// find the pattern that serves a path no template fits.
+var routeMuxes []*http.ServeMux
+
+// spanName names request spans after the route rather than the full path, so
+// titles, tokens and the like don't end up in the trace backend.
+func spanName(r *http.Request) string {
+	route, _ := routeOf(r)
+	return r.Method + " " + cfg.BasePath + route
+}
+
+// routeOf returns the route of r's path, and the title in it, still escaped,
+// if the route has one.  Paths no template fits are named after the mux
+// pattern that serves them, with {path} for whatever follows a subtree
+// pattern, since anything can follow it.
+func routeOf(r *http.Request) (route, title string) {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), cfg.BasePath)
+	for _, t := range routes {
+		if !strings.Contains(t, "{recipe}") {
+			if title, ok := matchRoute(t, path); ok {
+				return t, title
+			}
+			continue
+		}
+		for _, recipe := range recipes() {
+			t := strings.Replace(t, "{recipe}", recipe, 1)
+			if title, ok := matchRoute(t, path); ok {
+				return t, title
+			}
+		}
+	}
+	if len(routeMuxes) == 0 {
+		return path, ""
+	}
+	served := *r
+	u := *r.URL
+	u.Path, u.RawPath = strings.TrimPrefix(u.Path, cfg.BasePath), strings.TrimPrefix(u.RawPath, cfg.BasePath)
+	served.URL = &u
+	var pattern string
+	for _, m := range routeMuxes {
+		if _, pattern = m.Handler(&served); pattern != "/" {
+			break
+		}
+	}
+	switch {
+	case pattern == path || pattern == path+"/":
+		return path, ""
+	case strings.HasSuffix(pattern, "/"):
+		return pattern + "{path}", ""
+	}
+	return "/{path}", ""
+}
+
+// matchRoute reports whether path fits template, and returns the segment
+// that {title} stands for, if there is one.
+func matchRoute(template, path string) (title string, ok bool) {
+	ts, ps := strings.Split(template, "/"), strings.Split(path, "/")
+	last := len(ts) - 1
+	if len(ps) < len(ts) || len(ps) > len(ts) && !strings.HasPrefix(ts[last], "{") {
+		return "", false
+	}
+	for i, t := range ts {
+		p := ps[i]
+		if !strings.HasPrefix(t, "{") {
+			if p != t {
+				return "", false
+			}
+			continue
+		}
+		if i == last {
+			p = strings.Join(ps[i:], "/")
+		}
+		if p == "" {
+			return "", false
+		}
+		if t == "{title}" {
+			title = p
+		}
+	}
+	return title, true
+}
+
+// routeExporter exports spans with the path otelhttp records, title and all,
+// replaced by the route in the span's name, and the URL left out.
+type routeExporter struct {
+	sdktrace.SpanExporter
+}
+
+func (e routeExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	routed := make([]sdktrace.ReadOnlySpan, len(spans))
+	for i, s := range spans {
+		routed[i] = routedSpan{s}
+	}
+	return e.SpanExporter.ExportSpans(ctx, routed)
+}
+
+type routedSpan struct {
+	sdktrace.ReadOnlySpan
+}
+
+func (s routedSpan) Attributes() []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	for _, kv := range s.ReadOnlySpan.Attributes() {
+		switch kv.Key {
+		case "url.path", "http.target":
+			if i := strings.Index(s.Name(), " "); i >= 0 {
+				kv.Value = attribute.StringValue(s.Name()[i+1:])
+			}
+		case "url.full", "url.query", "http.url":
+			continue
+		}
+		attrs = append(attrs, kv)
+	}
+	return attrs
+}
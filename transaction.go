@@ -0,0 +1,187 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Re Transactions
+//
+// A batch save lets each tiddler succeed or fail on its own, which won't do for plugins keeping tiddlers that must
+// agree, like a data tiddler and its index.  POST /recipes/all/transaction saves and deletes a set of tiddlers in
+// one store transaction, so either all of it happens or none of it does:
+//     {"put": [{"title": "Data", "text": "..."}, ...], "delete": ["Old index"],
+//      "if-match": {"Index": "\"bag/Index/4:...\""}}
+// if-match optionally names, by ETag, the revision each tiddler must be at (see Re ETags), as If-Match does for a
+// single PUT or DELETE.  The response lists the new revision and ETag of each tiddler, puts first, in the same form
+// as a batch save's.  If anything is wrong nothing is saved, and the response says why: 400 for a bad tiddler or a
+// title given twice, 404 for a delete of a tiddler that doesn't exist, 412 if an if-match names a revision that
+// isn't current.  A transaction writes three entities per tiddler, so it may hold at most txMaxTiddlers.
+
+// txMaxTiddlers is how many tiddlers a transaction may touch; see batchChunk.
+const txMaxTiddlers = batchChunk
+
+type txRequest struct {
+	Put     []map[string]interface{} `json:"put"`
+	Delete  []string                 `json:"delete"`
+	IfMatch map[string]string        `json:"if-match"`
+}
+
+// txError is a reason to refuse a transaction, with its status code.
+type txError struct {
+	code int
+	msg  string
+}
+
+func (e *txError) Error() string { return e.msg }
+
+func transactionHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "POST") || !checkJSONBody(w, r) || !sameOrigin(w, r) {
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, cfg.MaxBatchBytes))
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			http.Error(w, fmt.Sprintf("transaction too large: limit is %d bytes", tooBig.Limit), 413)
+			return
+		}
+		http.Error(w, "cannot read data", 400)
+		return
+	}
+	var req txRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		http.Error(w, `expected {"put": [...], "delete": [...]}: `+err.Error(), 400)
+		return
+	}
+	ctx := r.Context()
+	results, err := runTransaction(ctx, &req)
+	var te *txError
+	if errors.As(err, &te) {
+		http.Error(w, te.msg, te.code)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	logf(ctx, "%s saved %d and deleted %d tiddlers in a transaction", currentUser(r), len(req.Put), len(req.Delete))
+	out, err := json.Marshal(results)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, out)
+}
+
+// runTransaction makes the changes in req all at once, returning the
+// outcome for each tiddler.
+func runTransaction(ctx context.Context, req *txRequest) ([]batchResult, error) {
+	n := len(req.Put) + len(req.Delete)
+	switch {
+	case n == 0:
+		return nil, &txError{400, "nothing to do"}
+	case n > txMaxTiddlers:
+		return nil, &txError{413, fmt.Sprintf("too many tiddlers: a transaction may touch at most %d", txMaxTiddlers)}
+	}
+	titles := make([]string, 0, n)
+	seen := make(map[string]bool)
+	for _, js := range req.Put {
+		title, _ := js["title"].(string)
+		if err := checkTitle(title); err != nil {
+			return nil, &txError{400, fmt.Sprintf("put %q: %v", title, err)}
+		}
+		titles = append(titles, title)
+	}
+	titles = append(titles, req.Delete...)
+	for _, title := range titles {
+		if seen[title] {
+			return nil, &txError{400, fmt.Sprintf("%q appears more than once", title)}
+		}
+		seen[title] = true
+	}
+	for title := range req.IfMatch {
+		if !seen[title] {
+			return nil, &txError{400, fmt.Sprintf("if-match names %q, which isn't in the transaction", title)}
+		}
+	}
+
+	// The revisions are made in the transaction, but the quota can't be
+	// checked there; their bodies are near enough in size.
+	var size int64
+	for _, js := range req.Put {
+		data, _ := json.Marshal(js)
+		size += int64(len(data))
+	}
+	if err := checkQuota(ctx, size); err != nil {
+		return nil, err
+	}
+
+	results := make([]batchResult, n)
+	saved := make([]int64, n) // bytes of each revision, for the quota
+	err := db.RunInTransaction(ctx, func(tx Transaction) error {
+		var keys []*datastore.Key
+		var ents []interface{}
+		for i, title := range titles {
+			key := datastore.NameKey("Tiddler", title, nil)
+			var cur Tiddler
+			if err := tx.Get(key, &cur); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			live := cur.Rev
+			if cur.Meta == "" {
+				live = 0
+			}
+			if etag, ok := req.IfMatch[title]; ok {
+				if _, etagTitle, rev, ok := parseETag(etag); !ok || etagTitle != title || rev != live {
+					return &txError{412, fmt.Sprintf("%s has changed: revision %d is current", title, live)}
+				}
+			}
+			var t Tiddler
+			var links *tiddlerLinks
+			if i < len(req.Put) {
+				js := make(map[string]interface{}, len(req.Put[i]))
+				for k, v := range req.Put[i] {
+					js[k] = v
+				}
+				var err error
+				if t, err = newRevision(ctx, js, cur.Rev+1); err != nil {
+					return &txError{400, fmt.Sprintf("put %q: %v", title, err)}
+				}
+				if int64(len(t.Meta)+len(t.Text)) > cfg.MaxTiddlerBytes {
+					return &txError{413, fmt.Sprintf("put %q: tiddler too large: limit is %d bytes", title, cfg.MaxTiddlerBytes)}
+				}
+				links = linksOf(&t)
+			} else {
+				if live == 0 {
+					return &txError{404, fmt.Sprintf("delete %q: no such tiddler", title)}
+				}
+				t = Tiddler{Rev: cur.Rev + 1, User: userOf(ctx)}
+				links = &tiddlerLinks{}
+			}
+			keys = append(keys, key, datastore.NameKey("TiddlerHistory", title+"#"+fmt.Sprint(t.Rev), nil), linksKey(title))
+			ents = append(ents, &t, &t, links)
+			results[i] = batchResult{Title: title, Revision: t.Rev, ETag: tiddlerETag(title, &t)}
+			saved[i] = revisionBytes(&t)
+		}
+		return tx.PutMulti(keys, ents)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, title := range titles {
+		usage.add(userOf(ctx), saved[i])
+		tiddlerChanged(title)
+	}
+	return results, nil
+}
@@ -0,0 +1,323 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+// Re Wikitext
+//
+// Pages rendered outside the wiki need tiddler text turned into HTML on the server.  Doing that exactly would mean
+// running TiddlyWiki, so this is a small renderer for the wikitext people actually write in notes: headings, lists,
+// quotes, code blocks, tables, horizontal rules, bold/italic/underline/strikethrough/super/subscript, code, and
+// internal, external and image links.  Anything it doesn't understand, macros and transclusions included, comes out
+// as escaped text.  Markdown has its own renderer (see Re Markdown).  Plain text and unknown types are shown
+// preformatted.
+
+// linkFunc returns the URL to link to the tiddler title, or "" if the link
+// should be left as text.
+type linkFunc func(title string) string
+
+// renderText renders a tiddler's text according to its type.
+func renderText(typ, text string, link linkFunc) template.HTML {
+	switch typ {
+	case "", "text/vnd.tiddlywiki":
+		return renderWikitext(text, link)
+	case "text/x-markdown", "text/markdown":
+		return renderMarkdown(text, link)
+	}
+	return template.HTML("<pre>" + html.EscapeString(text) + "</pre>\n")
+}
+
+func renderWikitext(text string, link linkFunc) template.HTML {
+	w := &wikiWriter{link: link}
+	w.blocks(strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n"))
+	return template.HTML(w.buf.String())
+}
+
+type wikiWriter struct {
+	buf  bytes.Buffer
+	link linkFunc
+}
+
+var (
+	headingRE = regexp.MustCompile(`^(!{1,6})\s*(.*)$`)
+	listRE    = regexp.MustCompile(`^([*#;:]+)\s*(.*)$`)
+	quoteRE   = regexp.MustCompile(`^>+\s?(.*)$`)
+)
+
+func (w *wikiWriter) blocks(lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+
+		case strings.HasPrefix(line, "```"):
+			j := i + 1
+			for j < len(lines) && !strings.HasPrefix(lines[j], "```") {
+				j++
+			}
+			w.buf.WriteString("<pre><code>")
+			w.buf.WriteString(html.EscapeString(strings.Join(lines[i+1:j], "\n")))
+			w.buf.WriteString("</code></pre>\n")
+			i = j + 1
+
+		case strings.HasPrefix(line, "<<<"):
+			j := i + 1
+			for j < len(lines) && !strings.HasPrefix(lines[j], "<<<") {
+				j++
+			}
+			w.buf.WriteString("<blockquote>\n")
+			w.blocks(lines[i+1 : j])
+			w.buf.WriteString("</blockquote>\n")
+			i = j + 1
+
+		case headingRE.MatchString(line):
+			m := headingRE.FindStringSubmatch(line)
+			n := string('0' + rune(len(m[1])))
+			w.buf.WriteString("<h" + n + ">")
+			w.inline(m[2])
+			w.buf.WriteString("</h" + n + ">\n")
+			i++
+
+		case strings.TrimSpace(line) == "---":
+			w.buf.WriteString("<hr>\n")
+			i++
+
+		case listRE.MatchString(line):
+			j := i
+			for j < len(lines) && listRE.MatchString(lines[j]) {
+				j++
+			}
+			w.list(lines[i:j])
+			i = j
+
+		case quoteRE.MatchString(line):
+			j := i
+			var quoted []string
+			for j < len(lines) && quoteRE.MatchString(lines[j]) {
+				quoted = append(quoted, quoteRE.FindStringSubmatch(lines[j])[1])
+				j++
+			}
+			w.buf.WriteString("<blockquote>\n")
+			w.blocks(quoted)
+			w.buf.WriteString("</blockquote>\n")
+			i = j
+
+		case strings.HasPrefix(line, "|"):
+			j := i
+			for j < len(lines) && strings.HasPrefix(lines[j], "|") {
+				j++
+			}
+			w.table(lines[i:j])
+			i = j
+
+		default:
+			j := i
+			for j < len(lines) && strings.TrimSpace(lines[j]) != "" && !w.startsBlock(lines[j]) {
+				j++
+			}
+			if j == i {
+				j++
+			}
+			w.buf.WriteString("<p>")
+			w.inline(strings.Join(lines[i:j], "\n"))
+			w.buf.WriteString("</p>\n")
+			i = j
+		}
+	}
+}
+
+// startsBlock reports whether line ends a paragraph by starting another
+// kind of block.
+func (w *wikiWriter) startsBlock(line string) bool {
+	return strings.HasPrefix(line, "```") || strings.HasPrefix(line, "<<<") || strings.HasPrefix(line, "|") ||
+		headingRE.MatchString(line) || listRE.MatchString(line) || quoteRE.MatchString(line) ||
+		strings.TrimSpace(line) == "---"
+}
+
+// list writes a run of list items, nesting by the length of their markers:
+// * bullets, # numbers, ; terms and : definitions.
+func (w *wikiWriter) list(lines []string) {
+	var open []string // closing tags of the open lists
+	var markers string
+	for _, line := range lines {
+		m := listRE.FindStringSubmatch(line)
+		cur := m[1]
+		common := 0
+		for common < len(cur) && common < len(markers) && listKind(cur[common]) == listKind(markers[common]) {
+			common++
+		}
+		if common == len(cur) {
+			common--
+		}
+		for len(open) > common {
+			w.buf.WriteString(open[len(open)-1])
+			open = open[:len(open)-1]
+		}
+		for len(open) < len(cur) {
+			tag := listKind(cur[len(open)])
+			w.buf.WriteString("<" + tag + ">\n")
+			open = append(open, "</"+tag+">\n")
+		}
+		item := "li"
+		switch cur[len(cur)-1] {
+		case ';':
+			item = "dt"
+		case ':':
+			item = "dd"
+		}
+		w.buf.WriteString("<" + item + ">")
+		w.inline(m[2])
+		w.buf.WriteString("</" + item + ">\n")
+		markers = cur
+	}
+	for len(open) > 0 {
+		w.buf.WriteString(open[len(open)-1])
+		open = open[:len(open)-1]
+	}
+}
+
+func listKind(c byte) string {
+	switch c {
+	case '*':
+		return "ul"
+	case '#':
+		return "ol"
+	}
+	return "dl"
+}
+
+func (w *wikiWriter) table(lines []string) {
+	w.buf.WriteString("<table>\n")
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if !strings.HasSuffix(line, "|") || len(line) < 2 {
+			continue
+		}
+		w.buf.WriteString("<tr>")
+		for _, cell := range strings.Split(line[1:len(line)-1], "|") {
+			tag := "td"
+			if strings.HasPrefix(cell, "!") {
+				tag, cell = "th", cell[1:]
+			}
+			w.buf.WriteString("<" + tag + ">")
+			w.inline(strings.TrimSpace(cell))
+			w.buf.WriteString("</" + tag + ">")
+		}
+		w.buf.WriteString("</tr>\n")
+	}
+	w.buf.WriteString("</table>\n")
+}
+
+// inlineFormats are the paired formatting markers and their HTML elements.
+var inlineFormats = []struct{ mark, tag string }{
+	{"''", "strong"},
+	{"//", "em"},
+	{"__", "u"},
+	{"~~", "s"},
+	{"^^", "sup"},
+	{",,", "sub"},
+}
+
+var urlRE = regexp.MustCompile(`^(?:https?|mailto|ftp):[^\s<>"'\]]+[^\s<>"'\].,;:!?)]`)
+
+func (w *wikiWriter) inline(s string) {
+	text := 0 // start of the pending run of plain text
+	for i := 0; i < len(s); {
+		elem, n := w.element(s[i:])
+		if n == 0 {
+			i++
+			continue
+		}
+		w.text(s[text:i])
+		w.buf.WriteString(elem)
+		i += n
+		text = i
+	}
+	w.text(s[text:])
+}
+
+// text writes plain text. As in TiddlyWiki, single line breaks within a
+// paragraph are just whitespace.
+func (w *wikiWriter) text(s string) {
+	w.buf.WriteString(html.EscapeString(s))
+}
+
+// element renders the inline element at the start of s, if there is one,
+// and returns it with its length in s.
+func (w *wikiWriter) element(s string) (string, int) {
+	switch {
+	case strings.HasPrefix(s, "`"):
+		if end := strings.Index(s[1:], "`"); end >= 0 {
+			return "<code>" + html.EscapeString(s[1:1+end]) + "</code>", end + 2
+		}
+
+	case strings.HasPrefix(s, "[["):
+		end := strings.Index(s, "]]")
+		if end < 0 {
+			break
+		}
+		label, target := s[2:end], s[2:end]
+		if bar := strings.Index(label, "|"); bar >= 0 {
+			label, target = label[:bar], label[bar+1:]
+		}
+		if urlRE.MatchString(target) {
+			return externalLink(label, target), end + 2
+		}
+		if href := w.link(target); href != "" {
+			return `<a href="` + html.EscapeString(href) + `">` + html.EscapeString(label) + `</a>`, end + 2
+		}
+		return html.EscapeString(label), end + 2
+
+	case strings.HasPrefix(s, "[ext["), strings.HasPrefix(s, "[img["):
+		end := strings.Index(s, "]]")
+		if end < 0 {
+			break
+		}
+		label, target := s[5:end], s[5:end]
+		if bar := strings.Index(label, "|"); bar >= 0 {
+			label, target = label[:bar], label[bar+1:]
+		}
+		if !urlRE.MatchString(target) {
+			break
+		}
+		if s[1] == 'i' {
+			if label == target {
+				label = ""
+			}
+			return `<img src="` + html.EscapeString(target) + `" alt="` + html.EscapeString(label) + `">`, end + 2
+		}
+		return externalLink(label, target), end + 2
+
+	case urlRE.MatchString(s):
+		u := urlRE.FindString(s)
+		return externalLink(u, u), len(u)
+	}
+
+	for _, f := range inlineFormats {
+		if !strings.HasPrefix(s, f.mark) {
+			continue
+		}
+		end := strings.Index(s[len(f.mark):], f.mark)
+		if end <= 0 {
+			continue
+		}
+		inner := &wikiWriter{link: w.link}
+		inner.inline(s[len(f.mark) : len(f.mark)+end])
+		return "<" + f.tag + ">" + inner.buf.String() + "</" + f.tag + ">", end + 2*len(f.mark)
+	}
+	return "", 0
+}
+
+func externalLink(label, url string) string {
+	return `<a href="` + html.EscapeString(url) + `" rel="noopener">` + html.EscapeString(label) + `</a>`
+}